@@ -1,7 +1,11 @@
 module listr
 
-go 1.24.3
+go 1.25.6
 
 require github.com/google/uuid v1.6.0
 
 require github.com/mjibson/go-dsp v0.0.0-20180508042940-11479a337f12
+
+require github.com/hajimehoshi/go-mp3 v0.3.4
+
+require github.com/skrashevich/go-aac v0.1.0
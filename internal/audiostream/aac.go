@@ -0,0 +1,349 @@
+package audiostream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileDecoder is implemented by decoders that can read a file by path. Unlike
+// Decode, they are free to seek, which MP4 files with their index after the
+// audio need.
+type FileDecoder interface {
+	// DecodeFile returns a reader of PCM bytes decoded from the file at path
+	DecodeFile(path string) (io.ReadCloser, error)
+}
+
+// DecodeFile starts ffmpeg reading the file at path and returns its PCM output
+func (d *FFmpegDecoder) DecodeFile(path string) (io.ReadCloser, error) {
+	// The file protocol keeps paths with a colon or leading dash from being
+	// taken for a protocol or an option
+	return startFFmpeg(d.Path, nil, "-i", "file:"+path)
+}
+
+// AACDecoder decodes AAC-LC audio in process, so no ffmpeg is needed. Decode
+// reads ADTS streams, and DecodeFile MP4 files too, wherever their index is.
+// HE-AAC and the Main and LTP profiles need an FFmpegDecoder instead.
+type AACDecoder struct{}
+
+// Decode returns the audio of an ADTS stream downmixed and resampled to 16kHz
+// mono PCM
+func (d *AACDecoder) Decode(r io.Reader) (io.ReadCloser, error) {
+	src := bufio.NewReader(r)
+	if head, _ := src.Peek(8); len(head) == 8 && string(head[4:8]) == "ftyp" {
+		return nil, fmt.Errorf("mp4 audio can only be decoded by path, see DecodeFile")
+	}
+	return newAACPCMReader(&adtsReader{src: src}, nil)
+}
+
+// DecodeFile returns the audio of the ADTS or MP4 file at path downmixed and
+// resampled to 16kHz mono PCM
+func (d *AACDecoder) DecodeFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	pcm, err := decodeAACFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return pcm, nil
+}
+
+// decodeAACFile starts decoding an open ADTS or MP4 file, which the returned
+// reader closes
+func decodeAACFile(file *os.File) (io.ReadCloser, error) {
+	container, err := sniffAACContainer(file)
+	if err != nil {
+		return nil, err
+	}
+	if container == containerADTS {
+		return newAACPCMReader(&adtsReader{src: bufio.NewReader(file)}, file)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	track, err := readMP4AudioTrack(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseAudioSpecificConfig(track.config)
+	if err != nil {
+		return nil, err
+	}
+	return newAACPCMReader(&mp4FrameReader{r: file, track: track, asc: config}, file)
+}
+
+// aacFrameSource yields the raw frames of an AAC stream
+type aacFrameSource interface {
+	// nextFrame returns the next raw data block, or io.EOF at the end
+	nextFrame() ([]byte, error)
+	// config returns the configuration of the frames returned so far
+	config() aacConfig
+}
+
+// aacPCMReader decodes AAC frames one at a time into 16kHz mono PCM
+type aacPCMReader struct {
+	src    aacFrameSource
+	dec    *aacFrameDecoder
+	closer io.Closer // Closed with the reader, if set
+	mono   []float32 // Decoded samples not yet resampled
+	resampleReader
+}
+
+// newAACPCMReader reads the first frame, which gives the configuration of
+// ADTS streams, and returns a reader of the decoded stream
+func newAACPCMReader(src aacFrameSource, closer io.Closer) (*aacPCMReader, error) {
+	frame, err := src.nextFrame()
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("no aac frames")
+		}
+		return nil, err
+	}
+	dec, err := newAACFrameDecoder(src.config())
+	if err != nil {
+		return nil, err
+	}
+
+	ar := &aacPCMReader{src: src, dec: dec, closer: closer}
+	if err := ar.decodeFrame(frame); err != nil {
+		return nil, err
+	}
+	ar.resampleReader = newResampleReader(dec.config.sampleRate(), int(SampleRate16000), ar.readSample)
+	return ar, nil
+}
+
+// readSample returns the next mono sample, decoding another frame when the
+// current one is used up
+func (ar *aacPCMReader) readSample() (float64, error) {
+	for len(ar.mono) == 0 {
+		frame, err := ar.src.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+		if ar.src.config() != ar.dec.config {
+			return 0, fmt.Errorf("aac stream configuration changed midway")
+		}
+		if err := ar.decodeFrame(frame); err != nil {
+			return 0, err
+		}
+	}
+	sample := ar.mono[0]
+	ar.mono = ar.mono[1:]
+	return float64(sample), nil
+}
+
+// decodeFrame decodes a frame downmixed to mono
+func (ar *aacPCMReader) decodeFrame(frame []byte) error {
+	mono, err := ar.dec.decodeMono(frame)
+	if err != nil {
+		return fmt.Errorf("failed to decode aac frame: %v", err)
+	}
+	ar.mono = mono
+	return nil
+}
+
+// Close closes the source of the frames, if the reader owns it
+func (ar *aacPCMReader) Close() error {
+	if ar.closer != nil {
+		return ar.closer.Close()
+	}
+	return nil
+}
+
+// maxAACFrameSize is the longest frame an ADTS header can describe, and more
+// than any AAC frame needs
+const maxAACFrameSize = 1<<13 - 1
+
+// adtsReader splits an ADTS stream into frames
+type adtsReader struct {
+	src    *bufio.Reader
+	header aacConfig // Configuration from the last frame's header
+}
+
+// config returns the configuration in the last frame's header
+func (ar *adtsReader) config() aacConfig {
+	return ar.header
+}
+
+// nextFrame returns the raw data block of the next frame. A truncated final
+// frame ends the stream.
+func (ar *adtsReader) nextFrame() ([]byte, error) {
+	header, err := ar.src.Peek(7)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if header[0] != 0xFF || header[1]&0xF6 != 0xF0 {
+		return nil, fmt.Errorf("lost adts frame sync")
+	}
+
+	if header[6]&0x03 != 0 {
+		return nil, fmt.Errorf("adts frames of several raw data blocks are not supported")
+	}
+	ar.header = aacConfig{
+		objectType:    int(header[2]>>6) + 1,
+		sampleIndex:   int(header[2] >> 2 & 0x0F),
+		channelConfig: int(header[2]&0x01)<<2 | int(header[3]>>6),
+	}
+	// Without protection_absent set, a CRC follows the header
+	headerSize := 7
+	if header[1]&0x01 == 0 {
+		headerSize = 9
+	}
+
+	// The frame length is 13 bits spread over the fourth to sixth bytes
+	length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	if length < headerSize {
+		return nil, fmt.Errorf("invalid adts frame length: %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(ar.src, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return frame[headerSize:], nil
+}
+
+// mp4FrameReader reads the frames of an MP4 audio track in order
+type mp4FrameReader struct {
+	r     io.ReaderAt
+	track *mp4AudioTrack
+	next  int       // Index of the next frame
+	asc   aacConfig // Parsed from the track's audio specific config
+}
+
+// config returns the track's configuration
+func (mr *mp4FrameReader) config() aacConfig {
+	return mr.asc
+}
+
+// nextFrame returns the next frame. A file cut short ends the track.
+func (mr *mp4FrameReader) nextFrame() ([]byte, error) {
+	if mr.next >= len(mr.track.sizes) {
+		return nil, io.EOF
+	}
+	size := mr.track.sizes[mr.next]
+	if size > maxAACFrameSize {
+		return nil, fmt.Errorf("aac frame %d is %d bytes, more than %d", mr.next, size, maxAACFrameSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := mr.r.ReadAt(frame, mr.track.offsets[mr.next]); err != nil {
+		return nil, err
+	}
+	mr.next++
+	return frame, nil
+}
+
+// aacContainer is the framing AAC audio is stored in
+type aacContainer int
+
+const (
+	containerADTS aacContainer = iota // Self-delimiting frames, as in .aac files
+	containerMP4                      // An ISO base media file, as in .m4a files
+)
+
+// AACStream serves chunks of audio from a local AAC file, either raw ADTS
+// frames or an MP4/M4A container. Decoding is done in process by an
+// AACDecoder by default; SetDecoder(&FFmpegDecoder{}) falls back to ffmpeg
+// for profiles it can't decode, such as HE-AAC. An MP4 file whose moov atom
+// follows its audio can only be decoded by a FileDecoder, as the index has to
+// be read before the audio.
+type AACStream struct {
+	path    string
+	decoder Decoder
+	pcmChunker
+	chunkSizer
+}
+
+// SetDecoder sets the Decoder used by InitStream, an AACDecoder by default.
+// A FileDecoder can also decode MP4 files whose moov atom follows the audio.
+func (as *AACStream) SetDecoder(d Decoder) {
+	as.decoder = d
+}
+
+// InitStream opens the AAC file at the given path and starts decoding it
+func (as *AACStream) InitStream(path any) error {
+	pathStr, ok := path.(string)
+	if !ok {
+		return fmt.Errorf("expected string path, got %T", path)
+	}
+	if as.decoder == nil {
+		as.decoder = &AACDecoder{}
+	}
+
+	file, err := os.Open(pathStr)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+
+	pcm, err := as.decode(file, pathStr)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to decode aac: %w", err)
+	}
+
+	as.path = pathStr
+	as.pcmChunker = pcmChunker{pcm: pcm, closer: multiCloser{pcm, file}}
+	return nil
+}
+
+// decode starts the decoder on the file, by path when its container may
+// need seeking
+func (as *AACStream) decode(file *os.File, path string) (io.ReadCloser, error) {
+	container, err := sniffAACContainer(file)
+	if err != nil {
+		return nil, err
+	}
+	if container == containerMP4 {
+		if fd, ok := as.decoder.(FileDecoder); ok {
+			return fd.DecodeFile(path)
+		}
+		moovFirst, err := mp4MoovBeforeMdat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !moovFirst {
+			return nil, fmt.Errorf("moov atom follows the audio, which %T can't seek to", as.decoder)
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return as.decoder.Decode(file)
+}
+
+// GetChunk returns the next chunk of audio, or io.EOF once the file is
+// exhausted. The final chunk may be shorter.
+func (as *AACStream) GetChunk() (Chunk, error) {
+	return as.nextChunk(&as.chunkSizer)
+}
+
+// sniffAACContainer identifies the container from the start of r
+func sniffAACContainer(r io.ReaderAt) (aacContainer, error) {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	switch {
+	case string(head[4:8]) == "ftyp":
+		return containerMP4, nil
+	// ADTS frames start with a 12 bit sync word and a layer of 0
+	case head[0] == 0xFF && head[1]&0xF6 == 0xF0:
+		return containerADTS, nil
+	default:
+		return 0, fmt.Errorf("not an aac file")
+	}
+}
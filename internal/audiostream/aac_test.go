@@ -0,0 +1,374 @@
+package audiostream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// aacFrameSamples is the number of samples in one AAC-LC frame
+	aacFrameSamples = 1024
+	// aacFrameRate is the sample rate of the generated frames
+	aacFrameRate = 44100
+)
+
+// writeTestFile writes data to a file with the given name and returns its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// writeTestADTS writes an AAC file of silent 44.1kHz mono ADTS frames and
+// returns its path
+func writeTestADTS(t *testing.T, frames int) string {
+	t.Helper()
+
+	// An 11 byte AAC-LC frame with no CRC: a single channel element with no
+	// scale factor bands, which decodes to silence
+	frame := []byte{0xFF, 0xF1, 0x50, 0x40, 0x01, 0x7F, 0xFC, 0x01, 0x18, 0x20, 0x07}
+	return writeTestFile(t, "test.aac", bytes.Repeat(frame, frames))
+}
+
+// bitWriter packs values most significant bit first
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (bw *bitWriter) write(v uint32, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if bw.bits%8 == 0 {
+			bw.buf = append(bw.buf, 0)
+		}
+		if v>>i&1 == 1 {
+			bw.buf[len(bw.buf)-1] |= 0x80 >> (bw.bits % 8)
+		}
+		bw.bits++
+	}
+}
+
+// aacToneFrame returns a raw AAC-LC frame of 44.1kHz mono audio holding a
+// single spectral line, at bin 46 or about 1kHz
+func aacToneFrame() []byte {
+	var bw bitWriter
+	bw.write(0, 3)   // Single channel element
+	bw.write(0, 4)   // Element tag
+	bw.write(176, 8) // Global gain
+	bw.write(0, 4)   // Reserved bit, a long window and its shape
+	bw.write(11, 6)  // Scalefactor bands used
+	bw.write(0, 1)   // No prediction
+	// Bands 0-9 are zero and band 10, bins 40-47, uses the escape codebook
+	bw.write(0, 4)
+	bw.write(10, 5)
+	bw.write(11, 4)
+	bw.write(1, 5)
+	bw.write(0, 1)    // Band 10's scalefactor is the global gain
+	bw.write(0, 3)    // No pulse, TNS or gain control data
+	bw.write(0, 3*4)  // Bins 40-45 are zero, a pair at a time
+	bw.write(943, 10) // Bins 46 and 47 are 8 and 0
+	bw.write(0, 1)    // The 8 is positive
+	bw.write(7, 3)    // End element
+	return bw.buf
+}
+
+// testADTSTone returns ADTS frames of a 1kHz tone
+func testADTSTone(frames int) []byte {
+	raw := aacToneFrame()
+	length := 7 + len(raw)
+	// AAC-LC at 44.1kHz mono without a CRC, the length spread over bytes 4-6
+	header := []byte{0xFF, 0xF1, 0x50, 0x40 | byte(length>>11), byte(length >> 3), byte(length<<5) | 0x1F, 0xFC}
+	return bytes.Repeat(append(header, raw...), frames)
+}
+
+// testMP4Tone returns an M4A file of a 1kHz tone, with the moov box after the
+// audio
+func testMP4Tone(frames int) []byte {
+	tone := make([][]byte, frames)
+	for i := range tone {
+		tone[i] = aacToneFrame()
+	}
+	return testMP4Track(tone, 10)
+}
+
+// mp4Box returns an MP4 box of the given type holding body
+func mp4Box(boxType string, body []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, boxType...)
+	return append(box, body...)
+}
+
+// testMP4 returns the top level boxes of an MP4 file, with the moov box
+// before or after the audio
+func testMP4(moovFirst bool) []byte {
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x02\x00isomM4A "))
+	moov := mp4Box("moov", make([]byte, 32))
+	mdat := mp4Box("mdat", make([]byte, 64))
+	if moovFirst {
+		return bytes.Join([][]byte{ftyp, moov, mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+// fileDecoder is a FileDecoder passing the file through as PCM, recording
+// the path it was given
+type fileDecoder struct {
+	passthroughDecoder
+	path string
+}
+
+func (fd *fileDecoder) DecodeFile(path string) (io.ReadCloser, error) {
+	fd.path = path
+	return os.Open(path)
+}
+
+func TestAACStreamDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoder Decoder
+	}{
+		{name: "In process"},
+		{name: "FFmpeg", decoder: &FFmpegDecoder{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.decoder != nil {
+				if _, err := exec.LookPath("ffmpeg"); err != nil {
+					t.Skip("ffmpeg not installed")
+				}
+			}
+
+			const frames = 100
+			as := &AACStream{}
+			if tt.decoder != nil {
+				as.SetDecoder(tt.decoder)
+			}
+			if err := as.InitStream(writeTestADTS(t, frames)); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer as.Close()
+
+			total := 0
+			for {
+				chunk, err := as.GetChunk()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("GetChunk() error = %v", err)
+				}
+				total += len(chunk.GetAudioData())
+			}
+
+			// Allow a frame either way for decoder delay
+			want := float64(frames*aacFrameSamples) / aacFrameRate * pcmBytesPerSecond
+			tolerance := float64(aacFrameSamples) / aacFrameRate * pcmBytesPerSecond
+			if math.Abs(float64(total)-want) > tolerance {
+				t.Errorf("decoded %d bytes, want %.0f ± %.0f", total, want, tolerance)
+			}
+		})
+	}
+}
+
+func TestSniffAACContainer(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    aacContainer
+		wantErr bool
+	}{
+		{name: "ADTS", data: []byte{0xFF, 0xF1, 0x50, 0x40, 0x01, 0x7F, 0xFC, 0x01}, want: containerADTS},
+		{name: "ADTS with CRC", data: []byte{0xFF, 0xF0, 0x50, 0x40, 0x01, 0x7F, 0xFC, 0x01}, want: containerADTS},
+		{name: "MP4", data: testMP4(true), want: containerMP4},
+		{name: "MP3 frame", data: []byte{0xFF, 0xFB, 0x90, 0xC4, 0, 0, 0, 0}, wantErr: true},
+		{name: "WAV", data: []byte("RIFF\x00\x00\x00\x00WAVE"), wantErr: true},
+		{name: "Empty", data: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sniffAACContainer(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sniffAACContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("sniffAACContainer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMP4MoovBeforeMdat(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x02\x00"))
+	// A free box with a 64 bit size
+	largeFree := append([]byte{0, 0, 0, 1, 'f', 'r', 'e', 'e'}, binary.BigEndian.AppendUint64(nil, 24)...)
+	largeFree = append(largeFree, make([]byte, 8)...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bool
+		wantErr bool
+	}{
+		{name: "Moov first", data: testMP4(true), want: true},
+		{name: "Moov last", data: testMP4(false), want: false},
+		{name: "Large box before moov", data: bytes.Join([][]byte{ftyp, largeFree, mp4Box("moov", nil)}, nil), want: true},
+		{name: "Mdat to end of file", data: append(slices.Concat(ftyp, []byte{0, 0, 0, 0}), "mdat"...), want: false},
+		{name: "No moov", data: slices.Concat(ftyp, mp4Box("free", nil)), wantErr: true},
+		{name: "Invalid size", data: slices.Concat(ftyp, []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'}), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mp4MoovBeforeMdat(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mp4MoovBeforeMdat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("mp4MoovBeforeMdat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAACStreamMP4(t *testing.T) {
+	t.Run("Moov first streams", func(t *testing.T) {
+		as := &AACStream{decoder: passthroughDecoder{}}
+		if err := as.InitStream(writeTestFile(t, "test.m4a", testMP4(true))); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		as.Close()
+	})
+
+	t.Run("Moov last needs seeking", func(t *testing.T) {
+		as := &AACStream{decoder: passthroughDecoder{}}
+		err := as.InitStream(writeTestFile(t, "test.m4a", testMP4(false)))
+		if err == nil || !strings.Contains(err.Error(), "moov") {
+			t.Errorf("InitStream() error = %v, want moov atom error", err)
+		}
+	})
+
+	t.Run("Moov last decoded by path", func(t *testing.T) {
+		decoder := &fileDecoder{}
+		path := writeTestFile(t, "test.m4a", testMP4(false))
+		as := &AACStream{decoder: decoder}
+		if err := as.InitStream(path); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		defer as.Close()
+		if decoder.path != path {
+			t.Errorf("DecodeFile() called with %q, want %q", decoder.path, path)
+		}
+	})
+}
+
+func TestAACDecoderTone(t *testing.T) {
+	const frames = 100
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{name: "ADTS", file: "tone.aac", data: testADTSTone(frames)},
+		{name: "MP4 with moov last", file: "tone.m4a", data: testMP4Tone(frames)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := &AACStream{}
+			if err := as.InitStream(writeTestFile(t, tt.file, tt.data)); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer as.Close()
+
+			var pcm []byte
+			for {
+				chunk, err := as.GetChunk()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("GetChunk() error = %v", err)
+				}
+				pcm = append(pcm, chunk.GetAudioData()...)
+			}
+
+			want := frames * aacFrameSamples * time.Second / aacFrameRate
+			frame := aacFrameSamples * time.Second / aacFrameRate
+			if got := pcmDuration(len(pcm)); got < want-frame || got > want+frame {
+				t.Errorf("decoded %v of audio, want %v ± %v", got, want, frame)
+			}
+
+			// Skip the first frame, which fades in
+			margin := pcmBytesPerSecond * aacFrameSamples / aacFrameRate &^ 1
+			if got := zeroCrossingRate(pcm[margin:]); math.Abs(got-1000) > 50 {
+				t.Errorf("tone at %.0fHz, want 1000Hz", got)
+			}
+			if got := peakAmplitude(pcm[margin:]); got < 4000 {
+				t.Errorf("tone peaks at %d, want a loud tone", got)
+			}
+		})
+	}
+}
+
+// peakAmplitude returns the largest absolute sample in 16-bit PCM
+func peakAmplitude(pcm []byte) int {
+	peak := 0
+	for i := 0; i+1 < len(pcm); i += 2 {
+		sample := int(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		peak = max(peak, sample, -sample)
+	}
+	return peak
+}
+
+func TestAACDecoderErrors(t *testing.T) {
+	tone := testADTSTone(1)
+	// A frame of zeros parses as an endless run of empty channels, on which
+	// go-aac's own frame loop never returns
+	zeroed := slices.Clone(tone)
+	clear(zeroed[7:])
+	// The profile bits of the header set to Main
+	main := slices.Clone(tone)
+	main[2] &^= 0xC0
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "Empty", data: nil},
+		{name: "Lost sync", data: append(slices.Clone(tone), 0, 0, 0, 0, 0, 0, 0, 0)},
+		{name: "MP4 without audio", data: testMP4(false)},
+		{name: "Frame of zeros", data: zeroed},
+		{name: "Main profile", data: main},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm, err := (&AACDecoder{}).DecodeFile(writeTestFile(t, "test.aac", tt.data))
+			if err == nil {
+				_, err = io.ReadAll(pcm)
+				pcm.Close()
+			}
+			if err == nil {
+				t.Error("decoding succeeded, want an error")
+			}
+		})
+	}
+
+	if _, err := (&AACDecoder{}).Decode(bytes.NewReader(testMP4Tone(1))); err == nil {
+		t.Error("Decode() of an MP4 file succeeded, want an error pointing at DecodeFile")
+	}
+}
@@ -0,0 +1,356 @@
+package audiostream
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/skrashevich/go-aac/pkg/cpe"
+	"github.com/skrashevich/go-aac/pkg/filterbank"
+	"github.com/skrashevich/go-aac/pkg/ics"
+	"github.com/skrashevich/go-aac/pkg/tables"
+)
+
+// MPEG-4 audio object type of AAC-LC, the only profile decoded in process
+const aacObjectTypeLC = 2
+
+// aacChannelCounts is the number of channels of each channel configuration
+var aacChannelCounts = [...]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 8}
+
+// aacConfig is what decoding an AAC stream's frames needs to know about it
+type aacConfig struct {
+	objectType    int // MPEG-4 audio object type
+	sampleIndex   int // Index into the standard sample rates
+	channelConfig int
+}
+
+// sampleRate returns the stream's sample rate in Hz
+func (c aacConfig) sampleRate() int {
+	return int(tables.SampleRates[c.sampleIndex])
+}
+
+// validate checks the stream is AAC-LC in a layout the in-process decoder
+// handles
+func (c aacConfig) validate() error {
+	if c.objectType != aacObjectTypeLC {
+		return fmt.Errorf("aac object type %d is not AAC-LC, decode it with an FFmpegDecoder", c.objectType)
+	}
+	if c.sampleIndex < 0 || c.sampleIndex >= len(tables.SampleRates) {
+		return fmt.Errorf("invalid aac sample rate index: %d", c.sampleIndex)
+	}
+	if c.channelConfig < 1 || c.channelConfig >= len(aacChannelCounts) {
+		return fmt.Errorf("unsupported aac channel configuration: %d", c.channelConfig)
+	}
+	return nil
+}
+
+// parseAudioSpecificConfig reads the stream configuration an MP4 track keeps
+// in its esds box
+func parseAudioSpecificConfig(asc []byte) (aacConfig, error) {
+	br := &aacBitReader{data: asc}
+	var config aacConfig
+	err := br.catch(func() {
+		config.objectType = int(br.ReadBits(5))
+		if config.objectType == 31 {
+			config.objectType = 32 + int(br.ReadBits(6))
+		}
+		config.sampleIndex = int(br.ReadBits(4))
+		if config.sampleIndex == 15 {
+			// An explicit rate outside the standard ones
+			config.sampleIndex = -1
+			return
+		}
+		config.channelConfig = int(br.ReadBits(4))
+		if config.objectType == aacObjectTypeLC && br.ReadBits(1) != 0 {
+			// 960 sample frames, used for digital radio
+			config.objectType = -1
+		}
+	})
+	if err != nil {
+		return aacConfig{}, fmt.Errorf("invalid audio specific config: %v", err)
+	}
+	if config.objectType == -1 {
+		return aacConfig{}, fmt.Errorf("aac frames of 960 samples are not supported")
+	}
+	return config, config.validate()
+}
+
+// errAACFrameOverrun is what aacBitReader panics with when a frame is read
+// past its end
+var errAACFrameOverrun = errors.New("read past the end of the aac frame")
+
+// aacBitReader reads a frame most significant bit first. go-aac's syntax
+// parsers read through it and have no way to report running out of data, so
+// it panics instead, which catch turns back into an error. Left to its own
+// reader, go-aac keeps decoding zeros past the end of a corrupt frame,
+// forever.
+type aacBitReader struct {
+	data []byte
+	pos  int // Position in bits
+}
+
+// ReadBits returns the next n bits
+func (br *aacBitReader) ReadBits(n int) uint32 {
+	if n < 0 || n > 32 || br.pos+n > len(br.data)*8 {
+		panic(errAACFrameOverrun)
+	}
+	var v uint32
+	for range n {
+		bit := br.data[br.pos/8] >> (7 - br.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+// skip advances n bits
+func (br *aacBitReader) skip(n int) {
+	if n < 0 || br.pos+n > len(br.data)*8 {
+		panic(errAACFrameOverrun)
+	}
+	br.pos += n
+}
+
+// align advances to the next byte boundary
+func (br *aacBitReader) align() {
+	br.pos = (br.pos + 7) &^ 7
+}
+
+// catch runs parse, returning the error of a read past the end of the data,
+// or of go-aac indexing its tables with a corrupt value, instead of
+// panicking
+func (br *aacBitReader) catch(parse func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r == errAACFrameOverrun {
+				err = errAACFrameOverrun
+				return
+			}
+			err = fmt.Errorf("corrupt frame: %v", r)
+		}
+	}()
+	parse()
+	return nil
+}
+
+// Syntax elements of an AAC raw data block
+const (
+	aacElementSCE = iota // Single channel
+	aacElementCPE        // Channel pair
+	aacElementCCE        // Coupling channel
+	aacElementLFE        // Low frequency effects channel
+	aacElementDSE        // Data stream
+	aacElementPCE        // Program config
+	aacElementFIL        // Fill
+	aacElementEND
+)
+
+// aacFrameDecoder decodes raw AAC-LC frames, the raw data blocks of ADTS
+// frames or the samples of an MP4 track, into PCM. The syntax and the
+// spectral tools come from go-aac; the frame loop is kept here, reading
+// through an aacBitReader, as go-aac's own loops forever on corrupt frames.
+// Coupling channels and gain control aren't supported, which AAC-LC music
+// doesn't use.
+type aacFrameDecoder struct {
+	config     aacConfig
+	icsConfig  ics.Config
+	filterBank *filterbank.FilterBank
+	channels   [][]float32 // Output of the last frame, one slice per channel
+}
+
+func newAACFrameDecoder(config aacConfig) (*aacFrameDecoder, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	channels := aacChannelCounts[config.channelConfig]
+	filterBank, err := filterbank.New(false, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &aacFrameDecoder{
+		config:     config,
+		icsConfig:  ics.Config{SampleIndex: config.sampleIndex, FrameLength: aacFrameLength, Profile: aacObjectTypeLC},
+		filterBank: filterBank,
+		channels:   make([][]float32, channels),
+	}
+	for i := range fd.channels {
+		fd.channels[i] = make([]float32, aacFrameLength)
+	}
+	return fd, nil
+}
+
+// aacFrameLength is the number of samples per channel in an AAC-LC frame
+const aacFrameLength = 1024
+
+// decodeMono decodes a frame and returns its channels averaged to mono
+func (fd *aacFrameDecoder) decodeMono(frame []byte) ([]float32, error) {
+	channels, err := fd.decode(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	mono := make([]float32, aacFrameLength)
+	for _, channel := range channels {
+		for i, sample := range channel {
+			mono[i] += sample
+		}
+	}
+	for i := range mono {
+		// go-aac's output is scaled to 16 bit samples
+		mono[i] /= float32(len(channels)) * 32768
+	}
+	return mono, nil
+}
+
+// decode decodes a frame, returning the channels it holds
+func (fd *aacFrameDecoder) decode(frame []byte) ([][]float32, error) {
+	br := &aacBitReader{data: frame}
+	decoded := 0
+	err := br.catch(func() {
+		for {
+			elementType := int(br.ReadBits(3))
+			if elementType == aacElementEND {
+				return
+			}
+			id := int(br.ReadBits(4))
+
+			switch elementType {
+			case aacElementSCE, aacElementLFE:
+				stream := fd.mustDecodeSingle(br)
+				fd.mustFilter(stream, &decoded)
+			case aacElementCPE:
+				pair := fd.mustDecodePair(br)
+				applyMidSide(pair)
+				applyIntensity(pair)
+				fd.mustFilter(pair.Left, &decoded)
+				fd.mustFilter(pair.Right, &decoded)
+			case aacElementDSE:
+				aligned := br.ReadBits(1) != 0
+				count := int(br.ReadBits(8))
+				if count == 255 {
+					count += int(br.ReadBits(8))
+				}
+				if aligned {
+					br.align()
+				}
+				br.skip(count * 8)
+			case aacElementFIL:
+				count := id
+				if count == 15 {
+					count += int(br.ReadBits(8)) - 1
+				}
+				br.skip(count * 8)
+			case aacElementCCE:
+				panic(fmt.Errorf("coupling channels are not supported, decode with an FFmpegDecoder"))
+			case aacElementPCE:
+				panic(fmt.Errorf("program config elements are not supported, decode with an FFmpegDecoder"))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fd.channels[:decoded], nil
+}
+
+// mustDecodeSingle decodes a single channel element's stream, panicking on
+// errors for catch to return
+func (fd *aacFrameDecoder) mustDecodeSingle(br *aacBitReader) *ics.ICStream {
+	stream, err := ics.New(fd.icsConfig)
+	if err == nil {
+		err = stream.Decode(br, fd.icsConfig, false)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return stream
+}
+
+// mustDecodePair decodes a channel pair element, panicking on errors for
+// catch to return
+func (fd *aacFrameDecoder) mustDecodePair(br *aacBitReader) *cpe.Element {
+	pair, err := cpe.New(fd.icsConfig)
+	if err == nil {
+		err = pair.Decode(br, fd.icsConfig)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return pair
+}
+
+// mustFilter turns a channel's spectrum into samples in the next output
+// channel, panicking on errors for catch to return
+func (fd *aacFrameDecoder) mustFilter(stream *ics.ICStream, decoded *int) {
+	if *decoded == len(fd.channels) {
+		panic(fmt.Errorf("frame holds more than %d channels", len(fd.channels)))
+	}
+	if stream.GainPresent {
+		panic(fmt.Errorf("gain control is not supported, decode with an FFmpegDecoder"))
+	}
+	if stream.TnsPresent {
+		stream.ApplyTNS(stream.Data, false)
+	}
+
+	window := filterbank.WindowInfo{WindowSequence: stream.Info.WindowSequence, WindowShape: stream.Info.WindowShape}
+	if err := fd.filterBank.Process(window, stream.Data, fd.channels[*decoded], *decoded); err != nil {
+		panic(err)
+	}
+	*decoded++
+}
+
+// forEachBand calls fn with the index, spectral offset and width of each
+// scalefactor band in use, once for each window of the band's group
+func forEachBand(info *ics.ICSInfo, fn func(band, offset, length int)) {
+	groupOffset, band := 0, 0
+	for g := range info.GroupCount {
+		for sfb := range info.MaxSFB {
+			for w := range info.GroupLength[g] {
+				offset := groupOffset + w*128 + info.SwbOffsets[sfb]
+				fn(band, offset, info.SwbOffsets[sfb+1]-info.SwbOffsets[sfb])
+			}
+			band++
+		}
+		groupOffset += info.GroupLength[g] * 128
+	}
+}
+
+// applyMidSide turns the bands of a channel pair coded as mid and side back
+// into left and right
+func applyMidSide(pair *cpe.Element) {
+	if !pair.CommonWindow || !pair.MaskPresent {
+		return
+	}
+	left, right := pair.Left, pair.Right
+	forEachBand(left.Info, func(band, offset, length int) {
+		if !pair.MSUsed[band] || left.BandTypes[band] >= ics.NoiseBT || right.BandTypes[band] >= ics.NoiseBT {
+			return
+		}
+		for i := offset; i < offset+length; i++ {
+			mid, side := left.Data[i], right.Data[i]
+			left.Data[i], right.Data[i] = mid+side, mid-side
+		}
+	})
+}
+
+// applyIntensity fills the bands of the right channel that are coded as a
+// scaled copy of the left
+func applyIntensity(pair *cpe.Element) {
+	left, right := pair.Left, pair.Right
+	forEachBand(right.Info, func(band, offset, length int) {
+		bandType := right.BandTypes[band]
+		if bandType != ics.IntensityBT && bandType != ics.IntensityBT2 {
+			return
+		}
+		scale := right.ScaleFactors[band]
+		if bandType == ics.IntensityBT2 {
+			scale = -scale
+		}
+		if pair.MaskPresent && pair.MSUsed[band] {
+			scale = -scale
+		}
+		for i := offset; i < offset+length; i++ {
+			right.Data[i] = left.Data[i] * scale
+		}
+	})
+}
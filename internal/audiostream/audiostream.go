@@ -1,15 +1,20 @@
 package audiostream
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 // Chunk represents a segment of audio data with its position in the stream
 type Chunk interface {
-	// Record captures audio data from the input channel into this chunk
-	Record(in chan byte) Chunk
+	// Record captures audio data from the input channel into this chunk,
+	// returning early with what it has if ctx is cancelled
+	Record(ctx context.Context, in chan byte) Chunk
 	// GetAudioData returns the raw audio data for this chunk
 	GetAudioData() []byte
 	// GetTimestamp returns the start time of this chunk in the stream
@@ -18,28 +23,98 @@ type Chunk interface {
 	GetDuration() time.Duration
 }
 
+// SampleRater is implemented by chunks that know the sample rate of their
+// audio. Chunks that don't are taken to hold 16kHz audio.
+type SampleRater interface {
+	// GetSampleRate returns the sample rate of the chunk's audio in Hz
+	GetSampleRate() int
+}
+
+// ChunkSampleRate returns the sample rate of a chunk's audio in Hz
+func ChunkSampleRate(c Chunk) int {
+	if sr, ok := c.(SampleRater); ok && sr.GetSampleRate() > 0 {
+		return sr.GetSampleRate()
+	}
+	return int(SampleRate16000)
+}
+
+// ErrStreamClosed is returned by GetChunk once a stream has been closed
+var ErrStreamClosed = errors.New("stream closed")
+
+// Stream is a source of audio served in chunks
 type Stream interface {
 	InitStream(V any) error
+	// GetChunk returns the next chunk of audio, or io.EOF once the stream has
+	// ended and all of its audio has been returned
 	GetChunk() (Chunk, error)
+	// Close stops the stream and releases its resources. It is safe to call
+	// more than once.
+	Close() error
+}
+
+// ChunkResizer is implemented by streams whose chunk duration can be set,
+// including between chunks of a stream that is already running
+type ChunkResizer interface {
+	// SetChunkDuration sets the length of audio in each following chunk
+	SetChunkDuration(d time.Duration) error
+}
+
+// RangeReader is implemented by streams that can serve audio from anywhere
+// in the stream, such as files, without disturbing the chunks GetChunk returns
+type RangeReader interface {
+	// ReadRange returns a chunk of the audio starting at start and lasting d,
+	// cut short at the end of the stream
+	ReadRange(start, d time.Duration) (Chunk, error)
+}
+
+// Lengther is implemented by streams that know the total duration of their
+// audio up front, such as files. Live streams don't.
+type Lengther interface {
+	// GetLength returns the duration of all the stream's audio
+	GetLength() time.Duration
+}
+
+// StreamLength returns the total duration of a stream's audio, or 0 if it
+// isn't known
+func StreamLength(s Stream) time.Duration {
+	if l, ok := s.(Lengther); ok {
+		return max(l.GetLength(), 0)
+	}
+	return 0
 }
 
-// SoundCloudChunk represents a 10-second segment of audio from a SoundCloud stream
+// SoundCloudChunk represents a segment of audio from a SoundCloud stream
 type SoundCloudChunk struct {
-	timestamp  *time.Duration // Start time of this chunk in the stream
-	audioChunk *[]byte        // Raw audio data
+	timestamp     *time.Duration // Start time of this chunk in the stream
+	audioChunk    *[]byte        // Raw audio data
+	chunkDuration time.Duration  // Length of audio to record
 }
 
-// Record captures audio data from the input channel into this chunk
-func (scc *SoundCloudChunk) Record(in chan byte) Chunk {
-	var newChunk SoundCloudChunk
-	newTimestamp := *scc.timestamp + 10*time.Second // Each chunk is 10 seconds
-	newChunk.timestamp = &newTimestamp
+// recordIdleTimeout is how long Record waits for the next byte of audio
+// before returning what it has
+const recordIdleTimeout = 100 * time.Millisecond
+
+// Record captures the next chunk of audio from the input channel, stopping
+// early if the channel is closed, no audio arrives in time or ctx is
+// cancelled. The returned chunk holds the recorded audio and starts where
+// this chunk ends.
+func (scc *SoundCloudChunk) Record(ctx context.Context, in chan byte) Chunk {
+	var start time.Duration
+	if scc.timestamp != nil {
+		start = *scc.timestamp
+	}
+	if scc.audioChunk != nil {
+		start += scc.GetDuration()
+	}
 
-	// Read 10 seconds of audio data (assuming 16kHz, 16-bit mono)
-	// 10 seconds * 16000 samples/second * 2 bytes/sample = 320,000 bytes
-	chunkBuffer := make([]byte, 320000)
+	// Read one chunk of 16kHz, 16-bit mono audio data. One timer is reused
+	// for every byte rather than a new one made for each.
+	chunkBuffer := make([]byte, chunkBytes(scc.chunkDuration))
+	idle := time.NewTimer(recordIdleTimeout)
+	defer idle.Stop()
 readLoop:
 	for i := 0; i < len(chunkBuffer); i++ {
+		idle.Reset(recordIdleTimeout)
 		select {
 		case buf, ok := <-in:
 			if !ok {
@@ -48,15 +123,22 @@ readLoop:
 				break readLoop
 			}
 			chunkBuffer[i] = buf
-		case <-time.After(100 * time.Millisecond):
+		case <-idle.C:
 			// Timeout, return partial chunk
 			chunkBuffer = chunkBuffer[:i]
 			break readLoop
+		case <-ctx.Done():
+			// Cancelled, return partial chunk
+			chunkBuffer = chunkBuffer[:i]
+			break readLoop
 		}
 	}
 
-	scc.audioChunk = &chunkBuffer
-	return &newChunk
+	return &SoundCloudChunk{
+		timestamp:     &start,
+		audioChunk:    &chunkBuffer,
+		chunkDuration: scc.chunkDuration,
+	}
 }
 
 // GetAudioData returns the raw audio data for this chunk
@@ -70,19 +152,73 @@ func (scc *SoundCloudChunk) GetTimestamp() time.Duration {
 }
 
 // GetDuration returns the duration of this chunk
-// For a full chunk, this will be 10 seconds. For partial chunks (due to stream end or timeout),
+// For a full chunk, this will be the stream's chunk duration. For partial chunks (due to stream end or timeout),
 // this will be calculated based on the actual amount of audio data.
 func (scc *SoundCloudChunk) GetDuration() time.Duration {
-	// Calculate duration based on actual audio data size
-	// For 16kHz, 16-bit mono: 1 second = 32000 bytes
-	bytesPerSecond := 32000
-	return time.Duration(len(*scc.audioChunk)/bytesPerSecond) * time.Second
+	// Calculate duration based on actual audio data size, keeping sub-second
+	// precision for partial chunks
+	return pcmDuration(len(*scc.audioChunk))
 }
 
 type SoundCloudStream struct {
-	url          string
-	chunkCounter int
-	audioChan    chan byte
+	url string
+	chanStream
+
+	apiBaseURL   string       // SoundCloud API to resolve tracks against
+	client       *http.Client // Client for API and audio requests
+	decoder      Decoder      // Turns the downloaded audio into PCM
+	allowedHosts []string     // Hosts links may point at, defaults to soundCloudHosts
+	clientID     string       // SoundCloud API client ID, sent when set
+}
+
+// soundCloudHosts are the hosts SoundCloud links are accepted from by default
+var soundCloudHosts = []string{"soundcloud.com"}
+
+// SetAllowedHosts replaces the hosts links may point at. Subdomains of an
+// allowed host are allowed too.
+func (scs *SoundCloudStream) SetAllowedHosts(hosts ...string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts allowed")
+	}
+	scs.allowedHosts = hosts
+	return nil
+}
+
+// SetDecoder sets the Decoder that turns the downloaded audio into PCM,
+// ffmpeg on PATH by default. It must be called before InitStream.
+func (scs *SoundCloudStream) SetDecoder(d Decoder) {
+	scs.decoder = d
+}
+
+// SetClientID sets the SoundCloud API client ID sent with the requests that
+// resolve a track. Most tracks can't be streamed in full without one.
+func (scs *SoundCloudStream) SetClientID(clientID string) {
+	scs.clientID = clientID
+}
+
+// checkURL makes sure a link is an http or https URL on an allowed host, so
+// the stream can't be pointed at local files or arbitrary servers
+func (scs *SoundCloudStream) checkURL(urlStr string) error {
+	u, err := url.ParseRequestURI(urlStr)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL scheme %q, want http or https", u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	allowed := scs.allowedHosts
+	if allowed == nil {
+		allowed = soundCloudHosts
+	}
+	for _, allowedHost := range allowed {
+		allowedHost = strings.ToLower(allowedHost)
+		if host == allowedHost || strings.HasSuffix(host, "."+allowedHost) {
+			return nil
+		}
+	}
+	return fmt.Errorf("URL host %q is not one of %s", u.Hostname(), strings.Join(allowed, ", "))
 }
 
 func (scs *SoundCloudStream) InitStream(link any) error {
@@ -91,46 +227,52 @@ func (scs *SoundCloudStream) InitStream(link any) error {
 		return fmt.Errorf("expected string URL, got %T", link)
 	}
 
-	_, err := url.ParseRequestURI(urlStr)
-	if err != nil {
-		return fmt.Errorf("invalid URL: %v", err)
+	if err := scs.checkURL(urlStr); err != nil {
+		return err
 	}
 
 	scs.url = urlStr
-	scs.chunkCounter = 0
-	scs.audioChan = make(chan byte, 320000) // Buffer for one chunk
+	if scs.apiBaseURL == "" {
+		scs.apiBaseURL = soundCloudAPIURL
+	}
+	if scs.client == nil {
+		scs.client = &http.Client{}
+	}
+	if scs.decoder == nil {
+		scs.decoder = &FFmpegDecoder{}
+	}
 
 	// Start streaming in a goroutine
-	go scs.streamAudio()
+	scs.start(scs.streamAudio)
 	return nil
 }
 
 func (scs *SoundCloudStream) GetChunk() (Chunk, error) {
-	if scs.audioChan == nil {
-		return nil, fmt.Errorf("stream not initialized")
+	timestamp, audio, err := scs.nextAudio()
+	if err != nil {
+		return nil, err
 	}
+	return &SoundCloudChunk{
+		timestamp:     &timestamp,
+		audioChunk:    &audio,
+		chunkDuration: scs.getChunkDuration(),
+	}, nil
+}
 
-	timestamp := time.Duration(scs.chunkCounter*10) * time.Second
-	chunk := &SoundCloudChunk{
-		timestamp: &timestamp,
+// streamAudio downloads and decodes the track, feeding PCM bytes into the
+// stream until the track ends, streaming fails or the stream is closed
+func (scs *SoundCloudStream) streamAudio(ctx context.Context) error {
+	body, err := scs.openStream(ctx)
+	if err != nil {
+		return err
 	}
+	defer body.Close()
 
-	// Record the next chunk of audio
-	newChunk := chunk.Record(scs.audioChan)
-	scs.chunkCounter++
-
-	return newChunk, nil
-}
-
-func (scs *SoundCloudStream) streamAudio() {
-	// TODO: Implement actual SoundCloud streaming
-	// For now, just simulate streaming by sending some test data
-	for {
-		select {
-		case scs.audioChan <- byte(scs.chunkCounter % 256):
-			// Simulate streaming by sending some test data
-		case <-time.After(100 * time.Millisecond):
-			// Simulate network delay
-		}
+	pcm, err := scs.decoder.Decode(body)
+	if err != nil {
+		return fmt.Errorf("failed to decode audio: %w", err)
 	}
+	defer pcm.Close()
+
+	return scs.pump(pcm)
 }
@@ -0,0 +1,380 @@
+package audiostream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChunkDuration(t *testing.T) {
+	tests := []struct {
+		name      string
+		duration  time.Duration
+		wantBytes int
+	}{
+		{name: "3 seconds", duration: 3 * time.Second, wantBytes: 96000},
+		{name: "12 seconds", duration: 12 * time.Second, wantBytes: 384000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("SoundCloudChunk", func(t *testing.T) {
+				in := make(chan byte, tt.wantBytes+100)
+				for i := 0; i < tt.wantBytes+100; i++ {
+					in <- byte(i)
+				}
+
+				start := 30 * time.Second
+				chunk := (&SoundCloudChunk{timestamp: &start, chunkDuration: tt.duration}).Record(context.Background(), in)
+				next := chunk.Record(context.Background(), in)
+
+				if got := len(chunk.GetAudioData()); got != tt.wantBytes {
+					t.Errorf("recorded %d bytes, want %d", got, tt.wantBytes)
+				}
+				if got := chunk.GetTimestamp(); got != start {
+					t.Errorf("timestamp = %v, want %v", got, start)
+				}
+				if got := next.GetTimestamp(); got != start+tt.duration {
+					t.Errorf("next timestamp = %v, want %v", got, start+tt.duration)
+				}
+			})
+
+			t.Run("FileStream", func(t *testing.T) {
+				fs := &FileStream{}
+				if err := fs.SetChunkDuration(tt.duration); err != nil {
+					t.Fatalf("SetChunkDuration() error = %v", err)
+				}
+				if err := fs.InitStream(writeTestWAV(t, 16000, 1, 30*time.Second)); err != nil {
+					t.Fatalf("InitStream() error = %v", err)
+				}
+
+				for i := 0; i < 2; i++ {
+					chunk, err := fs.GetChunk()
+					if err != nil {
+						t.Fatalf("GetChunk() error = %v", err)
+					}
+					if got := len(chunk.GetAudioData()); got != tt.wantBytes {
+						t.Errorf("chunk %d length = %d, want %d", i, got, tt.wantBytes)
+					}
+					if want := time.Duration(i) * tt.duration; chunk.GetTimestamp() != want {
+						t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSetChunkDurationInvalid(t *testing.T) {
+	scs := &SoundCloudStream{}
+	for _, d := range []time.Duration{0, -time.Second} {
+		if err := scs.SetChunkDuration(d); err == nil {
+			t.Errorf("SetChunkDuration(%v) error = nil, want error", d)
+		}
+	}
+}
+
+func TestOverlapDuration(t *testing.T) {
+	const (
+		chunkDuration   = 3 * time.Second
+		overlapDuration = time.Second
+		overlapBytes    = 32000
+	)
+
+	fs := &FileStream{}
+	if err := fs.SetChunkDuration(chunkDuration); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	if err := fs.SetOverlapDuration(overlapDuration); err != nil {
+		t.Fatalf("SetOverlapDuration() error = %v", err)
+	}
+	if err := fs.InitStream(writeTestWAV(t, 16000, 1, 10*time.Second)); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+
+	var prev Chunk
+	for i := 0; i < 3; i++ {
+		chunk, err := fs.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		if got := len(chunk.GetAudioData()); got != 96000 {
+			t.Errorf("chunk %d length = %d, want 96000", i, got)
+		}
+		if want := time.Duration(i) * (chunkDuration - overlapDuration); chunk.GetTimestamp() != want {
+			t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), want)
+		}
+
+		if prev != nil {
+			prevData := prev.GetAudioData()
+			tail := prevData[len(prevData)-overlapBytes:]
+			if !bytes.Equal(chunk.GetAudioData()[:overlapBytes], tail) {
+				t.Errorf("chunk %d does not start with the last %d bytes of chunk %d", i, overlapBytes, i-1)
+			}
+		}
+		prev = chunk
+	}
+}
+
+func TestSetOverlapDurationInvalid(t *testing.T) {
+	fs := &FileStream{}
+	if err := fs.SetChunkDuration(5 * time.Second); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	for _, d := range []time.Duration{-time.Second, 5 * time.Second, 6 * time.Second} {
+		if err := fs.SetOverlapDuration(d); err == nil {
+			t.Errorf("SetOverlapDuration(%v) error = nil, want error", d)
+		}
+	}
+
+	if err := fs.SetOverlapDuration(2 * time.Second); err != nil {
+		t.Fatalf("SetOverlapDuration() error = %v", err)
+	}
+	if err := fs.SetChunkDuration(2 * time.Second); err == nil {
+		t.Error("SetChunkDuration() shorter than overlap error = nil, want error")
+	}
+}
+
+func TestSoundCloudChunkGetDuration(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes int
+		want  time.Duration
+	}{
+		{name: "full chunk", bytes: 320000, want: 10 * time.Second},
+		{name: "one and a half seconds", bytes: 48000, want: 1500 * time.Millisecond},
+		{name: "half second", bytes: 16000, want: 500 * time.Millisecond},
+		{name: "empty", bytes: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.bytes)
+			chunk := &SoundCloudChunk{audioChunk: &data}
+			if got := chunk.GetDuration(); got != tt.want {
+				t.Errorf("GetDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoundCloudChunkRecord(t *testing.T) {
+	want := make([]byte, chunkBytes(time.Second))
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	in := make(chan byte, len(want)+10)
+	for _, b := range want {
+		in <- b
+	}
+	for i := 0; i < 10; i++ {
+		in <- 0xFF
+	}
+
+	start := 5 * time.Second
+	chunk := (&SoundCloudChunk{timestamp: &start, chunkDuration: time.Second}).Record(context.Background(), in)
+
+	if !bytes.Equal(chunk.GetAudioData(), want) {
+		t.Error("recorded chunk does not hold the recorded audio")
+	}
+	if chunk.GetTimestamp() != start {
+		t.Errorf("GetTimestamp() = %v, want %v", chunk.GetTimestamp(), start)
+	}
+	if chunk.GetDuration() != time.Second {
+		t.Errorf("GetDuration() = %v, want %v", chunk.GetDuration(), time.Second)
+	}
+
+	// The remainder is a partial chunk once the channel closes
+	close(in)
+	next := chunk.Record(context.Background(), in)
+	if got := next.GetAudioData(); !bytes.Equal(got, bytes.Repeat([]byte{0xFF}, 10)) {
+		t.Errorf("next chunk audio = %v, want 10 bytes of 0xFF", got)
+	}
+	if want := start + time.Second; next.GetTimestamp() != want {
+		t.Errorf("next GetTimestamp() = %v, want %v", next.GetTimestamp(), want)
+	}
+}
+
+func TestRecordPartialTimestamps(t *testing.T) {
+	// Full chunks alternating with partial ones, each followed by a pause
+	// long enough for the recording to give up on it
+	sizes := []int{32000, 8000, 32000, 12000, 32000, 2}
+	wantStarts := []time.Duration{
+		0,
+		time.Second,
+		1250 * time.Millisecond,
+		2250 * time.Millisecond,
+		2625 * time.Millisecond,
+		3625 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name  string
+		first Chunk
+		// record returns the chunk following c, giving up on partial audio
+		record func(c Chunk, in chan byte) Chunk
+	}{
+		{
+			name:  "SoundCloudChunk",
+			first: &SoundCloudChunk{timestamp: new(time.Duration), chunkDuration: time.Second},
+			record: func(c Chunk, in chan byte) Chunk {
+				// Partial audio ends with the idle timeout
+				return c.Record(context.Background(), in)
+			},
+		},
+		{
+			name:  "PCMChunk",
+			first: &PCMChunk{chunkDuration: time.Second},
+			record: func(c Chunk, in chan byte) Chunk {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*recordIdleTimeout)
+				defer cancel()
+				return c.Record(ctx, in)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan byte, 32000)
+			chunk := tt.first
+			for i, size := range sizes {
+				for range size {
+					in <- byte(i)
+				}
+				chunk = tt.record(chunk, in)
+
+				if got := len(chunk.GetAudioData()); got != size {
+					t.Fatalf("chunk %d recorded %d bytes, want %d", i, got, size)
+				}
+				if chunk.GetTimestamp() != wantStarts[i] {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), wantStarts[i])
+				}
+				if want := pcmDuration(size); chunk.GetDuration() != want {
+					t.Errorf("chunk %d duration = %v, want %v", i, chunk.GetDuration(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestPCMChunkRecordSampleRate(t *testing.T) {
+	for _, rate := range []int{8000, 16000, 32000} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			// Two and a half seconds of audio at the chunk's rate
+			in := make(chan byte, 5*rate)
+			for i := range 5 * rate {
+				in <- byte(i)
+			}
+			close(in)
+
+			var chunk Chunk = NewPCMChunk(nil, 0, rate)
+			chunk.(*PCMChunk).chunkDuration = time.Second
+			for i, want := range []time.Duration{time.Second, time.Second, 500 * time.Millisecond} {
+				chunk = chunk.Record(context.Background(), in)
+				if got := len(chunk.GetAudioData()); got != int(want.Seconds()*float64(2*rate)) {
+					t.Errorf("chunk %d recorded %d bytes, want %v of audio", i, got, want)
+				}
+				if chunk.GetDuration() != want {
+					t.Errorf("chunk %d duration = %v, want %v", i, chunk.GetDuration(), want)
+				}
+				if start := time.Duration(i) * time.Second; chunk.GetTimestamp() != start {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), start)
+				}
+				if got := ChunkSampleRate(chunk); got != rate {
+					t.Errorf("chunk %d sample rate = %d, want %d", i, got, rate)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPCMChunkRecordsDefaultDuration(t *testing.T) {
+	const rate = 8000
+	in := make(chan byte, 2*rate*int(DefaultChunkDuration/time.Second+1))
+	for range cap(in) {
+		in <- 0
+	}
+	close(in)
+
+	chunk := NewPCMChunk(nil, 0, rate).Record(context.Background(), in)
+	if got := chunk.GetDuration(); got != DefaultChunkDuration {
+		t.Errorf("Record() captured %v, want %v", got, DefaultChunkDuration)
+	}
+}
+
+func TestRecordCancel(t *testing.T) {
+	chunks := map[string]Chunk{
+		"SoundCloudChunk": &SoundCloudChunk{timestamp: new(time.Duration), chunkDuration: time.Second},
+		"PCMChunk":        &PCMChunk{chunkDuration: time.Second},
+	}
+
+	for name, chunk := range chunks {
+		t.Run(name, func(t *testing.T) {
+			// A stalled stream that trickles out a few bytes and then nothing
+			in := make(chan byte, 10)
+			for i := 0; i < 10; i++ {
+				in <- byte(i)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+
+			// Keep the SoundCloud timeout from ending the recording first
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				ticker := time.NewTicker(10 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						select {
+						case in <- 0xFF:
+						default:
+						}
+					case <-stop:
+						return
+					}
+				}
+			}()
+
+			start := time.Now()
+			recorded := chunk.Record(ctx, in)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Record() took %v after cancel", elapsed)
+			}
+			if got := len(recorded.GetAudioData()); got < 10 || got >= chunkBytes(time.Second) {
+				t.Errorf("Record() kept %d bytes, want the partial data gathered before cancel", got)
+			}
+		})
+	}
+}
+
+func TestPCMChunkSampleRate(t *testing.T) {
+	tests := []struct {
+		rate     int
+		wantRate int
+	}{
+		{rate: 0, wantRate: 16000},
+		{rate: 8000, wantRate: 8000},
+		{rate: 16000, wantRate: 16000},
+		{rate: 32000, wantRate: 32000},
+	}
+
+	for _, tt := range tests {
+		// One second of audio at the chunk's rate
+		chunk := NewPCMChunk(make([]byte, 2*tt.wantRate), 0, tt.rate)
+		if got := ChunkSampleRate(chunk); got != tt.wantRate {
+			t.Errorf("ChunkSampleRate() = %d, want %d", got, tt.wantRate)
+		}
+		if got := chunk.GetDuration(); got != time.Second {
+			t.Errorf("%dHz GetDuration() = %v, want 1s", tt.wantRate, got)
+		}
+	}
+
+	// Chunks that don't report a rate hold 16kHz audio
+	if got := ChunkSampleRate(&SoundCloudChunk{}); got != 16000 {
+		t.Errorf("ChunkSampleRate(SoundCloudChunk) = %d, want 16000", got)
+	}
+}
@@ -0,0 +1,170 @@
+// Package audiostreamtest provides fixed audio streams and chunks for testing
+// code that consumes audiostream interfaces
+package audiostreamtest
+
+import (
+	"context"
+	"io"
+	"listr/internal/audiostream"
+	"sync"
+	"time"
+)
+
+// bytesPerSecond is the rate of the 16kHz 16-bit mono PCM chunks hold
+const bytesPerSecond = 16000 * 2
+
+// pcmDuration returns how long n bytes of PCM audio last
+func pcmDuration(n int) time.Duration {
+	return time.Duration(n) * time.Second / bytesPerSecond
+}
+
+// StaticChunk is a Chunk holding fixed audio data
+type StaticChunk struct {
+	data      []byte
+	timestamp time.Duration
+	duration  time.Duration
+}
+
+// NewStaticChunk returns a chunk of the given PCM audio starting at ts in
+// its stream. Its duration follows from the length of data.
+func NewStaticChunk(data []byte, ts time.Duration) *StaticChunk {
+	return &StaticChunk{data: data, timestamp: ts, duration: pcmDuration(len(data))}
+}
+
+// NewTimedChunk returns a chunk of the given PCM audio starting at ts in its
+// stream that reports lasting d, however long data plays for. It lets tests
+// lay out long chunks without generating their audio.
+func NewTimedChunk(data []byte, ts, d time.Duration) *StaticChunk {
+	return &StaticChunk{data: data, timestamp: ts, duration: d}
+}
+
+// PatternChunks returns n chunks of short, distinct, non-silent audio, each
+// reporting a duration of step and timestamped step apart
+func PatternChunks(n int, step time.Duration) []audiostream.Chunk {
+	chunks := make([]audiostream.Chunk, n)
+	for i := range chunks {
+		data := make([]byte, 3200)
+		for j := range data {
+			data[j] = byte((i*7 + j*13) % 256)
+		}
+		chunks[i] = NewTimedChunk(data, time.Duration(i)*step, step)
+	}
+	return chunks
+}
+
+// Record returns the chunk itself, as its audio is fixed
+func (sc *StaticChunk) Record(ctx context.Context, in chan byte) audiostream.Chunk {
+	return sc
+}
+
+// GetAudioData returns the chunk's audio
+func (sc *StaticChunk) GetAudioData() []byte {
+	return sc.data
+}
+
+// GetTimestamp returns the start time of the chunk in its stream
+func (sc *StaticChunk) GetTimestamp() time.Duration {
+	return sc.timestamp
+}
+
+// GetDuration returns how long the chunk's audio lasts
+func (sc *StaticChunk) GetDuration() time.Duration {
+	return sc.duration
+}
+
+// StaticStream is a Stream serving a fixed list of chunks in order, followed
+// by io.EOF. It records how it was set up, so tests can check what the code
+// under test asked of it. It is safe for concurrent use.
+type StaticStream struct {
+	mu            sync.Mutex
+	chunks        []audiostream.Chunk
+	source        any
+	chunkDuration time.Duration
+	closed        bool
+}
+
+// NewStaticStream returns a stream serving each element of chunks as a chunk
+// of PCM audio, timestamped one after the other from the start of the stream
+func NewStaticStream(chunks [][]byte) *StaticStream {
+	ss := &StaticStream{}
+	var timestamp time.Duration
+	for _, data := range chunks {
+		chunk := NewStaticChunk(data, timestamp)
+		ss.chunks = append(ss.chunks, chunk)
+		timestamp += chunk.GetDuration()
+	}
+	return ss
+}
+
+// NewChunkStream returns a stream serving the given chunks as they are
+func NewChunkStream(chunks ...audiostream.Chunk) *StaticStream {
+	return &StaticStream{chunks: chunks}
+}
+
+// InitStream records V, as the stream's chunks are fixed
+func (ss *StaticStream) InitStream(V any) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.source = V
+	return nil
+}
+
+// Source returns what InitStream was last called with
+func (ss *StaticStream) Source() any {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.source
+}
+
+// SetChunkDuration records d without changing the stream's chunks
+func (ss *StaticStream) SetChunkDuration(d time.Duration) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.chunkDuration = d
+	return nil
+}
+
+// ChunkDuration returns what SetChunkDuration was last called with
+func (ss *StaticStream) ChunkDuration() time.Duration {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.chunkDuration
+}
+
+// GetChunk returns the next chunk, io.EOF once all have been returned, or
+// audiostream.ErrStreamClosed after Close
+func (ss *StaticStream) GetChunk() (audiostream.Chunk, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.closed {
+		return nil, audiostream.ErrStreamClosed
+	}
+	if len(ss.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := ss.chunks[0]
+	ss.chunks = ss.chunks[1:]
+	return chunk, nil
+}
+
+// Close stops the stream from serving further chunks
+func (ss *StaticStream) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.closed = true
+	return nil
+}
+
+// Closed reports whether Close has been called
+func (ss *StaticStream) Closed() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.closed
+}
@@ -0,0 +1,124 @@
+package audiostreamtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"listr/internal/audiostream"
+	"slices"
+	"testing"
+	"time"
+)
+
+var (
+	_ audiostream.Chunk        = (*StaticChunk)(nil)
+	_ audiostream.Stream       = (*StaticStream)(nil)
+	_ audiostream.ChunkResizer = (*StaticStream)(nil)
+)
+
+func TestStaticChunk(t *testing.T) {
+	data := make([]byte, 48000)
+	var chunk audiostream.Chunk = NewStaticChunk(data, 10*time.Second)
+
+	if got := chunk.GetTimestamp(); got != 10*time.Second {
+		t.Errorf("GetTimestamp() = %v, want 10s", got)
+	}
+	if got := chunk.GetDuration(); got != 1500*time.Millisecond {
+		t.Errorf("GetDuration() = %v, want 1.5s", got)
+	}
+	if got := chunk.Record(context.Background(), make(chan byte)); got != chunk {
+		t.Errorf("Record() = %v, want the chunk itself", got)
+	}
+}
+
+func TestStaticStream(t *testing.T) {
+	chunks := [][]byte{make([]byte, 32000), {1, 2, 3, 4}, make([]byte, 64000)}
+	var stream audiostream.Stream = NewStaticStream(chunks)
+	if err := stream.InitStream("anything"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	if got := stream.(*StaticStream).Source(); got != "anything" {
+		t.Errorf("Source() = %v, want anything", got)
+	}
+
+	wantTimestamps := []time.Duration{0, time.Second, time.Second + 125*time.Microsecond}
+	for i, want := range wantTimestamps {
+		chunk, err := stream.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() %d error = %v", i, err)
+		}
+		if !slices.Equal(chunk.GetAudioData(), chunks[i]) {
+			t.Errorf("chunk %d has the wrong audio", i)
+		}
+		if chunk.GetTimestamp() != want {
+			t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), want)
+		}
+	}
+
+	// The end is reported every time it is reached
+	for range 2 {
+		if _, err := stream.GetChunk(); err != io.EOF {
+			t.Fatalf("GetChunk() at end error = %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestStaticStreamClose(t *testing.T) {
+	stream := NewChunkStream(NewStaticChunk([]byte{0, 0}, 0))
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if !stream.Closed() {
+		t.Error("Closed() = false after Close")
+	}
+	if _, err := stream.GetChunk(); !errors.Is(err, audiostream.ErrStreamClosed) {
+		t.Errorf("GetChunk() after Close error = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestTimedChunk(t *testing.T) {
+	chunk := NewTimedChunk([]byte{1, 2, 3, 4}, 20*time.Second, 10*time.Second)
+	if got := chunk.GetDuration(); got != 10*time.Second {
+		t.Errorf("GetDuration() = %v, want 10s", got)
+	}
+	if got := chunk.GetTimestamp(); got != 20*time.Second {
+		t.Errorf("GetTimestamp() = %v, want 20s", got)
+	}
+}
+
+func TestPatternChunks(t *testing.T) {
+	chunks := PatternChunks(3, 5*time.Second)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if want := time.Duration(i) * 5 * time.Second; chunk.GetTimestamp() != want {
+			t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), want)
+		}
+		if chunk.GetDuration() != 5*time.Second {
+			t.Errorf("chunk %d duration = %v, want 5s", i, chunk.GetDuration())
+		}
+		if i > 0 && slices.Equal(chunk.GetAudioData(), chunks[i-1].GetAudioData()) {
+			t.Errorf("chunk %d has the same audio as chunk %d", i, i-1)
+		}
+	}
+}
+
+func TestStaticStreamChunkDuration(t *testing.T) {
+	stream := NewStaticStream([][]byte{make([]byte, 32000)})
+	if err := stream.SetChunkDuration(10 * time.Second); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	if got := stream.ChunkDuration(); got != 10*time.Second {
+		t.Errorf("ChunkDuration() = %v, want 10s", got)
+	}
+
+	// The chunks themselves are left as they are
+	chunk, err := stream.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if chunk.GetDuration() != time.Second {
+		t.Errorf("chunk duration = %v, want 1s", chunk.GetDuration())
+	}
+}
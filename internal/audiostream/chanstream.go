@@ -0,0 +1,183 @@
+package audiostream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// chanStream serves chunks of PCM that a background goroutine feeds into a
+// channel. Network and microphone streams embed it and supply the feed.
+type chanStream struct {
+	audioChan      chan byte
+	bufferDuration time.Duration // Audio the channel holds, defaults to one chunk
+	chunkSizer
+	chunkAssembler
+
+	errMu     sync.Mutex
+	streamErr error         // Why streaming stopped early, if it did
+	ended     chan struct{} // Closed once streaming has stopped
+
+	ctx       context.Context // Cancelled by Close, ending downloads and recording
+	cancel    context.CancelFunc
+	done      chan struct{} // Closed by Close to stop streaming
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// SetBufferDuration sets how much audio is buffered between the download and
+// GetChunk, one chunk by default. The buffer costs 32KB of memory per second.
+// A longer buffer rides out network stalls and slow match requests without
+// the download stalling, but a shorter one keeps less audio in flight. The
+// download waits while the buffer is full, so no audio is lost either way.
+// It takes effect the next time the stream is initialized.
+func (cs *chanStream) SetBufferDuration(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("buffer duration must be positive, got %v", d)
+	}
+	cs.bufferDuration = d
+	return nil
+}
+
+// start resets the stream and runs feed in a goroutine. feed should send the
+// audio with pump and return once it ends, with the error if it failed. The
+// channel is closed when feed returns. A stream started again without being
+// closed has its previous feed stopped first.
+func (cs *chanStream) start(feed func(ctx context.Context) error) {
+	cs.Close()
+	cs.chunkAssembler = chunkAssembler{}
+	cs.audioChan = make(chan byte, chunkBytes(cmp.Or(cs.bufferDuration, cs.getChunkDuration())))
+	cs.ended = make(chan struct{})
+	cs.done = make(chan struct{})
+	cs.closeOnce = sync.Once{}
+	cs.setStreamErr(nil)
+	cs.ctx, cs.cancel = context.WithCancel(context.Background())
+
+	cs.wg.Add(1)
+	go func() {
+		defer cs.wg.Done()
+		// ended is closed before audioChan, so a drained channel seen after
+		// the stream ended really is the end of the audio
+		defer close(cs.audioChan)
+		defer close(cs.ended)
+
+		if err := feed(cs.ctx); err != nil && !cs.isClosed() {
+			cs.setStreamErr(err)
+		}
+	}()
+}
+
+// pump copies PCM from r into the channel until r is exhausted. Sends block
+// while the channel is full so no audio is dropped. It returns
+// ErrStreamClosed if the stream is closed first.
+func (cs *chanStream) pump(r io.Reader) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			select {
+			case cs.audioChan <- b:
+			case <-cs.done:
+				return ErrStreamClosed
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read audio: %v", err)
+		}
+	}
+}
+
+// nextAudio records the next chunk's worth of audio, returning its start time
+// and the audio with the overlap from the previous chunk prepended
+func (cs *chanStream) nextAudio() (time.Duration, []byte, error) {
+	if cs.audioChan == nil {
+		return 0, nil, fmt.Errorf("stream not initialized")
+	}
+
+	// An empty chunk at the next start time records the chunk that follows it
+	timestamp := cs.nextStart()
+	start := &SoundCloudChunk{
+		timestamp:     &timestamp,
+		chunkDuration: pcmDuration(cs.newBytes(chunkBytes(cs.getChunkDuration()))),
+	}
+
+	// Record the new audio. A recording that times out with nothing is never
+	// handed out, as there is nothing to match; keep waiting for audio until
+	// the stream ends or is closed instead.
+	for {
+		if cs.isClosed() {
+			return 0, nil, ErrStreamClosed
+		}
+		if len(cs.audioChan) == 0 && cs.streamEnded() {
+			return 0, nil, cs.endErr()
+		}
+
+		recorded := start.Record(cs.ctx, cs.audioChan).GetAudioData()
+		if len(recorded) > 0 && !cs.isClosed() {
+			return timestamp, cs.assemble(recorded, cs.overlapBytes()), nil
+		}
+	}
+}
+
+// Close stops streaming, waits for the streaming goroutine to exit and
+// closes the audio channel
+func (cs *chanStream) Close() error {
+	if cs.done == nil {
+		return nil
+	}
+
+	cs.closeOnce.Do(func() {
+		close(cs.done)
+		cs.cancel()
+		cs.wg.Wait()
+	})
+	return nil
+}
+
+// isClosed reports whether Close has been called
+func (cs *chanStream) isClosed() bool {
+	select {
+	case <-cs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// streamEnded reports whether streaming has stopped
+func (cs *chanStream) streamEnded() bool {
+	select {
+	case <-cs.ended:
+		return true
+	default:
+		return false
+	}
+}
+
+// endErr returns why the stream ended: the streaming failure if there was
+// one, otherwise io.EOF. Any audio received before a failure is handed out
+// first.
+func (cs *chanStream) endErr() error {
+	if err := cs.getStreamErr(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (cs *chanStream) setStreamErr(err error) {
+	cs.errMu.Lock()
+	defer cs.errMu.Unlock()
+	cs.streamErr = err
+}
+
+func (cs *chanStream) getStreamErr() error {
+	cs.errMu.Lock()
+	defer cs.errMu.Unlock()
+	return cs.streamErr
+}
@@ -0,0 +1,105 @@
+package audiostream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Decoder converts encoded audio into raw 16kHz 16-bit little-endian mono PCM
+type Decoder interface {
+	// Decode returns a reader of PCM bytes decoded from r. Closing it releases
+	// any resources held by the decoder.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// ErrFFmpegNotFound is returned when the ffmpeg binary a decoder or capture
+// source runs can't be found
+var ErrFFmpegNotFound = errors.New("ffmpeg not found, install it or set the Path to its binary")
+
+// FFmpegDecoder decodes any format ffmpeg understands by piping the audio
+// through an ffmpeg process
+type FFmpegDecoder struct {
+	Path string // Path to the ffmpeg binary, defaults to "ffmpeg" on PATH
+}
+
+// Decode starts ffmpeg reading from r and returns its PCM output
+func (d *FFmpegDecoder) Decode(r io.Reader) (io.ReadCloser, error) {
+	return startFFmpeg(d.Path, r, "-i", "pipe:0")
+}
+
+// startFFmpeg runs ffmpeg with the given input arguments, converting the
+// input to 16kHz 16-bit mono PCM on its stdout
+func startFFmpeg(path string, stdin io.Reader, inputArgs ...string) (io.ReadCloser, error) {
+	if path == "" {
+		path = "ffmpeg"
+	}
+
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, inputArgs...)
+	args = append(args, "-f", "s16le", "-acodec", "pcm_s16le", "-ac", "1", "-ar", "16000", "pipe:1")
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = stdin
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ffmpeg pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %q", ErrFFmpegNotFound, path)
+		}
+		return nil, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	return &commandReader{cmd: cmd, stdout: stdout, stderr: stderr}, nil
+}
+
+// commandReader reads a command's stdout and reports its exit status at EOF.
+// Close may be called from another goroutine than the one reading, so the
+// command is reaped once, by whichever side gets there first.
+type commandReader struct {
+	cmd      *exec.Cmd
+	stdout   io.ReadCloser
+	stderr   *bytes.Buffer
+	waitOnce sync.Once
+	err      error // Set by wait
+}
+
+func (cr *commandReader) Read(p []byte) (int, error) {
+	n, err := cr.stdout.Read(p)
+	if err == io.EOF {
+		if waitErr := cr.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if it is still running. The rest of its output is
+// drained first, as Wait closes the pipe and mustn't run while it's read.
+func (cr *commandReader) Close() error {
+	if cr.cmd.Process != nil {
+		// Fails harmlessly if the command already exited
+		cr.cmd.Process.Kill()
+	}
+	io.Copy(io.Discard, cr.stdout)
+	cr.wait()
+	return nil
+}
+
+// wait reaps the command once and returns its failure, if any
+func (cr *commandReader) wait() error {
+	cr.waitOnce.Do(func() {
+		if err := cr.cmd.Wait(); err != nil {
+			cr.err = fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(cr.stderr.String()))
+		}
+	})
+	return cr.err
+}
@@ -0,0 +1,52 @@
+package audiostream
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeFakeFFmpeg writes a shell script standing in for ffmpeg, which
+// ignores its arguments and writes silence to stdout until killed
+func writeFakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nexec cat /dev/zero\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestCommandReaderCloseWhileReading closes ffmpeg's output while another
+// goroutine is reading it, as closing a stream does. Run it with -race.
+func TestCommandReaderCloseWhileReading(t *testing.T) {
+	ffmpeg := writeFakeFFmpeg(t)
+	for range 20 {
+		pcm, err := startFFmpeg(ffmpeg, nil, "-i", "pipe:0")
+		if err != nil {
+			t.Fatalf("startFFmpeg() error = %v", err)
+		}
+
+		read := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, pcm)
+			close(read)
+		}()
+		time.Sleep(time.Millisecond)
+
+		if err := pcm.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reading did not stop after Close()")
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package audiostream
 
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
 // FrequencyBand represents the different frequency bands used in Shazam signatures
 type FrequencyBand int
 
@@ -11,6 +18,33 @@ const (
 	VeryHighBand FrequencyBand = 3
 )
 
+// frequencyBandNames maps frequency bands to their human readable names
+var frequencyBandNames = map[FrequencyBand]string{
+	LowBand:      "low",
+	MidBand:      "mid",
+	HighBand:     "high",
+	VeryHighBand: "veryhigh",
+}
+
+// String returns the band's name, such as "low", or "unknown(N)" for a band
+// outside the four Shazam uses
+func (b FrequencyBand) String() string {
+	if name, ok := frequencyBandNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(b))
+}
+
+// ParseFrequencyBand returns the band named by String
+func ParseFrequencyBand(name string) (FrequencyBand, error) {
+	for frequencyBand, bandName := range frequencyBandNames {
+		if bandName == name {
+			return frequencyBand, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown frequency band: %q", name)
+}
+
 // SampleRate represents the supported sample rates
 type SampleRate int
 
@@ -21,3 +55,50 @@ const (
 	SampleRate44100 SampleRate = 44100
 	SampleRate48000 SampleRate = 48000
 )
+
+// sampleRateIDs maps supported sample rates to the IDs Shazam stores in the
+// signature header
+var sampleRateIDs = map[SampleRate]uint32{
+	SampleRate8000:  1,
+	SampleRate16000: 3,
+	SampleRate32000: 4,
+	SampleRate44100: 5,
+	SampleRate48000: 6,
+}
+
+// ErrUnsupportedSampleRate is returned when a sample rate has no Shazam ID
+var ErrUnsupportedSampleRate = errors.New("unsupported sample rate")
+
+// SupportedSampleRates returns the sample rates signatures can be encoded at,
+// lowest first
+func SupportedSampleRates() []SampleRate {
+	return slices.Sorted(maps.Keys(sampleRateIDs))
+}
+
+// ShazamID returns the ID Shazam stores in the signature header for the
+// rate, and whether the rate is supported
+func (r SampleRate) ShazamID() (uint32, bool) {
+	id, ok := sampleRateIDs[r]
+	return id, ok
+}
+
+// IsSupportedSampleRate reports whether a sample rate in Hz can be encoded
+func IsSupportedSampleRate(hz int) bool {
+	_, ok := SampleRate(hz).ShazamID()
+	return ok
+}
+
+// sampleRateID returns the Shazam ID for a sample rate in Hz
+func sampleRateID(hz int) (uint32, bool) {
+	return SampleRate(hz).ShazamID()
+}
+
+// sampleRateFromID returns the sample rate in Hz for a Shazam ID
+func sampleRateFromID(id uint32) (int, bool) {
+	for rate, rateID := range sampleRateIDs {
+		if rateID == id {
+			return int(rate), true
+		}
+	}
+	return 0, false
+}
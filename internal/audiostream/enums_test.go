@@ -0,0 +1,68 @@
+package audiostream
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFrequencyBandString(t *testing.T) {
+	tests := []struct {
+		band FrequencyBand
+		name string
+	}{
+		{band: LowBand, name: "low"},
+		{band: MidBand, name: "mid"},
+		{band: HighBand, name: "high"},
+		{band: VeryHighBand, name: "veryhigh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.band.String(); got != tt.name {
+				t.Errorf("String() = %q, want %q", got, tt.name)
+			}
+			band, err := ParseFrequencyBand(tt.name)
+			if err != nil {
+				t.Fatalf("ParseFrequencyBand(%q) error = %v", tt.name, err)
+			}
+			if band != tt.band {
+				t.Errorf("ParseFrequencyBand(%q) = %d, want %d", tt.name, band, tt.band)
+			}
+		})
+	}
+
+	if got := FrequencyBand(7).String(); got != "unknown(7)" {
+		t.Errorf("String() = %q, want %q", got, "unknown(7)")
+	}
+	for _, name := range []string{"", "LOW", "unknown(7)", "veryHigh"} {
+		if _, err := ParseFrequencyBand(name); err == nil {
+			t.Errorf("ParseFrequencyBand(%q) error = nil, want error", name)
+		}
+	}
+}
+
+func TestSupportedSampleRates(t *testing.T) {
+	want := []SampleRate{SampleRate8000, SampleRate16000, SampleRate32000, SampleRate44100, SampleRate48000}
+	if got := SupportedSampleRates(); !slices.Equal(got, want) {
+		t.Errorf("SupportedSampleRates() = %v, want %v", got, want)
+	}
+
+	wantIDs := []uint32{1, 3, 4, 5, 6}
+	for i, rate := range want {
+		id, ok := rate.ShazamID()
+		if !ok || id != wantIDs[i] {
+			t.Errorf("%d.ShazamID() = %d, %v, want %d, true", rate, id, ok, wantIDs[i])
+		}
+		if !IsSupportedSampleRate(int(rate)) {
+			t.Errorf("IsSupportedSampleRate(%d) = false, want true", rate)
+		}
+		if hz, ok := sampleRateFromID(id); !ok || hz != int(rate) {
+			t.Errorf("sampleRateFromID(%d) = %d, %v, want %d, true", id, hz, ok, rate)
+		}
+	}
+
+	for _, rate := range []SampleRate{0, 11025, 22050, 96000, -16000} {
+		if id, ok := rate.ShazamID(); ok {
+			t.Errorf("%d.ShazamID() = %d, true, want unsupported", rate, id)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package audiostream
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// FileStream serves chunks of audio from a local WAV file, converted to
+// 16-bit mono PCM at 16kHz unless SetKeepSampleRate is used
+type FileStream struct {
+	path   string
+	length time.Duration // Duration of the file's audio
+	pcmChunker
+	chunkSizer
+	rateKeeper
+}
+
+// InitStream opens the WAV file at the given path
+func (fs *FileStream) InitStream(path any) error {
+	pathStr, ok := path.(string)
+	if !ok {
+		return fmt.Errorf("expected string path, got %T", path)
+	}
+
+	file, err := os.Open(pathStr)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+
+	pcm, err := newWAVPCMReader(file, fs.keepSampleRate)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read wav: %v", err)
+	}
+	if fs.keepSampleRate && !IsSupportedSampleRate(pcm.rate) {
+		file.Close()
+		return fmt.Errorf("can't keep sample rate %d Hz, signatures don't support it", pcm.rate)
+	}
+
+	available := int64(math.MaxInt64)
+	if info, err := file.Stat(); err == nil {
+		available = info.Size()
+	}
+
+	fs.path = pathStr
+	fs.length = pcm.length(available)
+	fs.pcmChunker = pcmChunker{pcm: pcm, closer: file}
+	if fs.keepSampleRate {
+		fs.sampleRate = pcm.rate
+	}
+	return nil
+}
+
+// GetChunk returns the next chunk of audio, or io.EOF once the file is
+// exhausted. The final chunk may be shorter.
+func (fs *FileStream) GetChunk() (Chunk, error) {
+	return fs.nextChunk(&fs.chunkSizer)
+}
+
+// GetLength returns the duration of the file's audio
+func (fs *FileStream) GetLength() time.Duration {
+	return fs.length
+}
+
+// ReadRange returns the audio from start lasting d, read from a fresh handle
+// on the file so chunks from GetChunk carry on where they left off. It
+// returns io.EOF if start is at or past the end of the file.
+func (fs *FileStream) ReadRange(start, d time.Duration) (Chunk, error) {
+	if fs.pcm == nil {
+		return nil, fmt.Errorf("stream not initialized")
+	}
+	if fs.closed {
+		return nil, ErrStreamClosed
+	}
+	if start < 0 || d <= 0 {
+		return nil, fmt.Errorf("invalid range of %v from %v", d, start)
+	}
+
+	file, err := os.Open(fs.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	pcm, err := newWAVPCMReader(file, fs.keepSampleRate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wav: %v", err)
+	}
+
+	// Seek straight to the range rather than decoding the audio before it
+	srcRate := int64(pcm.format.SampleRate)
+	frames := int64(start) * srcRate / int64(time.Second)
+	if err := pcm.seekFrames(file, frames); err != nil {
+		return nil, err
+	}
+	data := make([]byte, chunkBytesAt(d, pcm.rate))
+	n, err := io.ReadFull(pcm, data)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read audio: %v", err)
+	}
+	timestamp := time.Duration(frames) * time.Second / time.Duration(srcRate)
+	return &PCMChunk{timestamp: timestamp, audioData: data[:n], chunkDuration: d, sampleRate: fs.sampleRate}, nil
+}
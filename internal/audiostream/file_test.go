@@ -0,0 +1,409 @@
+package audiostream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestWAV writes a 16-bit PCM WAV file of a 440Hz tone and returns its path
+func writeTestWAV(t *testing.T, sampleRate, channels int, duration time.Duration) string {
+	t.Helper()
+
+	frames := int(duration.Seconds() * float64(sampleRate))
+	data := new(bytes.Buffer)
+	for i := 0; i < frames; i++ {
+		sample := int16(10000 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		for ch := 0; ch < channels; ch++ {
+			binary.Write(data, binary.LittleEndian, sample)
+		}
+	}
+
+	wav := new(bytes.Buffer)
+	wav.WriteString("RIFF")
+	binary.Write(wav, binary.LittleEndian, uint32(36+data.Len()))
+	wav.WriteString("WAVE")
+	wav.WriteString("fmt ")
+	binary.Write(wav, binary.LittleEndian, uint32(16))
+	binary.Write(wav, binary.LittleEndian, wavFormat{
+		AudioFormat:   wavFormatPCM,
+		Channels:      uint16(channels),
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate * channels * 2),
+		BlockAlign:    uint16(channels * 2),
+		BitsPerSample: 16,
+	})
+	wav.WriteString("data")
+	binary.Write(wav, binary.LittleEndian, uint32(data.Len()))
+	wav.Write(data.Bytes())
+
+	path := filepath.Join(t.TempDir(), "test.wav")
+	if err := os.WriteFile(path, wav.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write wav: %v", err)
+	}
+	return path
+}
+
+func TestFileStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		channels   int
+	}{
+		{name: "16kHz mono", sampleRate: 16000, channels: 1},
+		{name: "44.1kHz stereo", sampleRate: 44100, channels: 2},
+		{name: "48kHz stereo", sampleRate: 48000, channels: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &FileStream{}
+			if err := fs.InitStream(writeTestWAV(t, tt.sampleRate, tt.channels, 25*time.Second)); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			if got := StreamLength(fs); got != 25*time.Second {
+				t.Errorf("StreamLength() = %v, want 25s", got)
+			}
+
+			wantTimestamps := []time.Duration{0, 10 * time.Second, 20 * time.Second}
+			wantLengths := []int{320000, 320000, 160000}
+			for i := range wantTimestamps {
+				chunk, err := fs.GetChunk()
+				if err != nil {
+					t.Fatalf("GetChunk() error = %v", err)
+				}
+				if chunk.GetTimestamp() != wantTimestamps[i] {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), wantTimestamps[i])
+				}
+				// Resampling may land a sample either side of the exact length
+				if got := len(chunk.GetAudioData()); math.Abs(float64(got-wantLengths[i])) > 4 {
+					t.Errorf("chunk %d length = %d, want %d", i, got, wantLengths[i])
+				}
+			}
+
+			if _, err := fs.GetChunk(); err != io.EOF {
+				t.Errorf("GetChunk() error = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestFileStreamPlaceholderDataSize(t *testing.T) {
+	// Streamed WAVs are written before their length is known
+	path := writeTestWAV(t, 16000, 1, 5*time.Second)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[40:], math.MaxUint32)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &FileStream{}
+	if err := fs.InitStream(path); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer fs.Close()
+	// Bounded by the file size, which includes the header
+	if got := fs.GetLength(); got < 5*time.Second || got > 5*time.Second+10*time.Millisecond {
+		t.Errorf("GetLength() = %v, want about 5s", got)
+	}
+}
+
+func TestFileStreamPreservesPCM(t *testing.T) {
+	path := writeTestWAV(t, 16000, 1, time.Second)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read wav: %v", err)
+	}
+
+	fs := &FileStream{}
+	if err := fs.InitStream(path); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	chunk, err := fs.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if !bytes.Equal(chunk.GetAudioData(), raw[44:]) {
+		t.Errorf("16kHz mono audio was altered by conversion")
+	}
+}
+
+func TestFileStreamReadRange(t *testing.T) {
+	path := writeTestWAV(t, 16000, 1, 25*time.Second)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read wav: %v", err)
+	}
+	pcm := raw[44:]
+
+	fs := &FileStream{}
+	if err := fs.InitStream(path); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer fs.Close()
+	if _, err := fs.GetChunk(); err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		start, d   time.Duration
+		wantLength int
+	}{
+		{name: "Inside", start: 5 * time.Second, d: 10 * time.Second, wantLength: 320000},
+		{name: "From the start", start: 0, d: time.Second, wantLength: 32000},
+		{name: "Past the end", start: 20 * time.Second, d: 10 * time.Second, wantLength: 160000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk, err := fs.ReadRange(tt.start, tt.d)
+			if err != nil {
+				t.Fatalf("ReadRange() error = %v", err)
+			}
+			if chunk.GetTimestamp() != tt.start {
+				t.Errorf("timestamp = %v, want %v", chunk.GetTimestamp(), tt.start)
+			}
+			offset := int(tt.start * pcmBytesPerSecond / time.Second)
+			if !bytes.Equal(chunk.GetAudioData(), pcm[offset:offset+tt.wantLength]) {
+				t.Errorf("audio of %d bytes doesn't match the file from %v", len(chunk.GetAudioData()), tt.start)
+			}
+		})
+	}
+
+	// Reading a range leaves GetChunk where it was
+	chunk, err := fs.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if chunk.GetTimestamp() != 10*time.Second {
+		t.Errorf("GetChunk() timestamp = %v, want 10s", chunk.GetTimestamp())
+	}
+
+	if _, err := fs.ReadRange(30*time.Second, time.Second); err != io.EOF {
+		t.Errorf("ReadRange() past the end error = %v, want io.EOF", err)
+	}
+	fs.Close()
+	if _, err := fs.ReadRange(0, time.Second); err != ErrStreamClosed {
+		t.Errorf("ReadRange() after Close error = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestFileStreamKeepSampleRate(t *testing.T) {
+	for _, rate := range []int{8000, 32000, 44100} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			path := writeTestWAV(t, rate, 1, 2500*time.Millisecond)
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read wav: %v", err)
+			}
+			pcm := raw[44:]
+
+			fs := &FileStream{}
+			fs.SetKeepSampleRate(true)
+			if err := fs.SetChunkDuration(time.Second); err != nil {
+				t.Fatalf("SetChunkDuration() error = %v", err)
+			}
+			if err := fs.InitStream(path); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer fs.Close()
+
+			var audio []byte
+			for i, want := range []time.Duration{time.Second, time.Second, 500 * time.Millisecond} {
+				chunk, err := fs.GetChunk()
+				if err != nil {
+					t.Fatalf("GetChunk() %d error = %v", i, err)
+				}
+				if got := ChunkSampleRate(chunk); got != rate {
+					t.Errorf("chunk %d sample rate = %d, want %d", i, got, rate)
+				}
+				if chunk.GetTimestamp() != time.Duration(i)*time.Second {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), time.Duration(i)*time.Second)
+				}
+				if chunk.GetDuration() != want {
+					t.Errorf("chunk %d duration = %v, want %v", i, chunk.GetDuration(), want)
+				}
+				audio = append(audio, chunk.GetAudioData()...)
+			}
+			if !bytes.Equal(audio, pcm) {
+				t.Errorf("audio at the file's own rate was altered")
+			}
+
+			// Ranges are measured at the file's rate too
+			chunk, err := fs.ReadRange(time.Second, time.Second)
+			if err != nil {
+				t.Fatalf("ReadRange() error = %v", err)
+			}
+			if !bytes.Equal(chunk.GetAudioData(), pcm[2*rate:4*rate]) || ChunkSampleRate(chunk) != rate {
+				t.Errorf("ReadRange() returned %d bytes at %dHz, want the file's second second", len(chunk.GetAudioData()), ChunkSampleRate(chunk))
+			}
+		})
+	}
+
+	// Rates signatures can't describe are refused rather than converted
+	fs := &FileStream{}
+	fs.SetKeepSampleRate(true)
+	if err := fs.InitStream(writeTestWAV(t, 22050, 1, time.Second)); err == nil {
+		t.Error("InitStream() of a 22050Hz file error = nil, want error")
+	}
+}
+
+// countingSeeker counts the bytes read through it
+type countingSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (cs *countingSeeker) Read(p []byte) (int, error) {
+	n, err := cs.ReadSeeker.Read(p)
+	cs.read += n
+	return n, err
+}
+
+func TestWAVPCMReaderSeekFrames(t *testing.T) {
+	raw, err := os.ReadFile(writeTestWAV(t, 16000, 2, 60*time.Second))
+	if err != nil {
+		t.Fatalf("failed to read wav: %v", err)
+	}
+	src := &countingSeeker{ReadSeeker: bytes.NewReader(raw)}
+	wr, err := newWAVPCMReader(src, false)
+	if err != nil {
+		t.Fatalf("newWAVPCMReader() error = %v", err)
+	}
+	if err := wr.seekFrames(src, 50*16000); err != nil {
+		t.Fatalf("seekFrames() error = %v", err)
+	}
+
+	got := make([]byte, 32000)
+	if _, err := io.ReadFull(wr, got); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	// The left channel of the stereo file at 50s, unchanged by the downmix
+	want := make([]byte, 0, len(got))
+	for i := 44 + 50*16000*4; len(want) < len(got); i += 4 {
+		want = append(want, raw[i], raw[i+1])
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("audio after seeking doesn't match the file at 50s")
+	}
+	// Only the header and the second read are decoded, not the 50s skipped
+	if src.read > 44+2*16000*4 {
+		t.Errorf("read %d bytes of a %d byte file, want the skipped audio left unread", src.read, len(raw))
+	}
+
+	// Seeking past the end leaves nothing to read
+	src = &countingSeeker{ReadSeeker: bytes.NewReader(raw)}
+	if wr, err = newWAVPCMReader(src, false); err != nil {
+		t.Fatalf("newWAVPCMReader() error = %v", err)
+	}
+	if err := wr.seekFrames(src, 90*16000); err != nil {
+		t.Fatalf("seekFrames() past the end error = %v", err)
+	}
+	if _, err := wr.Read(got); err != io.EOF {
+		t.Errorf("Read() past the end error = %v, want io.EOF", err)
+	}
+}
+
+func TestWriteWAV(t *testing.T) {
+	// The test WAV was written independently, so its header is the reference
+	path := writeTestWAV(t, 16000, 1, time.Second)
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read wav: %v", err)
+	}
+	pcm := want[44:]
+
+	got := new(bytes.Buffer)
+	if err := WriteWAV(got, pcm, 16000); err != nil {
+		t.Fatalf("WriteWAV() error = %v", err)
+	}
+	if got.Len() != 44+len(pcm) {
+		t.Errorf("wrote %d bytes, want %d", got.Len(), 44+len(pcm))
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("header = % x, want % x", got.Bytes()[:44], want[:44])
+	}
+
+	format, dataSize, err := readWAVHeader(bytes.NewReader(got.Bytes()))
+	if err != nil {
+		t.Fatalf("readWAVHeader() error = %v", err)
+	}
+	if format.SampleRate != 16000 || format.Channels != 1 || format.BitsPerSample != 16 || dataSize != int64(len(pcm)) {
+		t.Errorf("header describes %+v with %d data bytes", format, dataSize)
+	}
+}
+
+func TestWriteWAVInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		pcm        []byte
+		sampleRate int
+	}{
+		{name: "Odd length", pcm: make([]byte, 3), sampleRate: 16000},
+		{name: "No sample rate", pcm: make([]byte, 4), sampleRate: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			if err := WriteWAV(out, tt.pcm, tt.sampleRate); err == nil {
+				t.Error("WriteWAV() error = nil, want error")
+			}
+			if out.Len() != 0 {
+				t.Errorf("wrote %d bytes of an invalid wav", out.Len())
+			}
+		})
+	}
+}
+
+func TestFileStreamInvalid(t *testing.T) {
+	notWAV := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(notWAV, []byte("definitely not a riff file"), 0o644)
+
+	tests := []struct {
+		name string
+		path any
+	}{
+		{name: "Missing file", path: filepath.Join(t.TempDir(), "missing.wav")},
+		{name: "Not a wav", path: notWAV},
+		{name: "Not a string", path: 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &FileStream{}
+			if err := fs.InitStream(tt.path); err == nil {
+				t.Errorf("InitStream() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestFileStreamClose(t *testing.T) {
+	fs := &FileStream{}
+	if err := fs.InitStream(writeTestWAV(t, 16000, 1, 30*time.Second)); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	if _, err := fs.GetChunk(); err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := fs.GetChunk(); err != ErrStreamClosed {
+		t.Errorf("GetChunk() after Close error = %v, want %v", err, ErrStreamClosed)
+	}
+	if err := fs.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package audiostream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxReconnects  = 5
+	defaultReconnectDelay = time.Second
+)
+
+// HTTPStream serves chunks of audio from an HTTP audio stream, such as an
+// Icecast or Shoutcast internet radio station. Dropped connections are
+// reopened, so a live station plays until the stream is closed or stops
+// answering.
+type HTTPStream struct {
+	url string
+	chanStream
+
+	client         *http.Client  // Client for the stream request
+	decoder        Decoder       // Turns the received audio into PCM
+	maxReconnects  int           // Failed reconnects in a row before giving up
+	reconnectDelay time.Duration // Wait before each reconnect
+}
+
+// InitStream starts streaming from the given URL
+func (hs *HTTPStream) InitStream(link any) error {
+	urlStr, ok := link.(string)
+	if !ok {
+		return fmt.Errorf("expected string URL, got %T", link)
+	}
+	if _, err := url.ParseRequestURI(urlStr); err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+
+	hs.url = urlStr
+	if hs.client == nil {
+		hs.client = &http.Client{}
+	}
+	if hs.decoder == nil {
+		hs.decoder = &FFmpegDecoder{}
+	}
+	if hs.reconnectDelay == 0 {
+		hs.maxReconnects = defaultMaxReconnects
+		hs.reconnectDelay = defaultReconnectDelay
+	}
+
+	hs.start(hs.streamAudio)
+	return nil
+}
+
+// SetDecoder sets the Decoder that turns the received audio into PCM, ffmpeg
+// on PATH by default. It must be called before InitStream.
+func (hs *HTTPStream) SetDecoder(d Decoder) {
+	hs.decoder = d
+}
+
+// SetReconnect sets how many failed reconnects in a row are tolerated before
+// the stream gives up, and how long to wait before each one
+func (hs *HTTPStream) SetReconnect(maxReconnects int, delay time.Duration) error {
+	if maxReconnects < 0 || delay <= 0 {
+		return fmt.Errorf("invalid reconnect settings: %d reconnects every %v", maxReconnects, delay)
+	}
+	hs.maxReconnects = maxReconnects
+	hs.reconnectDelay = delay
+	return nil
+}
+
+// GetChunk blocks until the next chunk of audio has been received. It
+// returns an error once reconnecting has failed and all received audio is
+// consumed, and ErrStreamClosed after Close.
+func (hs *HTTPStream) GetChunk() (Chunk, error) {
+	timestamp, audio, err := hs.nextAudio()
+	if err != nil {
+		return nil, err
+	}
+	return &PCMChunk{
+		timestamp:     timestamp,
+		audioData:     audio,
+		chunkDuration: hs.getChunkDuration(),
+	}, nil
+}
+
+// streamAudio plays the stream, reconnecting whenever the connection drops,
+// until the stream is closed or too many reconnects fail in a row
+func (hs *HTTPStream) streamAudio(ctx context.Context) error {
+	failures := 0
+	for {
+		played, err := hs.playOnce(ctx)
+		if err == ErrStreamClosed || ctx.Err() != nil {
+			return nil
+		}
+
+		if played {
+			failures = 0
+		} else {
+			failures++
+		}
+		if failures > hs.maxReconnects {
+			return fmt.Errorf("gave up after %d failed reconnects: %v", hs.maxReconnects, err)
+		}
+
+		select {
+		case <-time.After(hs.reconnectDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// playOnce connects to the stream and feeds its audio until the connection
+// ends, reporting whether any audio was received
+func (hs *HTTPStream) playOnce(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", hs.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	// Ask for ICY metadata so it can be told apart from the audio
+	req.Header.Set("Icy-MetaData", "1")
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var audio io.Reader = resp.Body
+	if header := resp.Header.Get("Icy-Metaint"); header != "" {
+		metaInt, err := strconv.Atoi(header)
+		if err != nil || metaInt <= 0 {
+			return false, fmt.Errorf("invalid icy-metaint: %q", header)
+		}
+		audio = &icyReader{r: resp.Body, metaInt: metaInt, remaining: metaInt}
+	}
+
+	pcm, err := hs.decoder.Decode(audio)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode audio: %w", err)
+	}
+	defer pcm.Close()
+
+	counter := &countingReader{r: pcm}
+	err = hs.pump(counter)
+	return counter.n > 0, err
+}
+
+// icyReader strips the metadata blocks that Shoutcast and Icecast servers
+// interleave with the audio every metaInt bytes when asked for them
+type icyReader struct {
+	r         io.Reader
+	metaInt   int
+	remaining int // Audio bytes before the next metadata block
+}
+
+func (ir *icyReader) Read(p []byte) (int, error) {
+	if ir.remaining == 0 {
+		// Each block is preceded by its length in units of 16 bytes
+		var length [1]byte
+		if _, err := io.ReadFull(ir.r, length[:]); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, ir.r, int64(length[0])*16); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		ir.remaining = ir.metaInt
+	}
+
+	n, err := ir.r.Read(p[:min(len(p), ir.remaining)])
+	ir.remaining -= n
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,114 @@
+package audiostream
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// icyEncode interleaves audio with ICY metadata blocks every metaInt bytes,
+// alternating between a title and an empty block
+func icyEncode(audio []byte, metaInt int, title string) []byte {
+	meta := []byte("StreamTitle='" + title + "';")
+	meta = append(meta, make([]byte, (16-len(meta)%16)%16)...)
+
+	out := new(bytes.Buffer)
+	for i := 0; i < len(audio); i += metaInt {
+		out.Write(audio[i:min(i+metaInt, len(audio))])
+		if i+metaInt <= len(audio) {
+			if (i/metaInt)%2 == 0 {
+				out.WriteByte(byte(len(meta) / 16))
+				out.Write(meta)
+			} else {
+				out.WriteByte(0)
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+func TestHTTPStreamICY(t *testing.T) {
+	mp3, err := os.ReadFile(writeTestMP3(t, 20))
+	if err != nil {
+		t.Fatalf("failed to read mp3: %v", err)
+	}
+	// Make the body a whole number of metadata intervals long
+	const metaInt = 1000
+	mp3 = mp3[:len(mp3)/metaInt*metaInt]
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Icy-MetaData") != "1" {
+			w.Write(mp3)
+			return
+		}
+		w.Header().Set("icy-metaint", "1000")
+		w.Write(icyEncode(mp3, metaInt, "Aphex Twin - Windowlicker"))
+	}))
+	defer server.Close()
+
+	hs := &HTTPStream{client: server.Client(), decoder: passthroughDecoder{}}
+	if err := hs.SetChunkDuration(100 * time.Millisecond); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	if err := hs.SetReconnect(3, 10*time.Millisecond); err != nil {
+		t.Fatalf("SetReconnect() error = %v", err)
+	}
+	if err := hs.InitStream(server.URL + "/stream.mp3"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer hs.Close()
+
+	// Each time the body ends the stream reconnects and plays it again
+	want := bytes.Repeat(mp3, 3)
+	received := make([]byte, 0, len(want))
+	for len(received) < len(want) {
+		chunk, err := hs.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		received = append(received, chunk.GetAudioData()...)
+	}
+
+	if !bytes.Equal(received[:len(want)], want) {
+		t.Error("received audio differs from the body with metadata stripped")
+	}
+	if bytes.Contains(received, []byte("StreamTitle")) {
+		t.Error("received audio contains ICY metadata")
+	}
+	if got := requests.Load(); got < 3 {
+		t.Errorf("server saw %d requests, want at least 3 from reconnecting", got)
+	}
+}
+
+func TestHTTPStreamGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "station offline", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	hs := &HTTPStream{client: server.Client(), decoder: passthroughDecoder{}}
+	if err := hs.SetReconnect(2, 10*time.Millisecond); err != nil {
+		t.Fatalf("SetReconnect() error = %v", err)
+	}
+	if err := hs.InitStream(server.URL); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer hs.Close()
+
+	_, err := hs.GetChunk()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("GetChunk() error = %v, want the server's status", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("server saw %d requests, want 3", got)
+	}
+}
@@ -0,0 +1,188 @@
+package audiostream
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// CaptureSource opens a live audio input device
+type CaptureSource interface {
+	// Open starts capturing from the named device, or the system default when
+	// device is empty, and returns the audio as 16kHz 16-bit mono PCM.
+	// Closing the reader releases the device.
+	Open(device string) (io.ReadCloser, error)
+}
+
+// FFmpegCapture captures audio with ffmpeg using the platform's native input:
+// PulseAudio on Linux, AVFoundation on macOS and DirectShow on Windows. The
+// ffmpeg binary has to be installed at runtime; Open returns an error
+// wrapping ErrFFmpegNotFound when it isn't.
+type FFmpegCapture struct {
+	Path string // Path to the ffmpeg binary, defaults to "ffmpeg" on PATH
+}
+
+// Open starts an ffmpeg process capturing from the device
+func (fc *FFmpegCapture) Open(device string) (io.ReadCloser, error) {
+	var inputArgs []string
+	switch runtime.GOOS {
+	case "darwin":
+		// AVFoundation takes "video:audio" device indices
+		inputArgs = []string{"-f", "avfoundation", "-i", ":" + cmp.Or(device, "default")}
+	case "windows":
+		if device == "" {
+			// DirectShow has no default device, so take the first one listed
+			var err error
+			if device, err = defaultDShowDevice(fc.Path); err != nil {
+				return nil, err
+			}
+		}
+		inputArgs = []string{"-f", "dshow", "-i", "audio=" + device}
+	default:
+		inputArgs = []string{"-f", "pulse", "-i", cmp.Or(device, "default")}
+	}
+	return startFFmpeg(fc.Path, nil, inputArgs...)
+}
+
+// defaultDShowDevice returns the name of the first DirectShow audio device
+// ffmpeg lists
+func defaultDShowDevice(path string) (string, error) {
+	path = cmp.Or(path, "ffmpeg")
+	// Listing devices always ends in an error, as there is no input to open,
+	// so only a missing binary is an error here
+	listing, err := exec.Command(path, "-hide_banner", "-list_devices", "true", "-f", "dshow", "-i", "dummy").CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %q", ErrFFmpegNotFound, path)
+	}
+
+	devices := parseDShowAudioDevices(string(listing))
+	if len(devices) == 0 {
+		return "", fmt.Errorf("no directshow audio capture devices found")
+	}
+	return devices[0], nil
+}
+
+// parseDShowAudioDevices returns the audio device names in ffmpeg's
+// DirectShow device listing. Newer ffmpeg tags each device line "(audio)",
+// older releases list the audio devices under a heading of their own.
+func parseDShowAudioDevices(listing string) []string {
+	var devices []string
+	inAudioSection := false
+	scanner := bufio.NewScanner(strings.NewReader(listing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "DirectShow audio devices") {
+			inAudioSection = true
+			continue
+		}
+		if strings.Contains(line, "DirectShow video devices") {
+			inAudioSection = false
+			continue
+		}
+		if strings.Contains(line, "Alternative name") {
+			continue
+		}
+
+		start := strings.Index(line, `"`)
+		end := strings.LastIndex(line, `"`)
+		if start < 0 || end <= start {
+			continue
+		}
+		if inAudioSection || strings.HasSuffix(strings.TrimSpace(line[end+1:]), "(audio)") {
+			devices = append(devices, line[start+1:end])
+		}
+	}
+	return devices
+}
+
+// MicStream serves rolling chunks of live audio from a capture device. It
+// captures through an FFmpegCapture by default, so ffmpeg has to be installed
+// unless another CaptureSource is set.
+type MicStream struct {
+	device       string
+	source       CaptureSource
+	capture      io.ReadCloser
+	closeCapture func() error // Closes capture once, however often it's called
+	chanStream
+}
+
+// SetCaptureSource sets the CaptureSource used by InitStream, ffmpeg on PATH
+// by default
+func (ms *MicStream) SetCaptureSource(source CaptureSource) {
+	ms.source = source
+}
+
+// InitStream starts capturing from a device. The argument is the device name
+// as a string, or nil or "" for the system default.
+func (ms *MicStream) InitStream(device any) error {
+	var deviceName string
+	switch d := device.(type) {
+	case nil:
+	case string:
+		deviceName = d
+	default:
+		return fmt.Errorf("expected string device name, got %T", device)
+	}
+	if ms.source == nil {
+		ms.source = &FFmpegCapture{}
+	}
+	// Release the device of an earlier capture before opening another
+	if err := ms.Close(); err != nil {
+		return fmt.Errorf("failed to close previous capture: %w", err)
+	}
+
+	capture, err := ms.source.Open(deviceName)
+	if err != nil {
+		return fmt.Errorf("failed to open capture device: %w", err)
+	}
+
+	ms.device = deviceName
+	ms.capture = capture
+	ms.closeCapture = sync.OnceValue(capture.Close)
+	ms.start(ms.captureAudio)
+	return nil
+}
+
+// GetChunk blocks until the next chunk of audio has been captured. It
+// returns io.EOF once the device stops and all captured audio is consumed,
+// the read error if capturing failed, and ErrStreamClosed after Close.
+func (ms *MicStream) GetChunk() (Chunk, error) {
+	timestamp, audio, err := ms.nextAudio()
+	if err != nil {
+		return nil, err
+	}
+	return &PCMChunk{
+		timestamp:     timestamp,
+		audioData:     audio,
+		chunkDuration: ms.getChunkDuration(),
+	}, nil
+}
+
+// Close stops capturing, releases the device and closes the audio channel
+func (ms *MicStream) Close() error {
+	if ms.capture == nil {
+		return nil
+	}
+	ms.chanStream.Close()
+	return ms.closeCapture()
+}
+
+// captureAudio copies captured PCM into the channel until the device stops
+// or the stream is closed. Closing the stream closes the device, which is
+// what ends a read in progress.
+func (ms *MicStream) captureAudio(ctx context.Context) error {
+	// The AfterFunc can run after this returns, once InitStream has moved on
+	// to another device, so it closes the capture it was started for
+	capture, closeCapture := ms.capture, ms.closeCapture
+	stop := context.AfterFunc(ctx, func() { closeCapture() })
+	defer stop()
+	return ms.pump(capture)
+}
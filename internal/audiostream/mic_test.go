@@ -0,0 +1,264 @@
+package audiostream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCapture is a CaptureSource whose device audio is written by the test
+type fakeCapture struct {
+	device string
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+func newFakeCapture() *fakeCapture {
+	reader, writer := io.Pipe()
+	return &fakeCapture{reader: reader, writer: writer}
+}
+
+func (fc *fakeCapture) Open(device string) (io.ReadCloser, error) {
+	fc.device = device
+	return fc.reader, nil
+}
+
+func TestMicStream(t *testing.T) {
+	capture := newFakeCapture()
+	ms := &MicStream{source: capture}
+	if err := ms.InitStream("hw:1"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	if capture.device != "hw:1" {
+		t.Errorf("opened device %q, want %q", capture.device, "hw:1")
+	}
+
+	audio := make([]byte, 25*pcmBytesPerSecond)
+	for i := range audio {
+		audio[i] = byte(i % 253)
+	}
+	go func() {
+		capture.writer.Write(audio)
+		capture.writer.Close()
+	}()
+
+	var received []byte
+	wantTimestamps := []time.Duration{0, 10 * time.Second, 20 * time.Second}
+	for i, want := range wantTimestamps {
+		chunk, err := ms.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		if chunk.GetTimestamp() != want {
+			t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), want)
+		}
+		received = append(received, chunk.GetAudioData()...)
+	}
+	if !bytes.Equal(received, audio) {
+		t.Errorf("received %d bytes, want the %d captured", len(received), len(audio))
+	}
+
+	if _, err := ms.GetChunk(); err != io.EOF {
+		t.Errorf("GetChunk() error = %v, want io.EOF", err)
+	}
+	if err := ms.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestMicStreamCaptureError(t *testing.T) {
+	capture := newFakeCapture()
+	ms := &MicStream{source: capture}
+	if err := ms.InitStream(nil); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer ms.Close()
+
+	audio := make([]byte, 3*pcmBytesPerSecond)
+	go func() {
+		capture.writer.Write(audio)
+		capture.writer.CloseWithError(errors.New("device unplugged"))
+	}()
+
+	// The audio captured before the failure is handed out first
+	chunk, err := ms.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if got := len(chunk.GetAudioData()); got != len(audio) {
+		t.Errorf("chunk holds %d bytes, want the %d captured", got, len(audio))
+	}
+	if _, err := ms.GetChunk(); err == nil || err == io.EOF || !strings.Contains(err.Error(), "device unplugged") {
+		t.Errorf("GetChunk() error = %v, want the capture error", err)
+	}
+}
+
+func TestMicStreamClose(t *testing.T) {
+	capture := newFakeCapture()
+	ms := &MicStream{source: capture}
+	if err := ms.InitStream(nil); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+
+	// Keep the device busy so capture never finishes on its own
+	go io.Copy(capture.writer, zeroReader{})
+
+	closed := make(chan struct{})
+	go func() {
+		ms.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close() did not stop capture")
+	}
+
+	// The audio channel is closed, so draining it terminates
+	for range ms.audioChan {
+	}
+	if err := ms.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+// pipeCapture is a CaptureSource opening a new pipe on each Open
+type pipeCapture struct {
+	readers []*io.PipeReader
+}
+
+func (pc *pipeCapture) Open(device string) (io.ReadCloser, error) {
+	reader, writer := io.Pipe()
+	pc.readers = append(pc.readers, reader)
+	// Keep the device busy so capture never finishes on its own
+	go io.Copy(writer, zeroReader{})
+	return reader, nil
+}
+
+func TestMicStreamInitStreamAgain(t *testing.T) {
+	capture := &pipeCapture{}
+	ms := &MicStream{source: capture}
+	if err := ms.InitStream(nil); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	first := ms.audioChan
+
+	if err := ms.InitStream(nil); err != nil {
+		t.Fatalf("second InitStream() error = %v", err)
+	}
+	defer ms.Close()
+
+	// The first capture is released and its feed has exited, closing its
+	// audio channel
+	if _, err := capture.readers[0].Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("reading the first capture error = %v, want io.ErrClosedPipe", err)
+	}
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-first:
+		case <-timeout:
+			t.Fatal("the first capture's feed is still running")
+		}
+	}
+
+	if _, err := ms.GetChunk(); err != nil {
+		t.Errorf("GetChunk() error = %v", err)
+	}
+}
+
+// TestMicStreamFFmpegClose closes a stream while its capture goroutine is
+// reading from ffmpeg, which reaps the process from both sides. Run it with
+// -race.
+func TestMicStreamFFmpegClose(t *testing.T) {
+	ffmpeg := writeFakeFFmpeg(t)
+	for range 20 {
+		ms := &MicStream{}
+		ms.SetCaptureSource(&FFmpegCapture{Path: ffmpeg})
+		if err := ms.SetChunkDuration(100 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := ms.InitStream("default"); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		if _, err := ms.GetChunk(); err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			ms.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Close() did not stop ffmpeg")
+		}
+		if _, err := ms.GetChunk(); err != ErrStreamClosed {
+			t.Errorf("GetChunk() after Close error = %v, want ErrStreamClosed", err)
+		}
+	}
+}
+
+func TestMicStreamInvalidDevice(t *testing.T) {
+	ms := &MicStream{source: newFakeCapture()}
+	if err := ms.InitStream(3); err == nil {
+		t.Errorf("InitStream() error = nil, want error for non-string device")
+	}
+}
+
+// zeroReader is an endless source of silence
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestParseDShowAudioDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    []string
+	}{
+		{
+			name: "Tagged devices",
+			listing: `[dshow @ 0000021b] "Integrated Webcam" (video)
+[dshow @ 0000021b]   Alternative name "@device_pnp_\\?\usb#vid_0c45"
+[dshow @ 0000021b] "Microphone Array (Realtek(R) Audio)" (audio)
+[dshow @ 0000021b]   Alternative name "@device_cm_{33D9A762}\wave_{D2A3E1C4}"
+[dshow @ 0000021b] "Stereo Mix (Realtek(R) Audio)" (audio)
+dummy: Immediate exit requested`,
+			want: []string{"Microphone Array (Realtek(R) Audio)", "Stereo Mix (Realtek(R) Audio)"},
+		},
+		{
+			name: "Device sections",
+			listing: `[dshow @ 0000021b] DirectShow video devices (some may be both video and audio devices)
+[dshow @ 0000021b]  "Integrated Webcam"
+[dshow @ 0000021b]     Alternative name "@device_pnp_\\?\usb#vid_0c45"
+[dshow @ 0000021b] DirectShow audio devices
+[dshow @ 0000021b]  "Microphone (USB Audio)"
+[dshow @ 0000021b]     Alternative name "@device_cm_{33D9A762}\wave_{D2A3E1C4}"
+dummy: Immediate exit requested`,
+			want: []string{"Microphone (USB Audio)"},
+		},
+		{
+			name:    "No devices",
+			listing: "[dshow @ 0000021b] Could not enumerate audio only devices (or none found).\ndummy: Immediate exit requested",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDShowAudioDevices(tt.listing)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseDShowAudioDevices() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
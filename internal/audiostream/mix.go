@@ -0,0 +1,26 @@
+package audiostream
+
+import "math"
+
+// downmixToMono averages interleaved multi-channel samples into one channel.
+// A trailing partial frame is dropped, and mono input is returned as is.
+func downmixToMono(samples []int16, channels int) []int16 {
+	if channels <= 1 {
+		return samples
+	}
+
+	mono := make([]int16, len(samples)/channels)
+	for i := range mono {
+		sum := 0
+		for _, sample := range samples[i*channels : (i+1)*channels] {
+			sum += int(sample)
+		}
+		mono[i] = clipPCM16(math.Round(float64(sum) / float64(channels)))
+	}
+	return mono
+}
+
+// clipPCM16 converts a sample value to 16-bit PCM, clipping overs
+func clipPCM16(sample float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, sample)))
+}
@@ -0,0 +1,55 @@
+package audiostream
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestDownmixToMono(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []int16
+		channels int
+		want     []int16
+	}{
+		{
+			name:     "stereo",
+			samples:  []int16{100, 300, -200, 200, 1000, -1000, 7, 8},
+			channels: 2,
+			want:     []int16{200, 0, 0, 8},
+		},
+		{
+			name:     "full scale stays in range",
+			samples:  []int16{math.MaxInt16, math.MaxInt16, math.MinInt16, math.MinInt16, math.MaxInt16, -math.MaxInt16},
+			channels: 2,
+			want:     []int16{math.MaxInt16, math.MinInt16, 0},
+		},
+		{
+			name:     "partial trailing frame is dropped",
+			samples:  []int16{10, 20, 30},
+			channels: 2,
+			want:     []int16{15},
+		},
+		{
+			name:     "three channels",
+			samples:  []int16{3, 6, 9, -3, -6, -9},
+			channels: 3,
+			want:     []int16{6, -6},
+		},
+		{
+			name:     "mono is unchanged",
+			samples:  []int16{1, 2, 3},
+			channels: 1,
+			want:     []int16{1, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := downmixToMono(tt.samples, tt.channels); !slices.Equal(got, tt.want) {
+				t.Errorf("downmixToMono() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package audiostream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// MP3Decoder decodes MPEG-1 and MPEG-2 Layer III audio in process, so no
+// ffmpeg is needed. ID3 tags are skipped, VBR files decode frame by frame and
+// a truncated final frame ends the audio.
+type MP3Decoder struct{}
+
+// Decode reads the first frame of r and returns the audio downmixed and
+// resampled to 16kHz mono PCM
+func (d *MP3Decoder) Decode(r io.Reader) (io.ReadCloser, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mp3 frames: %v", err)
+	}
+
+	mr := &mp3PCMReader{src: bufio.NewReader(dec)}
+	mr.resampleReader = newResampleReader(dec.SampleRate(), int(SampleRate16000), mr.readSample)
+	return mr, nil
+}
+
+// mp3PCMReader converts the 16-bit stereo PCM go-mp3 produces into 16kHz mono
+type mp3PCMReader struct {
+	src *bufio.Reader
+	resampleReader
+}
+
+// readSample returns the next frame averaged to mono. go-mp3 duplicates mono
+// audio into both channels, so averaging leaves it unchanged.
+func (mr *mp3PCMReader) readSample() (float64, error) {
+	var frame [4]byte
+	if _, err := io.ReadFull(mr.src, frame[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	left := int16(binary.LittleEndian.Uint16(frame[0:]))
+	right := int16(binary.LittleEndian.Uint16(frame[2:]))
+	return (float64(left) + float64(right)) / 65536, nil
+}
+
+// Close is a no-op, the caller owns the MP3 source
+func (mr *mp3PCMReader) Close() error {
+	return nil
+}
+
+// MP3Stream serves chunks of audio from a local MP3 file. Decoding is done
+// in process by an MP3Decoder by default; SetDecoder(&FFmpegDecoder{}) falls
+// back to ffmpeg for files it can't read, such as MPEG-2.5 or Layer II audio.
+type MP3Stream struct {
+	path    string
+	decoder Decoder
+	pcmChunker
+	chunkSizer
+}
+
+// InitStream opens the MP3 file at the given path and starts decoding it
+func (ms *MP3Stream) InitStream(path any) error {
+	pathStr, ok := path.(string)
+	if !ok {
+		return fmt.Errorf("expected string path, got %T", path)
+	}
+	if ms.decoder == nil {
+		ms.decoder = &MP3Decoder{}
+	}
+
+	file, err := os.Open(pathStr)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+
+	pcm, err := ms.decoder.Decode(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to decode mp3: %w", err)
+	}
+
+	ms.path = pathStr
+	ms.pcmChunker = pcmChunker{pcm: pcm, closer: multiCloser{pcm, file}}
+	return nil
+}
+
+// SetDecoder sets the Decoder used by InitStream, an MP3Decoder by default
+func (ms *MP3Stream) SetDecoder(d Decoder) {
+	ms.decoder = d
+}
+
+// GetChunk returns the next chunk of audio, or io.EOF once the file is
+// exhausted. The final chunk may be shorter.
+func (ms *MP3Stream) GetChunk() (Chunk, error) {
+	return ms.nextChunk(&ms.chunkSizer)
+}
+
+// multiCloser closes each of its closers in order
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var firstErr error
+	for _, c := range mc {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
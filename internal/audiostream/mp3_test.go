@@ -0,0 +1,208 @@
+package audiostream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// silentFrameSamples is the number of samples in one MPEG-1 Layer III frame
+	silentFrameSamples = 1152
+	// silentFrameRate is the sample rate of the generated frames
+	silentFrameRate = 44100
+)
+
+// writeTestMP3 writes an MP3 file of silent 128kbps 44.1kHz mono frames,
+// preceded by an empty ID3v2 tag, and returns its path
+func writeTestMP3(t *testing.T, frames int) string {
+	t.Helper()
+
+	mp3 := new(bytes.Buffer)
+	// ID3v2.4 header with 16 bytes of padding, size stored syncsafe
+	mp3.Write([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 16})
+	mp3.Write(make([]byte, 16))
+
+	// Zeroed side info and main data decode to silence
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0xC4})
+	for i := 0; i < frames; i++ {
+		mp3.Write(frame)
+	}
+	// Truncated final frame
+	mp3.Write(frame[:100])
+
+	path := filepath.Join(t.TempDir(), "test.mp3")
+	if err := os.WriteFile(path, mp3.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write mp3: %v", err)
+	}
+	return path
+}
+
+func TestMP3StreamDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoder Decoder
+	}{
+		{name: "In process"},
+		{name: "FFmpeg", decoder: &FFmpegDecoder{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.decoder != nil {
+				if _, err := exec.LookPath("ffmpeg"); err != nil {
+					t.Skip("ffmpeg not installed")
+				}
+			}
+
+			const frames = 100
+			ms := &MP3Stream{}
+			if tt.decoder != nil {
+				ms.SetDecoder(tt.decoder)
+			}
+			if err := ms.InitStream(writeTestMP3(t, frames)); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+
+			total := 0
+			for {
+				chunk, err := ms.GetChunk()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("GetChunk() error = %v", err)
+				}
+				total += len(chunk.GetAudioData())
+			}
+
+			// Allow a frame either way for decoder delay and the truncated frame
+			want := float64(frames*silentFrameSamples) / silentFrameRate * pcmBytesPerSecond
+			tolerance := float64(silentFrameSamples) / silentFrameRate * pcmBytesPerSecond
+			if math.Abs(float64(total)-want) > tolerance {
+				t.Errorf("decoded %d bytes, want %.0f ± %.0f", total, want, tolerance)
+			}
+		})
+	}
+}
+
+// zeroCrossingRate estimates the frequency of a tone in 16kHz PCM from how
+// often it changes sign
+func zeroCrossingRate(pcm []byte) float64 {
+	crossings := 0
+	prev := int16(binary.LittleEndian.Uint16(pcm))
+	for i := 2; i+1 < len(pcm); i += 2 {
+		sample := int16(binary.LittleEndian.Uint16(pcm[i:]))
+		if (prev < 0) != (sample < 0) {
+			crossings++
+		}
+		prev = sample
+	}
+	return float64(crossings) / 2 / pcmDuration(len(pcm)).Seconds()
+}
+
+func TestMP3DecoderTone(t *testing.T) {
+	// testdata/tone.mp3 is 44.1kHz mono behind an ID3v2 tag: 39 frames of a
+	// 440Hz tone at 128kbps then 39 of 880Hz at 64kbps, the last truncated
+	ms := &MP3Stream{}
+	if err := ms.InitStream(filepath.Join("testdata", "tone.mp3")); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	ms.SetChunkDuration(time.Second)
+
+	var pcm []byte
+	for {
+		chunk, err := ms.GetChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		pcm = append(pcm, chunk.GetAudioData()...)
+	}
+
+	// 77 whole frames, give or take one for the decoder delay
+	want := 77 * silentFrameSamples * time.Second / silentFrameRate
+	frame := silentFrameSamples * time.Second / silentFrameRate
+	if got := pcmDuration(len(pcm)); got < want-frame || got > want+frame {
+		t.Errorf("decoded %v of audio, want %v ± %v", got, want, frame)
+	}
+
+	// Skip a frame either side of the bitrate change
+	split := pcmBytesPerSecond * 39 * silentFrameSamples / silentFrameRate &^ 1
+	margin := pcmBytesPerSecond * silentFrameSamples / silentFrameRate &^ 1
+	for _, half := range []struct {
+		pcm []byte
+		hz  float64
+	}{
+		{pcm: pcm[margin : split-margin], hz: 440},
+		{pcm: pcm[split+margin : len(pcm)-margin], hz: 880},
+	} {
+		if got := zeroCrossingRate(half.pcm); math.Abs(got-half.hz) > half.hz/20 {
+			t.Errorf("tone at %.0fHz, want %.0fHz", got, half.hz)
+		}
+	}
+}
+
+func TestMP3StreamChunks(t *testing.T) {
+	pcm := make([]byte, 25*pcmBytesPerSecond)
+	path := filepath.Join(t.TempDir(), "decoded.mp3")
+	if err := os.WriteFile(path, pcm, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	ms := &MP3Stream{decoder: passthroughDecoder{}}
+	if err := ms.InitStream(path); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+
+	wantLengths := []int{320000, 320000, 160000}
+	for i, want := range wantLengths {
+		chunk, err := ms.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		if got := len(chunk.GetAudioData()); got != want {
+			t.Errorf("chunk %d length = %d, want %d", i, got, want)
+		}
+	}
+	if _, err := ms.GetChunk(); err != io.EOF {
+		t.Errorf("GetChunk() error = %v, want io.EOF", err)
+	}
+}
+
+func TestMP3StreamDecoderFailure(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "no-ffmpeg")
+	ms := &MP3Stream{}
+	ms.SetDecoder(&FFmpegDecoder{Path: missing})
+	err := ms.InitStream(writeTestMP3(t, 1))
+	if !errors.Is(err, ErrFFmpegNotFound) {
+		t.Fatalf("InitStream() error = %v, want ErrFFmpegNotFound", err)
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("InitStream() error = %q, want it to name %q", err, missing)
+	}
+}
+
+func TestFFmpegNotOnPath(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	ms := &MP3Stream{}
+	ms.SetDecoder(&FFmpegDecoder{})
+	err := ms.InitStream(writeTestMP3(t, 1))
+	if !errors.Is(err, ErrFFmpegNotFound) {
+		t.Fatalf("InitStream() error = %v, want ErrFFmpegNotFound", err)
+	}
+	if !strings.Contains(err.Error(), `"ffmpeg"`) {
+		t.Errorf("InitStream() error = %q, want it to name the ffmpeg binary", err)
+	}
+}
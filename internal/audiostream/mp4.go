@@ -0,0 +1,400 @@
+package audiostream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// mp4BoxSpan is where a box of an MP4 file lies
+type mp4BoxSpan struct {
+	boxType string
+	body    int64 // Offset of the box contents, after its header
+	end     int64 // Offset just past the box
+}
+
+// readMP4Box reads the header of the box at offset, which has to end by end
+func readMP4Box(r io.ReaderAt, offset, end int64) (mp4BoxSpan, error) {
+	var header [16]byte
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return mp4BoxSpan{}, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	boxType := string(header[4:8])
+
+	headerSize := int64(8)
+	switch size {
+	case 0:
+		// The box runs to the end of the file
+		size = end - offset
+	case 1:
+		// A 64 bit size follows the type
+		if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+			return mp4BoxSpan{}, fmt.Errorf("truncated %q box header: %v", boxType, err)
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:16]))
+		headerSize = 16
+	}
+	if size < headerSize || size > end-offset {
+		return mp4BoxSpan{}, fmt.Errorf("invalid %q box size: %d", boxType, size)
+	}
+	return mp4BoxSpan{boxType: boxType, body: offset + headerSize, end: offset + size}, nil
+}
+
+// mp4MoovBeforeMdat walks the top level boxes of an MP4 file, reporting
+// whether the moov box holding the index comes before the mdat box holding
+// the audio, so the file can be decoded front to back
+func mp4MoovBeforeMdat(r io.ReaderAt) (bool, error) {
+	for offset := int64(0); ; {
+		box, err := readMP4Box(r, offset, math.MaxInt64)
+		if errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("no moov atom")
+		}
+		if err != nil {
+			return false, err
+		}
+
+		switch box.boxType {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+		offset = box.end
+	}
+}
+
+// mp4Children returns the boxes directly inside parent of the given type
+func mp4Children(r io.ReaderAt, parent mp4BoxSpan, boxType string) ([]mp4BoxSpan, error) {
+	var boxes []mp4BoxSpan
+	for offset := parent.body; offset+8 <= parent.end; {
+		box, err := readMP4Box(r, offset, parent.end)
+		if err != nil {
+			return nil, err
+		}
+		if box.boxType == boxType {
+			boxes = append(boxes, box)
+		}
+		offset = box.end
+	}
+	return boxes, nil
+}
+
+// mp4Descend follows a path of box types down from parent, taking the first
+// box of each type
+func mp4Descend(r io.ReaderAt, parent mp4BoxSpan, path ...string) (mp4BoxSpan, error) {
+	for _, boxType := range path {
+		boxes, err := mp4Children(r, parent, boxType)
+		if err != nil {
+			return mp4BoxSpan{}, err
+		}
+		if len(boxes) == 0 {
+			return mp4BoxSpan{}, fmt.Errorf("no %s atom in %s", boxType, parent.boxType)
+		}
+		parent = boxes[0]
+	}
+	return parent, nil
+}
+
+// readMP4Body reads the contents of a box
+func readMP4Body(r io.ReaderAt, box mp4BoxSpan) ([]byte, error) {
+	body := make([]byte, box.end-box.body)
+	if _, err := r.ReadAt(body, box.body); err != nil {
+		return nil, fmt.Errorf("truncated %s atom: %v", box.boxType, err)
+	}
+	return body, nil
+}
+
+// mp4AudioTrack is what decoding the first audio track of an MP4 file needs:
+// the decoder configuration and where each sample (one AAC frame) lies
+type mp4AudioTrack struct {
+	config  []byte // MPEG-4 AudioSpecificConfig
+	offsets []int64
+	sizes   []int64
+}
+
+// readMP4AudioTrack finds the first sound track in the moov box of an MP4 file
+// size bytes long and reads its sample table
+func readMP4AudioTrack(r io.ReaderAt, size int64) (*mp4AudioTrack, error) {
+	moov, err := mp4Descend(r, mp4BoxSpan{boxType: "file", end: size}, "moov")
+	if err != nil {
+		return nil, err
+	}
+	traks, err := mp4Children(r, moov, "trak")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, trak := range traks {
+		hdlr, err := mp4Descend(r, trak, "mdia", "hdlr")
+		if err != nil {
+			return nil, err
+		}
+		// Version and flags, then a predefined field, come before the handler
+		var handler [4]byte
+		if _, err := r.ReadAt(handler[:], hdlr.body+8); err != nil || string(handler[:]) != "soun" {
+			continue
+		}
+
+		stbl, err := mp4Descend(r, trak, "mdia", "minf", "stbl")
+		if err != nil {
+			return nil, err
+		}
+		return readMP4SampleTable(r, stbl, size)
+	}
+	return nil, fmt.Errorf("no audio track")
+}
+
+// readMP4SampleTable reads the decoder configuration, sizes and offsets of
+// the samples in a stbl box of a file size bytes long
+func readMP4SampleTable(r io.ReaderAt, stbl mp4BoxSpan, size int64) (*mp4AudioTrack, error) {
+	bodies := make(map[string][]byte)
+	for _, boxType := range []string{"stsd", "stsz", "stsc", "stco", "co64"} {
+		boxes, err := mp4Children(r, stbl, boxType)
+		if err != nil {
+			return nil, err
+		}
+		if len(boxes) == 0 {
+			continue
+		}
+		if bodies[boxType], err = readMP4Body(r, boxes[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := parseMP4AudioConfig(bodies["stsd"])
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := parseMP4SampleSizes(bodies["stsz"], size)
+	if err != nil {
+		return nil, err
+	}
+	chunkOffsets, err := parseMP4ChunkOffsets(bodies["stco"], bodies["co64"])
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := mp4SampleOffsets(bodies["stsc"], chunkOffsets, sizes)
+	if err != nil {
+		return nil, err
+	}
+	return &mp4AudioTrack{config: config, offsets: offsets, sizes: sizes}, nil
+}
+
+// parseMP4AudioConfig returns the AudioSpecificConfig held in the esds box of
+// the first mp4a sample entry of an stsd box
+func parseMP4AudioConfig(stsd []byte) ([]byte, error) {
+	// Version, flags and an entry count come before the first entry
+	if len(stsd) < 8+8 {
+		return nil, fmt.Errorf("no sample description")
+	}
+	entry := stsd[8:]
+	entrySize := int(binary.BigEndian.Uint32(entry[:4]))
+	if codec := string(entry[4:8]); codec != "mp4a" {
+		return nil, fmt.Errorf("unsupported audio codec %q", codec)
+	}
+	if entrySize < 8 || entrySize > len(entry) {
+		return nil, fmt.Errorf("invalid mp4a entry size: %d", entrySize)
+	}
+	entry = entry[8:entrySize]
+
+	// The fields of an audio sample entry take 28 bytes, and QuickTime's later
+	// versions add more
+	fieldsSize := 28
+	if len(entry) >= 10 {
+		switch binary.BigEndian.Uint16(entry[8:10]) {
+		case 1:
+			fieldsSize += 16
+		case 2:
+			fieldsSize += 36
+		}
+	}
+	if len(entry) < fieldsSize {
+		return nil, fmt.Errorf("truncated mp4a entry")
+	}
+
+	esds, err := mp4Descend(bytes.NewReader(entry), mp4BoxSpan{boxType: "mp4a", body: int64(fieldsSize), end: int64(len(entry))}, "esds")
+	if err != nil {
+		return nil, err
+	}
+	// Skip the version and flags
+	if esds.end-esds.body < 4 {
+		return nil, fmt.Errorf("truncated esds atom")
+	}
+	return parseESDescriptor(entry[esds.body+4 : esds.end])
+}
+
+// MPEG-4 descriptor tags leading to the AudioSpecificConfig
+const (
+	esDescriptorTag            = 0x03
+	decoderConfigDescriptorTag = 0x04
+	decoderSpecificInfoTag     = 0x05
+)
+
+// parseESDescriptor returns the decoder specific info, the
+// AudioSpecificConfig for AAC, nested in an ES descriptor
+func parseESDescriptor(data []byte) ([]byte, error) {
+	es, _, err := readDescriptor(data, esDescriptorTag)
+	if err != nil {
+		return nil, err
+	}
+	if len(es) < 3 {
+		return nil, fmt.Errorf("truncated es descriptor")
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 { // A stream dependence ID
+		es = es[min(2, len(es)):]
+	}
+	if flags&0x40 != 0 && len(es) > 0 { // A URL
+		es = es[min(1+int(es[0]), len(es)):]
+	}
+	if flags&0x20 != 0 { // An OCR stream ID
+		es = es[min(2, len(es)):]
+	}
+
+	decoderConfig, _, err := readDescriptor(es, decoderConfigDescriptorTag)
+	if err != nil {
+		return nil, err
+	}
+	// Object type, stream type, buffer size and bitrates precede the info
+	if len(decoderConfig) < 13 {
+		return nil, fmt.Errorf("truncated decoder config descriptor")
+	}
+	info, _, err := readDescriptor(decoderConfig[13:], decoderSpecificInfoTag)
+	if err != nil {
+		return nil, err
+	}
+	if len(info) < 2 {
+		return nil, fmt.Errorf("audio specific config is %d bytes, want at least 2", len(info))
+	}
+	return info, nil
+}
+
+// readDescriptor reads the MPEG-4 descriptor at the start of data, which must
+// have the given tag, returning its contents and what follows it
+func readDescriptor(data []byte, tag byte) ([]byte, []byte, error) {
+	if len(data) == 0 || data[0] != tag {
+		return nil, nil, fmt.Errorf("missing descriptor with tag %#x", tag)
+	}
+	// The size takes up to four bytes of seven bits, the top bit marking
+	// another byte follows
+	size, i := 0, 1
+	for {
+		if i >= len(data) || i > 4 {
+			return nil, nil, fmt.Errorf("truncated descriptor with tag %#x", tag)
+		}
+		b := data[i]
+		i++
+		size = size<<7 | int(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if size > len(data)-i {
+		return nil, nil, fmt.Errorf("truncated descriptor with tag %#x", tag)
+	}
+	return data[i : i+size], data[i+size:], nil
+}
+
+// parseMP4SampleSizes reads the size of each sample from an stsz box. Each
+// sample takes at least a byte of the file, which bounds how many there can
+// be to the file's size.
+func parseMP4SampleSizes(stsz []byte, fileSize int64) ([]int64, error) {
+	if len(stsz) < 12 {
+		return nil, fmt.Errorf("missing or truncated stsz atom")
+	}
+	sampleSize := int64(binary.BigEndian.Uint32(stsz[4:8]))
+	count := int64(binary.BigEndian.Uint32(stsz[8:12]))
+
+	if sampleSize != 0 {
+		if count > fileSize/sampleSize {
+			return nil, fmt.Errorf("%d samples of %d bytes exceed the file", count, sampleSize)
+		}
+		sizes := make([]int64, count)
+		for i := range sizes {
+			sizes[i] = sampleSize
+		}
+		return sizes, nil
+	}
+
+	entries := stsz[12:]
+	if int64(len(entries)/4) < count {
+		return nil, fmt.Errorf("stsz atom holds %d of %d sample sizes", len(entries)/4, count)
+	}
+	sizes := make([]int64, count)
+	for i := range sizes {
+		sizes[i] = int64(binary.BigEndian.Uint32(entries[4*i:]))
+	}
+	return sizes, nil
+}
+
+// parseMP4ChunkOffsets reads the file offset of each chunk from an stco box,
+// or a co64 box for files over 4GB
+func parseMP4ChunkOffsets(stco, co64 []byte) ([]int64, error) {
+	data, width := stco, 4
+	if data == nil {
+		data, width = co64, 8
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("missing or truncated stco atom")
+	}
+
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	entries := data[8:]
+	if len(entries)/width < count {
+		return nil, fmt.Errorf("chunk offset atom holds %d of %d offsets", len(entries)/width, count)
+	}
+	offsets := make([]int64, count)
+	for i := range offsets {
+		if width == 4 {
+			offsets[i] = int64(binary.BigEndian.Uint32(entries[4*i:]))
+		} else {
+			offsets[i] = int64(binary.BigEndian.Uint64(entries[8*i:]))
+		}
+	}
+	return offsets, nil
+}
+
+// mp4SampleOffsets works out the file offset of each sample from the
+// sample-to-chunk runs of an stsc box. Samples within a chunk are stored back
+// to back.
+func mp4SampleOffsets(stsc []byte, chunkOffsets, sizes []int64) ([]int64, error) {
+	if len(stsc) < 8 {
+		return nil, fmt.Errorf("missing or truncated stsc atom")
+	}
+	count := int(binary.BigEndian.Uint32(stsc[4:8]))
+	entries := stsc[8:]
+	if len(entries)/12 < count {
+		return nil, fmt.Errorf("stsc atom holds %d of %d entries", len(entries)/12, count)
+	}
+
+	offsets := make([]int64, 0, len(sizes))
+	for i := 0; i < count && len(offsets) < len(sizes); i++ {
+		// Each entry covers the chunks up to the next entry's first chunk
+		firstChunk := int(binary.BigEndian.Uint32(entries[12*i:]))
+		perChunk := int(binary.BigEndian.Uint32(entries[12*i+4:]))
+		lastChunk := len(chunkOffsets)
+		if i+1 < count {
+			lastChunk = min(lastChunk, int(binary.BigEndian.Uint32(entries[12*(i+1):]))-1)
+		}
+		if firstChunk < 1 {
+			return nil, fmt.Errorf("invalid first chunk: %d", firstChunk)
+		}
+
+		for chunk := firstChunk; chunk <= lastChunk && len(offsets) < len(sizes); chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for s := 0; s < perChunk && len(offsets) < len(sizes); s++ {
+				offsets = append(offsets, offset)
+				offset += sizes[len(offsets)-1]
+			}
+		}
+	}
+	if len(offsets) < len(sizes) {
+		return nil, fmt.Errorf("chunks hold %d of %d samples", len(offsets), len(sizes))
+	}
+	return offsets, nil
+}
@@ -0,0 +1,97 @@
+package audiostream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// testMP4Track returns an M4A file holding frames as the samples of a 44.1kHz
+// mono AAC-LC track, perChunk frames to a chunk with padding between the
+// chunks, and the moov box after the audio
+func testMP4Track(frames [][]byte, perChunk int) []byte {
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x02\x00isomM4A "))
+
+	var audio, chunkOffsets []byte
+	for i, frame := range frames {
+		if i%perChunk == 0 {
+			audio = append(audio, make([]byte, 16)...)
+			chunkOffsets = binary.BigEndian.AppendUint32(chunkOffsets, uint32(len(ftyp)+8+len(audio)))
+		}
+		audio = append(audio, frame...)
+	}
+	mdat := mp4Box("mdat", audio)
+
+	// AAC-LC at 44.1kHz mono
+	asc := []byte{0x12, 0x08}
+	decoderConfig := slices.Concat([]byte{0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0x05, byte(len(asc))}, asc)
+	es := slices.Concat([]byte{0, 1, 0}, []byte{0x04, byte(len(decoderConfig))}, decoderConfig)
+	esds := mp4Box("esds", slices.Concat(make([]byte, 4), []byte{0x03, byte(len(es))}, es))
+	mp4a := mp4Box("mp4a", slices.Concat(
+		[]byte{0, 0, 0, 0, 0, 0, 0, 1}, make([]byte, 8), // Data reference and reserved fields
+		[]byte{0, 1, 0, 16, 0, 0, 0, 0}, // Mono, 16 bits
+		binary.BigEndian.AppendUint32(nil, 44100<<16),
+		esds,
+	))
+	stsd := mp4Box("stsd", slices.Concat([]byte{0, 0, 0, 0, 0, 0, 0, 1}, mp4a))
+
+	stszBody := binary.BigEndian.AppendUint32(make([]byte, 8), uint32(len(frames)))
+	for _, frame := range frames {
+		stszBody = binary.BigEndian.AppendUint32(stszBody, uint32(len(frame)))
+	}
+	stsz := mp4Box("stsz", stszBody)
+	// Every chunk holds perChunk frames
+	stscBody := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, uint32(perChunk))
+	stsc := mp4Box("stsc", binary.BigEndian.AppendUint32(stscBody, 1))
+	stcoBody := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(chunkOffsets)/4))
+	stco := mp4Box("stco", append(stcoBody, chunkOffsets...))
+
+	hdlr := mp4Box("hdlr", slices.Concat(make([]byte, 8), []byte("soun"), make([]byte, 13)))
+	stbl := mp4Box("stbl", slices.Concat(stsd, stsz, stsc, stco))
+	mdia := mp4Box("mdia", slices.Concat(hdlr, mp4Box("minf", stbl)))
+	moov := mp4Box("moov", mp4Box("trak", mdia))
+	return slices.Concat(ftyp, mdat, moov)
+}
+
+func TestReadMP4AudioTrack(t *testing.T) {
+	frames := [][]byte{{1}, {2, 2}, {3, 3, 3}, {4, 4, 4, 4}, {5, 5, 5, 5, 5}, {6, 6, 6, 6, 6, 6}}
+	data := testMP4Track(frames, 4)
+
+	track, err := readMP4AudioTrack(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("readMP4AudioTrack() error = %v", err)
+	}
+	if want := []byte{0x12, 0x08}; !bytes.Equal(track.config, want) {
+		t.Errorf("config = %x, want %x", track.config, want)
+	}
+	if len(track.offsets) != len(frames) || len(track.sizes) != len(frames) {
+		t.Fatalf("read %d offsets and %d sizes, want %d of each", len(track.offsets), len(track.sizes), len(frames))
+	}
+	for i, frame := range frames {
+		got := data[track.offsets[i] : track.offsets[i]+track.sizes[i]]
+		if !bytes.Equal(got, frame) {
+			t.Errorf("frame %d = %v, want %v", i, got, frame)
+		}
+	}
+}
+
+func TestReadMP4AudioTrackErrors(t *testing.T) {
+	track := testMP4Track([][]byte{{1}, {2}}, 1)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "No moov", data: testMP4Track(nil, 1)[:28]},
+		{name: "No audio track", data: testMP4(false)},
+		{name: "Truncated", data: track[:len(track)-10]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readMP4AudioTrack(bytes.NewReader(tt.data), int64(len(tt.data))); err == nil {
+				t.Error("readMP4AudioTrack() error = nil, want an error")
+			}
+		})
+	}
+}
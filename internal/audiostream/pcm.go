@@ -0,0 +1,266 @@
+package audiostream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// pcmBytesPerSecond is the data rate of 16kHz 16-bit mono PCM
+	pcmBytesPerSecond = 32000
+	// DefaultChunkDuration is the length of audio in each chunk unless a
+	// stream is configured otherwise
+	DefaultChunkDuration = 10 * time.Second
+)
+
+// chunkSizer holds a stream's configurable chunk length and overlap
+type chunkSizer struct {
+	chunkDuration   time.Duration
+	overlapDuration time.Duration
+}
+
+// SetChunkDuration sets the length of audio in each chunk
+func (cs *chunkSizer) SetChunkDuration(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("chunk duration must be positive, got %v", d)
+	}
+	if cs.overlapDuration >= d {
+		return fmt.Errorf("chunk duration %v must be longer than overlap %v", d, cs.overlapDuration)
+	}
+	cs.chunkDuration = d
+	return nil
+}
+
+// SetOverlapDuration sets how much audio from the end of each chunk is
+// repeated at the start of the next, so a hook split across a chunk boundary
+// still lands whole in one chunk. Consecutive chunks start
+// ChunkDuration - OverlapDuration apart.
+func (cs *chunkSizer) SetOverlapDuration(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("overlap duration must not be negative, got %v", d)
+	}
+	if d >= cs.getChunkDuration() {
+		return fmt.Errorf("overlap %v must be shorter than chunk duration %v", d, cs.getChunkDuration())
+	}
+	cs.overlapDuration = d
+	return nil
+}
+
+// rateKeeper holds whether a stream keeps its source's sample rate
+type rateKeeper struct {
+	keepSampleRate bool
+}
+
+// SetKeepSampleRate chooses whether chunks keep the source audio's own sample
+// rate rather than being converted to 16kHz, sparing the signature the
+// resampling loss. The source must then be at a rate signatures support. It
+// takes effect from the next InitStream.
+func (rk *rateKeeper) SetKeepSampleRate(keep bool) {
+	rk.keepSampleRate = keep
+}
+
+// getChunkDuration returns the configured chunk length or the default
+func (cs *chunkSizer) getChunkDuration() time.Duration {
+	if cs.chunkDuration <= 0 {
+		return DefaultChunkDuration
+	}
+	return cs.chunkDuration
+}
+
+// overlapBytes returns the size of the audio carried between chunks of
+// 16kHz PCM
+func (cs *chunkSizer) overlapBytes() int {
+	return cs.overlapBytesAt(int(SampleRate16000))
+}
+
+// overlapBytesAt returns the size of the audio carried between chunks of PCM
+// at sampleRate Hz
+func (cs *chunkSizer) overlapBytesAt(sampleRate int) int {
+	if cs.overlapDuration <= 0 {
+		return 0
+	}
+	return chunkBytesAt(cs.overlapDuration, sampleRate)
+}
+
+// chunkBytes returns the size of a chunk of 16kHz PCM lasting d, rounded
+// down to a whole number of samples
+func chunkBytes(d time.Duration) int {
+	return chunkBytesAt(d, int(SampleRate16000))
+}
+
+// chunkBytesAt returns the size of a chunk of PCM at sampleRate Hz lasting d,
+// rounded down to a whole number of samples
+func chunkBytesAt(d time.Duration, sampleRate int) int {
+	n := int(d * time.Duration(2*sampleRate) / time.Second)
+	return max(n-n%2, 2)
+}
+
+// pcmDuration returns how long n bytes of 16kHz PCM last
+func pcmDuration(n int) time.Duration {
+	return time.Duration(n) * time.Second / pcmBytesPerSecond
+}
+
+// pcmDurationAt returns how long n bytes of PCM at sampleRate Hz last
+func pcmDurationAt(n, sampleRate int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(2*sampleRate)
+}
+
+// PCMChunk is a segment of 16-bit mono PCM audio, at 16kHz unless created
+// with another rate
+type PCMChunk struct {
+	timestamp     time.Duration // Start time of this chunk in the stream
+	audioData     []byte        // 16-bit mono PCM
+	chunkDuration time.Duration // Length of audio the next Record captures
+	sampleRate    int           // Sample rate of the audio in Hz, 0 for 16kHz
+}
+
+// NewPCMChunk returns a chunk of 16-bit mono PCM audio at the given sample
+// rate, starting at timestamp in its stream. Recording from it captures
+// DefaultChunkDuration of audio.
+func NewPCMChunk(data []byte, timestamp time.Duration, sampleRate int) *PCMChunk {
+	return &PCMChunk{
+		timestamp:     timestamp,
+		audioData:     data,
+		chunkDuration: DefaultChunkDuration,
+		sampleRate:    sampleRate,
+	}
+}
+
+// Record captures the next chunk of audio from the input channel, stopping
+// early if the channel is closed or ctx is cancelled
+func (pc *PCMChunk) Record(ctx context.Context, in chan byte) Chunk {
+	size := chunkBytesAt(pc.chunkDuration, pc.GetSampleRate())
+	data := make([]byte, 0, size)
+readLoop:
+	for len(data) < size {
+		select {
+		case b, ok := <-in:
+			if !ok {
+				break readLoop
+			}
+			data = append(data, b)
+		case <-ctx.Done():
+			break readLoop
+		}
+	}
+
+	return &PCMChunk{
+		timestamp:     pc.timestamp + pc.GetDuration(),
+		audioData:     data,
+		chunkDuration: pc.chunkDuration,
+		sampleRate:    pc.sampleRate,
+	}
+}
+
+// GetAudioData returns the raw audio data for this chunk
+func (pc *PCMChunk) GetAudioData() []byte {
+	return pc.audioData
+}
+
+// GetTimestamp returns the start time of this chunk in the stream
+func (pc *PCMChunk) GetTimestamp() time.Duration {
+	return pc.timestamp
+}
+
+// GetDuration returns the duration of the audio in this chunk
+func (pc *PCMChunk) GetDuration() time.Duration {
+	return pcmDurationAt(len(pc.audioData), pc.GetSampleRate())
+}
+
+// GetSampleRate returns the sample rate of the chunk's audio in Hz
+func (pc *PCMChunk) GetSampleRate() int {
+	return cmp.Or(pc.sampleRate, int(SampleRate16000))
+}
+
+// chunkAssembler joins newly read audio onto the tail carried over from the
+// previous chunk and tracks where each chunk starts in the stream
+type chunkAssembler struct {
+	tail       []byte // End of the previous chunk, repeated at the start of the next
+	bytesRead  int64  // New audio consumed so far
+	sampleRate int    // Sample rate of the audio in Hz, 0 for 16kHz
+}
+
+// newBytes returns how much new audio the next chunk of the given size needs
+func (ca *chunkAssembler) newBytes(size int) int {
+	// Always make progress, even if rounding leaves the tail as long as a chunk
+	return max(size-len(ca.tail), 2)
+}
+
+// nextStart returns the start time of the next chunk
+func (ca *chunkAssembler) nextStart() time.Duration {
+	return pcmDurationAt(int(ca.bytesRead)-len(ca.tail), cmp.Or(ca.sampleRate, int(SampleRate16000)))
+}
+
+// assemble prepends the carried tail to data and keeps the last overlap
+// bytes of the result for the next chunk
+func (ca *chunkAssembler) assemble(data []byte, overlap int) []byte {
+	audio := make([]byte, 0, len(ca.tail)+len(data))
+	audio = append(append(audio, ca.tail...), data...)
+	ca.bytesRead += int64(len(data))
+
+	keep := min(overlap, len(audio))
+	ca.tail = append(ca.tail[:0], audio[len(audio)-keep:]...)
+	return audio
+}
+
+// pcmChunker splits a reader of 16-bit mono PCM into PCMChunks, at 16kHz
+// unless its assembler is given another rate
+type pcmChunker struct {
+	pcm      io.Reader
+	closer   io.Closer // Released once the audio is exhausted
+	released bool      // Whether closer has been closed
+	closed   bool      // Whether Close has been called
+	chunkAssembler
+}
+
+// Close releases the source audio, after which GetChunk returns
+// ErrStreamClosed
+func (pc *pcmChunker) Close() error {
+	if pc.pcm == nil {
+		return nil
+	}
+	pc.closed = true
+	return pc.release()
+}
+
+// release closes the source once
+func (pc *pcmChunker) release() error {
+	if pc.released {
+		return nil
+	}
+	pc.released = true
+	return pc.closer.Close()
+}
+
+// nextChunk returns the next chunk of audio sized by cs, or io.EOF once the
+// reader is exhausted. The final chunk may be shorter.
+func (pc *pcmChunker) nextChunk(cs *chunkSizer) (Chunk, error) {
+	if pc.pcm == nil {
+		return nil, fmt.Errorf("stream not initialized")
+	}
+	if pc.closed {
+		return nil, ErrStreamClosed
+	}
+
+	sampleRate := cmp.Or(pc.sampleRate, int(SampleRate16000))
+	data := make([]byte, pc.newBytes(chunkBytesAt(cs.getChunkDuration(), sampleRate)))
+	n, err := io.ReadFull(pc.pcm, data)
+	if err == io.EOF {
+		pc.release()
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read audio: %v", err)
+	}
+
+	timestamp := pc.nextStart()
+	return &PCMChunk{
+		timestamp:     timestamp,
+		audioData:     pc.assemble(data[:n], cs.overlapBytesAt(sampleRate)),
+		chunkDuration: cs.getChunkDuration(),
+		sampleRate:    pc.sampleRate,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package audiostream
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PCMSource is the audio a PCMStream reads: raw 16-bit little endian mono
+// PCM at SampleRate Hz
+type PCMSource struct {
+	Reader     io.Reader
+	SampleRate int // Rate of the audio in Hz, 16kHz if zero
+}
+
+// PCMStream serves chunks of raw PCM read from any reader, such as the
+// output of ffmpeg, converted to 16kHz unless SetKeepSampleRate is used. A
+// reader that is also an io.Closer is closed once its audio runs out or the
+// stream is closed.
+type PCMStream struct {
+	pcmChunker
+	chunkSizer
+	rateKeeper
+}
+
+// InitStream starts reading from a PCMSource, or from an io.Reader of 16kHz
+// audio
+func (ps *PCMStream) InitStream(source any) error {
+	var src PCMSource
+	switch s := source.(type) {
+	case PCMSource:
+		src = s
+	case io.Reader:
+		src = PCMSource{Reader: s}
+	default:
+		return fmt.Errorf("expected PCMSource or io.Reader, got %T", source)
+	}
+	if src.Reader == nil {
+		return fmt.Errorf("no reader to stream from")
+	}
+	sampleRate := cmp.Or(src.SampleRate, int(SampleRate16000))
+	if sampleRate < 0 {
+		return fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+
+	closer, ok := src.Reader.(io.Closer)
+	if !ok {
+		closer = io.NopCloser(nil)
+	}
+	if ps.keepSampleRate {
+		if !IsSupportedSampleRate(sampleRate) {
+			return fmt.Errorf("can't keep sample rate %d Hz, signatures don't support it", sampleRate)
+		}
+		ps.pcmChunker = pcmChunker{pcm: src.Reader, closer: closer}
+		ps.sampleRate = sampleRate
+		return nil
+	}
+
+	pcm := src.Reader
+	if sampleRate != int(SampleRate16000) {
+		pcm = newPCMResampleReader(src.Reader, sampleRate)
+	}
+	ps.pcmChunker = pcmChunker{pcm: pcm, closer: closer}
+	return nil
+}
+
+// GetChunk returns the next chunk of audio, or io.EOF once the reader is
+// exhausted. The final chunk may be shorter.
+func (ps *PCMStream) GetChunk() (Chunk, error) {
+	return ps.nextChunk(&ps.chunkSizer)
+}
+
+// pcmResampleReader converts 16-bit mono PCM at one rate into 16kHz on the fly
+type pcmResampleReader struct {
+	src *bufio.Reader
+	resampleReader
+}
+
+func newPCMResampleReader(r io.Reader, sampleRate int) *pcmResampleReader {
+	pr := &pcmResampleReader{src: bufio.NewReader(r)}
+	pr.resampleReader = newResampleReader(sampleRate, int(SampleRate16000), pr.readSample)
+	return pr
+}
+
+// readSample returns the next source sample. A trailing odd byte is dropped.
+func (pr *pcmResampleReader) readSample() (float64, error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(pr.src, buf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	return float64(int16(binary.LittleEndian.Uint16(buf[:]))) / 32768, nil
+}
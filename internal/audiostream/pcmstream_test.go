@@ -0,0 +1,172 @@
+package audiostream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testPCM returns duration of a 440Hz tone as 16-bit mono PCM at sampleRate
+func testPCM(sampleRate int, duration time.Duration) []byte {
+	samples := int(duration.Seconds() * float64(sampleRate))
+	pcm := make([]byte, 0, 2*samples)
+	for i := 0; i < samples; i++ {
+		sample := int16(10000 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		pcm = append(pcm, byte(sample), byte(sample>>8))
+	}
+	return pcm
+}
+
+// closeTracker records whether it was closed
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (ct *closeTracker) Close() error {
+	ct.closed = true
+	return nil
+}
+
+func TestPCMStream(t *testing.T) {
+	pcm16k := testPCM(16000, 2500*time.Millisecond)
+	tests := []struct {
+		name        string
+		source      any
+		wantLengths []int
+		exact       []byte // Audio every chunk must match, when not resampled
+	}{
+		{name: "Reader", source: bytes.NewReader(pcm16k), wantLengths: []int{32000, 32000, 16000}, exact: pcm16k},
+		// Reads returning half of what was asked for, and an odd byte at the end
+		{name: "Short reads", source: iotest.HalfReader(bytes.NewReader(append(pcm16k, 0x7F))), wantLengths: []int{32000, 32000, 16001}, exact: append(pcm16k, 0x7F)},
+		{name: "16kHz source", source: PCMSource{Reader: bytes.NewReader(pcm16k), SampleRate: 16000}, wantLengths: []int{32000, 32000, 16000}, exact: pcm16k},
+		{name: "48kHz source", source: PCMSource{Reader: bytes.NewReader(testPCM(48000, 2500*time.Millisecond)), SampleRate: 48000}, wantLengths: []int{32000, 32000, 16000}},
+		{name: "Shorter than a chunk", source: bytes.NewReader(pcm16k[:1000]), wantLengths: []int{1000}, exact: pcm16k[:1000]},
+		{name: "Empty", source: bytes.NewReader(nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &PCMStream{}
+			if err := ps.SetChunkDuration(time.Second); err != nil {
+				t.Fatalf("SetChunkDuration() error = %v", err)
+			}
+			if err := ps.InitStream(tt.source); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer ps.Close()
+
+			var audio []byte
+			for i, want := range tt.wantLengths {
+				chunk, err := ps.GetChunk()
+				if err != nil {
+					t.Fatalf("GetChunk() %d error = %v", i, err)
+				}
+				if chunk.GetTimestamp() != time.Duration(i)*time.Second {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), time.Duration(i)*time.Second)
+				}
+				// Resampling may land a sample either side of the exact length
+				if got := len(chunk.GetAudioData()); math.Abs(float64(got-want)) > 4 {
+					t.Errorf("chunk %d length = %d, want %d", i, got, want)
+				}
+				audio = append(audio, chunk.GetAudioData()...)
+			}
+			if _, err := ps.GetChunk(); err != io.EOF {
+				t.Errorf("GetChunk() after %d chunks error = %v, want io.EOF", len(tt.wantLengths), err)
+			}
+			if tt.exact != nil && !bytes.Equal(audio, tt.exact) {
+				t.Error("16kHz audio was altered by chunking")
+			}
+		})
+	}
+}
+
+func TestPCMStreamKeepSampleRate(t *testing.T) {
+	for _, rate := range []int{8000, 32000, 48000} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			pcm := testPCM(rate, 2500*time.Millisecond)
+			ps := &PCMStream{}
+			ps.SetKeepSampleRate(true)
+			if err := ps.SetChunkDuration(time.Second); err != nil {
+				t.Fatalf("SetChunkDuration() error = %v", err)
+			}
+			if err := ps.InitStream(PCMSource{Reader: bytes.NewReader(pcm), SampleRate: rate}); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer ps.Close()
+
+			var audio []byte
+			for i, want := range []int{2 * rate, 2 * rate, rate} {
+				chunk, err := ps.GetChunk()
+				if err != nil {
+					t.Fatalf("GetChunk() %d error = %v", i, err)
+				}
+				if got := ChunkSampleRate(chunk); got != rate {
+					t.Errorf("chunk %d sample rate = %d, want %d", i, got, rate)
+				}
+				if got := len(chunk.GetAudioData()); got != want {
+					t.Errorf("chunk %d length = %d, want %d", i, got, want)
+				}
+				if chunk.GetTimestamp() != time.Duration(i)*time.Second {
+					t.Errorf("chunk %d timestamp = %v, want %v", i, chunk.GetTimestamp(), time.Duration(i)*time.Second)
+				}
+				audio = append(audio, chunk.GetAudioData()...)
+			}
+			if !bytes.Equal(audio, pcm) {
+				t.Error("audio at its own rate was altered")
+			}
+		})
+	}
+
+	// Rates signatures can't describe are refused rather than converted
+	ps := &PCMStream{}
+	ps.SetKeepSampleRate(true)
+	if err := ps.InitStream(PCMSource{Reader: bytes.NewReader(nil), SampleRate: 22050}); err == nil {
+		t.Error("InitStream() at 22050Hz error = nil, want error")
+	}
+}
+
+func TestPCMStreamClose(t *testing.T) {
+	reader := &closeTracker{Reader: bytes.NewReader(testPCM(16000, 25*time.Second))}
+	ps := &PCMStream{}
+	if err := ps.InitStream(reader); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	if _, err := ps.GetChunk(); err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if err := ps.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if !reader.closed {
+		t.Error("Close() did not close the reader")
+	}
+	if _, err := ps.GetChunk(); err != ErrStreamClosed {
+		t.Errorf("GetChunk() after Close() error = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestPCMStreamInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		source any
+	}{
+		{name: "Path", source: "audio.pcm"},
+		{name: "No reader", source: PCMSource{SampleRate: 16000}},
+		{name: "Negative sample rate", source: PCMSource{Reader: bytes.NewReader(nil), SampleRate: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&PCMStream{}).InitStream(tt.source); err == nil {
+				t.Error("InitStream() error = nil, want error")
+			}
+		})
+	}
+	if _, err := (&PCMStream{}).GetChunk(); err == nil {
+		t.Error("GetChunk() before InitStream() error = nil, want error")
+	}
+}
@@ -0,0 +1,127 @@
+package audiostream
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// streamResampler linearly interpolates a stream of mono samples at one rate
+// into samples at another, usually 16kHz, pulling source samples only as
+// needed. It handles both upsampling and downsampling, returning about
+// dstRate / srcRate times as many samples as it reads, and passes samples
+// through unchanged when the rates match. It is the package's one resampler:
+// every decoder converts to 16kHz through it, by way of resampleReader, as
+// it reads.
+//
+// Linear interpolation needs only the two neighbouring source samples, so it
+// adds no latency and works on streams a sample at a time, as the WAV and PCM
+// decoders read them. The cost is quality: there is no anti-aliasing filter,
+// so when downsampling, content above half dstRate folds back into the band
+// below it. Fingerprinting keys on the strongest spectral peaks and tolerates
+// that noise, but a polyphase filter would be needed for audio meant to be
+// listened to.
+type streamResampler struct {
+	read     func() (float64, error)
+	ratio    float64 // Source samples per output sample
+	outIndex int64
+	cur      float64
+	curIndex int64
+	next     float64
+	haveNext bool
+	started  bool
+}
+
+func newStreamResampler(srcRate, dstRate int, read func() (float64, error)) *streamResampler {
+	return &streamResampler{
+		read:  read,
+		ratio: float64(srcRate) / float64(dstRate),
+	}
+}
+
+// nextSample returns the next output sample, or io.EOF once the source is exhausted
+func (sr *streamResampler) nextSample() (float64, error) {
+	if !sr.started {
+		sample, err := sr.read()
+		if err != nil {
+			return 0, err
+		}
+		sr.started = true
+		sr.cur = sample
+		if err := sr.fillNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Position of this output sample in source samples
+	pos := float64(sr.outIndex) * sr.ratio
+	for pos >= float64(sr.curIndex+1) {
+		if !sr.haveNext {
+			return 0, io.EOF
+		}
+		sr.cur = sr.next
+		sr.curIndex++
+		if err := sr.fillNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	sample := sr.cur
+	if sr.haveNext {
+		sample += (sr.next - sr.cur) * (pos - float64(sr.curIndex))
+	}
+	sr.outIndex++
+	return sample, nil
+}
+
+// fillNext reads the source sample following cur
+func (sr *streamResampler) fillNext() error {
+	sample, err := sr.read()
+	if err == io.EOF {
+		sr.haveNext = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sr.next = sample
+	sr.haveNext = true
+	return nil
+}
+
+// resampleReader is an io.Reader of the 16-bit little endian PCM a
+// streamResampler produces, for decoders to embed
+type resampleReader struct {
+	resampler *streamResampler
+	pending   []byte // Converted bytes not yet returned by Read
+	sampleBuf [2]byte
+}
+
+// newResampleReader returns a reader of the samples read returns, converted
+// from srcRate to dstRate
+func newResampleReader(srcRate, dstRate int, read func() (float64, error)) resampleReader {
+	return resampleReader{resampler: newStreamResampler(srcRate, dstRate, read)}
+}
+
+// Read fills p with converted PCM bytes
+func (rr *resampleReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(rr.pending) > 0 {
+			copied := copy(p[n:], rr.pending)
+			rr.pending = rr.pending[copied:]
+			n += copied
+			continue
+		}
+
+		sample, err := rr.resampler.nextSample()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		binary.LittleEndian.PutUint16(rr.sampleBuf[:], uint16(floatToPCM16(sample)))
+		rr.pending = rr.sampleBuf[:]
+	}
+	return n, nil
+}
@@ -0,0 +1,73 @@
+package audiostream
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestStreamResampler(t *testing.T) {
+	tests := []struct {
+		srcRate, dstRate int
+	}{
+		{8000, 16000},
+		{16000, 16000},
+		{22050, 16000},
+		{44100, 16000},
+		{48000, 16000},
+		{16000, 32000},
+		{44100, 44100},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d to %d", tt.srcRate, tt.dstRate), func(t *testing.T) {
+			samples := make([]float64, tt.srcRate*2)
+			for i := range samples {
+				samples[i] = math.Sin(2 * math.Pi * 440 * float64(i) / float64(tt.srcRate))
+			}
+
+			next := 0
+			sr := newStreamResampler(tt.srcRate, tt.dstRate, func() (float64, error) {
+				if next == len(samples) {
+					return 0, io.EOF
+				}
+				next++
+				return samples[next-1], nil
+			})
+			var got []float64
+			for {
+				sample, err := sr.nextSample()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("nextSample() error = %v", err)
+				}
+				got = append(got, sample)
+			}
+
+			want := len(samples) * tt.dstRate / tt.srcRate
+			if diff := len(got) - want; diff < -1 || diff > 1 {
+				t.Errorf("resampled to %d samples, want about %d", len(got), want)
+			}
+
+			// The tone should survive the conversion
+			for i := 0; i < len(got); i += 997 {
+				expected := math.Sin(2 * math.Pi * 440 * float64(i) / float64(tt.dstRate))
+				if math.Abs(got[i]-expected) > 0.05 {
+					t.Errorf("sample %d = %f, want about %f", i, got[i], expected)
+				}
+			}
+
+			// Matching rates pass the samples through untouched
+			if tt.srcRate == tt.dstRate {
+				for i := range min(len(got), len(samples)) {
+					if got[i] != samples[i] {
+						t.Fatalf("sample %d = %f, want %f unchanged", i, got[i], samples[i])
+					}
+				}
+			}
+		})
+	}
+}
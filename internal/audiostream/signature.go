@@ -1,13 +1,21 @@
 package audiostream
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"maps"
 	"math"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
@@ -16,6 +24,9 @@ const (
 	Magic2        = 0x94119C00
 )
 
+// signatureHeaderSize is the encoded size of a RawSignatureHeader
+const signatureHeaderSize = 48
+
 // RawSignatureHeader represents the header structure for Shazam signatures
 type RawSignatureHeader struct {
 	Magic1                       uint32
@@ -37,19 +48,56 @@ type FrequencyPeak struct {
 	SampleRateHz              int
 }
 
-// GetFrequencyHz converts the frequency bin to Hz
+// ErrPeakOutOfRange is returned when encoding a peak whose fields don't fit
+// the binary format
+var ErrPeakOutOfRange = errors.New("peak out of range")
+
+// validate checks the peak's fields fit the fields they are encoded in
+func (fp *FrequencyPeak) validate() error {
+	switch {
+	case fp.FFTPassNumber < 0 || uint64(fp.FFTPassNumber) > math.MaxUint32:
+		return fmt.Errorf("%w: FFTPassNumber %d", ErrPeakOutOfRange, fp.FFTPassNumber)
+	case fp.PeakMagnitude < 0 || fp.PeakMagnitude > math.MaxUint16:
+		return fmt.Errorf("%w: PeakMagnitude %d", ErrPeakOutOfRange, fp.PeakMagnitude)
+	case fp.CorrectedPeakFrequencyBin < 0 || fp.CorrectedPeakFrequencyBin > math.MaxUint16:
+		return fmt.Errorf("%w: CorrectedPeakFrequencyBin %d", ErrPeakOutOfRange, fp.CorrectedPeakFrequencyBin)
+	}
+	return nil
+}
+
+// GetFrequencyHz converts the frequency bin to Hz. The corrected bin counts
+// 64ths of a bin of a 2048 point FFT, so the width of a bin, and with it the
+// frequency, scales with the peak's sample rate.
 func (fp *FrequencyPeak) GetFrequencyHz() float64 {
 	return float64(fp.CorrectedPeakFrequencyBin) * (float64(fp.SampleRateHz) / 2 / 1024 / 64)
 }
 
-// GetAmplitudePCM calculates the amplitude in PCM format
+// GetAmplitudePCM calculates the amplitude in PCM format. The magnitude is a
+// log scale of the FFT output, which does not depend on the sample rate.
 func (fp *FrequencyPeak) GetAmplitudePCM() float64 {
 	return math.Sqrt(math.Exp(float64(fp.PeakMagnitude-6144)/1477.3)*(1<<17)/2) / 1024
 }
 
-// GetSeconds calculates the time position in seconds
+// EncodePeakMagnitude is the inverse of GetAmplitudePCM, returning the
+// magnitude a peak of the given PCM amplitude is stored with. The result is
+// clamped to the 16 bits a signature has room for, so amplitudes too faint to
+// represent encode as 0.
+func EncodePeakMagnitude(amplitudePCM float64) int {
+	if amplitudePCM <= 0 {
+		return 0
+	}
+	power := math.Pow(amplitudePCM*1024, 2) * 2 / (1 << 17)
+	magnitude := math.Round(math.Log(power)*1477.3 + 6144)
+	return int(min(max(magnitude, 0), math.MaxUint16))
+}
+
+// fftPassSamples is how many samples apart consecutive FFT passes are
+const fftPassSamples = 128
+
+// GetSeconds calculates the time position in seconds, with FFT passes 128
+// samples apart
 func (fp *FrequencyPeak) GetSeconds() float64 {
-	return float64(fp.FFTPassNumber*128) / float64(fp.SampleRateHz)
+	return float64(fp.FFTPassNumber*fftPassSamples) / float64(fp.SampleRateHz)
 }
 
 // DecodedMessage represents the decoded Shazam signature message
@@ -57,22 +105,289 @@ type DecodedMessage struct {
 	SampleRateHz              int
 	NumberSamples             int
 	FrequencyBandToSoundPeaks map[FrequencyBand][]FrequencyPeak
+
+	// StreamOffset is where the signed audio starts in the stream it came
+	// from. Peak times are relative to the start of the signature, so this
+	// places them in the stream. It isn't part of the encoded signature.
+	StreamOffset time.Duration
+}
+
+// PeakStreamTime returns when a peak of this message occurs in the stream
+func (msg *DecodedMessage) PeakStreamTime(peak FrequencyPeak) time.Duration {
+	return msg.StreamOffset + time.Duration(peak.GetSeconds()*float64(time.Second))
+}
+
+// TotalPeaks returns the number of peaks across all bands
+func (msg *DecodedMessage) TotalPeaks() int {
+	total := 0
+	for _, peaks := range msg.FrequencyBandToSoundPeaks {
+		total += len(peaks)
+	}
+	return total
+}
+
+// TimeSpan returns the times of the earliest and latest peaks across all
+// bands, relative to the start of the signature. Both are zero for a message
+// without peaks.
+func (msg *DecodedMessage) TimeSpan() (start, end time.Duration) {
+	minSeconds, maxSeconds := math.Inf(1), math.Inf(-1)
+	for _, peaks := range msg.FrequencyBandToSoundPeaks {
+		for _, peak := range peaks {
+			seconds := peak.GetSeconds()
+			minSeconds = math.Min(minSeconds, seconds)
+			maxSeconds = math.Max(maxSeconds, seconds)
+		}
+	}
+	if math.IsInf(minSeconds, 1) {
+		return 0, 0
+	}
+	return time.Duration(minSeconds * float64(time.Second)), time.Duration(maxSeconds * float64(time.Second))
+}
+
+// FilterByBand returns a copy of the message holding only the peaks of the
+// given bands
+func (msg *DecodedMessage) FilterByBand(bands ...FrequencyBand) *DecodedMessage {
+	return msg.filterPeaks(func(band FrequencyBand, _ FrequencyPeak) bool {
+		return slices.Contains(bands, band)
+	})
+}
+
+// FilterByTime returns a copy of the message holding only the peaks from
+// start up to but not including end, relative to the start of the signature
+func (msg *DecodedMessage) FilterByTime(start, end time.Duration) *DecodedMessage {
+	return msg.filterPeaks(func(_ FrequencyBand, peak FrequencyPeak) bool {
+		at := time.Duration(peak.GetSeconds() * float64(time.Second))
+		return at >= start && at < end
+	})
+}
+
+// filterPeaks returns a copy of the message holding the peaks keep accepts.
+// Bands left without peaks are omitted.
+func (msg *DecodedMessage) filterPeaks(keep func(FrequencyBand, FrequencyPeak) bool) *DecodedMessage {
+	filtered := *msg
+	filtered.FrequencyBandToSoundPeaks = make(map[FrequencyBand][]FrequencyPeak)
+	for band, peaks := range msg.FrequencyBandToSoundPeaks {
+		var kept []FrequencyPeak
+		for _, peak := range peaks {
+			if keep(band, peak) {
+				kept = append(kept, peak)
+			}
+		}
+		if len(kept) > 0 {
+			filtered.FrequencyBandToSoundPeaks[band] = kept
+		}
+	}
+	return &filtered
+}
+
+// String summarizes the message with per-band peak counts and time spans
+func (msg *DecodedMessage) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "DecodedMessage{SampleRateHz: %d, NumberSamples: %d", msg.SampleRateHz, msg.NumberSamples)
+
+	for _, frequencyBand := range slices.Sorted(maps.Keys(msg.FrequencyBandToSoundPeaks)) {
+		peaks := msg.FrequencyBandToSoundPeaks[frequencyBand]
+		if len(peaks) == 0 {
+			fmt.Fprintf(&sb, ", %v band: 0 peaks", frequencyBand)
+			continue
+		}
+
+		minSeconds, maxSeconds := math.Inf(1), math.Inf(-1)
+		for _, peak := range peaks {
+			seconds := peak.GetSeconds()
+			minSeconds = math.Min(minSeconds, seconds)
+			maxSeconds = math.Max(maxSeconds, seconds)
+		}
+		fmt.Fprintf(&sb, ", %v band: %d peaks (%.2fs-%.2fs)", frequencyBand, len(peaks), minSeconds, maxSeconds)
+	}
+
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// Equal reports whether two messages have the same sample rate, sample count
+// and peaks. Peak order within a band is ignored.
+func (msg *DecodedMessage) Equal(other *DecodedMessage) bool {
+	if msg == nil || other == nil {
+		return msg == other
+	}
+	if msg.SampleRateHz != other.SampleRateHz || msg.NumberSamples != other.NumberSamples {
+		return false
+	}
+
+	bands := make(map[FrequencyBand]bool)
+	for frequencyBand := range msg.FrequencyBandToSoundPeaks {
+		bands[frequencyBand] = true
+	}
+	for frequencyBand := range other.FrequencyBandToSoundPeaks {
+		bands[frequencyBand] = true
+	}
+
+	for frequencyBand := range bands {
+		peaks := sortedPeaks(msg.FrequencyBandToSoundPeaks[frequencyBand])
+		otherPeaks := sortedPeaks(other.FrequencyBandToSoundPeaks[frequencyBand])
+		if len(peaks) != len(otherPeaks) {
+			return false
+		}
+		for i := range peaks {
+			if peaks[i].FFTPassNumber != otherPeaks[i].FFTPassNumber ||
+				peaks[i].PeakMagnitude != otherPeaks[i].PeakMagnitude ||
+				peaks[i].CorrectedPeakFrequencyBin != otherPeaks[i].CorrectedPeakFrequencyBin {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sortedPeaks returns a copy of peaks ordered by pass number, then frequency
+// bin and magnitude so equal peak sets always sort the same way
+func sortedPeaks(peaks []FrequencyPeak) []FrequencyPeak {
+	sorted := slices.Clone(peaks)
+	slices.SortFunc(sorted, func(a, b FrequencyPeak) int {
+		if a.FFTPassNumber != b.FFTPassNumber {
+			return a.FFTPassNumber - b.FFTPassNumber
+		}
+		if a.CorrectedPeakFrequencyBin != b.CorrectedPeakFrequencyBin {
+			return a.CorrectedPeakFrequencyBin - b.CorrectedPeakFrequencyBin
+		}
+		return a.PeakMagnitude - b.PeakMagnitude
+	})
+	return sorted
+}
+
+// jsonPeak is the JSON form of a FrequencyPeak. FrequencyHz and Seconds are
+// derived for readability and are ignored when unmarshalling.
+type jsonPeak struct {
+	FFTPassNumber             int     `json:"fftPassNumber"`
+	PeakMagnitude             int     `json:"peakMagnitude"`
+	CorrectedPeakFrequencyBin int     `json:"correctedPeakFrequencyBin"`
+	FrequencyHz               float64 `json:"frequencyHz"`
+	Seconds                   float64 `json:"seconds"`
+}
+
+// jsonMessage is the JSON form of a DecodedMessage, keyed by band name
+type jsonMessage struct {
+	SampleRateHz  int                   `json:"sampleRateHz"`
+	NumberSamples int                   `json:"numberSamples"`
+	Bands         map[string][]jsonPeak `json:"bands"`
+}
+
+// MarshalJSON encodes the message with named frequency bands and derived
+// peak frequencies and times
+func (msg *DecodedMessage) MarshalJSON() ([]byte, error) {
+	out := jsonMessage{
+		SampleRateHz:  msg.SampleRateHz,
+		NumberSamples: msg.NumberSamples,
+		Bands:         make(map[string][]jsonPeak, len(msg.FrequencyBandToSoundPeaks)),
+	}
+
+	for frequencyBand, peaks := range msg.FrequencyBandToSoundPeaks {
+		// Unknown bands have a name, but not one that parses back
+		if _, ok := frequencyBandNames[frequencyBand]; !ok {
+			return nil, fmt.Errorf("unknown frequency band: %d", frequencyBand)
+		}
+
+		jsonPeaks := make([]jsonPeak, 0, len(peaks))
+		for _, peak := range peaks {
+			jsonPeaks = append(jsonPeaks, jsonPeak{
+				FFTPassNumber:             peak.FFTPassNumber,
+				PeakMagnitude:             peak.PeakMagnitude,
+				CorrectedPeakFrequencyBin: peak.CorrectedPeakFrequencyBin,
+				FrequencyHz:               peak.GetFrequencyHz(),
+				Seconds:                   peak.GetSeconds(),
+			})
+		}
+		out.Bands[frequencyBand.String()] = jsonPeaks
+	}
+
+	return json.Marshal(out)
 }
 
-// DecodeFromBinary decodes a binary signature into a DecodedMessage
+// UnmarshalJSON decodes a message produced by MarshalJSON, rebuilding the
+// raw peak fields
+func (msg *DecodedMessage) UnmarshalJSON(data []byte) error {
+	var in jsonMessage
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	bands := make(map[FrequencyBand][]FrequencyPeak, len(in.Bands))
+	for name, jsonPeaks := range in.Bands {
+		frequencyBand, err := ParseFrequencyBand(name)
+		if err != nil {
+			return err
+		}
+
+		peaks := make([]FrequencyPeak, 0, len(jsonPeaks))
+		for _, peak := range jsonPeaks {
+			peaks = append(peaks, FrequencyPeak{
+				FFTPassNumber:             peak.FFTPassNumber,
+				PeakMagnitude:             peak.PeakMagnitude,
+				CorrectedPeakFrequencyBin: peak.CorrectedPeakFrequencyBin,
+				SampleRateHz:              in.SampleRateHz,
+			})
+		}
+		bands[frequencyBand] = peaks
+	}
+
+	msg.SampleRateHz = in.SampleRateHz
+	msg.NumberSamples = in.NumberSamples
+	msg.FrequencyBandToSoundPeaks = bands
+	return nil
+}
+
+// DefaultMaxDecodedPeaks is the most peaks decoding accepts from a signature
+// unless configured otherwise. It is far more than any real signature holds,
+// but stops a corrupt or crafted one from growing the decoded peaks without
+// bound.
+const DefaultMaxDecodedPeaks = 1 << 20
+
+// maxSignatureDuration bounds the audio a decoded signature may claim to
+// cover. Shazam signatures are seconds long, so anything beyond this comes
+// from a corrupt header.
+const maxSignatureDuration = time.Hour
+
+// maxPeaklessDuration bounds how much audio a decoded signature may claim to
+// cover past its last peak, or in all when it has none. Silence and quiet
+// tails leave no peaks, but not for longer than any chunk lasts, so a sample
+// count beyond this comes from a corrupt header.
+const maxPeaklessDuration = time.Minute
+
+// DecodeOptions configures DecodeFromBinaryWithOptions
+type DecodeOptions struct {
+	VerifyCRC bool // Check the header CRC32 against the signature contents
+	MaxPeaks  int  // Most peaks accepted across all bands, defaults to DefaultMaxDecodedPeaks
+}
+
+// DecodeFromBinary decodes a binary signature into a DecodedMessage.
+// The header CRC32 is not checked, so hand-built signatures can be inspected;
+// use DecodeFromBinaryVerify to reject corrupted data.
 func DecodeFromBinary(data []byte) (*DecodedMessage, error) {
+	return DecodeFromBinaryWithOptions(data, DecodeOptions{})
+}
+
+// DecodeFromBinaryVerify decodes a binary signature into a DecodedMessage
+// after checking the header CRC32 against the signature contents
+func DecodeFromBinaryVerify(data []byte) (*DecodedMessage, error) {
+	return DecodeFromBinaryWithOptions(data, DecodeOptions{VerifyCRC: true})
+}
+
+// DecodeFromBinaryWithOptions decodes a binary signature into a
+// DecodedMessage, rejecting it if it holds more peaks than allowed
+func DecodeFromBinaryWithOptions(data []byte, opts DecodeOptions) (*DecodedMessage, error) {
+	maxPeaks := cmp.Or(opts.MaxPeaks, DefaultMaxDecodedPeaks)
+	numPeaks := 0
+	lastPass := 0 // Latest FFT pass holding a peak
 	msg := &DecodedMessage{
 		FrequencyBandToSoundPeaks: make(map[FrequencyBand][]FrequencyPeak),
 	}
 
-	buf := bytes.NewReader(data)
-	buf.Seek(8, io.SeekStart)
-	_, err := io.ReadAll(buf)
-	if err != nil {
-		return nil, err
+	if len(data) < signatureHeaderSize {
+		return nil, fmt.Errorf("signature of %d bytes is shorter than its %d byte header", len(data), signatureHeaderSize)
 	}
 
-	buf.Seek(0, io.SeekStart)
+	buf := bytes.NewReader(data)
 	header := &RawSignatureHeader{}
 	if err := binary.Read(buf, binary.LittleEndian, header); err != nil {
 		return nil, err
@@ -81,33 +396,64 @@ func DecodeFromBinary(data []byte) (*DecodedMessage, error) {
 	if header.Magic1 != Magic1 {
 		return nil, fmt.Errorf("invalid magic1: %x", header.Magic1)
 	}
-	if header.SizeMinusHeader != uint32(len(data)-48) {
+	if header.SizeMinusHeader != uint32(len(data)-signatureHeaderSize) {
 		return nil, fmt.Errorf("invalid size: %d", header.SizeMinusHeader)
 	}
 	if header.Magic2 != Magic2 {
 		return nil, fmt.Errorf("invalid magic2: %x", header.Magic2)
 	}
+	if opts.VerifyCRC {
+		checkSummableData := data[8:]
+		if crc := crc32.ChecksumIEEE(checkSummableData); crc != header.CRC32 {
+			return nil, fmt.Errorf("crc mismatch: got %x want %x", crc, header.CRC32)
+		}
+	}
 
-	msg.SampleRateHz = int(header.ShiftedSampleRateID >> 27)
+	sampleRateHz, ok := sampleRateFromID(header.ShiftedSampleRateID >> 27)
+	if !ok {
+		return nil, fmt.Errorf("invalid sample rate id: %d", header.ShiftedSampleRateID>>27)
+	}
+	msg.SampleRateHz = sampleRateHz
 	msg.NumberSamples = int(float64(header.NumberSamplesPlusDividedRate) - float64(msg.SampleRateHz)*0.24)
+	maxSamples := int(maxSignatureDuration.Seconds()) * msg.SampleRateHz
+	if msg.NumberSamples < 0 || msg.NumberSamples > maxSamples {
+		return nil, fmt.Errorf("invalid sample count: %d", msg.NumberSamples)
+	}
 
-	// Read the type-length-value sequence
+	// Read the type-length-value sequence. The first entry is fixed and has
+	// no value, it just repeats the size of the message minus the header.
 	var tlvHeader [8]byte
+	if _, err := io.ReadFull(buf, tlvHeader[:]); err != nil {
+		return nil, err
+	}
+	if marker := binary.LittleEndian.Uint32(tlvHeader[:4]); marker != 0x40000000 {
+		return nil, fmt.Errorf("invalid contents marker: %x", marker)
+	}
+	if size := binary.LittleEndian.Uint32(tlvHeader[4:]); size != header.SizeMinusHeader {
+		return nil, fmt.Errorf("invalid contents size: %d", size)
+	}
+
 	for {
-		if _, err := buf.Read(tlvHeader[:]); err != nil {
+		if _, err := io.ReadFull(buf, tlvHeader[:]); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return nil, fmt.Errorf("truncated tlv header: %v", err)
 		}
 
 		frequencyBandID := binary.LittleEndian.Uint32(tlvHeader[:4])
 		frequencyPeaksSize := binary.LittleEndian.Uint32(tlvHeader[4:])
-		frequencyPeaksPadding := -int(frequencyPeaksSize) % 4
+		frequencyPeaksPadding := (4 - int(frequencyPeaksSize)%4) % 4
+
+		// Check the declared length before allocating so a crafted signature
+		// can't request an arbitrarily large buffer
+		if int64(frequencyPeaksSize) > int64(buf.Len()) {
+			return nil, fmt.Errorf("tlv length %d exceeds remaining %d", frequencyPeaksSize, buf.Len())
+		}
 
 		peaksBuf := make([]byte, frequencyPeaksSize)
-		if _, err := buf.Read(peaksBuf); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(buf, peaksBuf); err != nil {
+			return nil, fmt.Errorf("truncated tlv value: %v", err)
 		}
 		buf.Seek(int64(frequencyPeaksPadding), io.SeekCurrent)
 
@@ -145,6 +491,10 @@ func DecodeFromBinary(data []byte) (*DecodedMessage, error) {
 				return nil, err
 			}
 
+			if numPeaks++; numPeaks > maxPeaks {
+				return nil, fmt.Errorf("signature has more than %d peaks", maxPeaks)
+			}
+			lastPass = max(lastPass, fftPassNumber)
 			msg.FrequencyBandToSoundPeaks[frequencyBand] = append(msg.FrequencyBandToSoundPeaks[frequencyBand],
 				FrequencyPeak{
 					FFTPassNumber:             fftPassNumber,
@@ -155,60 +505,292 @@ func DecodeFromBinary(data []byte) (*DecodedMessage, error) {
 		}
 	}
 
+	// The sample count must be about what the peaks cover
+	covered := int(maxPeaklessDuration.Seconds()) * msg.SampleRateHz
+	if numPeaks > 0 {
+		covered += (lastPass + 1) * fftPassSamples
+	}
+	if msg.NumberSamples > covered {
+		return nil, fmt.Errorf("invalid sample count: %d is far beyond the %d samples the peaks cover",
+			msg.NumberSamples, covered)
+	}
+
 	return msg, nil
 }
 
+// DecodeAllFromBinary decodes signatures stored back to back, finding where
+// each ends from the size in its header. If a signature can't be decoded,
+// those before it are returned along with the error.
+func DecodeAllFromBinary(data []byte) ([]*DecodedMessage, error) {
+	var msgs []*DecodedMessage
+	for offset := 0; offset < len(data); {
+		rest := data[offset:]
+		if len(rest) < signatureHeaderSize {
+			return msgs, fmt.Errorf("signature %d at offset %d: %d trailing bytes are shorter than a header",
+				len(msgs), offset, len(rest))
+		}
+		size := signatureHeaderSize + int64(binary.LittleEndian.Uint32(rest[8:12]))
+		if size > int64(len(rest)) {
+			return msgs, fmt.Errorf("signature %d at offset %d: size %d exceeds remaining %d",
+				len(msgs), offset, size, len(rest))
+		}
+
+		msg, err := DecodeFromBinary(rest[:size])
+		if err != nil {
+			return msgs, fmt.Errorf("signature %d at offset %d: %w", len(msgs), offset, err)
+		}
+		msgs = append(msgs, msg)
+		offset += int(size)
+	}
+	return msgs, nil
+}
+
 // EncodeToBinary encodes a DecodedMessage to binary format
 func (msg *DecodedMessage) EncodeToBinary() ([]byte, error) {
-	header := &RawSignatureHeader{
-		Magic1:                       Magic1,
-		Magic2:                       Magic2,
-		ShiftedSampleRateID:          uint32(msg.SampleRateHz) << 27,
-		FixedValue:                   (15 << 19) + 0x40000,
-		NumberSamplesPlusDividedRate: uint32(float64(msg.NumberSamples) + float64(msg.SampleRateHz)*0.24),
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	contentsBuf := new(bytes.Buffer)
-	for frequencyBand, frequencyPeaks := range msg.FrequencyBandToSoundPeaks {
-		peaksBuf := new(bytes.Buffer)
-		fftPassNumber := 0
+// WriteTo writes the message to w in binary format, implementing
+// io.WriterTo. The header's CRC32 comes before the data it covers, so the
+// peaks are walked twice, once to checksum them and once to write them, but
+// nothing is built up in memory.
+func (msg *DecodedMessage) WriteTo(w io.Writer) (int64, error) {
+	if !IsSupportedSampleRate(msg.SampleRateHz) {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSampleRate, msg.SampleRateHz)
+	}
+	bands := msg.encodedBands()
+	for _, eb := range bands {
+		for _, peak := range eb.peaks {
+			if err := peak.validate(); err != nil {
+				return 0, fmt.Errorf("%v band: %w", eb.band, err)
+			}
+		}
+	}
+
+	checksum := crc32.NewIEEE()
+	sw := signatureWriter{bufio.NewWriter(checksum)}
+	msg.writeChecksummed(sw, bands)
+	sw.Flush()
+
+	cw := &countingWriter{w: w}
+	sw = signatureWriter{bufio.NewWriter(cw)}
+	sw.uint32(Magic1)
+	sw.uint32(checksum.Sum32())
+	msg.writeChecksummed(sw, bands)
+	// Write errors stick to the buffered writer, so Flush reports the first
+	err := sw.Flush()
+	return cw.n, err
+}
 
+// encodedBand is the peaks of a band in the order they are encoded
+type encodedBand struct {
+	band  FrequencyBand
+	peaks []FrequencyPeak
+	size  int // Encoded size of the peaks, before padding
+}
+
+// padding returns the zero bytes following the band's peaks to align the next
+// band to 4 bytes
+func (eb encodedBand) padding() int {
+	return (4 - eb.size%4) % 4
+}
+
+// encodedBands returns the message's bands in ascending order, so identical
+// messages encode identically, each with its peaks in ascending pass order as
+// offsets are written as deltas
+func (msg *DecodedMessage) encodedBands() []encodedBand {
+	var bands []encodedBand
+	for _, frequencyBand := range slices.Sorted(maps.Keys(msg.FrequencyBandToSoundPeaks)) {
+		frequencyPeaks := slices.Clone(msg.FrequencyBandToSoundPeaks[frequencyBand])
+		slices.SortStableFunc(frequencyPeaks, func(a, b FrequencyPeak) int {
+			return a.FFTPassNumber - b.FFTPassNumber
+		})
+
+		size, fftPassNumber := 0, 0
 		for _, peak := range frequencyPeaks {
-			if peak.FFTPassNumber-fftPassNumber >= 255 {
-				peaksBuf.WriteByte(0xFF)
-				binary.Write(peaksBuf, binary.LittleEndian, uint32(peak.FFTPassNumber))
+			if peak.FFTPassNumber-fftPassNumber > 254 {
+				size += 5
+			}
+			size += encodedPeakSize
+			fftPassNumber = peak.FFTPassNumber
+		}
+		bands = append(bands, encodedBand{band: frequencyBand, peaks: frequencyPeaks, size: size})
+	}
+	return bands
+}
+
+// writeChecksummed writes everything following the header's CRC32, which is
+// the data the checksum covers
+func (msg *DecodedMessage) writeChecksummed(sw signatureWriter, bands []encodedBand) {
+	contentsSize := 8
+	for _, eb := range bands {
+		contentsSize += 8 + eb.size + eb.padding()
+	}
+
+	sampleRateID, _ := sampleRateID(msg.SampleRateHz)
+	sw.uint32(uint32(contentsSize)) // SizeMinusHeader
+	sw.uint32(Magic2)
+	sw.Write(make([]byte, 12)) // Void1
+	sw.uint32(sampleRateID << 27)
+	sw.Write(make([]byte, 8)) // Void2
+	sw.uint32(uint32(float64(msg.NumberSamples) + float64(msg.SampleRateHz)*0.24))
+	sw.uint32((15 << 19) + 0x40000) // FixedValue
+
+	// The contents open with a fixed entry repeating their size
+	sw.uint32(0x40000000)
+	sw.uint32(uint32(contentsSize))
+
+	for _, eb := range bands {
+		sw.uint32(uint32(0x60030040 + int(eb.band)))
+		sw.uint32(uint32(eb.size))
+
+		fftPassNumber := 0
+		for _, peak := range eb.peaks {
+			// 0xFF is reserved as the escape byte, so the largest offset is 254
+			if peak.FFTPassNumber-fftPassNumber > 254 {
+				sw.WriteByte(0xFF)
+				sw.uint32(uint32(peak.FFTPassNumber))
 				fftPassNumber = peak.FFTPassNumber
 			}
 
-			peaksBuf.WriteByte(byte(peak.FFTPassNumber - fftPassNumber))
-			binary.Write(peaksBuf, binary.LittleEndian, uint16(peak.PeakMagnitude))
-			binary.Write(peaksBuf, binary.LittleEndian, uint16(peak.CorrectedPeakFrequencyBin))
+			sw.WriteByte(byte(peak.FFTPassNumber - fftPassNumber))
+			sw.uint16(uint16(peak.PeakMagnitude))
+			sw.uint16(uint16(peak.CorrectedPeakFrequencyBin))
 			fftPassNumber = peak.FFTPassNumber
 		}
+		sw.Write(make([]byte, eb.padding()))
+	}
+}
+
+// signatureWriter buffers the little endian fields of an encoded signature
+type signatureWriter struct {
+	*bufio.Writer
+}
+
+func (sw signatureWriter) uint16(v uint16) {
+	sw.Write(binary.LittleEndian.AppendUint16(sw.AvailableBuffer(), v))
+}
+
+func (sw signatureWriter) uint32(v uint32) {
+	sw.Write(binary.LittleEndian.AppendUint32(sw.AvailableBuffer(), v))
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// encodedPeakSize is the bytes a peak takes up in an encoded signature: a
+// pass offset, a magnitude and a frequency bin
+const encodedPeakSize = 5
+
+// EncodeBudget caps the size of an encoded signature. Zero fields are
+// unlimited.
+type EncodeBudget struct {
+	MaxPeaks int // Most peaks kept across all bands
+	MaxBytes int // Largest encoded size in bytes
+}
 
-		binary.Write(contentsBuf, binary.LittleEndian, uint32(0x60030040+int(frequencyBand)))
-		binary.Write(contentsBuf, binary.LittleEndian, uint32(peaksBuf.Len()))
-		contentsBuf.Write(peaksBuf.Bytes())
-		contentsBuf.Write(make([]byte, -peaksBuf.Len()%4))
+// EncodeToBinaryWithBudget encodes the message like EncodeToBinary, first
+// dropping its weakest peaks across all bands until it fits the budget. It
+// returns the encoding and how many peaks were dropped, leaving the message
+// itself untouched.
+func (msg *DecodedMessage) EncodeToBinaryWithBudget(budget EncodeBudget) ([]byte, int, error) {
+	weakest := msg.peaksByMagnitude()
+	drop := 0
+	if budget.MaxPeaks > 0 {
+		drop = max(len(weakest)-budget.MaxPeaks, 0)
 	}
 
-	header.SizeMinusHeader = uint32(contentsBuf.Len() + 8)
-	finalBuf := new(bytes.Buffer)
-	binary.Write(finalBuf, binary.LittleEndian, header)
-	binary.Write(finalBuf, binary.LittleEndian, uint32(0x40000000))
-	binary.Write(finalBuf, binary.LittleEndian, uint32(contentsBuf.Len()+8))
-	finalBuf.Write(contentsBuf.Bytes())
+	for {
+		data, err := msg.withoutPeaks(weakest[:drop]).EncodeToBinary()
+		if err != nil {
+			return nil, 0, err
+		}
+		if budget.MaxBytes <= 0 || len(data) <= budget.MaxBytes {
+			return data, drop, nil
+		}
+		if drop == len(weakest) {
+			return nil, 0, fmt.Errorf("signature without peaks is %d bytes, over the budget of %d", len(data), budget.MaxBytes)
+		}
+		// Each dropped peak saves about encodedPeakSize bytes, so drop enough
+		// of them to cover the excess before encoding again
+		drop = min(drop+max((len(data)-budget.MaxBytes)/encodedPeakSize, 1), len(weakest))
+	}
+}
 
-	// Calculate and write CRC32
-	checkSummableData := finalBuf.Bytes()[8:]
-	header.CRC32 = crc32.ChecksumIEEE(checkSummableData)
+// peakRef locates a peak within a message's bands
+type peakRef struct {
+	band  FrequencyBand
+	index int
+}
 
-	// Create a new buffer with the updated CRC32
-	updatedBuf := new(bytes.Buffer)
-	binary.Write(updatedBuf, binary.LittleEndian, header)
-	updatedBuf.Write(finalBuf.Bytes()[12:])
+// peaksByMagnitude returns every peak of the message from weakest to
+// strongest. Equally strong peaks are ordered by band, pass and frequency so
+// trimming is deterministic.
+func (msg *DecodedMessage) peaksByMagnitude() []peakRef {
+	var refs []peakRef
+	for band, peaks := range msg.FrequencyBandToSoundPeaks {
+		for i := range peaks {
+			refs = append(refs, peakRef{band: band, index: i})
+		}
+	}
 
-	return updatedBuf.Bytes(), nil
+	peak := func(ref peakRef) FrequencyPeak {
+		return msg.FrequencyBandToSoundPeaks[ref.band][ref.index]
+	}
+	slices.SortFunc(refs, func(a, b peakRef) int {
+		pa, pb := peak(a), peak(b)
+		if pa.PeakMagnitude != pb.PeakMagnitude {
+			return pa.PeakMagnitude - pb.PeakMagnitude
+		}
+		if a.band != b.band {
+			return int(a.band) - int(b.band)
+		}
+		if pa.FFTPassNumber != pb.FFTPassNumber {
+			return pa.FFTPassNumber - pb.FFTPassNumber
+		}
+		if pa.CorrectedPeakFrequencyBin != pb.CorrectedPeakFrequencyBin {
+			return pa.CorrectedPeakFrequencyBin - pb.CorrectedPeakFrequencyBin
+		}
+		return a.index - b.index
+	})
+	return refs
+}
+
+// withoutPeaks returns a copy of the message with the given peaks removed
+func (msg *DecodedMessage) withoutPeaks(drop []peakRef) *DecodedMessage {
+	dropped := make(map[peakRef]bool, len(drop))
+	for _, ref := range drop {
+		dropped[ref] = true
+	}
+
+	trimmed := *msg
+	trimmed.FrequencyBandToSoundPeaks = make(map[FrequencyBand][]FrequencyPeak, len(msg.FrequencyBandToSoundPeaks))
+	for band, peaks := range msg.FrequencyBandToSoundPeaks {
+		kept := make([]FrequencyPeak, 0, len(peaks))
+		for i, peak := range peaks {
+			if !dropped[peakRef{band: band, index: i}] {
+				kept = append(kept, peak)
+			}
+		}
+		// A band left without peaks would still cost its header
+		if len(kept) > 0 || len(peaks) == 0 {
+			trimmed.FrequencyBandToSoundPeaks[band] = kept
+		}
+	}
+	return &trimmed
 }
 
 // EncodeToURI encodes the signature to a data URI
@@ -219,3 +801,17 @@ func (msg *DecodedMessage) EncodeToURI() (string, error) {
 	}
 	return DataURIPrefix + base64.StdEncoding.EncodeToString(binary), nil
 }
+
+// DecodeFromURI decodes a signature data URI produced by EncodeToURI
+func DecodeFromURI(uri string) (*DecodedMessage, error) {
+	encoded, ok := strings.CutPrefix(uri, DataURIPrefix)
+	if !ok {
+		return nil, fmt.Errorf("missing data URI prefix %q", DataURIPrefix)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 signature: %v", err)
+	}
+	return DecodeFromBinary(data)
+}
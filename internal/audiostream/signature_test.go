@@ -1,8 +1,19 @@
 package audiostream
 
 import (
-	"encoding/base64"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFrequencyPeakCalculations(t *testing.T) {
@@ -62,6 +73,69 @@ func TestFrequencyPeakCalculations(t *testing.T) {
 	}
 }
 
+func TestFrequencyPeakSampleRates(t *testing.T) {
+	// The same peak decoded from signatures at each rate. Bin 256 is 256/64 = 4
+	// bins of a 2048 point FFT, i.e. 4/2048 of the sample rate.
+	tests := []struct {
+		rateHz      int
+		wantHz      float64
+		wantSeconds float64 // Of pass 250
+	}{
+		{rateHz: 8000, wantHz: 15.625, wantSeconds: 4},
+		{rateHz: 16000, wantHz: 31.25, wantSeconds: 2},
+		{rateHz: 32000, wantHz: 62.5, wantSeconds: 1},
+		{rateHz: 44100, wantHz: 86.1328125, wantSeconds: 0.7256235827664399},
+		{rateHz: 48000, wantHz: 93.75, wantSeconds: 0.6666666666666666},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.rateHz), func(t *testing.T) {
+			// A 1kHz tone falls in the corrected bin nearest 1000Hz at this rate
+			toneBin := int(math.Round(1000 * 2048 * 64 / float64(tt.rateHz)))
+			msg := &DecodedMessage{
+				SampleRateHz:  tt.rateHz,
+				NumberSamples: tt.rateHz * 3,
+				FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+					LowBand: {
+						{FFTPassNumber: 250, PeakMagnitude: 6144, CorrectedPeakFrequencyBin: 256},
+						{FFTPassNumber: 251, PeakMagnitude: 6144, CorrectedPeakFrequencyBin: toneBin},
+					},
+				},
+			}
+			encoded, err := msg.EncodeToBinary()
+			if err != nil {
+				t.Fatalf("EncodeToBinary() error = %v", err)
+			}
+			decoded, err := DecodeFromBinaryVerify(encoded)
+			if err != nil {
+				t.Fatalf("DecodeFromBinaryVerify() error = %v", err)
+			}
+
+			peaks := decoded.FrequencyBandToSoundPeaks[LowBand]
+			if len(peaks) != 2 {
+				t.Fatalf("decoded %d peaks, want 2", len(peaks))
+			}
+			if hz := peaks[0].GetFrequencyHz(); !floatEquals(hz, tt.wantHz) {
+				t.Errorf("GetFrequencyHz() = %v, want %v", hz, tt.wantHz)
+			}
+			if secs := peaks[0].GetSeconds(); !floatEquals(secs, tt.wantSeconds) {
+				t.Errorf("GetSeconds() = %v, want %v", secs, tt.wantSeconds)
+			}
+			// The magnitude's log scale is independent of the rate, with 6144
+			// standing for a quarter of full scale
+			if amp := peaks[0].GetAmplitudePCM(); !floatEquals(amp, 0.25) {
+				t.Errorf("GetAmplitudePCM() = %v, want 0.25", amp)
+			}
+
+			// Within half a corrected bin of the tone
+			halfBin := float64(tt.rateHz) / 2048 / 64 / 2
+			if hz := peaks[1].GetFrequencyHz(); math.Abs(hz-1000) > halfBin {
+				t.Errorf("tone GetFrequencyHz() = %v, want 1000 ± %v", hz, halfBin)
+			}
+		})
+	}
+}
+
 func TestDecodeEncodeRoundTrip(t *testing.T) {
 	// Create a sample message
 	msg := &DecodedMessage{
@@ -147,16 +221,10 @@ func TestDecodeEncodeRoundTrip(t *testing.T) {
 			t.Errorf("URI prefix = %v, want %v", uri[:len(DataURIPrefix)], DataURIPrefix)
 		}
 
-		// Decode base64 part
-		binary, err := base64.StdEncoding.DecodeString(uri[len(DataURIPrefix):])
+		// Decode URI
+		decoded, err := DecodeFromURI(uri)
 		if err != nil {
-			t.Fatalf("base64 decode error = %v", err)
-		}
-
-		// Decode binary
-		decoded, err := DecodeFromBinary(binary)
-		if err != nil {
-			t.Fatalf("DecodeFromBinary() error = %v", err)
+			t.Fatalf("DecodeFromURI() error = %v", err)
 		}
 
 		// Compare original and decoded messages
@@ -166,6 +234,720 @@ func TestDecodeEncodeRoundTrip(t *testing.T) {
 	})
 }
 
+func TestDecodeFromURIInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{
+			name: "Missing prefix",
+			uri:  "data:audio/wav;base64,AAAA",
+		},
+		{
+			name: "Malformed base64",
+			uri:  DataURIPrefix + "not base64!",
+		},
+		{
+			name: "Empty payload",
+			uri:  DataURIPrefix,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeFromURI(tt.uri); err == nil {
+				t.Errorf("DecodeFromURI() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDecodeFromBinaryVerify(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {
+				{FFTPassNumber: 100, PeakMagnitude: 7000, CorrectedPeakFrequencyBin: 512, SampleRateHz: 16000},
+			},
+		},
+	}
+
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+
+	t.Run("Freshly encoded", func(t *testing.T) {
+		if _, err := DecodeFromBinaryVerify(encoded); err != nil {
+			t.Errorf("DecodeFromBinaryVerify() error = %v", err)
+		}
+	})
+
+	t.Run("Flipped content byte", func(t *testing.T) {
+		corrupted := append([]byte(nil), encoded...)
+		corrupted[len(corrupted)-2] ^= 0xFF
+
+		if _, err := DecodeFromBinaryVerify(corrupted); err == nil {
+			t.Errorf("DecodeFromBinaryVerify() error = nil, want crc mismatch")
+		}
+		if _, err := DecodeFromBinary(corrupted); err != nil {
+			t.Errorf("DecodeFromBinary() error = %v, want unverified decode to succeed", err)
+		}
+	})
+}
+
+func TestEncodeToBinaryDeterministic(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			VeryHighBand: {{FFTPassNumber: 10, PeakMagnitude: 6000, CorrectedPeakFrequencyBin: 900, SampleRateHz: 16000}},
+			HighBand:     {{FFTPassNumber: 20, PeakMagnitude: 6100, CorrectedPeakFrequencyBin: 700, SampleRateHz: 16000}},
+			MidBand:      {{FFTPassNumber: 30, PeakMagnitude: 6200, CorrectedPeakFrequencyBin: 500, SampleRateHz: 16000}},
+			LowBand:      {{FFTPassNumber: 40, PeakMagnitude: 6300, CorrectedPeakFrequencyBin: 300, SampleRateHz: 16000}},
+		},
+	}
+
+	first, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := msg.EncodeToBinary()
+		if err != nil {
+			t.Fatalf("EncodeToBinary() error = %v", err)
+		}
+		if !bytes.Equal(first, again) {
+			t.Fatalf("EncodeToBinary() output differs between runs")
+		}
+	}
+}
+
+func TestDecodeAllFromBinary(t *testing.T) {
+	first := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 48000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			MidBand: {{FFTPassNumber: 3, PeakMagnitude: 6200, CorrectedPeakFrequencyBin: 500, SampleRateHz: 16000}},
+		},
+	}
+	second := &DecodedMessage{
+		SampleRateHz:  44100,
+		NumberSamples: 441000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand:  {{FFTPassNumber: 1, PeakMagnitude: 7000, CorrectedPeakFrequencyBin: 400, SampleRateHz: 44100}},
+			HighBand: {{FFTPassNumber: 9, PeakMagnitude: 7100, CorrectedPeakFrequencyBin: 1300, SampleRateHz: 44100}},
+		},
+	}
+	var data []byte
+	for _, msg := range []*DecodedMessage{first, second} {
+		encoded, err := msg.EncodeToBinary()
+		if err != nil {
+			t.Fatalf("EncodeToBinary() error = %v", err)
+		}
+		data = append(data, encoded...)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []*DecodedMessage
+		wantErr bool
+	}{
+		{name: "Both", data: data, want: []*DecodedMessage{first, second}},
+		{name: "Empty", data: nil, want: nil},
+		{name: "Trailing fragment", data: append(slices.Clone(data), 1, 2, 3), want: []*DecodedMessage{first, second}, wantErr: true},
+		{name: "Truncated second", data: data[:len(data)-4], want: []*DecodedMessage{first}, wantErr: true},
+		{name: "Corrupt first", data: append([]byte{0}, data[1:]...), want: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := DecodeAllFromBinary(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeAllFromBinary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(msgs) != len(tt.want) {
+				t.Fatalf("DecodeAllFromBinary() returned %d signatures, want %d", len(msgs), len(tt.want))
+			}
+			for i, msg := range msgs {
+				if !msg.Equal(tt.want[i]) {
+					t.Errorf("signature %d = %v, want %v", i, msg, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 16000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			HighBand: {{FFTPassNumber: 10, PeakMagnitude: 0x1234, CorrectedPeakFrequencyBin: 0x5678}},
+			LowBand: {
+				{FFTPassNumber: 300, PeakMagnitude: 2, CorrectedPeakFrequencyBin: 3},
+				{FFTPassNumber: 1, PeakMagnitude: 4, CorrectedPeakFrequencyBin: 5},
+			},
+		},
+	}
+
+	// The layout spelled out, with the pass offset of 299 escaped
+	le := binary.LittleEndian
+	var contents []byte
+	contents = le.AppendUint32(contents, 0x60030040+uint32(LowBand))
+	contents = le.AppendUint32(contents, 15)
+	contents = append(contents, 1, 4, 0, 5, 0, 0xFF, 44, 1, 0, 0, 0, 2, 0, 3, 0, 0)
+	contents = le.AppendUint32(contents, 0x60030040+uint32(HighBand))
+	contents = le.AppendUint32(contents, 5)
+	contents = append(contents, 10, 0x34, 0x12, 0x78, 0x56, 0, 0, 0)
+	var want []byte
+	want = le.AppendUint32(want, Magic1)
+	want = le.AppendUint32(want, 0) // CRC32, filled in below
+	want = le.AppendUint32(want, uint32(len(contents)+8))
+	want = le.AppendUint32(want, Magic2)
+	want = append(want, make([]byte, 12)...)
+	want = le.AppendUint32(want, 3<<27)
+	want = append(want, make([]byte, 8)...)
+	want = le.AppendUint32(want, 16000+3840)
+	want = le.AppendUint32(want, (15<<19)+0x40000)
+	want = le.AppendUint32(want, 0x40000000)
+	want = le.AppendUint32(want, uint32(len(contents)+8))
+	want = append(want, contents...)
+	le.PutUint32(want[4:], crc32.ChecksumIEEE(want[8:]))
+
+	var buf bytes.Buffer
+	n, err := msg.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo() = %d, wrote %d bytes", n, buf.Len())
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WriteTo() wrote\n% x\nwant\n% x", buf.Bytes(), want)
+	}
+
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	if !bytes.Equal(encoded, buf.Bytes()) {
+		t.Error("EncodeToBinary() differs from WriteTo()")
+	}
+}
+
+// failingWriter accepts limit bytes and then fails
+type failingWriter struct {
+	limit int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		n := fw.limit
+		fw.limit = 0
+		return n, errors.New("disk full")
+	}
+	fw.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteToErrors(t *testing.T) {
+	msg := &DecodedMessage{SampleRateHz: 16000, FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{}}
+	if n, err := msg.WriteTo(&failingWriter{limit: 20}); err == nil || n != 20 {
+		t.Errorf("WriteTo() = %d, %v, want 20 bytes and an error", n, err)
+	}
+
+	msg.SampleRateHz = 22050
+	if _, err := msg.WriteTo(io.Discard); !errors.Is(err, ErrUnsupportedSampleRate) {
+		t.Errorf("WriteTo() error = %v, want ErrUnsupportedSampleRate", err)
+	}
+}
+
+func TestEncodePeakOutOfRange(t *testing.T) {
+	// Held in a variable so the conversions below compile where int is 32 bits
+	var maxPass uint64 = math.MaxUint32
+	tests := []struct {
+		name  string
+		peak  FrequencyPeak
+		field string
+	}{
+		{name: "Negative pass", peak: FrequencyPeak{FFTPassNumber: -1}, field: "FFTPassNumber"},
+		{name: "Negative magnitude", peak: FrequencyPeak{PeakMagnitude: -1}, field: "PeakMagnitude"},
+		{name: "Magnitude too large", peak: FrequencyPeak{PeakMagnitude: math.MaxUint16 + 1}, field: "PeakMagnitude"},
+		{name: "Negative bin", peak: FrequencyPeak{CorrectedPeakFrequencyBin: -1}, field: "CorrectedPeakFrequencyBin"},
+		{name: "Bin too large", peak: FrequencyPeak{CorrectedPeakFrequencyBin: math.MaxUint16 + 1}, field: "CorrectedPeakFrequencyBin"},
+	}
+	// Every int fits the pass number's field where int is 32 bits
+	if strconv.IntSize == 64 {
+		tests = append(tests, struct {
+			name  string
+			peak  FrequencyPeak
+			field string
+		}{name: "Pass too large", peak: FrequencyPeak{FFTPassNumber: int(maxPass + 1)}, field: "FFTPassNumber"})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid := FrequencyPeak{FFTPassNumber: 10, PeakMagnitude: 6000, CorrectedPeakFrequencyBin: 1000, SampleRateHz: 16000}
+			tt.peak.SampleRateHz = 16000
+			msg := &DecodedMessage{
+				SampleRateHz:              16000,
+				FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{MidBand: {valid, tt.peak}},
+			}
+
+			_, err := msg.EncodeToBinary()
+			if !errors.Is(err, ErrPeakOutOfRange) {
+				t.Fatalf("EncodeToBinary() error = %v, want ErrPeakOutOfRange", err)
+			}
+			if !strings.Contains(err.Error(), tt.field) {
+				t.Errorf("EncodeToBinary() error = %v, want it to name %s", err, tt.field)
+			}
+			var buf bytes.Buffer
+			if n, err := msg.WriteTo(&buf); err == nil || n != 0 || buf.Len() != 0 {
+				t.Errorf("WriteTo() = %d, %v, want nothing written and an error", n, err)
+			}
+		})
+	}
+
+	// The largest values of each field still encode
+	msg := &DecodedMessage{
+		SampleRateHz: 16000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{MidBand: {
+			{FFTPassNumber: int(min(maxPass, math.MaxInt)), PeakMagnitude: math.MaxUint16, CorrectedPeakFrequencyBin: math.MaxUint16, SampleRateHz: 16000},
+		}},
+	}
+	if _, err := msg.EncodeToBinary(); err != nil {
+		t.Errorf("EncodeToBinary() at the field limits error = %v", err)
+	}
+}
+
+func TestEncodeUnorderedPeaks(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {
+				{FFTPassNumber: 300, PeakMagnitude: 6300, CorrectedPeakFrequencyBin: 300, SampleRateHz: 16000},
+				{FFTPassNumber: 45, PeakMagnitude: 6100, CorrectedPeakFrequencyBin: 100, SampleRateHz: 16000},
+				{FFTPassNumber: 299, PeakMagnitude: 6200, CorrectedPeakFrequencyBin: 200, SampleRateHz: 16000},
+				{FFTPassNumber: 554, PeakMagnitude: 6400, CorrectedPeakFrequencyBin: 400, SampleRateHz: 16000},
+				{FFTPassNumber: 5000, PeakMagnitude: 6500, CorrectedPeakFrequencyBin: 500, SampleRateHz: 16000},
+			},
+		},
+	}
+
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	decoded, err := DecodeFromBinaryVerify(encoded)
+	if err != nil {
+		t.Fatalf("DecodeFromBinaryVerify() error = %v", err)
+	}
+
+	want := []int{45, 299, 300, 554, 5000}
+	peaks := decoded.FrequencyBandToSoundPeaks[LowBand]
+	if len(peaks) != len(want) {
+		t.Fatalf("Number of peaks = %v, want %v", len(peaks), len(want))
+	}
+	for i, peak := range peaks {
+		if peak.FFTPassNumber != want[i] {
+			t.Errorf("peaks[%d].FFTPassNumber = %v, want %v", i, peak.FFTPassNumber, want[i])
+		}
+	}
+
+	// The source message must not be reordered by encoding
+	if msg.FrequencyBandToSoundPeaks[LowBand][0].FFTPassNumber != 300 {
+		t.Errorf("EncodeToBinary() reordered the source peaks")
+	}
+}
+
+func TestEncodePeakMagnitude(t *testing.T) {
+	// Every encodable magnitude survives a round trip through its amplitude
+	for magnitude := 0; magnitude <= math.MaxUint16; magnitude++ {
+		peak := FrequencyPeak{PeakMagnitude: magnitude}
+		if got := EncodePeakMagnitude(peak.GetAmplitudePCM()); got != magnitude {
+			t.Fatalf("EncodePeakMagnitude(GetAmplitudePCM(%d)) = %d", magnitude, got)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		amplitude float64
+		want      int
+	}{
+		{name: "quarter", amplitude: 0.25, want: 6144},
+		{name: "zero", amplitude: 0, want: 0},
+		{name: "negative", amplitude: -1, want: 0},
+		{name: "too faint", amplitude: 1e-6, want: 0},
+		{name: "too loud", amplitude: 1e12, want: math.MaxUint16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodePeakMagnitude(tt.amplitude); got != tt.want {
+				t.Errorf("EncodePeakMagnitude(%v) = %d, want %d", tt.amplitude, got, tt.want)
+			}
+		})
+	}
+
+	// Amplitudes in range come back to within the rounding of the log scale
+	for _, amplitude := range []float64{0.1, 1, 17.5, 1000, 5793} {
+		peak := FrequencyPeak{PeakMagnitude: EncodePeakMagnitude(amplitude)}
+		if got := peak.GetAmplitudePCM(); math.Abs(got-amplitude)/amplitude > 1/2000.0 {
+			t.Errorf("amplitude %v round tripped to %v", amplitude, got)
+		}
+	}
+}
+
+func TestEncodeToBinaryWithBudget(t *testing.T) {
+	// 400 peaks spread over the bands with distinct magnitudes, as 37 and 400
+	// are coprime
+	msg := &DecodedMessage{
+		SampleRateHz:              16000,
+		NumberSamples:             160000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{},
+	}
+	for i := 0; i < 400; i++ {
+		band := FrequencyBand(i % 4)
+		msg.FrequencyBandToSoundPeaks[band] = append(msg.FrequencyBandToSoundPeaks[band], FrequencyPeak{
+			FFTPassNumber:             i * 3,
+			PeakMagnitude:             1000 + (i*37)%400,
+			CorrectedPeakFrequencyBin: 1000 + i,
+			SampleRateHz:              16000,
+		})
+	}
+	full, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		budget      EncodeBudget
+		wantDropped int // -1 to only check that some were dropped
+	}{
+		{name: "Unlimited", budget: EncodeBudget{}, wantDropped: 0},
+		{name: "Fits", budget: EncodeBudget{MaxBytes: len(full)}, wantDropped: 0},
+		{name: "Max peaks", budget: EncodeBudget{MaxPeaks: 150}, wantDropped: 250},
+		{name: "Max bytes", budget: EncodeBudget{MaxBytes: 1000}, wantDropped: -1},
+		{name: "Both", budget: EncodeBudget{MaxPeaks: 300, MaxBytes: 600}, wantDropped: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, dropped, err := msg.EncodeToBinaryWithBudget(tt.budget)
+			if err != nil {
+				t.Fatalf("EncodeToBinaryWithBudget() error = %v", err)
+			}
+			if tt.budget.MaxBytes > 0 && len(data) > tt.budget.MaxBytes {
+				t.Errorf("encoded %d bytes, over the budget of %d", len(data), tt.budget.MaxBytes)
+			}
+			if tt.wantDropped >= 0 && dropped != tt.wantDropped {
+				t.Errorf("dropped %d peaks, want %d", dropped, tt.wantDropped)
+			}
+			if tt.wantDropped < 0 && dropped == 0 {
+				t.Error("dropped no peaks")
+			}
+
+			decoded, err := DecodeFromBinaryVerify(data)
+			if err != nil {
+				t.Fatalf("DecodeFromBinaryVerify() error = %v", err)
+			}
+			kept := 0
+			weakestKept := math.MaxInt
+			for _, peaks := range decoded.FrequencyBandToSoundPeaks {
+				kept += len(peaks)
+				for _, peak := range peaks {
+					weakestKept = min(weakestKept, peak.PeakMagnitude)
+				}
+			}
+			if kept != 400-dropped {
+				t.Errorf("kept %d peaks, want %d", kept, 400-dropped)
+			}
+			if tt.budget.MaxPeaks > 0 && kept > tt.budget.MaxPeaks {
+				t.Errorf("kept %d peaks, over the budget of %d", kept, tt.budget.MaxPeaks)
+			}
+
+			// Magnitudes are distinct, so keeping only the strongest means no
+			// dropped peak is stronger than the weakest kept
+			atLeastWeakest := 0
+			for _, peaks := range msg.FrequencyBandToSoundPeaks {
+				for _, peak := range peaks {
+					if peak.PeakMagnitude >= weakestKept {
+						atLeastWeakest++
+					}
+				}
+			}
+			if atLeastWeakest != kept {
+				t.Errorf("%d peaks at least as strong as the weakest kept, want %d", atLeastWeakest, kept)
+			}
+		})
+	}
+
+	if len(msg.FrequencyBandToSoundPeaks[LowBand]) != 100 {
+		t.Error("EncodeToBinaryWithBudget() modified the message")
+	}
+}
+
+func TestEncodeToBinaryWithBudgetTooSmall(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 16000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {{FFTPassNumber: 10, PeakMagnitude: 20, CorrectedPeakFrequencyBin: 30}},
+		},
+	}
+	if _, _, err := msg.EncodeToBinaryWithBudget(EncodeBudget{MaxBytes: 16}); err == nil {
+		t.Error("EncodeToBinaryWithBudget() error = nil, want error for a budget smaller than the header")
+	}
+}
+
+func TestSampleRateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		rateHz int
+		wantID uint32
+	}{
+		{name: "8kHz", rateHz: 8000, wantID: 1},
+		{name: "16kHz", rateHz: 16000, wantID: 3},
+		{name: "32kHz", rateHz: 32000, wantID: 4},
+		{name: "44.1kHz", rateHz: 44100, wantID: 5},
+		{name: "48kHz", rateHz: 48000, wantID: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &DecodedMessage{
+				SampleRateHz:              tt.rateHz,
+				NumberSamples:             tt.rateHz * 3,
+				FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{},
+			}
+
+			encoded, err := msg.EncodeToBinary()
+			if err != nil {
+				t.Fatalf("EncodeToBinary() error = %v", err)
+			}
+
+			header := &RawSignatureHeader{}
+			if err := binary.Read(bytes.NewReader(encoded), binary.LittleEndian, header); err != nil {
+				t.Fatalf("binary.Read() error = %v", err)
+			}
+			if id := header.ShiftedSampleRateID >> 27; id != tt.wantID {
+				t.Errorf("sample rate id = %v, want %v", id, tt.wantID)
+			}
+
+			decoded, err := DecodeFromBinaryVerify(encoded)
+			if err != nil {
+				t.Fatalf("DecodeFromBinaryVerify() error = %v", err)
+			}
+			if decoded.SampleRateHz != tt.rateHz {
+				t.Errorf("SampleRateHz = %v, want %v", decoded.SampleRateHz, tt.rateHz)
+			}
+			if decoded.NumberSamples != msg.NumberSamples {
+				t.Errorf("NumberSamples = %v, want %v", decoded.NumberSamples, msg.NumberSamples)
+			}
+		})
+	}
+}
+
+func TestUnsupportedSampleRate(t *testing.T) {
+	if IsSupportedSampleRate(22050) {
+		t.Errorf("IsSupportedSampleRate(22050) = true, want false")
+	}
+	if !IsSupportedSampleRate(16000) {
+		t.Errorf("IsSupportedSampleRate(16000) = false, want true")
+	}
+
+	msg := &DecodedMessage{
+		SampleRateHz:              22050,
+		NumberSamples:             1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{},
+	}
+	if _, err := msg.EncodeToBinary(); !errors.Is(err, ErrUnsupportedSampleRate) {
+		t.Errorf("EncodeToBinary() error = %v, want %v", err, ErrUnsupportedSampleRate)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {
+				{FFTPassNumber: 100, PeakMagnitude: 7000, CorrectedPeakFrequencyBin: 512, SampleRateHz: 16000},
+				{FFTPassNumber: 140, PeakMagnitude: 7200, CorrectedPeakFrequencyBin: 530, SampleRateHz: 16000},
+			},
+			VeryHighBand: {
+				{FFTPassNumber: 200, PeakMagnitude: 6500, CorrectedPeakFrequencyBin: 2560, SampleRateHz: 16000},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	bands := raw["bands"].(map[string]any)
+	for _, name := range []string{"low", "veryhigh"} {
+		if _, ok := bands[name]; !ok {
+			t.Errorf("band %q missing from JSON: %s", name, data)
+		}
+	}
+	firstPeak := bands["low"].([]any)[0].(map[string]any)
+	if !floatEquals(firstPeak["seconds"].(float64), 0.8) {
+		t.Errorf("seconds = %v, want 0.8", firstPeak["seconds"])
+	}
+
+	var decoded DecodedMessage
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Errorf("json round trip = %v, want %v", &decoded, msg)
+	}
+}
+
+func TestDecodedMessageString(t *testing.T) {
+	// At 16kHz every 125 passes are a second
+	peak := func(pass int) FrequencyPeak {
+		return FrequencyPeak{FFTPassNumber: pass, PeakMagnitude: 6000, CorrectedPeakFrequencyBin: 1000, SampleRateHz: 16000}
+	}
+
+	tests := []struct {
+		name  string
+		bands map[FrequencyBand][]FrequencyPeak
+		want  string
+	}{
+		{
+			name:  "No bands",
+			bands: map[FrequencyBand][]FrequencyPeak{},
+			want:  "DecodedMessage{SampleRateHz: 16000, NumberSamples: 32000}",
+		},
+		{
+			name: "Bands in order",
+			bands: map[FrequencyBand][]FrequencyPeak{
+				VeryHighBand: {peak(250)},
+				LowBand:      {peak(250), peak(125), peak(0)},
+				HighBand:     {peak(25), peak(50)},
+			},
+			want: "DecodedMessage{SampleRateHz: 16000, NumberSamples: 32000" +
+				", low band: 3 peaks (0.00s-2.00s)" +
+				", high band: 2 peaks (0.20s-0.40s)" +
+				", veryhigh band: 1 peaks (2.00s-2.00s)}",
+		},
+		{
+			name: "Empty band",
+			bands: map[FrequencyBand][]FrequencyPeak{
+				MidBand: {},
+				LowBand: {peak(125)},
+			},
+			want: "DecodedMessage{SampleRateHz: 16000, NumberSamples: 32000" +
+				", low band: 1 peaks (1.00s-1.00s)" +
+				", mid band: 0 peaks}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &DecodedMessage{SampleRateHz: 16000, NumberSamples: 32000, FrequencyBandToSoundPeaks: tt.bands}
+			// Map iteration order varies, so the output must not
+			for range 5 {
+				if got := msg.String(); got != tt.want {
+					t.Fatalf("String() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodedMessageEqual(t *testing.T) {
+	newMessage := func(sampleRateHz int, passes ...int) *DecodedMessage {
+		peaks := make([]FrequencyPeak, 0, len(passes))
+		for _, pass := range passes {
+			peaks = append(peaks, FrequencyPeak{
+				FFTPassNumber:             pass,
+				PeakMagnitude:             7000,
+				CorrectedPeakFrequencyBin: 512,
+				SampleRateHz:              sampleRateHz,
+			})
+		}
+		return &DecodedMessage{
+			SampleRateHz:              sampleRateHz,
+			NumberSamples:             1000,
+			FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{LowBand: peaks},
+		}
+	}
+
+	tests := []struct {
+		name string
+		a, b *DecodedMessage
+		want bool
+	}{
+		{
+			name: "Equal messages",
+			a:    newMessage(16000, 10, 20, 30),
+			b:    newMessage(16000, 10, 20, 30),
+			want: true,
+		},
+		{
+			name: "Different sample rates",
+			a:    newMessage(16000, 10, 20, 30),
+			b:    newMessage(44100, 10, 20, 30),
+			want: false,
+		},
+		{
+			name: "Reordered peaks",
+			a:    newMessage(16000, 10, 20, 30),
+			b:    newMessage(16000, 30, 10, 20),
+			want: true,
+		},
+		{
+			name: "Different peaks",
+			a:    newMessage(16000, 10, 20, 30),
+			b:    newMessage(16000, 10, 20, 31),
+			want: false,
+		},
+		{
+			name: "Missing peak",
+			a:    newMessage(16000, 10, 20, 30),
+			b:    newMessage(16000, 10, 20),
+			want: false,
+		},
+		{
+			name: "Both nil",
+			a:    nil,
+			b:    nil,
+			want: true,
+		},
+		{
+			name: "Nil argument",
+			a:    newMessage(16000, 10),
+			b:    nil,
+			want: false,
+		},
+		{
+			name: "Nil receiver",
+			a:    nil,
+			b:    newMessage(16000, 10),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestInvalidBinaryData(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -199,8 +981,387 @@ func TestInvalidBinaryData(t *testing.T) {
 	}
 }
 
+func TestMalformedTLVLength(t *testing.T) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {
+				{FFTPassNumber: 100, PeakMagnitude: 7000, CorrectedPeakFrequencyBin: 512, SampleRateHz: 16000},
+				{FFTPassNumber: 120, PeakMagnitude: 7100, CorrectedPeakFrequencyBin: 520, SampleRateHz: 16000},
+			},
+		},
+	}
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Oversized length field",
+			data: func() []byte {
+				data := append([]byte(nil), encoded...)
+				binary.LittleEndian.PutUint32(data[60:], 0xFFFFFFF0)
+				return data
+			}(),
+		},
+		{
+			name: "Length one past remaining",
+			data: func() []byte {
+				data := append([]byte(nil), encoded...)
+				binary.LittleEndian.PutUint32(data[60:], uint32(len(data)-64+1))
+				return data
+			}(),
+		},
+		{
+			name: "Truncated tlv header",
+			data: truncateSignature(encoded, 60),
+		},
+		{
+			name: "Truncated tlv value",
+			data: truncateSignature(encoded, 66),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeFromBinary(tt.data); err == nil {
+				t.Errorf("DecodeFromBinary() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestPeakStreamTime(t *testing.T) {
+	msg := &DecodedMessage{SampleRateHz: 16000, StreamOffset: 20 * time.Second}
+
+	tests := []struct {
+		pass int
+		want time.Duration
+	}{
+		{pass: 0, want: 20 * time.Second},
+		{pass: 125, want: 21 * time.Second},
+		{pass: 625, want: 25 * time.Second},
+	}
+
+	for _, tt := range tests {
+		peak := FrequencyPeak{FFTPassNumber: tt.pass, SampleRateHz: 16000}
+		if got := msg.PeakStreamTime(peak); got != tt.want {
+			t.Errorf("PeakStreamTime(pass %d) = %v, want %v", tt.pass, got, tt.want)
+		}
+	}
+}
+
+func FuzzDecodeFromBinary(f *testing.F) {
+	msg := &DecodedMessage{
+		SampleRateHz:  16000,
+		NumberSamples: 1000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+			LowBand: {{FFTPassNumber: 100, PeakMagnitude: 7000, CorrectedPeakFrequencyBin: 512, SampleRateHz: 16000}},
+		},
+	}
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		f.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	f.Add(encoded)
+	f.Add(truncateSignature(encoded, 60))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Malformed input must be rejected with an error, never a panic
+		DecodeFromBinary(data)
+	})
+}
+
+// truncateSignature cuts an encoded signature to n bytes and patches the
+// header sizes so decoding gets past the header checks
+func truncateSignature(data []byte, n int) []byte {
+	truncated := append([]byte(nil), data[:n]...)
+	binary.LittleEndian.PutUint32(truncated[8:], uint32(n-48))
+	binary.LittleEndian.PutUint32(truncated[52:], uint32(n-48))
+	return truncated
+}
+
 // Helper function to compare float64 values with a small epsilon
 func floatEquals(a, b float64) bool {
 	epsilon := 0.0001
 	return (a-b) < epsilon && (b-a) < epsilon
 }
+
+// craftSignature returns a valid signature whose low band holds count copies
+// of the same peak, as a crafted signature might
+func craftSignature(t *testing.T, count int) []byte {
+	t.Helper()
+
+	msg := &DecodedMessage{SampleRateHz: 16000, NumberSamples: 16000, FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{}}
+	encoded, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+
+	peaks := bytes.Repeat([]byte{0, 0x00, 0x1C, 0x00, 0x02}, count)
+	data := append([]byte(nil), encoded[:56]...)
+	data = binary.LittleEndian.AppendUint32(data, 0x60030040+uint32(LowBand))
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(peaks)))
+	data = append(data, peaks...)
+	data = append(data, make([]byte, (4-len(peaks)%4)%4)...)
+
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(data)-48))
+	binary.LittleEndian.PutUint32(data[52:], uint32(len(data)-48))
+	binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(data[8:]))
+	return data
+}
+
+func TestDecodeMaxPeaks(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		maxPeaks int
+		wantErr  bool
+	}{
+		{name: "Within default", count: 10000},
+		{name: "Millions of peaks", count: 2_000_000, wantErr: true},
+		{name: "At limit", count: 100, maxPeaks: 100},
+		{name: "Over limit", count: 101, maxPeaks: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := craftSignature(t, tt.count)
+			msg, err := DecodeFromBinaryWithOptions(data, DecodeOptions{VerifyCRC: true, MaxPeaks: tt.maxPeaks})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeFromBinaryWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(msg.FrequencyBandToSoundPeaks[LowBand]) != tt.count {
+				t.Errorf("decoded %d peaks, want %d", len(msg.FrequencyBandToSoundPeaks[LowBand]), tt.count)
+			}
+		})
+	}
+}
+
+func TestDecodeSampleCount(t *testing.T) {
+	// At 16kHz the header stores the sample count plus 3840, and FFT passes
+	// are 128 samples apart
+	tests := []struct {
+		name        string
+		stored      uint32
+		lastPass    int
+		wantSamples int
+		wantErr     bool
+	}{
+		{name: "Ten seconds", stored: 160000 + 3840, lastPass: 1200, wantSamples: 160000},
+		{name: "No samples", stored: 3840, wantSamples: 0},
+		{name: "A minute past the last peak", stored: 60*16000 + 128 + 3840, wantSamples: 60*16000 + 128},
+		{name: "An hour of peaks", stored: 3600*16000 + 3840, lastPass: 3600 * 125, wantSamples: 3600 * 16000},
+		{name: "Zero", stored: 0, wantErr: true},
+		{name: "Just under the offset", stored: 3839, wantErr: true},
+		{name: "Over a minute past the last peak", stored: 60*16000 + 129 + 3840, wantErr: true},
+		{name: "An hour over one peak", stored: 3600*16000 + 3840, wantErr: true},
+		{name: "Over an hour", stored: 3600*16000 + 3841, lastPass: 3600 * 125, wantErr: true},
+		{name: "Max uint32", stored: math.MaxUint32, lastPass: 3600 * 125, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &DecodedMessage{
+				SampleRateHz: 16000,
+				FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+					LowBand: {{FFTPassNumber: tt.lastPass, PeakMagnitude: 0x1C00, CorrectedPeakFrequencyBin: 0x200, SampleRateHz: 16000}},
+				},
+			}
+			data, err := msg.EncodeToBinary()
+			if err != nil {
+				t.Fatalf("EncodeToBinary() error = %v", err)
+			}
+			binary.LittleEndian.PutUint32(data[40:], tt.stored)
+			binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(data[8:]))
+
+			msg, err = DecodeFromBinaryVerify(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeFromBinaryVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && msg.NumberSamples != tt.wantSamples {
+				t.Errorf("NumberSamples = %d, want %d", msg.NumberSamples, tt.wantSamples)
+			}
+		})
+	}
+}
+
+func TestDecodeSampleCountWithoutPeaks(t *testing.T) {
+	msg := &DecodedMessage{SampleRateHz: 16000, NumberSamples: 60 * 16000, FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{}}
+	data, err := msg.EncodeToBinary()
+	if err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	if _, err := DecodeFromBinaryVerify(data); err != nil {
+		t.Errorf("DecodeFromBinaryVerify() error = %v for a minute of silence", err)
+	}
+
+	msg.NumberSamples++
+	if data, err = msg.EncodeToBinary(); err != nil {
+		t.Fatalf("EncodeToBinary() error = %v", err)
+	}
+	if _, err := DecodeFromBinaryVerify(data); err == nil {
+		t.Error("DecodeFromBinaryVerify() succeeded for over a minute without peaks")
+	}
+}
+
+func TestTotalPeaksAndTimeSpan(t *testing.T) {
+	tests := []struct {
+		name      string
+		bands     map[FrequencyBand][]FrequencyPeak
+		wantTotal int
+		wantStart time.Duration
+		wantEnd   time.Duration
+	}{
+		{name: "Empty", bands: map[FrequencyBand][]FrequencyPeak{}},
+		{name: "Empty bands", bands: map[FrequencyBand][]FrequencyPeak{LowBand: {}, HighBand: nil}},
+		{
+			name: "Multiple bands",
+			bands: map[FrequencyBand][]FrequencyPeak{
+				LowBand: {
+					{FFTPassNumber: 250, SampleRateHz: 16000},
+					{FFTPassNumber: 125, SampleRateHz: 16000},
+				},
+				MidBand: {{FFTPassNumber: 1000, SampleRateHz: 16000}},
+				VeryHighBand: {
+					{FFTPassNumber: 500, SampleRateHz: 16000},
+					{FFTPassNumber: 625, SampleRateHz: 16000},
+				},
+			},
+			wantTotal: 5,
+			wantStart: time.Second,     // Pass 125 of 128 samples at 16kHz
+			wantEnd:   8 * time.Second, // Pass 1000
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &DecodedMessage{SampleRateHz: 16000, FrequencyBandToSoundPeaks: tt.bands}
+			if got := msg.TotalPeaks(); got != tt.wantTotal {
+				t.Errorf("TotalPeaks() = %d, want %d", got, tt.wantTotal)
+			}
+			start, end := msg.TimeSpan()
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("TimeSpan() = %v, %v, want %v, %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestFilterPeaks(t *testing.T) {
+	// Passes of 125 samples are a second apart at 16kHz
+	peak := func(pass int) FrequencyPeak {
+		return FrequencyPeak{FFTPassNumber: pass, PeakMagnitude: 6000 + pass, SampleRateHz: 16000}
+	}
+	newMessage := func() *DecodedMessage {
+		return &DecodedMessage{
+			SampleRateHz:  16000,
+			NumberSamples: 10 * 16000,
+			StreamOffset:  time.Minute,
+			FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{
+				LowBand:      {peak(0), peak(125), peak(250)},
+				MidBand:      {peak(375)},
+				VeryHighBand: {peak(500), peak(625)},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter func(*DecodedMessage) *DecodedMessage
+		want   map[FrequencyBand][]FrequencyPeak
+	}{
+		{
+			name:   "One band",
+			filter: func(msg *DecodedMessage) *DecodedMessage { return msg.FilterByBand(MidBand) },
+			want:   map[FrequencyBand][]FrequencyPeak{MidBand: {peak(375)}},
+		},
+		{
+			name:   "Two bands",
+			filter: func(msg *DecodedMessage) *DecodedMessage { return msg.FilterByBand(LowBand, VeryHighBand) },
+			want: map[FrequencyBand][]FrequencyPeak{
+				LowBand:      {peak(0), peak(125), peak(250)},
+				VeryHighBand: {peak(500), peak(625)},
+			},
+		},
+		{
+			name:   "Missing band",
+			filter: func(msg *DecodedMessage) *DecodedMessage { return msg.FilterByBand(HighBand) },
+			want:   map[FrequencyBand][]FrequencyPeak{},
+		},
+		{
+			name:   "Time window",
+			filter: func(msg *DecodedMessage) *DecodedMessage { return msg.FilterByTime(time.Second, 4*time.Second) },
+			want: map[FrequencyBand][]FrequencyPeak{
+				LowBand: {peak(125), peak(250)},
+				MidBand: {peak(375)},
+			},
+		},
+		{
+			name:   "Empty window",
+			filter: func(msg *DecodedMessage) *DecodedMessage { return msg.FilterByTime(6*time.Second, 9*time.Second) },
+			want:   map[FrequencyBand][]FrequencyPeak{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newMessage()
+			filtered := tt.filter(msg)
+
+			if !reflect.DeepEqual(filtered.FrequencyBandToSoundPeaks, tt.want) {
+				t.Errorf("peaks = %v, want %v", filtered.FrequencyBandToSoundPeaks, tt.want)
+			}
+			if filtered.SampleRateHz != msg.SampleRateHz || filtered.NumberSamples != msg.NumberSamples ||
+				filtered.StreamOffset != msg.StreamOffset {
+				t.Errorf("filtered header = %v, want that of %v", filtered, msg)
+			}
+
+			// The filtered peaks are copies, and the source is left as it was
+			for _, peaks := range filtered.FrequencyBandToSoundPeaks {
+				for i := range peaks {
+					peaks[i].PeakMagnitude = 0
+				}
+			}
+			if !msg.Equal(newMessage()) {
+				t.Errorf("source changed to %v", msg)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeFromBinary(b *testing.B) {
+	// A minute of peaks, several per pass as findFrequencyPeaks produces
+	msg := &DecodedMessage{
+		SampleRateHz:              16000,
+		NumberSamples:             60 * 16000,
+		FrequencyBandToSoundPeaks: map[FrequencyBand][]FrequencyPeak{},
+	}
+	for pass := 0; pass < 60*16000/128; pass++ {
+		for band := LowBand; band <= VeryHighBand; band++ {
+			msg.FrequencyBandToSoundPeaks[band] = append(msg.FrequencyBandToSoundPeaks[band], FrequencyPeak{
+				FFTPassNumber:             pass,
+				PeakMagnitude:             6000 + pass%1000,
+				CorrectedPeakFrequencyBin: 2000 + int(band)*3000,
+				SampleRateHz:              16000,
+			})
+		}
+	}
+	data, err := msg.EncodeToBinary()
+	if err != nil {
+		b.Fatalf("EncodeToBinary() error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		if _, err := DecodeFromBinary(data); err != nil {
+			b.Fatalf("DecodeFromBinary() error = %v", err)
+		}
+	}
+}
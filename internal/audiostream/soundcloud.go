@@ -0,0 +1,225 @@
+package audiostream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// soundCloudAPIURL is the base URL of the SoundCloud API used to resolve tracks
+const soundCloudAPIURL = "https://api-v2.soundcloud.com"
+
+// ErrAuthRequired is returned when SoundCloud refuses to resolve a track
+// without a client ID
+var ErrAuthRequired = errors.New("soundcloud track requires a client ID, see SetClientID")
+
+// soundCloudTrack is the part of a resolved SoundCloud track we need to stream it
+type soundCloudTrack struct {
+	Media struct {
+		Transcodings []soundCloudTranscoding `json:"transcodings"`
+	} `json:"media"`
+}
+
+// soundCloudTranscoding is one encoding of a track SoundCloud can serve
+type soundCloudTranscoding struct {
+	URL    string `json:"url"`
+	Format struct {
+		Protocol string `json:"protocol"` // "progressive" or "hls"
+		MimeType string `json:"mime_type"`
+	} `json:"format"`
+}
+
+// openStream resolves the track URL and returns the encoded audio body,
+// preferring a progressive download over HLS
+func (scs *SoundCloudStream) openStream(ctx context.Context) (io.ReadCloser, error) {
+	var track soundCloudTrack
+	resolveURL := scs.apiBaseURL + "/resolve?url=" + url.QueryEscape(scs.url)
+	if err := scs.getAPI(ctx, resolveURL, &track); err != nil {
+		return nil, fmt.Errorf("failed to resolve track: %w", err)
+	}
+
+	transcoding, ok := pickTranscoding(track.Media.Transcodings)
+	if !ok {
+		return nil, fmt.Errorf("track has no streamable transcodings")
+	}
+
+	var stream struct {
+		URL string `json:"url"`
+	}
+	if err := scs.getAPI(ctx, transcoding.URL, &stream); err != nil {
+		return nil, fmt.Errorf("failed to get stream url: %w", err)
+	}
+
+	if transcoding.Format.Protocol == "hls" {
+		segments, err := scs.hlsSegments(ctx, stream.URL)
+		if err != nil {
+			return nil, err
+		}
+		return &hlsReader{ctx: ctx, client: scs.client, segments: segments}, nil
+	}
+	return scs.get(ctx, stream.URL)
+}
+
+// getAPI fetches a SoundCloud API URL, with the client ID if there is one,
+// and decodes its JSON body into v. Being refused without a client ID
+// returns ErrAuthRequired.
+func (scs *SoundCloudStream) getAPI(ctx context.Context, rawURL string, v any) error {
+	if scs.clientID != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid api url: %v", err)
+		}
+		query := u.Query()
+		query.Set("client_id", scs.clientID)
+		u.RawQuery = query.Encode()
+		rawURL = u.String()
+	}
+
+	err := scs.getJSON(ctx, rawURL, v)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && scs.clientID == "" &&
+		(statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden) {
+		return ErrAuthRequired
+	}
+	return err
+}
+
+// pickTranscoding returns the progressive transcoding if there is one,
+// falling back to HLS
+func pickTranscoding(transcodings []soundCloudTranscoding) (soundCloudTranscoding, bool) {
+	for _, protocol := range []string{"progressive", "hls"} {
+		for _, transcoding := range transcodings {
+			if transcoding.Format.Protocol == protocol {
+				return transcoding, true
+			}
+		}
+	}
+	return soundCloudTranscoding{}, false
+}
+
+// hlsSegments fetches an HLS media playlist and returns its segment URLs
+func (scs *SoundCloudStream) hlsSegments(ctx context.Context, playlistURL string) ([]string, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist url: %v", err)
+	}
+
+	body, err := scs.get(ctx, playlistURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlist: %v", err)
+	}
+	defer body.Close()
+
+	var segments []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		segment, err := base.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment url: %v", err)
+		}
+		segments = append(segments, segment.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %v", err)
+	}
+	return segments, nil
+}
+
+// getJSON fetches a URL and decodes its JSON body into v
+func (scs *SoundCloudStream) getJSON(ctx context.Context, rawURL string, v any) error {
+	body, err := scs.get(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// get fetches a URL and returns its body, failing on non-200 responses
+func (scs *SoundCloudStream) get(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	return httpGet(ctx, scs.client, rawURL)
+}
+
+// httpGet fetches a URL with client and returns its body, failing on non-200
+// responses
+func httpGet(ctx context.Context, client *http.Client, rawURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpStatusError{code: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+// httpStatusError is returned by httpGet for a response other than 200 OK
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.code)
+}
+
+// hlsReader reads HLS segments back to back as one continuous stream
+type hlsReader struct {
+	ctx      context.Context
+	client   *http.Client
+	segments []string
+	current  io.ReadCloser
+}
+
+func (hr *hlsReader) Read(p []byte) (int, error) {
+	for {
+		if hr.current == nil {
+			if len(hr.segments) == 0 {
+				return 0, io.EOF
+			}
+			body, err := httpGet(hr.ctx, hr.client, hr.segments[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to get segment: %v", err)
+			}
+			hr.current = body
+			hr.segments = hr.segments[1:]
+		}
+
+		n, err := hr.current.Read(p)
+		if err == io.EOF {
+			hr.current.Close()
+			hr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (hr *hlsReader) Close() error {
+	if hr.current != nil {
+		return hr.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build integration
+
+package audiostream
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSoundCloudStreamIntegration streams a real track. It needs network
+// access and ffmpeg on PATH: go test -tags integration ./...
+func TestSoundCloudStreamIntegration(t *testing.T) {
+	scs := &SoundCloudStream{}
+	if err := scs.InitStream("https://soundcloud.com/platform/lolsnake-boiler-room-berlin-weeirdos"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+
+	received := 0
+	timeout := time.After(30 * time.Second)
+	for received < 32000 {
+		select {
+		case _, ok := <-scs.audioChan:
+			if !ok {
+				t.Fatalf("stream ended after %d bytes: %v", received, scs.getStreamErr())
+			}
+			received++
+		case <-timeout:
+			t.Fatalf("received only %d bytes before timing out", received)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package audiostream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// passthroughDecoder treats its input as already decoded PCM
+type passthroughDecoder struct{}
+
+func (passthroughDecoder) Decode(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// newSoundCloudServer serves a fake SoundCloud API resolving every track to
+// the given audio, using the given transcoding protocol
+func newSoundCloudServer(t *testing.T, protocol string, audio []byte) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") == "" {
+			http.Error(w, "missing url", http.StatusBadRequest)
+			return
+		}
+		var track soundCloudTrack
+		transcoding := soundCloudTranscoding{URL: server.URL + "/media/" + protocol}
+		transcoding.Format.Protocol = protocol
+		track.Media.Transcodings = []soundCloudTranscoding{transcoding}
+		json.NewEncoder(w).Encode(track)
+	})
+	mux.HandleFunc("/media/progressive", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"url": %q}`, server.URL+"/audio.mp3")
+	})
+	mux.HandleFunc("/media/hls", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"url": %q}`, server.URL+"/hls/playlist.m3u8")
+	})
+	mux.HandleFunc("/audio.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(audio)
+	})
+	mux.HandleFunc("/hls/playlist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.0,\nsegment0.mp3\n#EXTINF:10.0,\nsegment1.mp3\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/hls/segment0.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(audio[:len(audio)/2])
+	})
+	mux.HandleFunc("/hls/segment1.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(audio[len(audio)/2:])
+	})
+
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestSoundCloudStream starts a stream against the fake API
+func newTestSoundCloudStream(t *testing.T, server *httptest.Server) *SoundCloudStream {
+	t.Helper()
+
+	scs := &SoundCloudStream{
+		apiBaseURL: server.URL,
+		client:     server.Client(),
+		decoder:    passthroughDecoder{},
+	}
+	if err := scs.InitStream("https://soundcloud.com/artist/track"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	return scs
+}
+
+func TestSoundCloudStreamAudio(t *testing.T) {
+	audio := make([]byte, 500000)
+	for i := range audio {
+		audio[i] = byte(i % 251)
+	}
+
+	for _, protocol := range []string{"progressive", "hls"} {
+		t.Run(protocol, func(t *testing.T) {
+			scs := newTestSoundCloudStream(t, newSoundCloudServer(t, protocol, audio))
+
+			received := make([]byte, 0, len(audio))
+			for b := range scs.audioChan {
+				received = append(received, b)
+			}
+			if !bytes.Equal(received, audio) {
+				t.Errorf("streamed %d bytes, want the %d byte fixture", len(received), len(audio))
+			}
+			if err := scs.getStreamErr(); err != nil {
+				t.Errorf("stream error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSoundCloudStreamHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	scs := newTestSoundCloudStream(t, server)
+
+	// Wait for streaming to give up
+	for range scs.audioChan {
+	}
+
+	if _, err := scs.GetChunk(); err == nil {
+		t.Errorf("GetChunk() error = nil, want resolve failure")
+	}
+}
+
+func TestSoundCloudStreamGetChunk(t *testing.T) {
+	audio := make([]byte, 500000)
+	for i := range audio {
+		audio[i] = byte(i % 251)
+	}
+	scs := newTestSoundCloudStream(t, newSoundCloudServer(t, "progressive", audio))
+
+	first, err := scs.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if !bytes.Equal(first.GetAudioData(), audio[:320000]) {
+		t.Errorf("first chunk holds %d bytes, want the first 320000 bytes of the track", len(first.GetAudioData()))
+	}
+	if first.GetTimestamp() != 0 {
+		t.Errorf("first chunk timestamp = %v, want 0", first.GetTimestamp())
+	}
+
+	second, err := scs.GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if !bytes.Equal(second.GetAudioData(), audio[320000:]) {
+		t.Errorf("second chunk holds %d bytes, want the remaining %d bytes", len(second.GetAudioData()), len(audio)-320000)
+	}
+	if want := 10 * time.Second; second.GetTimestamp() != want {
+		t.Errorf("second chunk timestamp = %v, want %v", second.GetTimestamp(), want)
+	}
+
+	if _, err := scs.GetChunk(); err != io.EOF {
+		t.Errorf("GetChunk() at end of track error = %v, want io.EOF", err)
+	}
+}
+
+func TestSoundCloudStreamEnd(t *testing.T) {
+	scs := &SoundCloudStream{chanStream: chanStream{
+		audioChan: make(chan byte, 80000),
+		ended:     make(chan struct{}),
+		ctx:       context.Background(),
+	}}
+	if err := scs.SetChunkDuration(time.Second); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	for i := 0; i < 80000; i++ {
+		scs.audioChan <- byte(i)
+	}
+	close(scs.ended)
+	close(scs.audioChan)
+
+	var lengths []int
+	eofs := 0
+	for i := 0; i < 5; i++ {
+		chunk, err := scs.GetChunk()
+		if err == io.EOF {
+			eofs++
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		if eofs > 0 {
+			t.Fatalf("GetChunk() returned a chunk after io.EOF")
+		}
+		lengths = append(lengths, len(chunk.GetAudioData()))
+	}
+
+	if want := []int{32000, 32000, 16000}; !slices.Equal(lengths, want) {
+		t.Errorf("chunk lengths = %v, want %v", lengths, want)
+	}
+	if eofs != 2 {
+		t.Errorf("got io.EOF %d times, want it from every call after the audio ran out", eofs)
+	}
+}
+
+func TestSoundCloudStreamEndWithError(t *testing.T) {
+	scs := &SoundCloudStream{chanStream: chanStream{
+		audioChan: make(chan byte, 10),
+		ended:     make(chan struct{}),
+		ctx:       context.Background(),
+	}}
+	scs.setStreamErr(fmt.Errorf("connection reset"))
+	close(scs.ended)
+	close(scs.audioChan)
+
+	if _, err := scs.GetChunk(); err == nil || err == io.EOF {
+		t.Errorf("GetChunk() error = %v, want the streaming failure", err)
+	}
+}
+
+func TestSoundCloudStreamClose(t *testing.T) {
+	// More audio than the channel buffers, so streaming blocks until read
+	audio := make([]byte, 2000000)
+	scs := newTestSoundCloudStream(t, newSoundCloudServer(t, "progressive", audio))
+	if _, err := scs.GetChunk(); err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		scs.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not stop the streaming goroutine")
+	}
+
+	// The goroutine has exited, so the channel is closed
+	for range scs.audioChan {
+	}
+	if _, err := scs.GetChunk(); err != ErrStreamClosed {
+		t.Errorf("GetChunk() after Close error = %v, want %v", err, ErrStreamClosed)
+	}
+	if err := scs.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+func TestSoundCloudStreamCloseLeaks(t *testing.T) {
+	// More audio than the channel buffers, so streaming is blocked when closed
+	audio := make([]byte, 2000000)
+	server := newSoundCloudServer(t, "progressive", audio)
+	before := runtime.NumGoroutine()
+
+	for range 3 {
+		scs := newTestSoundCloudStream(t, server)
+		if _, err := scs.GetChunk(); err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		scs.Close()
+	}
+
+	// Connections to the test server wind down in the background
+	server.Client().CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before streaming, %d after closing", before, after)
+	}
+}
+
+func TestSoundCloudStreamSkipsEmptyChunks(t *testing.T) {
+	newStream := func() *SoundCloudStream {
+		scs := &SoundCloudStream{chanStream: chanStream{
+			audioChan: make(chan byte, 32000),
+			ended:     make(chan struct{}),
+			ctx:       context.Background(),
+		}}
+		scs.SetChunkDuration(time.Second)
+		return scs
+	}
+
+	t.Run("audio arrives late", func(t *testing.T) {
+		scs := newStream()
+		// Nothing arrives for several recording timeouts
+		time.AfterFunc(350*time.Millisecond, func() {
+			for i := 0; i < 32000; i++ {
+				scs.audioChan <- 1
+			}
+		})
+
+		chunk, err := scs.GetChunk()
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		if len(chunk.GetAudioData()) == 0 {
+			t.Error("GetChunk() returned an empty chunk")
+		}
+	})
+
+	t.Run("stream ends without audio", func(t *testing.T) {
+		scs := newStream()
+		time.AfterFunc(250*time.Millisecond, func() {
+			close(scs.ended)
+			close(scs.audioChan)
+		})
+
+		chunk, err := scs.GetChunk()
+		if err != io.EOF {
+			t.Errorf("GetChunk() = %v, %v, want io.EOF", chunk, err)
+		}
+	})
+}
+
+func TestSoundCloudStreamBuffer(t *testing.T) {
+	audio := make([]byte, 200000)
+	for i := range audio {
+		audio[i] = byte(i % 251)
+	}
+
+	server := newSoundCloudServer(t, "progressive", audio)
+	scs := &SoundCloudStream{
+		apiBaseURL: server.URL,
+		client:     server.Client(),
+		decoder:    passthroughDecoder{},
+	}
+	if err := scs.SetChunkDuration(time.Second); err != nil {
+		t.Fatalf("SetChunkDuration() error = %v", err)
+	}
+	// A buffer far smaller than the track, and than a chunk
+	if err := scs.SetBufferDuration(100 * time.Millisecond); err != nil {
+		t.Fatalf("SetBufferDuration() error = %v", err)
+	}
+	if err := scs.InitStream("https://soundcloud.com/artist/track"); err != nil {
+		t.Fatalf("InitStream() error = %v", err)
+	}
+	defer scs.Close()
+	if got := cap(scs.audioChan); got != 3200 {
+		t.Errorf("buffer holds %d bytes, want 3200", got)
+	}
+
+	received := make([]byte, 0, len(audio))
+	for {
+		chunk, err := scs.GetChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("GetChunk() error = %v", err)
+		}
+		received = append(received, chunk.GetAudioData()...)
+		// A slow consumer lets the download fill the buffer
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !bytes.Equal(received, audio) {
+		t.Errorf("received %d bytes, want all %d bytes of the track in order", len(received), len(audio))
+	}
+}
+
+func TestSoundCloudStreamCheckURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		hosts   []string
+		wantErr bool
+	}{
+		{name: "Track", url: "https://soundcloud.com/artist/track"},
+		{name: "Plain http", url: "http://soundcloud.com/artist/track"},
+		{name: "Mobile", url: "https://m.soundcloud.com/artist/track"},
+		{name: "Short link", url: "https://on.soundcloud.com/abc123"},
+		{name: "Upper case host", url: "https://SoundCloud.com/artist/track"},
+		{name: "File", url: "file:///etc/passwd", wantErr: true},
+		{name: "Gopher", url: "gopher://soundcloud.com/artist", wantErr: true},
+		{name: "Other host", url: "https://example.com/artist/track", wantErr: true},
+		{name: "Lookalike host", url: "https://evilsoundcloud.com/artist/track", wantErr: true},
+		{name: "Host suffix", url: "https://soundcloud.com.example.com/track", wantErr: true},
+		{name: "Local address", url: "http://127.0.0.1:8080/track", wantErr: true},
+		{name: "Allowed host", url: "https://music.example.com/track", hosts: []string{"example.com"}},
+		{name: "Not allowed host", url: "https://soundcloud.com/artist/track", hosts: []string{"example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scs := &SoundCloudStream{}
+			if tt.hosts != nil {
+				if err := scs.SetAllowedHosts(tt.hosts...); err != nil {
+					t.Fatalf("SetAllowedHosts() error = %v", err)
+				}
+			}
+			if err := scs.checkURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("checkURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSoundCloudStreamRejectsURL(t *testing.T) {
+	scs := &SoundCloudStream{}
+	if err := scs.InitStream("file:///etc/passwd"); err == nil {
+		scs.Close()
+		t.Fatal("InitStream() error = nil, want error for a file URL")
+	}
+}
+
+func TestSoundCloudStreamClientID(t *testing.T) {
+	audio := bytes.Repeat([]byte{1, 2, 3, 4}, 8000)
+
+	// Only the API needs the client ID, which the fake refuses to serve
+	// without, as SoundCloud does for tracks that need auth
+	var mu sync.Mutex
+	var apiIDs, audioIDs []string
+	var server *httptest.Server
+	requireID := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			apiIDs = append(apiIDs, r.URL.Query().Get("client_id"))
+			mu.Unlock()
+			if r.URL.Query().Get("client_id") != "abc123" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", requireID(func(w http.ResponseWriter, r *http.Request) {
+		transcoding := soundCloudTranscoding{URL: server.URL + "/media/progressive?format=mp3"}
+		transcoding.Format.Protocol = "progressive"
+		var track soundCloudTrack
+		track.Media.Transcodings = []soundCloudTranscoding{transcoding}
+		json.NewEncoder(w).Encode(track)
+	}))
+	mux.HandleFunc("/media/progressive", requireID(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "mp3" {
+			http.Error(w, "lost the transcoding's own query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"url": %q}`, server.URL+"/audio.mp3")
+	}))
+	mux.HandleFunc("/audio.mp3", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		audioIDs = append(audioIDs, r.URL.Query().Get("client_id"))
+		mu.Unlock()
+		w.Write(audio)
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	stream := func(clientID string) (*SoundCloudStream, []byte) {
+		scs := &SoundCloudStream{apiBaseURL: server.URL, client: server.Client(), decoder: passthroughDecoder{}}
+		scs.SetClientID(clientID)
+		if err := scs.InitStream("https://soundcloud.com/artist/private-track"); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		var received []byte
+		for b := range scs.audioChan {
+			received = append(received, b)
+		}
+		return scs, received
+	}
+
+	t.Run("with client ID", func(t *testing.T) {
+		apiIDs, audioIDs = nil, nil
+		scs, received := stream("abc123")
+		if err := scs.getStreamErr(); err != nil {
+			t.Fatalf("stream error = %v", err)
+		}
+		if !bytes.Equal(received, audio) {
+			t.Errorf("streamed %d bytes, want the %d byte fixture", len(received), len(audio))
+		}
+		if want := []string{"abc123", "abc123"}; !slices.Equal(apiIDs, want) {
+			t.Errorf("api requests sent client IDs %q, want %q", apiIDs, want)
+		}
+		if want := []string{""}; !slices.Equal(audioIDs, want) {
+			t.Errorf("audio request sent client IDs %q, want none", audioIDs)
+		}
+	})
+
+	t.Run("without client ID", func(t *testing.T) {
+		scs, _ := stream("")
+		if _, err := scs.GetChunk(); !errors.Is(err, ErrAuthRequired) {
+			t.Errorf("GetChunk() error = %v, want ErrAuthRequired", err)
+		}
+	})
+}
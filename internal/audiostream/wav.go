@@ -0,0 +1,256 @@
+package audiostream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// wavFormat is the audio layout described by a WAV file's fmt chunk
+type wavFormat struct {
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+// readWAVHeader parses the RIFF header of r up to the start of the data chunk,
+// returning the audio format and the size of the sample data
+func readWAVHeader(r io.Reader) (*wavFormat, int64, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read riff header: %v", err)
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return nil, 0, fmt.Errorf("not a wav file")
+	}
+
+	var format *wavFormat
+	for {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(r, chunkHeader[:]); err != nil {
+			return nil, 0, fmt.Errorf("failed to read chunk header: %v", err)
+		}
+		chunkID := string(chunkHeader[:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+
+		switch chunkID {
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, 0, fmt.Errorf("fmt chunk too short: %d", chunkSize)
+			}
+			format = &wavFormat{}
+			if err := binary.Read(r, binary.LittleEndian, format); err != nil {
+				return nil, 0, fmt.Errorf("failed to read fmt chunk: %v", err)
+			}
+			if err := skipChunk(r, chunkSize-16); err != nil {
+				return nil, 0, err
+			}
+		case "data":
+			if format == nil {
+				return nil, 0, fmt.Errorf("data chunk before fmt chunk")
+			}
+			return format, chunkSize, nil
+		default:
+			if err := skipChunk(r, chunkSize); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+}
+
+// WriteWAV writes raw 16-bit little-endian mono PCM at the given sample rate
+// to w as a WAV file, such as to listen to a chunk's audio
+func WriteWAV(w io.Writer, pcm []byte, sampleRate int) error {
+	if sampleRate <= 0 {
+		return fmt.Errorf("invalid sample rate: %d", sampleRate)
+	}
+	if len(pcm)%2 != 0 {
+		return fmt.Errorf("pcm of %d bytes is not a whole number of 16-bit samples", len(pcm))
+	}
+	if int64(len(pcm)) > math.MaxUint32-36 {
+		return fmt.Errorf("pcm of %d bytes is too long for a wav file", len(pcm))
+	}
+
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+len(pcm)))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header, _ = binary.Append(header, binary.LittleEndian, wavFormat{
+		AudioFormat:   wavFormatPCM,
+		Channels:      1,
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate * 2),
+		BlockAlign:    2,
+		BitsPerSample: 16,
+	})
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(pcm)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(pcm)
+	return err
+}
+
+// skipChunk discards a chunk body, including the pad byte of odd-sized chunks
+func skipChunk(r io.Reader, size int64) error {
+	if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+		return fmt.Errorf("failed to skip chunk: %v", err)
+	}
+	return nil
+}
+
+// frameSize returns the size in bytes of one sample for every channel
+func (wf *wavFormat) frameSize() int64 {
+	return int64(wf.Channels) * int64(wf.BitsPerSample/8)
+}
+
+// sampleDecoder returns a function decoding one sample of the given format
+// into [-1, 1]
+func (wf *wavFormat) sampleDecoder() (func([]byte) float64, error) {
+	audioFormat := wf.AudioFormat
+	if audioFormat == wavFormatExtensible {
+		// The subformat GUID isn't parsed, so assume the common integer PCM
+		audioFormat = wavFormatPCM
+	}
+
+	switch {
+	case audioFormat == wavFormatPCM && wf.BitsPerSample == 8:
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }, nil
+	case audioFormat == wavFormatPCM && wf.BitsPerSample == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }, nil
+	case audioFormat == wavFormatPCM && wf.BitsPerSample == 24:
+		return func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}, nil
+	case audioFormat == wavFormatPCM && wf.BitsPerSample == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }, nil
+	case audioFormat == wavFormatFloat && wf.BitsPerSample == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported wav format %d with %d bits per sample", wf.AudioFormat, wf.BitsPerSample)
+	}
+}
+
+// wavFrameBlock is how many frames wavPCMReader decodes at a time
+const wavFrameBlock = 1024
+
+// wavPCMReader converts WAV sample data into 16-bit mono PCM on the fly, at
+// 16kHz or the file's own rate
+type wavPCMReader struct {
+	src      *bufio.Reader
+	format   *wavFormat
+	rate     int   // Sample rate of the converted audio in Hz
+	dataSize int64 // Bytes of sample data the header declares
+	decode   func([]byte) float64
+	block    []byte  // Raw frames read from src
+	samples  []int16 // Interleaved samples decoded from block
+	mono     []int16 // Downmixed samples not yet resampled
+	resampleReader
+}
+
+// newWAVPCMReader reads a WAV file from r and returns a reader of its audio
+// as 16-bit mono PCM, at 16kHz or, if keepRate is set, the file's own rate
+func newWAVPCMReader(r io.Reader, keepRate bool) (*wavPCMReader, error) {
+	format, dataSize, err := readWAVHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if format.Channels == 0 || format.SampleRate == 0 || format.BitsPerSample < 8 {
+		return nil, fmt.Errorf("invalid wav format: %d channels of %d bits at %d Hz", format.Channels, format.BitsPerSample, format.SampleRate)
+	}
+	decode, err := format.sampleDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	wr := &wavPCMReader{
+		src:      bufio.NewReader(io.LimitReader(r, dataSize)),
+		format:   format,
+		rate:     int(SampleRate16000),
+		dataSize: dataSize,
+		decode:   decode,
+		block:    make([]byte, wavFrameBlock*int(format.frameSize())),
+	}
+	if keepRate {
+		wr.rate = int(format.SampleRate)
+	}
+	wr.resampleReader = newResampleReader(int(format.SampleRate), wr.rate, wr.readSample)
+	return wr, nil
+}
+
+// length returns the duration of the sample data, given at most available
+// bytes of it exist. Streamed WAVs often declare a placeholder data size, so
+// the bound keeps such files from claiming to be hours long.
+func (wr *wavPCMReader) length(available int64) time.Duration {
+	frames := min(wr.dataSize, available) / wr.format.frameSize()
+	return time.Duration(frames) * time.Second / time.Duration(wr.format.SampleRate)
+}
+
+// seekFrames skips the first frames frames of sample data by seeking r, the
+// reader the header was read from, instead of decoding them. It must be
+// called before the first Read.
+func (wr *wavPCMReader) seekFrames(r io.ReadSeeker, frames int64) error {
+	skip := min(frames*wr.format.frameSize(), wr.dataSize)
+	if _, err := r.Seek(skip, io.SeekCurrent); err != nil {
+		return fmt.Errorf("failed to seek: %v", err)
+	}
+	wr.src = bufio.NewReader(io.LimitReader(r, wr.dataSize-skip))
+	return nil
+}
+
+// readSample returns the next mono sample, decoding another block of frames
+// when the current one is used up
+func (wr *wavPCMReader) readSample() (float64, error) {
+	if len(wr.mono) == 0 {
+		if err := wr.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	sample := wr.mono[0]
+	wr.mono = wr.mono[1:]
+	return float64(sample) / 32768, nil
+}
+
+// readBlock reads up to wavFrameBlock frames and downmixes them to mono
+func (wr *wavPCMReader) readBlock() error {
+	n, err := io.ReadFull(wr.src, wr.block)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bytesPerSample := int(wr.format.BitsPerSample / 8)
+	wr.samples = wr.samples[:0]
+	for i := 0; i+bytesPerSample <= n; i += bytesPerSample {
+		wr.samples = append(wr.samples, floatToPCM16(wr.decode(wr.block[i:])))
+	}
+
+	// A partial trailing frame is dropped by the downmix
+	wr.mono = downmixToMono(wr.samples, int(wr.format.Channels))
+	if len(wr.mono) == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// floatToPCM16 converts a sample in [-1, 1] to 16-bit PCM, clipping overs
+func floatToPCM16(sample float64) int16 {
+	return clipPCM16(math.Round(sample * 32768))
+}
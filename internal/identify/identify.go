@@ -0,0 +1,99 @@
+package identify
+
+import (
+	"context"
+	"fmt"
+	"listr/internal/audiostream"
+	"listr/internal/shazam"
+	"listr/internal/song"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Options configures IdentifyStream. The zero value uses the defaults.
+type Options struct {
+	ChunkDuration  time.Duration        // Length of audio sent per match request
+	MinConfidence  float64              // Matches scoring below this are dropped
+	SilenceDBFS    float64              // Chunks quieter than this are skipped, 0 to match all
+	Normalize      bool                 // Scale quiet chunks up before fingerprinting
+	RequestTimeout time.Duration        // Chunks taking longer than this to match are skipped, 0 for no limit
+	ClientID       string               // SoundCloud API client ID, needed by most tracks
+	Progress       shazam.ProgressFunc  // Called after each chunk, see ShazamHandler.SetProgress
+	Shazam         shazam.ShazamOptions // Endpoint and client for match requests
+}
+
+// newStream creates the stream a link is played from
+var newStream = func() audiostream.Stream {
+	return &audiostream.SoundCloudStream{}
+}
+
+// IdentifyStream plays the SoundCloud track at url and returns the songs
+// heard in it, in the order they were played. Consecutive matches of the same
+// song are collapsed into one. The songs identified before a failure are
+// returned along with the error.
+func IdentifyStream(ctx context.Context, url string, opts Options) ([]*song.Song, error) {
+	stream := newStream()
+	if opts.ClientID != "" {
+		if scs, ok := stream.(interface{ SetClientID(string) }); ok {
+			scs.SetClientID(opts.ClientID)
+		}
+	}
+	return identify(ctx, stream, url, opts)
+}
+
+// fileStreams creates the stream for each kind of audio file IdentifyFile
+// reads, by extension. WAV, MP3 and AAC-LC files are all decoded in process.
+var fileStreams = map[string]func() audiostream.Stream{
+	".wav": func() audiostream.Stream { return &audiostream.FileStream{} },
+	".mp3": func() audiostream.Stream { return &audiostream.MP3Stream{} },
+	".aac": func() audiostream.Stream { return &audiostream.AACStream{} },
+	".m4a": func() audiostream.Stream { return &audiostream.AACStream{} },
+	".mp4": func() audiostream.Stream { return &audiostream.AACStream{} },
+}
+
+// IdentifyFile is IdentifyStream for a local audio file, such as a recorded
+// DJ set. WAV, MP3 and AAC files are supported, told apart by their
+// extension. The audio is converted to what Shazam expects, and each song is
+// timestamped with where it was heard in the file.
+func IdentifyFile(ctx context.Context, path string, opts Options) ([]*song.Song, error) {
+	newFileStream, ok := fileStreams[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		exts := slices.Sorted(maps.Keys(fileStreams))
+		return nil, fmt.Errorf("unsupported audio file %q, want one of %s", filepath.Base(path), strings.Join(exts, ", "))
+	}
+	return identify(ctx, newFileStream(), path, opts)
+}
+
+// identify starts stream from source and matches the songs in it
+func identify(ctx context.Context, stream audiostream.Stream, source string, opts Options) ([]*song.Song, error) {
+	handler, err := shazam.NewShazamHandler(
+		shazam.WithOptions(opts.Shazam),
+		shazam.WithMinConfidence(opts.MinConfidence),
+		shazam.WithSilenceThreshold(opts.SilenceDBFS),
+		shazam.WithNormalize(opts.Normalize),
+		shazam.WithRequestTimeout(opts.RequestTimeout),
+		shazam.WithProgress(opts.Progress),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init shazam: %w", err)
+	}
+
+	if opts.ChunkDuration > 0 {
+		sizer, ok := stream.(audiostream.ChunkResizer)
+		if !ok {
+			return nil, fmt.Errorf("stream %T has a fixed chunk duration", stream)
+		}
+		if err := sizer.SetChunkDuration(opts.ChunkDuration); err != nil {
+			return nil, err
+		}
+	}
+	if err := stream.InitStream(source); err != nil {
+		return nil, fmt.Errorf("failed to start stream: %w", err)
+	}
+	defer stream.Close()
+
+	return handler.MatchStream(ctx, stream)
+}
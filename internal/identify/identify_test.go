@@ -0,0 +1,303 @@
+package identify
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"listr/internal/audiostream"
+	"listr/internal/audiostream/audiostreamtest"
+	"listr/internal/shazam"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends every request to a test server instead
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestIdentifyStream(t *testing.T) {
+	titles := []string{"Song A", "Song A", "", "Song B"}
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		title := titles[min(requests, len(titles)-1)]
+		requests++
+		mu.Unlock()
+
+		var resp shazam.ShazamResponse
+		resp.Track.Title = title
+		resp.Track.Subtitle = "Artist"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := audiostreamtest.NewChunkStream(audiostreamtest.PatternChunks(len(titles), 10*time.Second)...)
+	newStream = func() audiostream.Stream { return stream }
+	t.Cleanup(func() {
+		newStream = func() audiostream.Stream { return &audiostream.SoundCloudStream{} }
+	})
+
+	const link = "https://soundcloud.com/artist/set"
+	songs, err := IdentifyStream(context.Background(), link, Options{
+		ChunkDuration: 10 * time.Second,
+		Shazam: shazam.ShazamOptions{
+			Client: &http.Client{Transport: redirectTransport{target: target}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("IdentifyStream() error = %v", err)
+	}
+
+	if stream.Source() != link {
+		t.Errorf("stream started with %v, want %v", stream.Source(), link)
+	}
+	if stream.ChunkDuration() != 10*time.Second {
+		t.Errorf("chunk duration = %v, want 10s", stream.ChunkDuration())
+	}
+	if !stream.Closed() {
+		t.Error("stream was not closed")
+	}
+	if requests != len(titles) {
+		t.Errorf("sent %d match requests, want %d", requests, len(titles))
+	}
+
+	want := []struct {
+		title     string
+		timestamp time.Duration
+	}{
+		{"Song A", 0},
+		{"Song B", 30 * time.Second},
+	}
+	if len(songs) != len(want) {
+		t.Fatalf("got %d songs, want %d", len(songs), len(want))
+	}
+	for i, w := range want {
+		if *songs[i].SongTitle != w.title || *songs[i].TimestampFound != w.timestamp {
+			t.Errorf("song %d = %q at %v, want %q at %v",
+				i, *songs[i].SongTitle, *songs[i].TimestampFound, w.title, w.timestamp)
+		}
+	}
+}
+
+// writeToneWAV writes a 44.1kHz stereo WAV file playing each of the given
+// tones in turn for the given duration, returning its path
+func writeToneWAV(t *testing.T, each time.Duration, tonesHz ...float64) string {
+	t.Helper()
+
+	const sampleRate = 44100
+	data := new(bytes.Buffer)
+	frames := int(each.Seconds() * sampleRate)
+	for _, hz := range tonesHz {
+		for i := 0; i < frames; i++ {
+			sample := int16(10000 * math.Sin(2*math.Pi*hz*float64(i)/sampleRate))
+			binary.Write(data, binary.LittleEndian, [2]int16{sample, sample})
+		}
+	}
+
+	wav := new(bytes.Buffer)
+	wav.WriteString("RIFF")
+	binary.Write(wav, binary.LittleEndian, uint32(36+data.Len()))
+	wav.WriteString("WAVEfmt ")
+	binary.Write(wav, binary.LittleEndian, struct {
+		Size          uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{16, 1, 2, sampleRate, sampleRate * 4, 4, 16})
+	wav.WriteString("data")
+	binary.Write(wav, binary.LittleEndian, uint32(data.Len()))
+	wav.Write(data.Bytes())
+
+	path := filepath.Join(t.TempDir(), "mix.wav")
+	if err := os.WriteFile(path, wav.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write wav: %v", err)
+	}
+	return path
+}
+
+// newToneServer returns a server that names each chunk after the frequency
+// of the loudest peak in its signature, to the nearest 100Hz, counting the
+// requests it answers
+func newToneServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var body struct {
+			Signature struct {
+				URI string `json:"uri"`
+			} `json:"signature"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sig, err := audiostream.DecodeFromURI(body.Signature.URI)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var loudest audiostream.FrequencyPeak
+		for _, peaks := range sig.FrequencyBandToSoundPeaks {
+			for _, peak := range peaks {
+				if peak.PeakMagnitude > loudest.PeakMagnitude {
+					loudest = peak
+				}
+			}
+		}
+		var resp shazam.ShazamResponse
+		if loudest.PeakMagnitude > 0 {
+			resp.Track.Title = fmt.Sprintf("Tone %.0f", math.Round(loudest.GetFrequencyHz()/100)*100)
+			resp.Track.Subtitle = "Oscillator"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIdentifyFile(t *testing.T) {
+	var requests atomic.Int32
+	server := newToneServer(t, &requests)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeToneWAV(t, 3*time.Second, 700, 700, 2000)
+
+	songs, err := IdentifyFile(context.Background(), path, Options{
+		ChunkDuration: 3 * time.Second,
+		Shazam: shazam.ShazamOptions{
+			Client: &http.Client{Transport: redirectTransport{target: target}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("IdentifyFile() error = %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("sent %d match requests, want 3", got)
+	}
+
+	want := []struct {
+		title     string
+		timestamp time.Duration
+	}{
+		{"Tone 700", 0},
+		{"Tone 2000", 6 * time.Second},
+	}
+	if len(songs) != len(want) {
+		t.Fatalf("got %d songs (%v), want %d", len(songs), songs, len(want))
+	}
+	for i, w := range want {
+		if *songs[i].SongTitle != w.title || *songs[i].TimestampFound != w.timestamp {
+			t.Errorf("song %d = %q at %v, want %q at %v",
+				i, *songs[i].SongTitle, *songs[i].TimestampFound, w.title, w.timestamp)
+		}
+	}
+}
+
+func TestIdentifyFileMP3(t *testing.T) {
+	var requests atomic.Int32
+	server := newToneServer(t, &requests)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second of a 440Hz tone then one of 880Hz, decoded in process
+	path := filepath.Join("..", "audiostream", "testdata", "tone.mp3")
+
+	songs, err := IdentifyFile(context.Background(), path, Options{
+		ChunkDuration: time.Second,
+		Shazam: shazam.ShazamOptions{
+			Client: &http.Client{Transport: redirectTransport{target: target}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("IdentifyFile() error = %v", err)
+	}
+
+	var titles []string
+	for _, found := range songs {
+		titles = append(titles, *found.SongTitle)
+	}
+	if want := []string{"Tone 400", "Tone 900"}; !slices.Equal(titles, want) {
+		t.Errorf("IdentifyFile() = %v, want %v", titles, want)
+	}
+}
+
+func TestIdentifyFileUnsupported(t *testing.T) {
+	var requests atomic.Int32
+	server := newToneServer(t, &requests)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("not audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = IdentifyFile(context.Background(), path, Options{
+		Shazam: shazam.ShazamOptions{
+			Client: &http.Client{Transport: redirectTransport{target: target}},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unsupported audio file") {
+		t.Errorf("IdentifyFile() error = %v, want unsupported audio file", err)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("sent %d match requests for a text file, want 0", got)
+	}
+}
+
+func TestIdentifyFileMissing(t *testing.T) {
+	var requests atomic.Int32
+	server := newToneServer(t, &requests)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = IdentifyFile(context.Background(), filepath.Join(t.TempDir(), "missing.wav"), Options{
+		Shazam: shazam.ShazamOptions{
+			Client: &http.Client{Transport: redirectTransport{target: target}},
+		},
+	})
+	if err == nil {
+		t.Fatal("IdentifyFile() error = nil, want error")
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("sent %d match requests for a missing file, want 0", got)
+	}
+}
@@ -0,0 +1,67 @@
+package shazam
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// responseCache is a bounded LRU cache of Shazam responses keyed by a hash of
+// the signature they were returned for
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Most recently used at the front
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// cacheEntry is the value stored in each element of responseCache.order
+type cacheEntry struct {
+	key  [sha256.Size]byte
+	resp *ShazamResponse
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// signatureKey hashes an encoded signature into a cache key
+func signatureKey(signatureURI string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(signatureURI))
+}
+
+// get returns the response cached for key, if any, marking it recently used
+func (rc *responseCache) get(key [sha256.Size]byte) (*ShazamResponse, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	rc.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).resp, true
+}
+
+// put caches resp under key, evicting the least recently used entry when full
+func (rc *responseCache) put(key [sha256.Size]byte, resp *ShazamResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[key]; ok {
+		elem.Value.(*cacheEntry).resp = resp
+		rc.order.MoveToFront(elem)
+		return
+	}
+
+	rc.entries[key] = rc.order.PushFront(&cacheEntry{key: key, resp: resp})
+	if rc.order.Len() > rc.size {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
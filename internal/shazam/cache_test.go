@@ -0,0 +1,97 @@
+package shazam
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"listr/internal/audiostream/audiostreamtest"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingServer answers every request with the same track and counts them
+func newCountingServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// toneChunk returns a one second chunk of a pure tone
+func toneChunk(hz float64, timestamp time.Duration) *audiostreamtest.StaticChunk {
+	data := make([]byte, 32000)
+	for i := 0; i < len(data)/2; i++ {
+		sample := int16(10000 * math.Sin(2*math.Pi*hz*float64(i)/16000))
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	return audiostreamtest.NewStaticChunk(data, timestamp)
+}
+
+func TestSendMatchRequestCache(t *testing.T) {
+	chunks := []*audiostreamtest.StaticChunk{
+		toneChunk(440, 0),
+		toneChunk(1000, 10*time.Second),
+		toneChunk(440, 20*time.Second), // Same audio as the first chunk
+	}
+
+	tests := []struct {
+		name         string
+		cacheSize    int
+		wantRequests int32
+	}{
+		{name: "cache off", cacheSize: 0, wantRequests: 3},
+		{name: "cache on", cacheSize: 8, wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newCountingServer(t)
+			sh := newTestHandler(server)
+			sh.SetCacheSize(tt.cacheSize)
+
+			for _, chunk := range chunks {
+				found, err := sh.SendMatchRequest(context.Background(), chunk)
+				if err != nil {
+					t.Fatalf("SendMatchRequest() error = %v", err)
+				}
+				if found == nil || *found.TimestampFound != chunk.GetTimestamp() {
+					t.Errorf("SendMatchRequest() found = %v, want Song A at %v", found, chunk.GetTimestamp())
+				}
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("server saw %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(2)
+	a, b, c := signatureKey("a"), signatureKey("b"), signatureKey("c")
+	cache.put(a, &ShazamResponse{})
+	cache.put(b, &ShazamResponse{})
+
+	// Using a makes b the least recently used
+	if _, ok := cache.get(a); !ok {
+		t.Fatal("get(a) missed")
+	}
+	cache.put(c, &ShazamResponse{})
+
+	if _, ok := cache.get(b); ok {
+		t.Error("get(b) hit after eviction")
+	}
+	for name, key := range map[string][32]byte{"a": a, "c": c} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("get(%s) missed", name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package shazam
+
+import "math"
+
+const (
+	// normalizeTarget is the sample peak normalize scales chunks to, -1dBFS
+	normalizeTarget = 0.891
+	// normalizeFloor is the quietest sample peak normalize amplifies, -60dBFS.
+	// Anything below it is silence or noise floor, not music.
+	normalizeFloor = 1e-3
+	// maxNormalizeGain caps how much normalize amplifies, 40dB
+	maxNormalizeGain = 100
+)
+
+// highPass returns the samples run through a second order Butterworth
+// high-pass filter. It removes DC offset and the rumble and bass below
+// cutoffHz, which carry no fingerprint value but are often the loudest part
+// of a track, while leaving the bands peaks are taken from nearly untouched.
+func highPass(samples []float64, sampleRate int, cutoffHz float64) []float64 {
+	w0 := 2 * math.Pi * cutoffHz / float64(sampleRate)
+	cosW0 := math.Cos(w0)
+	alpha := math.Sin(w0) / math.Sqrt2 // Q of 1/√2 keeps the passband flat
+
+	a0 := 1 + alpha
+	b0 := (1 + cosW0) / 2 / a0
+	b1 := -(1 + cosW0) / a0
+	b2 := b0
+	a1 := -2 * cosW0 / a0
+	a2 := (1 - alpha) / a0
+
+	filtered := make([]float64, len(samples))
+	var x1, x2, y1, y2 float64
+	for i, x := range samples {
+		y := b0*x + b1*x1 + b2*x2 - a1*y1 - a2*y2
+		filtered[i] = y
+		x1, x2 = x, x1
+		y1, y2 = y, y1
+	}
+	return filtered
+}
+
+// rmsDBFS returns the RMS level of the samples in decibels relative to full
+// scale, or -Inf for digital silence
+func rmsDBFS(samples []float64) float64 {
+	if len(samples) == 0 {
+		return math.Inf(-1)
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += s * s
+	}
+	return 20 * math.Log10(math.Sqrt(sum/float64(len(samples))))
+}
+
+// normalize scales the samples in place so their largest absolute value is
+// normalizeTarget, so that quiet recordings still have peaks above the
+// magnitude floor. Samples peaking below normalizeFloor are left alone, and
+// the gain is capped at maxNormalizeGain, so silence and noise aren't
+// amplified into peaks.
+func normalize(samples []float64) {
+	var peak float64
+	for _, s := range samples {
+		peak = max(peak, math.Abs(s))
+	}
+	if peak < normalizeFloor {
+		return
+	}
+	gain := min(normalizeTarget/peak, maxNormalizeGain)
+	for i := range samples {
+		samples[i] *= gain
+	}
+}
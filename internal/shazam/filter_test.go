@@ -0,0 +1,137 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+func TestHighPass(t *testing.T) {
+	tests := []struct {
+		frequency float64
+		minGain   float64
+		maxGain   float64
+	}{
+		{frequency: 0, minGain: 0, maxGain: 0.01},
+		{frequency: 50, minGain: 0, maxGain: 0.07},
+		{frequency: 100, minGain: 0, maxGain: 0.25},
+		{frequency: 250, minGain: 0.8, maxGain: 1},
+		{frequency: 1000, minGain: 0.99, maxGain: 1.01},
+		{frequency: 5000, minGain: 0.99, maxGain: 1.01},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.frequency), func(t *testing.T) {
+			samples := make([]float64, 16000)
+			for i := range samples {
+				samples[i] = math.Cos(2 * math.Pi * tt.frequency * float64(i) / 16000)
+			}
+
+			// Measure once the filter has settled
+			filtered := highPass(samples, 16000, defaultHighPassHz)
+			peak := 0.0
+			for _, sample := range filtered[8000:] {
+				peak = math.Max(peak, math.Abs(sample))
+			}
+			if peak < tt.minGain || peak > tt.maxGain {
+				t.Errorf("gain at %vHz = %.4f, want %v to %v", tt.frequency, peak, tt.minGain, tt.maxGain)
+			}
+		})
+	}
+}
+
+func TestFindFrequencyPeaksBassHeavy(t *testing.T) {
+	// A DC offset and loud hum under two quiet tones, bin centred at 500Hz
+	// and 2500Hz
+	samples := make([]float64, 16000)
+	for i := range samples {
+		ti := float64(i) / 16000
+		samples[i] = 0.3 + 0.6*math.Sin(2*math.Pi*50*ti) +
+			0.05*math.Sin(2*math.Pi*500*ti) + 0.05*math.Sin(2*math.Pi*2500*ti)
+	}
+
+	// Before filtering the bass towers over the tones, afterwards it doesn't
+	lowBin, toneBin := 3, 32 // 46.875Hz and 500Hz
+	frame := samples[8000 : 8000+windowSize]
+	for _, cutoff := range []float64{0, defaultHighPassHz} {
+		filtered := frame
+		if cutoff > 0 {
+			filtered = highPass(samples, 16000, cutoff)[8000 : 8000+windowSize]
+		}
+		powers := spectrumPowers(fft.FFTReal(applyWindow(filtered, analysisWindow)))
+		if bassDominates := powers[lowBin] > powers[toneBin]; bassDominates != (cutoff == 0) {
+			t.Errorf("cutoff %vHz: bass magnitude %.2f, tone magnitude %.2f",
+				cutoff, math.Sqrt(powers[lowBin]), math.Sqrt(powers[toneBin]))
+		}
+	}
+
+	peaks := findFrequencyPeaks(samples, 16000, peakConfig{})
+	if len(peaks) == 0 {
+		t.Fatal("findFrequencyPeaks() found no peaks")
+	}
+	for _, peak := range peaks {
+		if peak.Frequency != 500 && peak.Frequency != 2500 {
+			t.Errorf("peak at %vHz, want only the tones at 500Hz and 2500Hz", peak.Frequency)
+		}
+	}
+}
+
+func TestRMSDBFS(t *testing.T) {
+	sine := make([]float64, 16000)
+	for i := range sine {
+		sine[i] = math.Sin(2 * math.Pi * 440 * float64(i) / 16000)
+	}
+	tests := []struct {
+		name    string
+		samples []float64
+		want    float64
+	}{
+		{name: "full scale sine", samples: sine, want: -3.01},
+		{name: "full scale square", samples: []float64{1, -1, 1, -1}, want: 0},
+		{name: "tenth of full scale", samples: []float64{0.1, -0.1}, want: -20},
+		{name: "digital silence", samples: make([]float64, 100), want: math.Inf(-1)},
+		{name: "empty", samples: nil, want: math.Inf(-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rmsDBFS(tt.samples)
+			if got != tt.want && math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("rmsDBFS() = %.2f, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		peak     float64
+		wantPeak float64
+	}{
+		{name: "Quiet", peak: 0.05, wantPeak: normalizeTarget},
+		{name: "Loud", peak: 1, wantPeak: normalizeTarget},
+		{name: "Gain capped", peak: 0.002, wantPeak: 0.2},
+		{name: "Below floor", peak: 0.0005, wantPeak: 0.0005},
+		{name: "Silence", peak: 0, wantPeak: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := make([]float64, 1000)
+			for i := range samples {
+				samples[i] = tt.peak * math.Sin(2*math.Pi*float64(i)/100)
+			}
+			normalize(samples)
+
+			peak := 0.0
+			for _, s := range samples {
+				peak = math.Max(peak, math.Abs(s))
+			}
+			if math.Abs(peak-tt.wantPeak) > 1e-9 {
+				t.Errorf("peak after normalize = %v, want %v", peak, tt.wantPeak)
+			}
+		})
+	}
+}
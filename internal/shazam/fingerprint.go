@@ -0,0 +1,75 @@
+package shazam
+
+import (
+	"fmt"
+	"listr/internal/audiostream"
+)
+
+// FingerprintOption tunes how FingerprintSamples picks peaks
+type FingerprintOption func(*peakConfig)
+
+// PeakThreshold is SetPeakThreshold for FingerprintSamples
+func PeakThreshold(factor float64) FingerprintOption {
+	return func(cfg *peakConfig) { cfg.thresholdFactor = factor }
+}
+
+// PeakLimits is SetPeakLimits for FingerprintSamples
+func PeakLimits(perFrame, perBand int) FingerprintOption {
+	return func(cfg *peakConfig) {
+		cfg.maxPerFrame = perFrame
+		cfg.maxPerBand = perBand
+	}
+}
+
+// PeakSeparation is SetPeakSeparation for FingerprintSamples
+func PeakSeparation(bins int) FingerprintOption {
+	return func(cfg *peakConfig) { cfg.minSeparation = bins }
+}
+
+// PeakFloor is SetPeakFloor for FingerprintSamples
+func PeakFloor(dBFS float64) FingerprintOption {
+	return func(cfg *peakConfig) { cfg.floorDBFS = dBFS }
+}
+
+// HighPassCutoff is SetHighPass for FingerprintSamples
+func HighPassCutoff(cutoffHz float64) FingerprintOption {
+	return func(cfg *peakConfig) { cfg.highPassHz = cutoffHz }
+}
+
+// FingerprintSamples builds the signature of mono samples in [-1, 1] at
+// sampleRate Hz: the spectral peaks of each frame, quantized as a signature
+// stores them and grouped by frequency band. The signature's StreamOffset is
+// left zero.
+func FingerprintSamples(samples []float64, sampleRate int, opts ...FingerprintOption) (*audiostream.DecodedMessage, error) {
+	var cfg peakConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return fingerprint(samples, sampleRate, cfg)
+}
+
+// fingerprint is FingerprintSamples with the peak settings given
+func fingerprint(samples []float64, sampleRate int, cfg peakConfig) (*audiostream.DecodedMessage, error) {
+	if !audiostream.IsSupportedSampleRate(sampleRate) {
+		return nil, fmt.Errorf("%w: %d", audiostream.ErrUnsupportedSampleRate, sampleRate)
+	}
+
+	signature := &audiostream.DecodedMessage{
+		SampleRateHz:              sampleRate,
+		NumberSamples:             len(samples),
+		FrequencyBandToSoundPeaks: make(map[audiostream.FrequencyBand][]audiostream.FrequencyPeak),
+	}
+	for _, peak := range findFrequencyPeaks(samples, sampleRate, cfg) {
+		band := getFrequencyBand(peak.Frequency)
+		signature.FrequencyBandToSoundPeaks[band] = append(
+			signature.FrequencyBandToSoundPeaks[band],
+			audiostream.FrequencyPeak{
+				FFTPassNumber:             peak.TimeIndex,
+				PeakMagnitude:             peak.Magnitude,
+				CorrectedPeakFrequencyBin: peak.correctedBin(),
+				SampleRateHz:              sampleRate,
+			},
+		)
+	}
+	return signature, nil
+}
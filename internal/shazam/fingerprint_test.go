@@ -0,0 +1,101 @@
+package shazam
+
+import (
+	"errors"
+	"listr/internal/audiostream"
+	"math"
+	"slices"
+	"testing"
+)
+
+// tones returns a second of the given tones at 16kHz, each at half scale
+// divided between them
+func tones(hz ...float64) []float64 {
+	samples := make([]float64, 16000)
+	for i := range samples {
+		for _, f := range hz {
+			samples[i] += 0.5 / float64(len(hz)) * math.Sin(2*math.Pi*f*float64(i)/16000)
+		}
+	}
+	return samples
+}
+
+func TestFingerprintSamples(t *testing.T) {
+	tests := []struct {
+		name      string
+		hz        []float64
+		wantBands []audiostream.FrequencyBand
+	}{
+		{name: "Low", hz: []float64{500}, wantBands: []audiostream.FrequencyBand{audiostream.LowBand}},
+		{name: "Mid", hz: []float64{1000}, wantBands: []audiostream.FrequencyBand{audiostream.MidBand}},
+		{name: "High", hz: []float64{2500}, wantBands: []audiostream.FrequencyBand{audiostream.HighBand}},
+		{name: "Very high", hz: []float64{4000}, wantBands: []audiostream.FrequencyBand{audiostream.VeryHighBand}},
+		{name: "Chord", hz: []float64{500, 2500}, wantBands: []audiostream.FrequencyBand{audiostream.LowBand, audiostream.HighBand}},
+		{name: "Out of band", hz: []float64{7000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := tones(tt.hz...)
+			signature, err := FingerprintSamples(samples, 16000)
+			if err != nil {
+				t.Fatalf("FingerprintSamples() error = %v", err)
+			}
+			if signature.SampleRateHz != 16000 || signature.NumberSamples != len(samples) {
+				t.Errorf("signature of %d samples at %dHz, want %d at 16000Hz",
+					signature.NumberSamples, signature.SampleRateHz, len(samples))
+			}
+
+			var bands []audiostream.FrequencyBand
+			for band, peaks := range signature.FrequencyBandToSoundPeaks {
+				bands = append(bands, band)
+				for _, peak := range peaks {
+					if !slices.Contains(tt.hz, peak.GetFrequencyHz()) {
+						t.Errorf("%v band peak at %vHz, want one of %v", band, peak.GetFrequencyHz(), tt.hz)
+					}
+				}
+			}
+			slices.Sort(bands)
+			if !slices.Equal(bands, tt.wantBands) {
+				t.Errorf("bands = %v, want %v", bands, tt.wantBands)
+			}
+		})
+	}
+}
+
+func TestFingerprintSamplesOptions(t *testing.T) {
+	samples := tones(500, 1000, 2500)
+	all, err := FingerprintSamples(samples, 16000)
+	if err != nil {
+		t.Fatalf("FingerprintSamples() error = %v", err)
+	}
+	limited, err := FingerprintSamples(samples, 16000, PeakLimits(1, 1))
+	if err != nil {
+		t.Fatalf("FingerprintSamples() error = %v", err)
+	}
+	if passes := (len(samples)-windowSize)/hopSize + 1; limited.TotalPeaks() != passes || all.TotalPeaks() <= passes {
+		t.Errorf("peaks = %d limited to one a frame and %d without, want %d and more", limited.TotalPeaks(), all.TotalPeaks(), passes)
+	}
+
+	// The signature matches what the handler would send with the same settings
+	sh := &ShazamHandler{}
+	sh.SetPeakThreshold(4)
+	sh.SetHighPass(-1)
+	want, err := fingerprint(samples, 16000, sh.peaks)
+	if err != nil {
+		t.Fatalf("fingerprint() error = %v", err)
+	}
+	got, err := FingerprintSamples(samples, 16000, PeakThreshold(4), HighPassCutoff(-1))
+	if err != nil {
+		t.Fatalf("FingerprintSamples() error = %v", err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("FingerprintSamples() = %v, want %v", got, want)
+	}
+}
+
+func TestFingerprintSamplesUnsupportedRate(t *testing.T) {
+	if _, err := FingerprintSamples(tones(1000), 22050); !errors.Is(err, audiostream.ErrUnsupportedSampleRate) {
+		t.Errorf("FingerprintSamples() error = %v, want ErrUnsupportedSampleRate", err)
+	}
+}
@@ -0,0 +1,280 @@
+package shazam
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Option configures a handler made by NewShazamHandler
+type Option func(*handlerOptions) error
+
+// handlerOptions collects the options passed to NewShazamHandler: the
+// endpoint the handler is initialised for and the settings applied after
+type handlerOptions struct {
+	endpoint ShazamOptions
+	settings []func(*ShazamHandler)
+}
+
+// set records a setting to apply once the handler is initialised
+func (ho *handlerOptions) set(setting func(*ShazamHandler)) error {
+	ho.settings = append(ho.settings, setting)
+	return nil
+}
+
+// NewShazamHandler returns a handler ready to match, configured by opts in
+// order, so a later option overrides an earlier one. Without options it is
+// the same as a handler set up by Init.
+func NewShazamHandler(opts ...Option) (*ShazamHandler, error) {
+	var ho handlerOptions
+	for _, opt := range opts {
+		if err := opt(&ho); err != nil {
+			return nil, err
+		}
+	}
+
+	sh := &ShazamHandler{}
+	if err := sh.InitWithOptions(ho.endpoint); err != nil {
+		return nil, err
+	}
+	for _, setting := range ho.settings {
+		setting(sh)
+	}
+	return sh, nil
+}
+
+// WithOptions sets the endpoint and client from opts, replacing any set by
+// earlier options
+func WithOptions(opts ShazamOptions) Option {
+	return func(ho *handlerOptions) error {
+		ho.endpoint = opts
+		return nil
+	}
+}
+
+// WithHTTPClient sends requests with client
+func WithHTTPClient(client *http.Client) Option {
+	return func(ho *handlerOptions) error {
+		ho.endpoint.Client = client
+		return nil
+	}
+}
+
+// WithRegion sets the language of the metadata returned and the country of
+// the endpoint, such as "fr" and "FR"
+func WithRegion(language, country string) Option {
+	return func(ho *handlerOptions) error {
+		if language == "" || country == "" {
+			return fmt.Errorf("region needs a language and a country, got %q and %q", language, country)
+		}
+		ho.endpoint.Language = language
+		ho.endpoint.Country = country
+		return nil
+	}
+}
+
+// WithDevice sets the device requests claim to come from
+func WithDevice(device string) Option {
+	return func(ho *handlerOptions) error {
+		ho.endpoint.Device = device
+		return nil
+	}
+}
+
+// WithHeaders sends headers with every request, see ShazamOptions.Headers
+func WithHeaders(headers http.Header) Option {
+	return func(ho *handlerOptions) error {
+		ho.endpoint.Headers = headers
+		return nil
+	}
+}
+
+// WithEndpoints sets the templates of the endpoints requests are sent to, see
+// ShazamOptions.Endpoints
+func WithEndpoints(templates ...string) Option {
+	return func(ho *handlerOptions) error {
+		if len(templates) == 0 {
+			return fmt.Errorf("at least one endpoint is needed")
+		}
+		ho.endpoint.Endpoints = templates
+		return nil
+	}
+}
+
+// WithUUIDs puts first and second in the request path in place of random
+// UUIDs, so requests are reproducible
+func WithUUIDs(first, second uuid.UUID) Option {
+	return func(ho *handlerOptions) error {
+		ids := [2]uuid.UUID{first, second}
+		next := 0
+		ho.endpoint.NewUUID = func() uuid.UUID {
+			id := ids[next%len(ids)]
+			next++
+			return id
+		}
+		return nil
+	}
+}
+
+// WithRetries is SetRetries as an option
+func WithRetries(maxAttempts int, baseDelay time.Duration) Option {
+	return func(ho *handlerOptions) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("at least one attempt is needed, got %d", maxAttempts)
+		}
+		return ho.set(func(sh *ShazamHandler) { sh.SetRetries(maxAttempts, baseDelay) })
+	}
+}
+
+// WithRequestTimeout is SetRequestTimeout as an option
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetRequestTimeout(timeout) })
+	}
+}
+
+// WithSampleRate is SetSampleRate as an option
+func WithSampleRate(hz int) Option {
+	return func(ho *handlerOptions) error {
+		if err := checkSampleRate(hz); err != nil {
+			return err
+		}
+		return ho.set(func(sh *ShazamHandler) { sh.sampleRate = hz })
+	}
+}
+
+// WithDedupWindow is SetDedupWindow as an option
+func WithDedupWindow(window time.Duration) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetDedupWindow(window) })
+	}
+}
+
+// WithPeakThreshold is SetPeakThreshold as an option
+func WithPeakThreshold(factor float64) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetPeakThreshold(factor) })
+	}
+}
+
+// WithPeakLimits is SetPeakLimits as an option
+func WithPeakLimits(perFrame, perBand int) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetPeakLimits(perFrame, perBand) })
+	}
+}
+
+// WithPeakSeparation is SetPeakSeparation as an option
+func WithPeakSeparation(bins int) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetPeakSeparation(bins) })
+	}
+}
+
+// WithPeakFloor is SetPeakFloor as an option
+func WithPeakFloor(dBFS float64) Option {
+	return func(ho *handlerOptions) error {
+		if dBFS > 0 {
+			return fmt.Errorf("peak floor must not be above full scale, got %vdBFS", dBFS)
+		}
+		return ho.set(func(sh *ShazamHandler) { sh.SetPeakFloor(dBFS) })
+	}
+}
+
+// WithHighPass is SetHighPass as an option
+func WithHighPass(cutoffHz float64) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetHighPass(cutoffHz) })
+	}
+}
+
+// WithMinConfidence is SetMinConfidence as an option
+func WithMinConfidence(min float64) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetMinConfidence(min) })
+	}
+}
+
+// WithSilenceThreshold is SetSilenceThreshold as an option
+func WithSilenceThreshold(dBFS float64) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetSilenceThreshold(dBFS) })
+	}
+}
+
+// WithNormalize is SetNormalize as an option
+func WithNormalize(enable bool) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetNormalize(enable) })
+	}
+}
+
+// WithKeepRawResponse is SetKeepRawResponse as an option
+func WithKeepRawResponse(keep bool) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetKeepRawResponse(keep) })
+	}
+}
+
+// WithAdaptiveChunks is SetAdaptiveChunks as an option
+func WithAdaptiveChunks(min, max time.Duration) Option {
+	return func(ho *handlerOptions) error {
+		adaptive, err := newAdaptiveChunks(min, max)
+		if err != nil {
+			return err
+		}
+		return ho.set(func(sh *ShazamHandler) { sh.adaptive = adaptive })
+	}
+}
+
+// WithMissRetry is SetMissRetry as an option
+func WithMissRetry(widen time.Duration) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetMissRetry(widen) })
+	}
+}
+
+// WithConcurrency is SetConcurrency as an option
+func WithConcurrency(n int) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetConcurrency(n) })
+	}
+}
+
+// WithCacheSize is SetCacheSize as an option
+func WithCacheSize(size int) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetCacheSize(size) })
+	}
+}
+
+// WithSignatureDumpDir is SetSignatureDumpDir as an option
+func WithSignatureDumpDir(dir string) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetSignatureDumpDir(dir) })
+	}
+}
+
+// WithChunkDumpDir is SetChunkDumpDir as an option
+func WithChunkDumpDir(dir string) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetChunkDumpDir(dir) })
+	}
+}
+
+// WithProgress is SetProgress as an option
+func WithProgress(progress ProgressFunc) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetProgress(progress) })
+	}
+}
+
+// WithLogger is SetLogger as an option
+func WithLogger(logger *slog.Logger) Option {
+	return func(ho *handlerOptions) error {
+		return ho.set(func(sh *ShazamHandler) { sh.SetLogger(logger) })
+	}
+}
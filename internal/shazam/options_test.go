@@ -0,0 +1,265 @@
+package shazam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"listr/internal/audiostream"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNewShazamHandlerDefaults(t *testing.T) {
+	sh, err := NewShazamHandler()
+	if err != nil {
+		t.Fatalf("NewShazamHandler() error = %v", err)
+	}
+	want := &ShazamHandler{}
+	want.Init()
+
+	if !strings.HasPrefix(sh.requestURLs[0], "https://amp.shazam.com/discovery/v5/en/US/desktop_mac/-/tag/") {
+		t.Errorf("request URL = %q, want the default endpoint", sh.requestURLs[0])
+	}
+	if sh.client.Timeout != want.client.Timeout {
+		t.Errorf("client timeout = %v, want %v", sh.client.Timeout, want.client.Timeout)
+	}
+	if sh.maxAttempts != want.maxAttempts || sh.retryBaseDelay != want.retryBaseDelay {
+		t.Errorf("retries = %d every %v, want %d every %v",
+			sh.maxAttempts, sh.retryBaseDelay, want.maxAttempts, want.retryBaseDelay)
+	}
+	if sh.concurrency != want.concurrency || sh.requestTimeout != want.requestTimeout || sh.sampleRate != 0 {
+		t.Errorf("handler = %+v, want %+v", sh, want)
+	}
+	if sh.finds == nil || len(*sh.finds) != 0 {
+		t.Error("finds not initialized empty")
+	}
+}
+
+func TestNewShazamHandlerOptions(t *testing.T) {
+	client := &http.Client{Timeout: time.Second}
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantPrefix string
+		check      func(t *testing.T, sh *ShazamHandler)
+	}{
+		{
+			name:       "Region and device",
+			opts:       []Option{WithRegion("fr", "FR"), WithDevice("iphone")},
+			wantPrefix: "/discovery/v5/fr/FR/iphone/-/tag/",
+		},
+		{
+			name:       "Later options override earlier",
+			opts:       []Option{WithRegion("fr", "FR"), WithRetries(5, time.Second), WithRegion("de", "DE"), WithRetries(2, time.Millisecond)},
+			wantPrefix: "/discovery/v5/de/DE/desktop_mac/-/tag/",
+			check: func(t *testing.T, sh *ShazamHandler) {
+				if sh.maxAttempts != 2 || sh.retryBaseDelay != time.Millisecond {
+					t.Errorf("retries = %d every %v, want 2 every 1ms", sh.maxAttempts, sh.retryBaseDelay)
+				}
+			},
+		},
+		{
+			name:       "WithOptions then client",
+			opts:       []Option{WithOptions(ShazamOptions{Language: "es", Country: "ES"}), WithHTTPClient(client)},
+			wantPrefix: "/discovery/v5/es/ES/desktop_mac/-/tag/",
+			check: func(t *testing.T, sh *ShazamHandler) {
+				if sh.client != client {
+					t.Error("handler does not use the client given")
+				}
+			},
+		},
+		{
+			name: "Settings",
+			opts: []Option{
+				WithRequestTimeout(3 * time.Second),
+				WithSampleRate(44100),
+				WithPeakThreshold(4),
+				WithPeakLimits(3, 1),
+				WithPeakFloor(-60),
+				WithPeakSeparation(5),
+				WithMinConfidence(0.5),
+				WithSilenceThreshold(-50),
+				WithConcurrency(4),
+				WithCacheSize(8),
+				WithHighPass(300),
+				WithKeepRawResponse(true),
+				WithDedupWindow(time.Minute),
+			},
+			wantPrefix: "/discovery/v5/en/US/desktop_mac/-/tag/",
+			check: func(t *testing.T, sh *ShazamHandler) {
+				if sh.requestTimeout != 3*time.Second {
+					t.Errorf("request timeout = %v, want 3s", sh.requestTimeout)
+				}
+				if sh.sampleRate != 44100 {
+					t.Errorf("sample rate = %d, want 44100", sh.sampleRate)
+				}
+				if sh.peaks.thresholdFactor != 4 || sh.peaks.maxPerFrame != 3 || sh.peaks.maxPerBand != 1 {
+					t.Errorf("peaks = %+v, want threshold 4 and limits 3 and 1", sh.peaks)
+				}
+				if sh.peaks.floorDBFS != -60 || sh.peaks.minSeparation != 5 {
+					t.Errorf("peaks = %+v, want floor -60dBFS and separation 5", sh.peaks)
+				}
+				if sh.minConfidence != 0.5 || sh.silenceDBFS != -50 || sh.concurrency != 4 {
+					t.Errorf("handler = %+v", sh)
+				}
+				if sh.cache == nil {
+					t.Error("cache not enabled")
+				}
+				if sh.peaks.highPassHz != 300 || !sh.keepRaw || sh.dedupWindow != time.Minute {
+					t.Errorf("high-pass = %vHz, keep raw = %v, dedup window = %v, want 300Hz, true and 1m",
+						sh.peaks.highPassHz, sh.keepRaw, sh.dedupWindow)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh, err := NewShazamHandler(tt.opts...)
+			if err != nil {
+				t.Fatalf("NewShazamHandler() error = %v", err)
+			}
+			requestURL, err := url.Parse(sh.requestURLs[0])
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			if !strings.HasPrefix(requestURL.Path, tt.wantPrefix) {
+				t.Errorf("request path = %q, want prefix %q", requestURL.Path, tt.wantPrefix)
+			}
+			if tt.check != nil {
+				tt.check(t, sh)
+			}
+		})
+	}
+}
+
+func TestNewShazamHandlerInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     Option
+		wantErr error
+	}{
+		{"No attempts", WithRetries(0, time.Second), nil},
+		{"Missing country", WithRegion("en", ""), nil},
+		{"Unsupported sample rate", WithSampleRate(22050), audiostream.ErrUnsupportedSampleRate},
+		{"No endpoints", WithEndpoints(), nil},
+		{"Peak floor above full scale", WithPeakFloor(3), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh, err := NewShazamHandler(tt.opt)
+			if err == nil {
+				t.Fatal("NewShazamHandler() error = nil, want error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewShazamHandler() error = %v, want %v", err, tt.wantErr)
+			}
+			if sh != nil {
+				t.Error("NewShazamHandler() returned a handler with its error")
+			}
+		})
+	}
+}
+
+func TestSetSampleRate(t *testing.T) {
+	sh := &ShazamHandler{}
+	if err := sh.SetSampleRate(32000); err != nil || sh.sampleRate != 32000 {
+		t.Errorf("SetSampleRate(32000) = %v, rate %d, want nil and 32000", err, sh.sampleRate)
+	}
+	if err := sh.SetSampleRate(22050); !errors.Is(err, audiostream.ErrUnsupportedSampleRate) {
+		t.Errorf("SetSampleRate(22050) error = %v, want ErrUnsupportedSampleRate", err)
+	}
+	if sh.sampleRate != 32000 {
+		t.Errorf("rate = %d after a rejected rate, want 32000 kept", sh.sampleRate)
+	}
+	if err := sh.SetSampleRate(0); err != nil || sh.sampleRate != 0 {
+		t.Errorf("SetSampleRate(0) = %v, rate %d, want the default restored", err, sh.sampleRate)
+	}
+}
+
+func TestWithSampleRate(t *testing.T) {
+	var body struct {
+		SampleMS  int `json:"samplems"`
+		Signature struct {
+			URI string `json:"uri"`
+		} `json:"signature"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(ShazamResponse{})
+	}))
+	defer server.Close()
+
+	sh, err := NewShazamHandler(WithSampleRate(8000))
+	if err != nil {
+		t.Fatalf("NewShazamHandler() error = %v", err)
+	}
+	requestURL := server.URL + "/tag"
+	sh.requestURLs = []string{requestURL}
+
+	// 16000 samples from a chunk that doesn't report its rate, so two seconds
+	if _, err := sh.SendMatchRequest(context.Background(), toneChunk(1000, 0)); err != nil {
+		t.Fatalf("SendMatchRequest() error = %v", err)
+	}
+	if body.SampleMS != 2000 {
+		t.Errorf("samplems = %d, want 2000", body.SampleMS)
+	}
+	signature, err := audiostream.DecodeFromURI(body.Signature.URI)
+	if err != nil {
+		t.Fatalf("DecodeFromURI() error = %v", err)
+	}
+	if signature.SampleRateHz != 8000 {
+		t.Errorf("signature SampleRateHz = %d, want 8000", signature.SampleRateHz)
+	}
+}
+
+// redirectTransport sends every request to a test server instead
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithUUIDs(t *testing.T) {
+	first := uuid.MustParse("6b3e4bb0-5c5a-4b4c-9a55-5a3ef5f4c1e2")
+	second := uuid.MustParse("0f1e2d3c-4b5a-4968-8776-655443322110")
+
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewEncoder(w).Encode(ShazamResponse{})
+	}))
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh, err := NewShazamHandler(
+		WithUUIDs(first, second),
+		WithHTTPClient(&http.Client{Transport: redirectTransport{target: target}}),
+	)
+	if err != nil {
+		t.Fatalf("NewShazamHandler() error = %v", err)
+	}
+	if _, err := sh.SendMatchRequest(context.Background(), testChunk()); err != nil {
+		t.Fatalf("SendMatchRequest() error = %v", err)
+	}
+
+	want := "/discovery/v5/en/US/desktop_mac/-/tag/" + first.String() + "/" + second.String()
+	if path != want {
+		t.Errorf("request path = %q, want %q", path, want)
+	}
+}
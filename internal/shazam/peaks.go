@@ -0,0 +1,297 @@
+package shazam
+
+import (
+	"cmp"
+	"listr/internal/audiostream"
+	"math"
+	"slices"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+const (
+	windowSize   = 1024 // Samples in each FFT frame
+	hopSize      = 128  // Samples between the starts of consecutive frames
+	minMagnitude = 1e-3 // Floor under the peak threshold so near silence yields no peaks, about -108dBFS
+	// fullScaleMagnitude is the FFT magnitude of a full scale sine centred on
+	// a bin of a Hann windowed frame, the 0dBFS level of the peak floor
+	fullScaleMagnitude = windowSize / 4
+
+	// defaultPeakThreshold is how many times louder than its frame's median
+	// bin a peak must be unless configured otherwise
+	defaultPeakThreshold = 10
+	// defaultMaxPeaksPerFrame and defaultMaxPeaksPerBand cap how many peaks
+	// each frame contributes, as Shazam only keeps the most prominent ones
+	defaultMaxPeaksPerFrame = 5
+	defaultMaxPeaksPerBand  = 2
+	// defaultMinPeakSeparation is how many bins apart peaks kept from one
+	// frame must be, so a broad peak with a ripple on top counts once
+	defaultMinPeakSeparation = 3
+	// defaultHighPassHz is the cutoff of the filter removing DC and low bass
+	// before analysis, set below the lowest band's 250Hz edge
+	defaultHighPassHz = 200
+)
+
+// peakConfig tunes how peaks are picked out of each frame's spectrum. The
+// zero value uses the defaults.
+type peakConfig struct {
+	thresholdFactor float64 // Multiple of the frame's median magnitude a peak must exceed
+	maxPerFrame     int     // Most peaks kept from one frame
+	maxPerBand      int     // Most peaks kept from one frequency band of a frame
+	highPassHz      float64 // Cutoff of the high-pass filter, negative to turn it off
+	floorDBFS       float64 // Level in dBFS a peak must exceed whatever its frame holds, 0 for the default
+	minSeparation   int     // Fewest bins between peaks kept from one frame, below 2 to not limit it
+}
+
+// separation returns the fewest bins apart peaks kept from one frame must be
+func (pc peakConfig) separation() int {
+	if pc.minSeparation == 0 {
+		return defaultMinPeakSeparation
+	}
+	return pc.minSeparation
+}
+
+// floor returns the magnitude a peak must exceed whatever the rest of its
+// frame holds
+func (pc peakConfig) floor() float64 {
+	if pc.floorDBFS >= 0 {
+		return minMagnitude
+	}
+	return dBFSToMagnitude(pc.floorDBFS)
+}
+
+// dBFSToMagnitude converts the level of a sine in dBFS to the FFT magnitude
+// of the bin it is centred on
+func dBFSToMagnitude(dBFS float64) float64 {
+	return fullScaleMagnitude * math.Pow(10, dBFS/20)
+}
+
+// highPassCutoff returns the cutoff of the high-pass filter applied before
+// analysis, or 0 if there is none
+func (pc peakConfig) highPassCutoff() float64 {
+	if pc.highPassHz < 0 {
+		return 0
+	}
+	return cmp.Or(pc.highPassHz, defaultHighPassHz)
+}
+
+// threshold returns the power a peak must exceed in a frame with the given
+// bin powers, the square of the magnitude threshold. Scaling it with the
+// frame keeps the peaks found the same however loud the recording is.
+func (pc peakConfig) threshold(powers []float64) float64 {
+	factor := pc.thresholdFactor
+	if factor <= 0 {
+		factor = defaultPeakThreshold
+	}
+	sorted := slices.Clone(powers)
+	slices.Sort(sorted)
+	floor := pc.floor()
+	return max(sorted[len(sorted)/2]*factor*factor, floor*floor)
+}
+
+// analysisWindow is the Hann window applied to every frame
+var analysisWindow = hannWindow(windowSize)
+
+// Peak represents a frequency peak in the audio
+type Peak struct {
+	Frequency    float64 // Centre frequency of the peak's bin in Hz
+	FrequencyBin int     // Index of the peak's bin in a windowSize point FFT
+	Magnitude    int     // Encoded as a signature stores it, see quantizeMagnitude
+	TimeIndex    int     // FFT pass, i.e. the frame the peak was found in
+}
+
+// shazamFFTSize is the FFT length Shazam signatures count frequency bins in
+const shazamFFTSize = 2048
+
+// correctedBin returns the peak's frequency in the units of a signature's
+// CorrectedPeakFrequencyBin, which are 64ths of a shazamFFTSize point FFT bin
+func (p Peak) correctedBin() int {
+	return p.FrequencyBin * 64 * shazamFFTSize / windowSize
+}
+
+// binFrequency returns the centre frequency of an FFT bin in Hz
+func binFrequency(bin, sampleRate int) float64 {
+	return float64(bin) * float64(sampleRate) / windowSize
+}
+
+// findFrequencyPeaks high-pass filters the audio, then slides a windowed frame
+// of windowSize samples across it in steps of hopSize, and returns the local
+// maxima of each frame's spectrum that stand out above the frame's threshold,
+// in frame order
+func findFrequencyPeaks(samples []float64, sampleRate int, cfg peakConfig) []Peak {
+	if cutoff := cfg.highPassCutoff(); cutoff > 0 {
+		samples = highPass(samples, sampleRate, cutoff)
+	}
+	return findPeaksWithWindow(samples, sampleRate, cfg, analysisWindow)
+}
+
+// findPeaksWithWindow is findFrequencyPeaks with the frame window given
+func findPeaksWithWindow(samples []float64, sampleRate int, cfg peakConfig, window []float64) []Peak {
+	peaks := make([]Peak, 0)
+
+	for pass := 0; pass*hopSize+windowSize <= len(samples); pass++ {
+		start := pass * hopSize
+		frame := applyWindow(samples[start:start+windowSize], window)
+		peaks = append(peaks, cfg.framePeaks(fft.FFTReal(frame), pass, sampleRate)...)
+	}
+
+	return peaks
+}
+
+// framePeaks returns the peaks kept from the spectrum of one frame. Squared
+// magnitudes order the same way as magnitudes, so they are compared instead
+// and only the peaks kept have their square root taken.
+func (pc peakConfig) framePeaks(fftResult []complex128, pass, sampleRate int) []Peak {
+	powers := spectrumPowers(fftResult)
+	threshold := pc.threshold(powers)
+
+	// Find local maxima within the bands Shazam uses
+	var candidates []peakCandidate
+	for i := 1; i < len(powers)-1; i++ {
+		if powers[i] > threshold &&
+			powers[i] > powers[i-1] &&
+			powers[i] > powers[i+1] &&
+			getFrequencyBand(binFrequency(i, sampleRate)) != skipBand {
+			candidates = append(candidates, peakCandidate{
+				Peak: Peak{
+					Frequency:    binFrequency(i, sampleRate),
+					FrequencyBin: i,
+					TimeIndex:    pass,
+				},
+				power: powers[i],
+			})
+		}
+	}
+	return pc.strongest(candidates)
+}
+
+// peakCandidate is a local maximum along with its exact power for ranking
+type peakCandidate struct {
+	Peak
+	power float64 // Squared magnitude of the peak's bin
+}
+
+// strongest keeps the loudest candidates of a frame, at most maxPerBand from
+// any one band and maxPerFrame in all, returned in frequency order with their
+// magnitudes set. A candidate closer than the minimum separation to a louder
+// one kept is dropped as part of the same peak. Equally loud candidates are
+// ranked by frequency so the choice is deterministic.
+func (pc peakConfig) strongest(candidates []peakCandidate) []Peak {
+	slices.SortStableFunc(candidates, func(a, b peakCandidate) int {
+		return cmp.Or(cmp.Compare(b.power, a.power), cmp.Compare(a.FrequencyBin, b.FrequencyBin))
+	})
+
+	maxPerFrame := cmp.Or(pc.maxPerFrame, defaultMaxPeaksPerFrame)
+	maxPerBand := cmp.Or(pc.maxPerBand, defaultMaxPeaksPerBand)
+	separation := pc.separation()
+	perBand := make(map[audiostream.FrequencyBand]int)
+	var kept []Peak
+	for _, candidate := range candidates {
+		if len(kept) == maxPerFrame {
+			break
+		}
+		band := getFrequencyBand(candidate.Frequency)
+		if perBand[band] == maxPerBand || tooClose(kept, candidate.FrequencyBin, separation) {
+			continue
+		}
+		perBand[band]++
+		candidate.Magnitude = quantizeMagnitude(math.Sqrt(candidate.power))
+		kept = append(kept, candidate.Peak)
+	}
+
+	slices.SortFunc(kept, func(a, b Peak) int {
+		return cmp.Compare(a.FrequencyBin, b.FrequencyBin)
+	})
+	return kept
+}
+
+// tooClose reports whether bin is within separation bins of a peak kept
+func tooClose(kept []Peak, bin, separation int) bool {
+	for _, peak := range kept {
+		if distance := peak.FrequencyBin - bin; distance < separation && -distance < separation {
+			return true
+		}
+	}
+	return false
+}
+
+// quantizeMagnitude converts the magnitude of a bin of a windowSize point FFT
+// of samples normalised to [-1, 1] into the log scale signatures store. The
+// samples are scaled back to 16-bit PCM and the magnitude to the amplitude
+// GetAmplitudePCM reports.
+func quantizeMagnitude(fftMagnitude float64) int {
+	return audiostream.EncodePeakMagnitude(fftMagnitude * 32768 / (windowSize * math.Sqrt2))
+}
+
+// spectrumPowers returns the squared magnitudes of the non-negative frequency
+// bins of a real signal's FFT
+func spectrumPowers(fftResult []complex128) []float64 {
+	powers := make([]float64, len(fftResult)/2+1)
+	for i := range powers {
+		c := fftResult[i]
+		powers[i] = real(c)*real(c) + imag(c)*imag(c)
+	}
+	return powers
+}
+
+// skipBand is returned by getFrequencyBand for frequencies outside every
+// band, whose peaks are left out of the signature
+const skipBand audiostream.FrequencyBand = -1
+
+// getFrequencyBand determines which frequency band a peak belongs to, using
+// Shazam's split of 250-520Hz, 520-1450Hz, 1450-3500Hz and 3500-5500Hz.
+// Anything outside that range returns skipBand.
+func getFrequencyBand(frequency float64) audiostream.FrequencyBand {
+	switch {
+	case frequency < 250:
+		return skipBand
+	case frequency < 520:
+		return audiostream.LowBand
+	case frequency < 1450:
+		return audiostream.MidBand
+	case frequency < 3500:
+		return audiostream.HighBand
+	case frequency < 5500:
+		return audiostream.VeryHighBand
+	default:
+		return skipBand
+	}
+}
+
+// PeakStats summarises a set of peaks, to see why a chunk yields too few or
+// too many
+type PeakStats struct {
+	Count         int
+	MinMagnitude  int
+	MaxMagnitude  int
+	MeanMagnitude float64
+	// BandCounts is the number of peaks in each band. Peaks outside every
+	// band are in Count but not here.
+	BandCounts map[audiostream.FrequencyBand]int
+}
+
+// SummarizePeaks returns the count, magnitude range and band spread of peaks.
+// The magnitudes are zero when there are no peaks.
+func SummarizePeaks(peaks []Peak) PeakStats {
+	stats := PeakStats{
+		Count:      len(peaks),
+		BandCounts: make(map[audiostream.FrequencyBand]int),
+	}
+	if len(peaks) == 0 {
+		return stats
+	}
+
+	stats.MinMagnitude = peaks[0].Magnitude
+	stats.MaxMagnitude = peaks[0].Magnitude
+	var sum float64
+	for _, peak := range peaks {
+		stats.MinMagnitude = min(stats.MinMagnitude, peak.Magnitude)
+		stats.MaxMagnitude = max(stats.MaxMagnitude, peak.Magnitude)
+		sum += float64(peak.Magnitude)
+		if band := getFrequencyBand(peak.Frequency); band != skipBand {
+			stats.BandCounts[band]++
+		}
+	}
+	stats.MeanMagnitude = sum / float64(len(peaks))
+	return stats
+}
@@ -0,0 +1,531 @@
+package shazam
+
+import (
+	"cmp"
+	"fmt"
+	"listr/internal/audiostream"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+func TestFindFrequencyPeaksChirp(t *testing.T) {
+	// A linear chirp sweeping from 300Hz to 3000Hz over one second
+	const (
+		sampleRate = 16000
+		startHz    = 300.0
+		endHz      = 3000.0
+	)
+	samples := make([]float64, sampleRate)
+	for i := range samples {
+		tm := float64(i) / sampleRate
+		phase := 2 * math.Pi * (startHz*tm + (endHz-startHz)*tm*tm/2)
+		samples[i] = 0.5 * math.Sin(phase)
+	}
+
+	peaks := findFrequencyPeaks(samples, sampleRate, peakConfig{})
+	if len(peaks) == 0 {
+		t.Fatal("findFrequencyPeaks() found no peaks")
+	}
+
+	wantFrames := (len(samples)-windowSize)/hopSize + 1
+	strongest := make(map[int]Peak)
+	for i, peak := range peaks {
+		if i > 0 && peak.TimeIndex < peaks[i-1].TimeIndex {
+			t.Fatalf("peak %d has time index %d after %d", i, peak.TimeIndex, peaks[i-1].TimeIndex)
+		}
+		if peak.TimeIndex < 0 || peak.TimeIndex >= wantFrames {
+			t.Fatalf("peak %d time index = %d, want within %d frames", i, peak.TimeIndex, wantFrames)
+		}
+		if peak.Magnitude > strongest[peak.TimeIndex].Magnitude {
+			strongest[peak.TimeIndex] = peak
+		}
+	}
+	if len(strongest) != wantFrames {
+		t.Errorf("found peaks in %d frames, want %d", len(strongest), wantFrames)
+	}
+
+	// The dominant frequency rises with the chirp
+	for frame := 1; frame < wantFrames; frame++ {
+		if strongest[frame].FrequencyBin < strongest[frame-1].FrequencyBin {
+			t.Errorf("frame %d strongest bin = %d, below frame %d's %d",
+				frame, strongest[frame].FrequencyBin, frame-1, strongest[frame-1].FrequencyBin)
+		}
+	}
+}
+
+func TestFindFrequencyPeaksGainInvariant(t *testing.T) {
+	// A few tones over noise, played back at very different volumes
+	rng := rand.New(rand.NewPCG(3, 4))
+	signal := make([]float64, 16000)
+	for i := range signal {
+		tm := float64(i) / 16000
+		signal[i] = 0.3*math.Sin(2*math.Pi*440*tm) +
+			0.2*math.Sin(2*math.Pi*1250*tm) +
+			0.1*math.Sin(2*math.Pi*3100*tm) +
+			0.05*(rng.Float64()-0.5)
+	}
+
+	counts := make(map[float64]int)
+	for _, gain := range []float64{0.01, 0.1, 1} {
+		samples := make([]float64, len(signal))
+		for i, sample := range signal {
+			samples[i] = sample * gain
+		}
+		counts[gain] = len(findFrequencyPeaks(samples, 16000, peakConfig{}))
+	}
+
+	if counts[1] == 0 {
+		t.Fatal("findFrequencyPeaks() found no peaks")
+	}
+	for gain, count := range counts {
+		if diff := math.Abs(float64(count - counts[1])); diff > float64(counts[1])/50 {
+			t.Errorf("gain %v found %d peaks, want about the %d found at full gain", gain, count, counts[1])
+		}
+	}
+}
+
+func TestFindFrequencyPeaksThreshold(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	samples := make([]float64, 16000)
+	for i := range samples {
+		samples[i] = 0.4*math.Sin(2*math.Pi*800*float64(i)/16000) + 0.1*(rng.Float64()-0.5)
+	}
+
+	loose := findFrequencyPeaks(samples, 16000, peakConfig{thresholdFactor: 2})
+	strict := findFrequencyPeaks(samples, 16000, peakConfig{thresholdFactor: 50})
+	if len(strict) == 0 || len(strict) >= len(loose) {
+		t.Errorf("threshold 50 found %d peaks, want some but fewer than the %d at threshold 2", len(strict), len(loose))
+	}
+}
+
+func TestDBFSToMagnitude(t *testing.T) {
+	tests := []struct {
+		dBFS float64
+		want float64
+	}{
+		{dBFS: 0, want: 256},
+		{dBFS: -20 * math.Log10(2), want: 128},
+		{dBFS: -20, want: 25.6},
+		{dBFS: -60, want: 0.256},
+		// The default floor
+		{dBFS: 20 * math.Log10(minMagnitude/fullScaleMagnitude), want: minMagnitude},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.dBFS), func(t *testing.T) {
+			if got := dBFSToMagnitude(tt.dBFS); math.Abs(got-tt.want) > 1e-9*tt.want {
+				t.Errorf("dBFSToMagnitude(%v) = %v, want %v", tt.dBFS, got, tt.want)
+			}
+		})
+	}
+
+	// A full scale sine centred on a bin reaches the 0dBFS magnitude
+	samples := make([]float64, windowSize)
+	for i := range samples {
+		samples[i] = math.Sin(2 * math.Pi * 64 * float64(i) / windowSize)
+	}
+	powers := spectrumPowers(fft.FFTReal(applyWindow(samples, analysisWindow)))
+	if got := math.Sqrt(powers[64]); math.Abs(got-fullScaleMagnitude) > 1 {
+		t.Errorf("full scale sine magnitude = %v, want %v", got, fullScaleMagnitude)
+	}
+}
+
+func TestFindFrequencyPeaksFloor(t *testing.T) {
+	// A 1kHz tone at -30dBFS
+	amplitude := math.Pow(10, -30.0/20)
+	samples := make([]float64, 4096)
+	for i := range samples {
+		samples[i] = amplitude * math.Sin(2*math.Pi*1000*float64(i)/16000)
+	}
+
+	tests := []struct {
+		name      string
+		floorDBFS float64
+		wantPeaks bool
+	}{
+		{name: "Default", floorDBFS: 0, wantPeaks: true},
+		{name: "Below the tone", floorDBFS: -40, wantPeaks: true},
+		{name: "Above the tone", floorDBFS: -20, wantPeaks: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peaks := findFrequencyPeaks(samples, 16000, peakConfig{floorDBFS: tt.floorDBFS})
+			if got := len(peaks) > 0; got != tt.wantPeaks {
+				t.Errorf("floor %vdBFS found %d peaks, want peaks %v", tt.floorDBFS, len(peaks), tt.wantPeaks)
+			}
+		})
+	}
+}
+
+func TestFindFrequencyPeaksLimits(t *testing.T) {
+	// A comb of equally loud tones gives far more local maxima than the caps
+	samples := make([]float64, 16000)
+	for i := range samples {
+		tm := float64(i) / 16000
+		for hz := 200.0; hz < 7000; hz += 250 {
+			samples[i] += 0.02 * math.Sin(2*math.Pi*hz*tm)
+		}
+	}
+
+	tests := []struct {
+		name string
+		cfg  peakConfig
+	}{
+		{name: "defaults", cfg: peakConfig{}},
+		{name: "one per band", cfg: peakConfig{maxPerFrame: 3, maxPerBand: 1}},
+		{name: "frame cap only", cfg: peakConfig{maxPerFrame: 4, maxPerBand: 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peaks := findFrequencyPeaks(samples, 16000, tt.cfg)
+			if len(peaks) == 0 {
+				t.Fatal("findFrequencyPeaks() found no peaks")
+			}
+			maxPerFrame := cmp.Or(tt.cfg.maxPerFrame, defaultMaxPeaksPerFrame)
+			maxPerBand := cmp.Or(tt.cfg.maxPerBand, defaultMaxPeaksPerBand)
+
+			perFrame := make(map[int]int)
+			perBand := make(map[[2]int]int)
+			for _, peak := range peaks {
+				perFrame[peak.TimeIndex]++
+				perBand[[2]int{peak.TimeIndex, int(getFrequencyBand(peak.Frequency))}]++
+			}
+			for frame, count := range perFrame {
+				if count > maxPerFrame {
+					t.Errorf("frame %d kept %d peaks, want at most %d", frame, count, maxPerFrame)
+				}
+			}
+			for key, count := range perBand {
+				if count > maxPerBand {
+					t.Errorf("frame %d band %d kept %d peaks, want at most %d", key[0], key[1], count, maxPerBand)
+				}
+			}
+			if most := slices.Max(slices.Collect(maps.Values(perFrame))); most < min(maxPerFrame, maxPerBand) {
+				t.Errorf("fullest frame kept %d peaks, want the caps to be reached", most)
+			}
+		})
+	}
+}
+
+func TestFramePeaksSeparation(t *testing.T) {
+	// A broad bump around 1kHz at 16kHz, bin 64, with a ripple making local
+	// maxima two bins apart, on a low noise floor
+	spectrum := make([]complex128, windowSize)
+	for i := range spectrum {
+		spectrum[i] = 0.01
+	}
+	bump := map[int]float64{60: 0.5, 61: 0.6, 62: 0.8, 63: 0.7, 64: 1, 65: 0.7, 66: 0.9, 67: 0.6, 68: 0.5}
+	for bin, magnitude := range bump {
+		spectrum[bin] = complex(magnitude, 0)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      peakConfig
+		wantBins []int
+	}{
+		{name: "Default", cfg: peakConfig{}, wantBins: []int{64}},
+		{name: "Off", cfg: peakConfig{minSeparation: 1, maxPerBand: 5}, wantBins: []int{62, 64, 66}},
+		{name: "Two bins", cfg: peakConfig{minSeparation: 2, maxPerBand: 5}, wantBins: []int{62, 64, 66}},
+		{name: "Wide", cfg: peakConfig{minSeparation: 10, maxPerBand: 5}, wantBins: []int{64}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bins []int
+			for _, peak := range tt.cfg.framePeaks(spectrum, 0, 16000) {
+				bins = append(bins, peak.FrequencyBin)
+			}
+			if !slices.Equal(bins, tt.wantBins) {
+				t.Errorf("framePeaks() kept bins %v, want %v", bins, tt.wantBins)
+			}
+		})
+	}
+
+	// Separate peaks further apart than the separation are all kept
+	spectrum[80] = 0.95
+	var bins []int
+	for _, peak := range (peakConfig{}).framePeaks(spectrum, 0, 16000) {
+		bins = append(bins, peak.FrequencyBin)
+	}
+	if want := []int{64, 80}; !slices.Equal(bins, want) {
+		t.Errorf("framePeaks() kept bins %v, want %v", bins, want)
+	}
+}
+
+func TestStrongestTies(t *testing.T) {
+	var candidates []peakCandidate
+	for bin := 10; bin > 0; bin-- {
+		candidates = append(candidates, peakCandidate{
+			Peak:  Peak{Frequency: 2000, FrequencyBin: bin},
+			power: 1,
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		kept := peakConfig{maxPerFrame: 3, maxPerBand: 3, minSeparation: 1}.strongest(slices.Clone(candidates))
+		var bins []int
+		for _, peak := range kept {
+			bins = append(bins, peak.FrequencyBin)
+		}
+		if want := []int{1, 2, 3}; !slices.Equal(bins, want) {
+			t.Errorf("strongest() kept bins %v, want %v", bins, want)
+		}
+	}
+}
+
+func TestFindFrequencyPeaksHz(t *testing.T) {
+	// Tones centred on bins of the 1024 point FFT at 16kHz, 15.625Hz apart
+	tests := []struct {
+		bin  int
+		want float64
+	}{
+		{bin: 32, want: 500},
+		{bin: 64, want: 1000},
+		{bin: 160, want: 2500},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.want), func(t *testing.T) {
+			samples := make([]float64, 4096)
+			for i := range samples {
+				samples[i] = 0.5 * math.Sin(2*math.Pi*tt.want*float64(i)/16000)
+			}
+
+			peaks := findFrequencyPeaks(samples, 16000, peakConfig{})
+			if len(peaks) == 0 {
+				t.Fatal("findFrequencyPeaks() found no peaks")
+			}
+			for _, peak := range peaks {
+				if peak.Frequency != tt.want || peak.FrequencyBin != tt.bin {
+					t.Errorf("peak at %vHz in bin %d, want %vHz in bin %d", peak.Frequency, peak.FrequencyBin, tt.want, tt.bin)
+				}
+
+				// The signature encoding must describe the same frequency
+				signaturePeak := audiostream.FrequencyPeak{CorrectedPeakFrequencyBin: peak.correctedBin(), SampleRateHz: 16000}
+				if got := signaturePeak.GetFrequencyHz(); got != tt.want {
+					t.Errorf("signature peak frequency = %vHz, want %vHz", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFrequencyBand(t *testing.T) {
+	tests := []struct {
+		frequency float64
+		want      audiostream.FrequencyBand
+	}{
+		{frequency: 0, want: skipBand},
+		{frequency: 249.9, want: skipBand},
+		{frequency: 250, want: audiostream.LowBand},
+		{frequency: 519.9, want: audiostream.LowBand},
+		{frequency: 520, want: audiostream.MidBand},
+		{frequency: 1449.9, want: audiostream.MidBand},
+		{frequency: 1450, want: audiostream.HighBand},
+		{frequency: 3499.9, want: audiostream.HighBand},
+		{frequency: 3500, want: audiostream.VeryHighBand},
+		{frequency: 5499.9, want: audiostream.VeryHighBand},
+		{frequency: 5500, want: skipBand},
+		{frequency: 8000, want: skipBand},
+	}
+
+	for _, tt := range tests {
+		if got := getFrequencyBand(tt.frequency); got != tt.want {
+			t.Errorf("getFrequencyBand(%v) = %v, want %v", tt.frequency, got, tt.want)
+		}
+	}
+}
+
+func TestFindFrequencyPeaksSkipsOutOfBand(t *testing.T) {
+	// 100Hz and 6500Hz fall outside every band, 1000Hz is inside
+	samples := make([]float64, 4096)
+	for i := range samples {
+		tm := float64(i) / 16000
+		samples[i] = 0.3*math.Sin(2*math.Pi*100*tm) + 0.3*math.Sin(2*math.Pi*1000*tm) + 0.3*math.Sin(2*math.Pi*6500*tm)
+	}
+
+	for _, peak := range findFrequencyPeaks(samples, 16000, peakConfig{}) {
+		if getFrequencyBand(peak.Frequency) == skipBand {
+			t.Errorf("kept a peak at %vHz outside every band", peak.Frequency)
+		}
+	}
+}
+
+func TestSummarizePeaks(t *testing.T) {
+	tests := []struct {
+		name  string
+		peaks []Peak
+		want  PeakStats
+	}{
+		{
+			name:  "No peaks",
+			peaks: nil,
+			want:  PeakStats{BandCounts: map[audiostream.FrequencyBand]int{}},
+		},
+		{
+			name: "Spread across bands",
+			peaks: []Peak{
+				{Frequency: 300, Magnitude: 20000},
+				{Frequency: 440, Magnitude: 22000},
+				{Frequency: 1000, Magnitude: 18000},
+				{Frequency: 2000, Magnitude: 26000},
+				{Frequency: 4000, Magnitude: 19000},
+				{Frequency: 6000, Magnitude: 15000}, // Outside every band
+			},
+			want: PeakStats{
+				Count:         6,
+				MinMagnitude:  15000,
+				MaxMagnitude:  26000,
+				MeanMagnitude: 20000,
+				BandCounts: map[audiostream.FrequencyBand]int{
+					audiostream.LowBand:      2,
+					audiostream.MidBand:      1,
+					audiostream.HighBand:     1,
+					audiostream.VeryHighBand: 1,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SummarizePeaks(tt.peaks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SummarizePeaks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuantizeMagnitude(t *testing.T) {
+	// The strongest peak of a 1kHz tone at the given amplitude
+	tonePeak := func(amplitude float64) Peak {
+		samples := make([]float64, windowSize)
+		for i := range samples {
+			samples[i] = amplitude * math.Sin(2*math.Pi*1000*float64(i)/16000)
+		}
+		var loudest Peak
+		for _, peak := range findPeaksWithWindow(samples, 16000, peakConfig{}, analysisWindow) {
+			if peak.Magnitude > loudest.Magnitude {
+				loudest = peak
+			}
+		}
+		return loudest
+	}
+
+	full := tonePeak(1)
+	if full.Magnitude <= 0 || full.Magnitude > math.MaxUint16 {
+		t.Fatalf("full scale tone magnitude = %d, want within 16 bits", full.Magnitude)
+	}
+	// Halving the amplitude quarters the power, which the log scale turns
+	// into a drop of 1477.3 * ln(4)
+	half := tonePeak(0.5)
+	if drop := full.Magnitude - half.Magnitude; drop < 2047 || drop > 2049 {
+		t.Errorf("halving the amplitude lowered the magnitude by %d, want 2048", drop)
+	}
+
+	// The encoded magnitude decodes to the FFT magnitude in 16-bit PCM terms
+	encoded := audiostream.FrequencyPeak{PeakMagnitude: quantizeMagnitude(100)}
+	want := 100 * 32768 / (windowSize * math.Sqrt2)
+	if got := encoded.GetAmplitudePCM(); math.Abs(got-want)/want > 1/2000.0 {
+		t.Errorf("GetAmplitudePCM() = %v, want %v", got, want)
+	}
+}
+
+// benchmarkSignal returns ten seconds of tones over noise at 16kHz
+func benchmarkSignal() []float64 {
+	rng := rand.New(rand.NewPCG(7, 8))
+	samples := make([]float64, 10*16000)
+	for i := range samples {
+		tm := float64(i) / 16000
+		samples[i] = 0.3*math.Sin(2*math.Pi*440*tm) +
+			0.2*math.Sin(2*math.Pi*(1000+500*tm)*tm) +
+			0.1*math.Sin(2*math.Pi*3100*tm) +
+			0.1*(rng.Float64()-0.5)
+	}
+	return samples
+}
+
+// benchmarkSpectra returns the FFT of every frame of benchmarkSignal
+func benchmarkSpectra() [][]complex128 {
+	samples := benchmarkSignal()
+	var spectra [][]complex128
+	for start := 0; start+windowSize <= len(samples); start += hopSize {
+		spectra = append(spectra, fft.FFTReal(applyWindow(samples[start:start+windowSize], analysisWindow)))
+	}
+	return spectra
+}
+
+// magnitudeFramePeaks is framePeaks as it was before comparing powers,
+// taking the magnitude of every bin
+func magnitudeFramePeaks(pc peakConfig, fftResult []complex128, pass, sampleRate int) []Peak {
+	magnitudes := make([]float64, len(fftResult)/2+1)
+	for i := range magnitudes {
+		magnitudes[i] = math.Sqrt(real(fftResult[i])*real(fftResult[i]) + imag(fftResult[i])*imag(fftResult[i]))
+	}
+	sorted := slices.Clone(magnitudes)
+	slices.Sort(sorted)
+	threshold := max(sorted[len(sorted)/2]*cmp.Or(pc.thresholdFactor, defaultPeakThreshold), pc.floor())
+
+	var candidates []peakCandidate
+	for i := 1; i < len(magnitudes)-1; i++ {
+		if magnitudes[i] > threshold && magnitudes[i] > magnitudes[i-1] && magnitudes[i] > magnitudes[i+1] &&
+			getFrequencyBand(binFrequency(i, sampleRate)) != skipBand {
+			candidates = append(candidates, peakCandidate{
+				Peak:  Peak{Frequency: binFrequency(i, sampleRate), FrequencyBin: i, TimeIndex: pass},
+				power: magnitudes[i] * magnitudes[i],
+			})
+		}
+	}
+	return pc.strongest(candidates)
+}
+
+func TestFramePeaksMatchMagnitudes(t *testing.T) {
+	spectra := benchmarkSpectra()
+	for _, cfg := range []peakConfig{{}, {thresholdFactor: 2}, {thresholdFactor: 50, maxPerFrame: 8, maxPerBand: 3}} {
+		for _, gain := range []float64{1e-4, 1} {
+			for pass, spectrum := range spectra {
+				scaled := make([]complex128, len(spectrum))
+				for i, c := range spectrum {
+					scaled[i] = c * complex(gain, 0)
+				}
+				got := cfg.framePeaks(scaled, pass, 16000)
+				want := magnitudeFramePeaks(cfg, scaled, pass, 16000)
+				if !slices.Equal(got, want) {
+					t.Fatalf("config %+v gain %v frame %d: framePeaks() = %v, want %v", cfg, gain, pass, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkFramePeaks(b *testing.B) {
+	spectra := benchmarkSpectra()
+	b.Run("powers", func(b *testing.B) {
+		for b.Loop() {
+			for pass, spectrum := range spectra {
+				peakConfig{}.framePeaks(spectrum, pass, 16000)
+			}
+		}
+	})
+	b.Run("magnitudes", func(b *testing.B) {
+		for b.Loop() {
+			for pass, spectrum := range spectra {
+				magnitudeFramePeaks(peakConfig{}, spectrum, pass, 16000)
+			}
+		}
+	})
+}
+
+func BenchmarkFindFrequencyPeaks(b *testing.B) {
+	samples := benchmarkSignal()
+	b.ReportAllocs()
+	for b.Loop() {
+		findFrequencyPeaks(samples, 16000, peakConfig{})
+	}
+}
@@ -1,70 +1,750 @@
 package shazam
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"listr/internal/audiostream"
 	"listr/internal/song"
+	"log/slog"
 	"math"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/mjibson/go-dsp/fft"
 )
 
 type ShazamHandlerInterface interface {
 	Init()
-	SendMatchRequest(chunk *audiostream.Chunk) (*song.Song, error)
-	Match(stream *audiostream.Stream) (*[]*song.Song, error) // Takes in audio stream
+	SendMatchRequest(ctx context.Context, chunk audiostream.Chunk) (*song.Song, error)
+	Match(ctx context.Context, stream audiostream.Stream) (*[]*song.Song, error) // Takes in audio stream
+	MatchStream(ctx context.Context, stream audiostream.Stream) ([]*song.Song, error)
+	MatchStreaming(ctx context.Context, stream audiostream.Stream, onMatch func(*song.Song)) error
 }
 
-/*
-SEARCH_FROM_FILE = (
-        "https://amp.shazam.com/discovery/v5/{language}/{endpoint_country}/{device}/-/tag"
-        "/{uuid_1}/{uuid_2}?sync=true&webv3=true&sampling=true"
-        "&connected=&shazamapiversion=v3&sharehub=true&hubv5minorversion=v5.1&hidelb=true&video=v3"
-    )
-*/
+var _ ShazamHandlerInterface = (*ShazamHandler)(nil)
 
+// matchDedupWindow is how long after a song was last heard that a repeat
+// match is still treated as the same play, unless configured otherwise
+const matchDedupWindow = 30 * time.Second
+
+// DefaultEndpoints are the templates of the endpoints match requests are sent
+// to, in the order they are tried. The v3 endpoint is only used once the v5
+// one answers 404 or 410.
+var DefaultEndpoints = []string{
+	"https://amp.shazam.com/discovery/v5/{language}/{endpoint_country}/{device}/-/tag" +
+		"/{uuid_1}/{uuid_2}?sync=true&webv3=true&sampling=true" +
+		"&connected=&shazamapiversion=v3&sharehub=true&hubv5minorversion=v5.1&hidelb=true&video=v3",
+	"https://amp.shazam.com/discovery/v3/{language}/{endpoint_country}/{device}/-/tag" +
+		"/{uuid_1}/{uuid_2}?sync=true&webv3=true&sampling=true&connected=&shazamapiversion=v3",
+}
+
+const (
+	// defaultRequestTimeout bounds a single match request when using the default client
+	defaultRequestTimeout = 15 * time.Second
+	// defaultMaxAttempts is how many times a match request is tried before giving up
+	defaultMaxAttempts = 3
+	// defaultRetryBaseDelay is the wait before the first retry
+	defaultRetryBaseDelay = 500 * time.Millisecond
+)
+
+// ShazamHandler identifies the songs in audio by sending fingerprints of it
+// to Shazam.
+//
+// Once configured, a handler's SendMatchRequest, AddFind and Finds may be
+// called from any number of goroutines: the finds are guarded by a mutex and
+// the response cache by its own. Configuration, Reset and matching a stream
+// with Match, MatchStream or MatchStreaming are not safe to run concurrently
+// with each other, as matching a stream tracks its progress in the handler.
+// Match may send requests concurrently itself, see SetConcurrency.
 type ShazamHandler struct {
-	finds      *[]*song.Song
-	requestURL *string
+	findsMu        sync.Mutex // Guards finds and lastHeard
+	finds          *[]*song.Song
+	lastHeard      []time.Duration // When each find was last matched in the stream
+	dedupWindow    time.Duration   // Repeats heard within this of a find are skipped
+	requestURLs    []string        // Endpoints tried in order, moving on when one is gone
+	endpoint       atomic.Int32    // Index of the first endpoint still answering
+	client         *http.Client    // Shared across requests so connections are reused
+	headers        http.Header     // Extra headers set on every request
+	maxAttempts    int
+	retryBaseDelay time.Duration
+	minConfidence  float64 // Matches scoring below this are dropped by Match
+	peaks          peakConfig
+	cache          *responseCache // Responses by signature, nil when caching is off
+	concurrency    int            // Match requests Match keeps in flight at once
+	logger         *slog.Logger   // Debug logging of each match, nil to discard
+	silenceDBFS    float64        // Chunks quieter than this are not sent, 0 to send all
+	normalize      bool           // Scale each chunk to a fixed peak before fingerprinting
+	keepRaw        bool           // Attach the raw response to each song found
+	signatureDir   string         // Directory each signature sent is saved in, empty to not save
+	chunkDir       string         // Directory the audio of each chunk is saved in, empty to not save
+	requestTimeout time.Duration  // Longest Match waits on one chunk, 0 for no limit
+	sampleRate     int            // Rate of chunks that don't report one, 0 for 16kHz
+	progress       ProgressFunc   // Called after each chunk is matched, nil for none
+	adaptive       adaptiveChunks // Chunk duration bounds when sizing chunks by match success
+	missRetry      time.Duration  // How far either side of a missed chunk to retry, 0 to not retry
 }
 
+// ShazamOptions configures the endpoint a ShazamHandler talks to. Empty fields
+// fall back to the defaults.
+type ShazamOptions struct {
+	Language string       // Metadata language, defaults to "en"
+	Country  string       // Endpoint country, defaults to "US"
+	Device   string       // Device the requests claim to come from, defaults to "desktop_mac"
+	Client   *http.Client // Client used for requests, defaults to one with a 15s timeout
+	Headers  http.Header  // Extra headers sent with every request, overriding the User-Agent if set
+	// Endpoints are the templates of the URLs requests are sent to, each
+	// tried in turn when the one before answers 404 or 410. The language,
+	// country, device and UUIDs are filled in for {language},
+	// {endpoint_country}, {device}, {uuid_1} and {uuid_2}. Defaults to
+	// DefaultEndpoints.
+	Endpoints []string
+	// NewUUID generates the two UUIDs in the request path, defaults to
+	// uuid.New. Pinning them makes the request URL reproducible.
+	NewUUID func() uuid.UUID
+}
+
+// Init prepares the handler with the default options.
+//
+// Deprecated: Use NewShazamHandler, which returns an error instead of
+// panicking.
 func (sh *ShazamHandler) Init() {
-	reqURL := fmt.Sprintf(
-		"https://amp.shazam.com/discovery/v5/en/US/desktop_mac/-/tag/%s/%s?sync=true&webv3=true&sampling=true&connected=&shazamapiversion=v3&sharehub=true&hubv5minorversion=v5.1&hidelb=true&video=v3",
-		uuid.New().String(), uuid.New().String(),
+	if err := sh.InitWithOptions(ShazamOptions{}); err != nil {
+		panic(err)
+	}
+}
+
+// InitWithClient prepares the handler to send requests with the given client.
+//
+// Deprecated: Use NewShazamHandler with WithHTTPClient.
+func (sh *ShazamHandler) InitWithClient(client *http.Client) {
+	if err := sh.InitWithOptions(ShazamOptions{Client: client}); err != nil {
+		panic(err)
+	}
+}
+
+// InitWithOptions prepares the handler for the region and client in opts
+func (sh *ShazamHandler) InitWithOptions(opts ShazamOptions) error {
+	language := cmp.Or(opts.Language, "en")
+	country := cmp.Or(opts.Country, "US")
+	device := cmp.Or(opts.Device, "desktop_mac")
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultRequestTimeout}
+	}
+	newUUID := opts.NewUUID
+	if newUUID == nil {
+		newUUID = uuid.New
+	}
+
+	endpoints := opts.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = DefaultEndpoints
+	}
+	fill := strings.NewReplacer(
+		"{language}", url.PathEscape(language),
+		"{endpoint_country}", url.PathEscape(country),
+		"{device}", url.PathEscape(device),
+		"{uuid_1}", newUUID().String(),
+		"{uuid_2}", newUUID().String(),
 	)
+	requestURLs := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		requestURLs[i] = fill.Replace(endpoint)
+		if _, err := url.ParseRequestURI(requestURLs[i]); err != nil {
+			return fmt.Errorf("invalid request url: %w", err)
+		}
+	}
+
+	sh.Reset()
+	sh.requestURLs = requestURLs
+	sh.endpoint.Store(0)
+	sh.client = client
+	sh.headers = opts.Headers.Clone()
+	sh.maxAttempts = defaultMaxAttempts
+	sh.retryBaseDelay = defaultRetryBaseDelay
+	return nil
+}
 
+// Reset forgets the songs found and any cached responses so the handler can
+// match another stream. The endpoint, client and every other setting are
+// kept. Results already returned by Match are left untouched.
+func (sh *ShazamHandler) Reset() {
 	findSlice := make([]*song.Song, 0, 5)
+	sh.findsMu.Lock()
 	sh.finds = &findSlice
-	_, err := url.ParseRequestURI(reqURL)
+	sh.lastHeard = nil
+	sh.findsMu.Unlock()
+	sh.adaptive.current = 0
+	if sh.cache != nil {
+		sh.cache = newResponseCache(sh.cache.size)
+	}
+}
+
+// SetRetries configures how many attempts are made per match request and the
+// delay before the first retry, which doubles on each further retry
+func (sh *ShazamHandler) SetRetries(maxAttempts int, baseDelay time.Duration) {
+	sh.maxAttempts = maxAttempts
+	sh.retryBaseDelay = baseDelay
+}
+
+// SetDedupWindow sets how long after a song was last heard that finding it
+// again counts as the same play rather than a repeat. Zero restores the
+// default of 30 seconds.
+func (sh *ShazamHandler) SetDedupWindow(window time.Duration) {
+	sh.dedupWindow = window
+}
+
+// AddFind adds a song to the handler's finds, reporting whether it was added.
+// A song with the same title and artist as a find last heard within the dedup
+// window of its TimestampFound is the same play, so it is skipped and only
+// extends when that find was last heard. It is safe for concurrent use.
+func (sh *ShazamHandler) AddFind(found *song.Song) bool {
+	var timestamp time.Duration
+	if found.TimestampFound != nil {
+		timestamp = *found.TimestampFound
+	}
+
+	window := cmp.Or(sh.dedupWindow, matchDedupWindow)
+	sh.findsMu.Lock()
+	defer sh.findsMu.Unlock()
+	for i, find := range *sh.finds {
+		gap := timestamp - sh.lastHeard[i]
+		if sameTrack(find, found) && gap <= window && -gap <= window {
+			sh.lastHeard[i] = max(sh.lastHeard[i], timestamp)
+			return false
+		}
+	}
+
+	*sh.finds = append(*sh.finds, found)
+	sh.lastHeard = append(sh.lastHeard, timestamp)
+	return true
+}
+
+// Finds returns a copy of the songs found so far, in the order they were
+// added. Unlike the slice Match returns, it is safe to read while songs are
+// still being added.
+func (sh *ShazamHandler) Finds() []*song.Song {
+	sh.findsMu.Lock()
+	defer sh.findsMu.Unlock()
+	return slices.Clone(*sh.finds)
+}
+
+// SetSampleRate sets the sample rate, in Hz, of chunks that don't report
+// their own, which must be one signatures support. Zero restores the default
+// of 16kHz.
+func (sh *ShazamHandler) SetSampleRate(hz int) error {
+	if err := checkSampleRate(hz); err != nil {
+		return err
+	}
+	sh.sampleRate = hz
+	return nil
+}
+
+// checkSampleRate checks the rate given to SetSampleRate
+func checkSampleRate(hz int) error {
+	if hz != 0 && !audiostream.IsSupportedSampleRate(hz) {
+		return fmt.Errorf("%w: %d", audiostream.ErrUnsupportedSampleRate, hz)
+	}
+	return nil
+}
+
+// SetMinConfidence makes Match drop songs whose confidence is below min
+func (sh *ShazamHandler) SetMinConfidence(min float64) {
+	sh.minConfidence = min
+}
+
+// SetPeakThreshold sets how many times louder than the median of its frame a
+// spectral peak must be to go into the signature. Higher values keep fewer,
+// stronger peaks. Zero restores the default.
+func (sh *ShazamHandler) SetPeakThreshold(factor float64) {
+	sh.peaks.thresholdFactor = factor
+}
+
+// SetPeakLimits caps how many of the strongest peaks each analysis frame
+// contributes to the signature, overall and per frequency band. Zero restores
+// the default for either limit.
+func (sh *ShazamHandler) SetPeakLimits(perFrame, perBand int) {
+	sh.peaks.maxPerFrame = perFrame
+	sh.peaks.maxPerBand = perBand
+}
+
+// SetPeakSeparation sets how many FFT bins apart the peaks kept from one
+// analysis frame must be. Of two closer peaks only the stronger is kept, as
+// they are usually one broad peak. Zero restores the default of 3 bins and 1
+// or less keeps every peak.
+func (sh *ShazamHandler) SetPeakSeparation(bins int) {
+	sh.peaks.minSeparation = bins
+}
+
+// SetPeakFloor sets how loud in dBFS a tone must be for its peak to go into
+// the signature, however quiet the rest of its frame. Levels are those of a
+// sine, so -20 keeps tones above a tenth of full scale. Zero restores the
+// default of about -108dBFS, which only leaves out near silence.
+func (sh *ShazamHandler) SetPeakFloor(dBFS float64) {
+	sh.peaks.floorDBFS = dBFS
+}
+
+// SetHighPass sets the cutoff of the high-pass filter that removes DC offset
+// and low bass from the audio before peaks are picked. Zero restores the
+// default of 200Hz and a negative cutoff turns the filter off.
+func (sh *ShazamHandler) SetHighPass(cutoffHz float64) {
+	sh.peaks.highPassHz = cutoffHz
+}
+
+// SetSilenceThreshold makes SendMatchRequest skip chunks whose RMS level is
+// below thresholdDBFS, such as the dead air between tracks, treating them as
+// unmatched without a request. Zero or above turns detection off, which is
+// the default. Around -50dBFS is quieter than any music.
+func (sh *ShazamHandler) SetSilenceThreshold(thresholdDBFS float64) {
+	sh.silenceDBFS = min(thresholdDBFS, 0)
+}
+
+// SetNormalize makes SendMatchRequest scale each chunk so its loudest sample
+// is just under full scale before fingerprinting, lifting quiet recordings
+// clear of the peak magnitude floor and storing their peaks as loud as a
+// loud recording's. Chunks below -60dBFS are left as they are and no chunk
+// is amplified by more than 40dB, so silence and noise aren't turned into
+// peaks. It is off by default.
+func (sh *ShazamHandler) SetNormalize(enable bool) {
+	sh.normalize = enable
+}
+
+// SetKeepRawResponse makes each song found carry the JSON Shazam answered
+// with in its RawResponse, so callers can read fields that aren't modelled,
+// such as lyrics or related tracks. It is off by default.
+func (sh *ShazamHandler) SetKeepRawResponse(keep bool) {
+	sh.keepRaw = keep
+}
+
+// SetSignatureDumpDir saves the signature of every chunk sent to Shazam in
+// dir, to inspect when a match fails. Each is written as a .bin file and a .uri
+// file holding the data URI sent, named after the chunk's timestamp in
+// milliseconds. The directory is created if needed. Failing to save is logged
+// rather than failing the match. An empty dir, the default, saves nothing.
+func (sh *ShazamHandler) SetSignatureDumpDir(dir string) {
+	sh.signatureDir = dir
+}
+
+// dumpSignature saves a chunk's signature in the signature dump directory
+func (sh *ShazamHandler) dumpSignature(signature *audiostream.DecodedMessage, signatureURI string) {
+	if sh.signatureDir == "" {
+		return
+	}
+
+	err := func() error {
+		data, err := signature.EncodeToBinary()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(sh.signatureDir, 0o755); err != nil {
+			return err
+		}
+		name := filepath.Join(sh.signatureDir, fmt.Sprintf("%010d", signature.StreamOffset.Milliseconds()))
+		if err := os.WriteFile(name+".bin", data, 0o644); err != nil {
+			return err
+		}
+		return os.WriteFile(name+".uri", []byte(signatureURI), 0o644)
+	}()
 	if err != nil {
-		panic(err)
+		sh.log().Warn("failed to save signature", "timestamp", signature.StreamOffset, "error", err)
 	}
-	sh.requestURL = &reqURL
+}
+
+// SetChunkDumpDir saves the audio of every chunk fingerprinted in dir as a
+// WAV file, to listen to exactly what was captured when a match fails. Files
+// are named after the chunk's timestamp in milliseconds like signature dumps,
+// so both can share a directory. Silent chunks are saved too. Failing to
+// save is logged rather than failing the match. An empty dir, the default,
+// saves nothing.
+func (sh *ShazamHandler) SetChunkDumpDir(dir string) {
+	sh.chunkDir = dir
+}
+
+// dumpChunk saves a chunk's audio in the chunk dump directory
+func (sh *ShazamHandler) dumpChunk(c audiostream.Chunk, sampleRate int) {
+	if sh.chunkDir == "" {
+		return
+	}
+
+	err := func() error {
+		if err := os.MkdirAll(sh.chunkDir, 0o755); err != nil {
+			return err
+		}
+		name := filepath.Join(sh.chunkDir, fmt.Sprintf("%010d.wav", c.GetTimestamp().Milliseconds()))
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		if err := audiostream.WriteWAV(file, c.GetAudioData(), sampleRate); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}()
+	if err != nil {
+		sh.log().Warn("failed to save chunk", "timestamp", c.GetTimestamp(), "error", err)
+	}
+}
+
+// SetRequestTimeout limits how long Match spends on any one chunk, retries
+// included. A chunk that runs out of time is skipped as unmatched and the
+// stream carries on, while cancelling the context passed to Match still stops
+// it. Zero, the default, sets no limit.
+func (sh *ShazamHandler) SetRequestTimeout(timeout time.Duration) {
+	sh.requestTimeout = timeout
+}
+
+// matchChunk sends the match request for a chunk within the request timeout,
+// returning a nil song and error if it runs out of time or Shazam recognizes
+// no music in it
+func (sh *ShazamHandler) matchChunk(ctx context.Context, chunk audiostream.Chunk) (*song.Song, error) {
+	requestCtx := ctx
+	if sh.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, sh.requestTimeout)
+		defer cancel()
+	}
+
+	found, err := sh.SendMatchRequest(requestCtx, chunk)
+	switch {
+	case errors.Is(err, ErrNotMusic):
+		return nil, nil
+	case err != nil && ctx.Err() == nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded):
+		sh.log().Debug("match request timed out", "timestamp", chunk.GetTimestamp(), "timeout", sh.requestTimeout)
+		return nil, nil
+	}
+	return found, err
+}
+
+// ProgressFunc is told how much of a stream has been matched, and the
+// stream's total length if known
+type ProgressFunc func(done, total time.Duration)
+
+// SetProgress makes matching a stream call progress after each chunk with
+// how far into the stream matching has got and the stream's total length.
+// The total is taken from streams implementing audiostream.Lengther, such as
+// FileStream, and is zero for live streams. A nil progress, the default,
+// reports nothing.
+func (sh *ShazamHandler) SetProgress(progress ProgressFunc) {
+	sh.progress = progress
+}
+
+// reportProgress tells the progress callback a chunk of the stream has been
+// matched
+func (sh *ShazamHandler) reportProgress(stream audiostream.Stream, chunk audiostream.Chunk) {
+	if sh.progress == nil {
+		return
+	}
+	total := audiostream.StreamLength(stream)
+	done := chunk.GetTimestamp() + chunk.GetDuration()
+	if total > 0 {
+		done = min(done, total)
+	}
+	sh.progress(done, total)
+}
+
+// adaptiveChunks tracks the chunk duration Match asks the stream for when
+// chunks are sized by match success
+type adaptiveChunks struct {
+	min, max time.Duration // Bounds of the chunk duration, zero when off
+	current  time.Duration // Duration of the next chunk, zero before matching starts
+}
+
+// SetAdaptiveChunks makes matching size chunks by how matching is going:
+// after a chunk fails to match the next is half as long, to pin down where a
+// transition falls, and after a confident match the next is twice as long, to
+// spend fewer requests while a song plays. Durations stay between min and max
+// and matching starts at max. The stream must implement
+// audiostream.ChunkResizer. As each chunk's size depends on the one before,
+// chunks are matched one at a time whatever the concurrency. A max of zero,
+// the default, leaves chunk sizes to the stream.
+func (sh *ShazamHandler) SetAdaptiveChunks(min, max time.Duration) error {
+	adaptive, err := newAdaptiveChunks(min, max)
+	if err != nil {
+		return err
+	}
+	sh.adaptive = adaptive
+	return nil
+}
+
+// newAdaptiveChunks checks the bounds given to SetAdaptiveChunks
+func newAdaptiveChunks(min, max time.Duration) (adaptiveChunks, error) {
+	if max == 0 {
+		return adaptiveChunks{}, nil
+	}
+	if min <= 0 || min > max {
+		return adaptiveChunks{}, fmt.Errorf("invalid adaptive chunk durations %v to %v", min, max)
+	}
+	return adaptiveChunks{min: min, max: max}, nil
+}
+
+// sizeNextChunk sets the duration of the stream's next chunk when chunks are
+// sized adaptively
+func (sh *ShazamHandler) sizeNextChunk(stream audiostream.Stream) error {
+	if sh.adaptive.max == 0 {
+		return nil
+	}
+	resizer, ok := stream.(audiostream.ChunkResizer)
+	if !ok {
+		return fmt.Errorf("stream %T can't change its chunk duration", stream)
+	}
+	if sh.adaptive.current == 0 {
+		sh.adaptive.current = sh.adaptive.max
+	}
+	return resizer.SetChunkDuration(sh.adaptive.current)
+}
+
+// adaptChunkSize shrinks the next chunk after a miss and grows it after a
+// confident match
+func (sh *ShazamHandler) adaptChunkSize(matched bool) {
+	if sh.adaptive.max == 0 {
+		return
+	}
+	if matched {
+		sh.adaptive.current = min(2*sh.adaptive.current, sh.adaptive.max)
+	} else {
+		sh.adaptive.current = max(sh.adaptive.current/2, sh.adaptive.min)
+	}
+}
+
+// SetMissRetry makes matching try once more when a chunk doesn't match, with
+// a window of the stream reaching widen further either side of the chunk, in
+// case the recognizable part of a song fell across its edge. Only streams
+// implementing audiostream.RangeReader, such as FileStream, can serve the
+// window; chunks of other streams aren't retried. A song found by the retry
+// is timestamped where the window starts. Zero, the default, doesn't retry.
+func (sh *ShazamHandler) SetMissRetry(widen time.Duration) {
+	sh.missRetry = widen
+}
+
+// matchWithRetry matches a chunk, retrying the window around it once if it
+// doesn't confidently match
+func (sh *ShazamHandler) matchWithRetry(ctx context.Context, stream audiostream.Stream, chunk audiostream.Chunk) (*song.Song, error) {
+	found, err := sh.matchChunk(ctx, chunk)
+	if err != nil || sh.missRetry <= 0 || (found != nil && sh.confidentEnough(found)) {
+		return found, err
+	}
+	reader, ok := stream.(audiostream.RangeReader)
+	if !ok {
+		return found, nil
+	}
+
+	start := max(chunk.GetTimestamp()-sh.missRetry, 0)
+	end := chunk.GetTimestamp() + chunk.GetDuration() + sh.missRetry
+	window, err := reader.ReadRange(start, end-start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retry window: %w", err)
+	}
+	sh.log().Debug("retrying missed chunk", "timestamp", chunk.GetTimestamp(),
+		"window_start", window.GetTimestamp(), "window_duration", window.GetDuration())
+	retried, err := sh.matchChunk(ctx, window)
+	if err != nil || retried == nil {
+		return found, err
+	}
+	return retried, nil
+}
+
+// SetConcurrency lets Match send up to n match requests at once. Songs are
+// still added in stream order. Values below 2 match one chunk at a time,
+// which is the default.
+func (sh *ShazamHandler) SetConcurrency(n int) {
+	sh.concurrency = n
+}
+
+// SetLogger makes the handler log each chunk it fingerprints, the requests it
+// sends and their results at debug level. A nil logger, the default, discards
+// everything.
+func (sh *ShazamHandler) SetLogger(logger *slog.Logger) {
+	sh.logger = logger
+}
+
+// log returns the logger to write to
+func (sh *ShazamHandler) log() *slog.Logger {
+	if sh.logger == nil {
+		return discardLogger
+	}
+	return sh.logger
+}
+
+// discardLogger drops everything logged to it
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// redactURL returns a request URL fit for logs, without its query and with
+// the IDs in its path replaced
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		if uuid.Validate(segment) == nil {
+			segments[i] = "REDACTED"
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String()
+}
+
+// SetCacheSize keeps the responses to the last size distinct signatures so a
+// repeated signature is answered without another request. Zero turns caching
+// off, which is the default.
+func (sh *ShazamHandler) SetCacheSize(size int) {
+	if size <= 0 {
+		sh.cache = nil
+		return
+	}
+	sh.cache = newResponseCache(size)
+}
+
+// ShazamMatch describes how the signature lined up with a matched track
+type ShazamMatch struct {
+	Offset        float64 `json:"offset"`        // Seconds into the track where the signature starts
+	TimeSkew      float64 `json:"timeskew"`      // Relative playback speed difference
+	FrequencySkew float64 `json:"frequencyskew"` // Relative pitch difference
+}
+
+// maxConfidenceSkew is the combined time and frequency skew at which a match
+// is given zero confidence
+const maxConfidenceSkew = 0.01
+
+// Confidence maps the match skews to a score in [0, 1]. A signature that lines
+// up exactly with the track scores 1, and the score falls linearly to 0 as the
+// combined absolute skew approaches maxConfidenceSkew.
+func (m ShazamMatch) Confidence() float64 {
+	skew := math.Abs(m.TimeSkew) + math.Abs(m.FrequencySkew)
+	return math.Max(0, 1-skew/maxConfidenceSkew)
 }
 
 // ShazamResponse represents the response from the Shazam API
 type ShazamResponse struct {
-	Track struct {
+	Matches []ShazamMatch `json:"matches"`
+	Track   struct {
 		Title    string `json:"title"`
 		Subtitle string `json:"subtitle"`
 		Images   struct {
 			CoverArt string `json:"coverart"`
 		} `json:"images"`
+		ISRC string `json:"isrc"`
+		Hub  struct {
+			Options []struct {
+				ProviderName string         `json:"providername"`
+				Actions      []ShazamAction `json:"actions"`
+			} `json:"options"`
+		} `json:"hub"`
+		Providers []struct {
+			Type    string         `json:"type"`
+			Actions []ShazamAction `json:"actions"`
+		} `json:"providers"`
+		Sections []struct {
+			Type     string `json:"type"`
+			Metadata []struct {
+				Title string `json:"title"`
+				Text  string `json:"text"`
+			} `json:"metadata"`
+		} `json:"sections"`
 	} `json:"track"`
+	// RetryMS is how long Shazam suggests waiting before sending more of the
+	// audio, given when it recognized nothing
+	RetryMS int `json:"retryms"`
+	// Classification is what Shazam heard in audio it couldn't match, such
+	// as "speech" or "noise". Ordinary misses leave it out.
+	Classification string `json:"classification"`
+
+	Raw json.RawMessage `json:"-"` // Response as sent, kept when the handler is asked to
+}
+
+// ShazamAction is a link to the track on another service
+type ShazamAction struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+}
+
+// streamLinks collects the first link for each streaming service in the hub
+// and providers sections, keyed by lower-cased service name
+func (sr *ShazamResponse) streamLinks() map[string]string {
+	links := make(map[string]string)
+	addLink := func(service string, actions []ShazamAction) {
+		service = strings.ToLower(service)
+		if _, ok := links[service]; ok || service == "" {
+			return
+		}
+		for _, action := range actions {
+			if action.URI != "" {
+				links[service] = action.URI
+				return
+			}
+		}
+	}
+
+	for _, option := range sr.Track.Hub.Options {
+		addLink(option.ProviderName, option.Actions)
+	}
+	for _, provider := range sr.Track.Providers {
+		addLink(provider.Type, provider.Actions)
+	}
+	return links
+}
+
+// notMusic reports whether Shazam classified the audio as something other
+// than music, such as speech. A retry delay alone doesn't say so, as
+// ordinary misses carry one too.
+func (sr *ShazamResponse) notMusic() bool {
+	classification := strings.ToLower(sr.Classification)
+	return classification != "" && classification != "music"
+}
+
+// metadata returns the text of the named entry in the track's metadata
+func (sr *ShazamResponse) metadata(title string) (string, bool) {
+	for _, section := range sr.Track.Sections {
+		for _, entry := range section.Metadata {
+			if entry.Title == title && entry.Text != "" {
+				return entry.Text, true
+			}
+		}
+	}
+	return "", false
 }
 
-func (sh *ShazamHandler) SendMatchRequest(c audiostream.Chunk) (*song.Song, error) {
+// SendMatchRequest fingerprints a chunk and asks Shazam to identify it. It
+// returns a nil song and error when nothing matched, or ErrNotMusic when
+// Shazam says the audio holds nothing it recognizes as music. The request is
+// abandoned when ctx is cancelled.
+func (sh *ShazamHandler) SendMatchRequest(ctx context.Context, c audiostream.Chunk) (*song.Song, error) {
 	// Get audio data from chunk
 	audioData := c.GetAudioData()
 	if len(audioData) == 0 {
-		return nil, fmt.Errorf("empty audio chunk")
+		return nil, ErrEmptyChunk
+	}
+	sampleRate := audiostream.ChunkSampleRate(c)
+	if _, ok := c.(audiostream.SampleRater); !ok && sh.sampleRate > 0 {
+		sampleRate = sh.sampleRate
 	}
+	if !audiostream.IsSupportedSampleRate(sampleRate) {
+		return nil, fmt.Errorf("%w: %d", audiostream.ErrUnsupportedSampleRate, sampleRate)
+	}
+	sh.dumpChunk(c, sampleRate)
 
 	// Convert raw bytes to PCM samples (16-bit mono)
 	samples := make([]float64, len(audioData)/2)
@@ -74,149 +754,593 @@ func (sh *ShazamHandler) SendMatchRequest(c audiostream.Chunk) (*song.Song, erro
 		samples[i] = float64(sample) / 32768.0 // Normalize to [-1, 1]
 	}
 
-	// Apply FFT
-	fftResult := fft.FFTReal(samples)
-
-	// Find frequency peaks
-	peaks := findFrequencyPeaks(fftResult, 16000) // Assuming 16kHz sample rate
+	if sh.silenceDBFS < 0 {
+		if level := rmsDBFS(samples); level < sh.silenceDBFS {
+			sh.log().Debug("skipped silent chunk", "timestamp", c.GetTimestamp(), "dbfs", level)
+			return nil, nil
+		}
+	}
 
-	// Create signature from peaks
-	signature := &audiostream.DecodedMessage{
-		SampleRateHz:              16000,
-		NumberSamples:             len(samples),
-		FrequencyBandToSoundPeaks: make(map[audiostream.FrequencyBand][]audiostream.FrequencyPeak),
+	if sh.normalize {
+		normalize(samples)
 	}
 
-	// Group peaks into frequency bands
-	for _, peak := range peaks {
-		band := getFrequencyBand(peak.Frequency)
-		signature.FrequencyBandToSoundPeaks[band] = append(
-			signature.FrequencyBandToSoundPeaks[band],
-			audiostream.FrequencyPeak{
-				FFTPassNumber:             peak.TimeIndex,
-				PeakMagnitude:             peak.Magnitude,
-				CorrectedPeakFrequencyBin: peak.FrequencyBin,
-				SampleRateHz:              16000,
-			},
-		)
+	signature, err := fingerprint(samples, sampleRate, sh.peaks)
+	if err != nil {
+		return nil, err
 	}
+	signature.StreamOffset = c.GetTimestamp()
+
+	sh.log().Debug("fingerprinted chunk",
+		"timestamp", c.GetTimestamp(), "duration", c.GetDuration(), "peaks", signature.TotalPeaks())
 
 	// Convert signature to URI format
 	signatureURI, err := signature.EncodeToURI()
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode signature: %v", err)
+		return nil, fmt.Errorf("failed to encode signature: %w", err)
 	}
+	sh.dumpSignature(signature, signatureURI)
 
 	// Create request body
 	requestBody := map[string]interface{}{
 		"signature": map[string]interface{}{
 			"uri": signatureURI,
 		},
-		"samplems": len(samples) * 1000 / 16000, // Convert samples to milliseconds
+		"samplems": len(samples) * 1000 / sampleRate, // Convert samples to milliseconds
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %v", err)
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
+	// Send request, retrying transient failures, unless the same signature
+	// was already looked up
+	shazamResp, err := sh.lookup(ctx, signatureURI, jsonBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// Most chunks don't match anything, in which case there's no track
+	if shazamResp.Track.Title == "" {
+		if shazamResp.notMusic() {
+			retry := time.Duration(shazamResp.RetryMS) * time.Millisecond
+			sh.log().Debug("no music recognized", "timestamp", c.GetTimestamp(),
+				"classification", shazamResp.Classification, "retry", retry)
+			return nil, fmt.Errorf("%w: heard %s, retry in %v", ErrNotMusic, shazamResp.Classification, retry)
+		}
+		sh.log().Debug("no match", "timestamp", c.GetTimestamp())
+		return nil, nil
+	}
+	sh.log().Debug("matched chunk", "timestamp", c.GetTimestamp(),
+		"title", shazamResp.Track.Title, "artist", shazamResp.Track.Subtitle, "matches", len(shazamResp.Matches))
+
+	// Create song object from response, found where the chunk starts in the stream
+	timestamp := signature.StreamOffset
+	title := shazamResp.Track.Title
+	artist := shazamResp.Track.Subtitle
+
+	found := &song.Song{
+		SongTitle:      &title,
+		ArtistName:     &artist,
+		TimestampFound: &timestamp,
+		StreamLinks:    shazamResp.streamLinks(),
+		RawResponse:    shazamResp.Raw,
+	}
+	if album, ok := shazamResp.metadata("Album"); ok {
+		found.AlbumName = &album
+	}
+	if isrc := shazamResp.Track.ISRC; isrc != "" {
+		found.ISRC = &isrc
+	}
+	// Tracks without artwork have no images object, or a blank cover
+	if coverArt := strings.TrimSpace(shazamResp.Track.Images.CoverArt); coverArt != "" {
+		found.AlbumArtURL = &coverArt
+	}
+	// Without a match entry there is nothing to score, so leave both unset
+	if len(shazamResp.Matches) > 0 {
+		match := shazamResp.Matches[0]
+		offset := time.Duration(match.Offset * float64(time.Second))
+		confidence := match.Confidence()
+		found.MatchOffset = &offset
+		found.Confidence = &confidence
+	}
+	return found, nil
+}
+
+// RateLimitError is returned when Shazam is still rate limiting requests after
+// waiting out its Retry-After delay once
+type RateLimitError struct {
+	RetryAfter time.Duration // Delay Shazam asked for before the next request
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by shazam, retry after %v", e.RetryAfter)
+}
+
+var (
+	// ErrEmptyChunk is returned for a chunk holding no audio
+	ErrEmptyChunk = errors.New("empty audio chunk")
+	// ErrDecodeResponse is returned when Shazam's response can't be
+	// decompressed or parsed
+	ErrDecodeResponse = errors.New("failed to decode response")
+	// ErrNotMusic is returned when Shazam classified the audio as something
+	// other than music, such as speech or noise. Matching a stream skips
+	// such chunks.
+	ErrNotMusic = errors.New("no music recognized")
+)
+
+// ErrUnexpectedStatus is returned when Shazam answers with a status other
+// than OK, once any retries are used up
+type ErrUnexpectedStatus struct {
+	Code int // HTTP status code of the response
+}
+
+func (e *ErrUnexpectedStatus) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.Code)
+}
+
+// lookup returns the cached response for a signature, sending the request
+// only on a cache miss
+func (sh *ShazamHandler) lookup(ctx context.Context, signatureURI string, jsonBody []byte) (*ShazamResponse, error) {
+	if sh.cache == nil {
+		return sh.postToEndpoints(ctx, jsonBody)
+	}
+
+	key := signatureKey(signatureURI)
+	if resp, ok := sh.cache.get(key); ok {
+		return resp, nil
+	}
+	resp, err := sh.postToEndpoints(ctx, jsonBody)
+	if err != nil {
+		return nil, err
+	}
+	sh.cache.put(key, resp)
+	return resp, nil
+}
+
+// postToEndpoints sends the match request to the first endpoint still
+// answering, falling back to the next when one answers 404 or 410 as it has
+// been moved or retired. Later requests skip the endpoints found gone. The
+// error from the last endpoint is returned if none answer.
+func (sh *ShazamHandler) postToEndpoints(ctx context.Context, jsonBody []byte) (*ShazamResponse, error) {
+	var err error
+	for i := int(sh.endpoint.Load()); i < len(sh.requestURLs); i++ {
+		var resp *ShazamResponse
+		resp, err = sh.postWithRetry(ctx, sh.requestURLs[i], jsonBody)
+		if !endpointGone(err) {
+			return resp, err
+		}
+		sh.log().Debug("endpoint gone", "url", redactURL(sh.requestURLs[i]), "error", err)
+		// The last endpoint is kept, so there is always one to try
+		if i+1 < len(sh.requestURLs) {
+			sh.endpoint.CompareAndSwap(int32(i), int32(i+1))
+		}
+	}
+	return nil, err
+}
+
+// endpointGone reports whether an error means the endpoint no longer exists
+func endpointGone(err error) bool {
+	var statusErr *ErrUnexpectedStatus
+	return errors.As(err, &statusErr) &&
+		(statusErr.Code == http.StatusNotFound || statusErr.Code == http.StatusGone)
+}
+
+// postWithRetry sends the match request, retrying connection errors and
+// transient server errors with exponential backoff. A rate limited request is
+// retried once after the delay Shazam asks for.
+func (sh *ShazamHandler) postWithRetry(ctx context.Context, requestURL string, jsonBody []byte) (*ShazamResponse, error) {
+	maxAttempts := max(sh.maxAttempts, 1)
+	rateLimitRetried := false
+
+	for attempt := 1; ; attempt++ {
+		shazamResp, retryable, err := sh.post(ctx, requestURL, jsonBody)
+		if err == nil {
+			return shazamResp, nil
+		}
+
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			if rateLimitRetried {
+				return nil, err
+			}
+			rateLimitRetried = true
+			if err := sleepContext(ctx, rateLimitErr.RetryAfter); err != nil {
+				return nil, err
+			}
+			// Waiting out a rate limit doesn't count against the retry budget
+			attempt--
+			continue
+		}
+
+		if !retryable || attempt >= maxAttempts {
+			return nil, err
+		}
+		if err := sleepContext(ctx, sh.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// post sends a single match request to requestURL and reports whether a
+// failure is worth retrying
+func (sh *ShazamHandler) post(ctx context.Context, requestURL string, jsonBody []byte) (*ShazamResponse, bool, error) {
 	// Create HTTP request
-	req, err := http.NewRequest("POST", *sh.requestURL, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(jsonBody))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
+	// Set headers, letting the configured ones replace the defaults except
+	// for those the request can't do without
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.114 Safari/537.36")
+	for key, values := range sh.headers {
+		req.Header[http.CanonicalHeaderKey(key)] = slices.Clone(values)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Asking for compression ourselves means the transport leaves the body
+	// for decodeBody to decompress
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
 
 	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := sh.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		sh.log().Debug("match request failed", "url", redactURL(requestURL), "error", err)
+		// Connection errors are transient unless we were cancelled
+		return nil, ctx.Err() == nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer resp.Body.Close()
+	sh.log().Debug("match request sent", "url", redactURL(requestURL), "status", resp.StatusCode)
+	defer func() {
+		// Drain the body so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
 
 	// Check response status
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			retryAfter = sh.retryBaseDelay
+		}
+		return nil, false, &RateLimitError{RetryAfter: retryAfter}
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, retryableStatus(resp.StatusCode), &ErrUnexpectedStatus{Code: resp.StatusCode}
 	}
 
 	// Parse response
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: failed to decompress: %w", ErrDecodeResponse, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("failed to read response: %w", err)
+	}
 	var shazamResp ShazamResponse
-	if err := json.NewDecoder(resp.Body).Decode(&shazamResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	if err := json.Unmarshal(data, &shazamResp); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrDecodeResponse, err)
+	}
+	if sh.keepRaw {
+		shazamResp.Raw = data
 	}
+	return &shazamResp, false, nil
+}
 
-	// Create song object from response
-	timestamp := c.GetTimestamp()
-	title := shazamResp.Track.Title
-	artist := shazamResp.Track.Subtitle
+// decodeBody returns the response body decompressed according to its
+// Content-Encoding. Deflate bodies are meant to be zlib wrapped, but raw
+// deflate data is accepted too as some servers send it.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		body := bufio.NewReader(resp.Body)
+		header, err := body.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		// A zlib header is a deflate method byte and a checksum over both
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(body)
+		}
+		return flate.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
 
-	return &song.Song{
-		SongTitle:      &title,
-		ArtistName:     &artist,
-		TimestampFound: &timestamp,
-	}, nil
+// parseRetryAfter parses a Retry-After header given either as a number of
+// seconds or as an HTTP date relative to now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
 }
 
-// Peak represents a frequency peak in the audio
-type Peak struct {
-	Frequency    float64
-	FrequencyBin int
-	Magnitude    int
-	TimeIndex    int
+// retryableStatus reports whether an HTTP status indicates a transient failure
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
 }
 
-// findFrequencyPeaks finds significant peaks in the frequency domain
-func findFrequencyPeaks(fftResult []complex128, sampleRate int) []Peak {
-	const (
-		minMagnitude = 1000 // Minimum magnitude to consider a peak
-		windowSize   = 1024 // FFT window size
-		hopSize      = 128  // Number of samples between windows
-	)
+// backoff returns the delay before the given retry attempt: the base delay
+// doubled for each previous retry, plus up to 50% random jitter
+func (sh *ShazamHandler) backoff(attempt int) time.Duration {
+	delay := sh.retryBaseDelay << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay + rand.N(delay/2+1)
+}
 
-	peaks := make([]Peak, 0)
-	magnitudes := make([]float64, len(fftResult))
+// sleepContext waits for d or until ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	// Calculate magnitudes
-	for i, c := range fftResult {
-		magnitudes[i] = math.Sqrt(real(c)*real(c) + imag(c)*imag(c))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
+}
 
-	// Find local maxima
-	for i := 1; i < len(magnitudes)-1; i++ {
-		if magnitudes[i] > minMagnitude &&
-			magnitudes[i] > magnitudes[i-1] &&
-			magnitudes[i] > magnitudes[i+1] {
-			// Convert to frequency bin
-			freqBin := i * sampleRate / windowSize
-			// Convert to actual frequency
-			freq := float64(freqBin) * float64(sampleRate) / float64(windowSize)
+// Match identifies every song in the stream, reading chunks until the stream
+// reports io.EOF or ctx is cancelled. Songs are added with AddFind, so repeat
+// matches of a song within the dedup window are collapsed into the first one.
+// The slice returned is the handler's own, so it should not be read while
+// songs may still be added to it; Finds returns a copy that can be.
+func (sh *ShazamHandler) Match(ctx context.Context, stream audiostream.Stream) (*[]*song.Song, error) {
+	if sh.concurrency > 1 && sh.adaptive.max == 0 {
+		return sh.finds, sh.matchConcurrently(ctx, stream)
+	}
 
-			peaks = append(peaks, Peak{
-				Frequency:    freq,
-				FrequencyBin: freqBin,
-				Magnitude:    int(magnitudes[i]),
-				TimeIndex:    i / hopSize,
-			})
+	for {
+		found, _, err := sh.nextMatch(ctx, stream)
+		if err == io.EOF {
+			return sh.finds, nil
 		}
+		if err != nil {
+			return sh.finds, err
+		}
+		sh.AddFind(found)
 	}
+}
 
-	return peaks
+// matchResult is the outcome of matching the chunk at index in the stream
+type matchResult struct {
+	index int
+	chunk audiostream.Chunk
+	found *song.Song
+	err   error
 }
 
-// getFrequencyBand determines which frequency band a peak belongs to
-func getFrequencyBand(frequency float64) audiostream.FrequencyBand {
-	switch {
-	case frequency < 250:
-		return audiostream.LowBand
-	case frequency < 520:
-		return audiostream.MidBand
-	case frequency < 1450:
-		return audiostream.HighBand
-	default:
-		return audiostream.VeryHighBand
+// matchConcurrently is Match with up to sh.concurrency match requests in
+// flight. Chunks are read in order by one goroutine and matched by a pool of
+// workers, and the results are added as finds in stream order. The first
+// failure cancels the outstanding requests and is returned.
+func (sh *ShazamHandler) matchConcurrently(ctx context.Context, stream audiostream.Stream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		index int
+		chunk audiostream.Chunk
+	}
+	jobs := make(chan job)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			if err := ctx.Err(); err != nil {
+				readErr <- err
+				return
+			}
+			chunk, err := stream.GetChunk()
+			if errors.Is(err, io.EOF) {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- fmt.Errorf("failed to get chunk: %w", err)
+				return
+			}
+
+			select {
+			case jobs <- job{index: index, chunk: chunk}:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	results := make(chan matchResult)
+	var wg sync.WaitGroup
+	for range sh.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case j, ok := <-jobs:
+					if !ok {
+						return
+					}
+					found, err := sh.matchWithRetry(ctx, stream, j.chunk)
+					results <- matchResult{index: j.index, chunk: j.chunk, found: found, err: err}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results arrive in any order, so hold them until the ones before have
+	// been added
+	pending := make(map[int]matchResult)
+	next := 0
+	var failure error
+	for result := range results {
+		if result.err != nil && failure == nil {
+			failure = result.err
+			cancel()
+		}
+		pending[result.index] = result
+		for {
+			result, ok := pending[next]
+			if !ok || result.err != nil {
+				break
+			}
+			delete(pending, next)
+			next++
+			sh.reportProgress(stream, result.chunk)
+			if result.found != nil && sh.confidentEnough(result.found) {
+				sh.AddFind(result.found)
+			}
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+
+	select {
+	case err := <-readErr:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MatchStream identifies every song in the stream like Match, but returns the
+// songs rather than adding them to the handler's finds. Each run of
+// consecutive matches of the same song becomes one Song, found at the run's
+// first chunk and with a Duration lasting to the end of its last.
+func (sh *ShazamHandler) MatchStream(ctx context.Context, stream audiostream.Stream) ([]*song.Song, error) {
+	var songs []*song.Song
+	for {
+		found, chunk, err := sh.nextMatch(ctx, stream)
+		if err == io.EOF {
+			return songs, nil
+		}
+		if err != nil {
+			return songs, err
+		}
+
+		if n := len(songs); n > 0 && sameTrack(songs[n-1], found) {
+			duration := chunk.GetTimestamp() + chunk.GetDuration() - *songs[n-1].TimestampFound
+			songs[n-1].Duration = &duration
+			continue
+		}
+
+		duration := chunk.GetDuration()
+		found.Duration = &duration
+		songs = append(songs, found)
+	}
+}
+
+// MatchStreaming identifies songs in the stream like MatchStream, but calls
+// onMatch with each confident match as soon as its chunk is identified rather
+// than returning them at the end. Matches aren't collapsed, so a song heard
+// over several chunks is reported for each of them. onMatch is not called
+// once ctx is cancelled. It returns nil when the stream ends.
+func (sh *ShazamHandler) MatchStreaming(ctx context.Context, stream audiostream.Stream, onMatch func(*song.Song)) error {
+	for {
+		found, _, err := sh.nextMatch(ctx, stream)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The request may have completed just as ctx was cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		onMatch(found)
+	}
+}
+
+// nextMatch reads chunks until one confidently matches a song, returning the
+// song and the chunk it was found in. It returns io.EOF once the stream ends.
+func (sh *ShazamHandler) nextMatch(ctx context.Context, stream audiostream.Stream) (*song.Song, audiostream.Chunk, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if err := sh.sizeNextChunk(stream); err != nil {
+			return nil, nil, err
+		}
+		chunk, err := stream.GetChunk()
+		if errors.Is(err, io.EOF) {
+			return nil, nil, io.EOF
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get chunk: %w", err)
+		}
+
+		found, err := sh.matchWithRetry(ctx, stream, chunk)
+		if err != nil {
+			return nil, nil, err
+		}
+		sh.reportProgress(stream, chunk)
+		matched := found != nil && sh.confidentEnough(found)
+		sh.adaptChunkSize(matched)
+		if matched {
+			return found, chunk, nil
+		}
+	}
+}
+
+// confidentEnough reports whether a match meets the minimum confidence. Songs
+// without a confidence score are only kept when no minimum is set.
+func (sh *ShazamHandler) confidentEnough(found *song.Song) bool {
+	if sh.minConfidence <= 0 {
+		return true
+	}
+	return found.Confidence != nil && *found.Confidence >= sh.minConfidence
+}
+
+// sameTrack reports whether two songs have the same title and artist, ignoring
+// case and surrounding space. Unlike song.Song.Equal it ignores the album,
+// which Shazam doesn't always return for the same track.
+func sameTrack(a, b *song.Song) bool {
+	return strings.EqualFold(trimmedField(a.SongTitle), trimmedField(b.SongTitle)) &&
+		strings.EqualFold(trimmedField(a.ArtistName), trimmedField(b.ArtistName))
+}
+
+// trimmedField returns an optional field trimmed of space, or "" when it is
+// missing
+func trimmedField(field *string) string {
+	if field == nil {
+		return ""
 	}
+	return strings.TrimSpace(*field)
 }
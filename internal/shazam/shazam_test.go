@@ -0,0 +1,2028 @@
+package shazam
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"listr/internal/audiostream"
+	"listr/internal/audiostream/audiostreamtest"
+	"listr/internal/song"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFakeStream returns a stream of n ten second chunks of test audio
+func newFakeStream(n int) *audiostreamtest.StaticStream {
+	return audiostreamtest.NewChunkStream(audiostreamtest.PatternChunks(n, 10*time.Second)...)
+}
+
+// testChunk returns a ten second chunk of test audio
+func testChunk() audiostream.Chunk {
+	return audiostreamtest.PatternChunks(1, 10*time.Second)[0]
+}
+
+// trackResponse builds a Shazam response body for the given track
+func trackResponse(title, artist string) ShazamResponse {
+	var resp ShazamResponse
+	resp.Track.Title = title
+	resp.Track.Subtitle = artist
+	return resp
+}
+
+// skewedResponse builds a Shazam response for a track matched with the given
+// time skew
+func skewedResponse(title, artist string, timeSkew float64) ShazamResponse {
+	resp := trackResponse(title, artist)
+	resp.Matches = []ShazamMatch{{Offset: 42.5, TimeSkew: timeSkew}}
+	return resp
+}
+
+// newSequenceServer returns a server answering successive requests with the
+// given responses, repeating the last one once they run out
+func newSequenceServer(t *testing.T, responses ...ShazamResponse) *httptest.Server {
+	t.Helper()
+
+	var mu sync.Mutex
+	next := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resp := responses[min(next, len(responses)-1)]
+		next++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestHandler returns an initialized handler pointed at the test server
+func newTestHandler(server *httptest.Server) *ShazamHandler {
+	sh := &ShazamHandler{}
+	sh.Init()
+	requestURL := server.URL + "/tag"
+	sh.requestURLs = []string{requestURL}
+	return sh
+}
+
+func TestMatch(t *testing.T) {
+	server := newSequenceServer(t,
+		trackResponse("Song A", "Artist A"),
+		trackResponse("Song A", "Artist A"),
+		trackResponse("song a ", "ARTIST A"),
+		trackResponse("Song B", "Artist B"),
+		trackResponse("Song A", "Artist A"),
+		ShazamResponse{},
+	)
+	sh := newTestHandler(server)
+	// Short enough that Song A coming back after Song B is a new play
+	sh.SetDedupWindow(15 * time.Second)
+
+	finds, err := sh.Match(context.Background(), newFakeStream(6))
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+
+	want := []struct {
+		title     string
+		timestamp time.Duration
+	}{
+		{title: "Song A", timestamp: 0},
+		{title: "Song B", timestamp: 30 * time.Second},
+		{title: "Song A", timestamp: 40 * time.Second},
+	}
+	if len(*finds) != len(want) {
+		t.Fatalf("Match() returned %d songs, want %d", len(*finds), len(want))
+	}
+	for i, found := range *finds {
+		if *found.SongTitle != want[i].title {
+			t.Errorf("finds[%d].SongTitle = %q, want %q", i, *found.SongTitle, want[i].title)
+		}
+		if *found.TimestampFound != want[i].timestamp {
+			t.Errorf("finds[%d].TimestampFound = %v, want %v", i, *found.TimestampFound, want[i].timestamp)
+		}
+	}
+}
+
+func TestAddFindConcurrent(t *testing.T) {
+	sh := &ShazamHandler{}
+	sh.Init()
+
+	const goroutines, songs = 16, 50
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range songs {
+				// Every goroutine adds the same songs, each heard at once
+				title := fmt.Sprintf("Song %d", i)
+				artist := "Artist"
+				timestamp := time.Duration(i) * time.Minute
+				if sh.AddFind(&song.Song{SongTitle: &title, ArtistName: &artist, TimestampFound: &timestamp}) {
+					added.Add(1)
+				}
+				if g == 0 {
+					sh.Finds()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each song is added exactly once, by whichever goroutine got there first
+	if got := len(sh.Finds()); got != songs || added.Load() != songs {
+		t.Errorf("Finds() has %d songs with %d added, want %d of each", got, added.Load(), songs)
+	}
+}
+
+func TestAddFind(t *testing.T) {
+	type find struct {
+		title     string
+		timestamp time.Duration
+	}
+	tests := []struct {
+		name   string
+		window time.Duration
+		adds   []find
+		want   []find
+	}{
+		{
+			name: "Near duplicates",
+			adds: []find{{"Song A", 0}, {"Song A", 10 * time.Second}, {"Song A", 25 * time.Second}},
+			want: []find{{"Song A", 0}},
+		},
+		{
+			name: "Heard throughout",
+			adds: []find{{"Song A", 0}, {"Song A", 25 * time.Second}, {"Song A", 50 * time.Second}, {"Song A", 75 * time.Second}},
+			want: []find{{"Song A", 0}},
+		},
+		{
+			name: "Back within the window",
+			adds: []find{{"Song A", 0}, {"Song B", 10 * time.Second}, {"Song A", 20 * time.Second}},
+			want: []find{{"Song A", 0}, {"Song B", 10 * time.Second}},
+		},
+		{
+			name: "Distinct repeats",
+			adds: []find{{"Song A", 0}, {"Song B", 20 * time.Second}, {"Song A", 2 * time.Minute}},
+			want: []find{{"Song A", 0}, {"Song B", 20 * time.Second}, {"Song A", 2 * time.Minute}},
+		},
+		{
+			name:   "Custom window",
+			window: 5 * time.Second,
+			adds:   []find{{"Song A", 0}, {"Song A", 4 * time.Second}, {"Song A", 10 * time.Second}},
+			want:   []find{{"Song A", 0}, {"Song A", 10 * time.Second}},
+		},
+		{
+			name: "Out of order",
+			adds: []find{{"Song A", 40 * time.Second}, {"Song A", 20 * time.Second}},
+			want: []find{{"Song A", 40 * time.Second}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := &ShazamHandler{}
+			sh.Init()
+			sh.SetDedupWindow(tt.window)
+
+			for _, add := range tt.adds {
+				title, artist, timestamp := add.title, "Artist", add.timestamp
+				sh.AddFind(&song.Song{SongTitle: &title, ArtistName: &artist, TimestampFound: &timestamp})
+			}
+
+			finds := sh.Finds()
+			if len(finds) != len(tt.want) {
+				t.Fatalf("Finds() returned %d songs, want %d", len(finds), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if *finds[i].SongTitle != want.title || *finds[i].TimestampFound != want.timestamp {
+					t.Errorf("finds[%d] = %q at %v, want %q at %v",
+						i, *finds[i].SongTitle, *finds[i].TimestampFound, want.title, want.timestamp)
+				}
+			}
+		})
+	}
+}
+
+func TestAddFindIgnoresAlbum(t *testing.T) {
+	sh := &ShazamHandler{}
+	sh.Init()
+
+	// Shazam names the album for one hit on the track and not the next
+	title, artist, album := "Song A", "Artist A", "Album A"
+	first, second := time.Duration(0), 10*time.Second
+	sh.AddFind(&song.Song{SongTitle: &title, ArtistName: &artist, AlbumName: &album, TimestampFound: &first})
+	otherTitle, otherArtist := " song a", "ARTIST A "
+	if sh.AddFind(&song.Song{SongTitle: &otherTitle, ArtistName: &otherArtist, TimestampFound: &second}) {
+		t.Error("AddFind() added the same track without its album, want it skipped")
+	}
+	if got := len(sh.Finds()); got != 1 {
+		t.Errorf("Finds() returned %d songs, want 1", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	server := newSequenceServer(t,
+		trackResponse("Song A", "Artist A"),
+		trackResponse("Song B", "Artist B"),
+		trackResponse("Song A", "Artist A"),
+		trackResponse("Song C", "Artist C"),
+	)
+	sh := newTestHandler(server)
+	sh.SetCacheSize(8)
+	sh.SetRetries(5, time.Millisecond)
+	requestURL := sh.requestURLs[0]
+
+	first, err := sh.Match(context.Background(), newFakeStream(2))
+	if err != nil {
+		t.Fatalf("first Match() error = %v", err)
+	}
+	firstFinds := slices.Clone(*first)
+
+	sh.Reset()
+	if len(sh.Finds()) != 0 {
+		t.Errorf("Finds() after Reset() = %v, want none", sh.Finds())
+	}
+	if sh.requestURLs[0] != requestURL || sh.maxAttempts != 5 || sh.cache == nil {
+		t.Error("Reset() changed the handler's settings")
+	}
+
+	// The second stream has the same audio as the first, so only a cleared
+	// cache sends its chunks to the server and hears Song A and C
+	second, err := sh.Match(context.Background(), newFakeStream(2))
+	if err != nil {
+		t.Fatalf("second Match() error = %v", err)
+	}
+
+	titles := func(songs []*song.Song) []string {
+		var titles []string
+		for _, s := range songs {
+			titles = append(titles, *s.SongTitle)
+		}
+		return titles
+	}
+	if got, want := titles(*second), []string{"Song A", "Song C"}; !slices.Equal(got, want) {
+		t.Errorf("second Match() = %v, want %v", got, want)
+	}
+	if got, want := titles(*first), titles(firstFinds); !slices.Equal(got, want) {
+		t.Errorf("first Match() result changed to %v, want %v", got, want)
+	}
+}
+
+func TestMatchStream(t *testing.T) {
+	server := newSequenceServer(t,
+		trackResponse("Song A", "Artist A"),
+		trackResponse("Song A", "Artist A"),
+		ShazamResponse{},
+		trackResponse("song a ", "ARTIST A"),
+		trackResponse("Song B", "Artist B"),
+		trackResponse("Song A", "Artist A"),
+		ShazamResponse{},
+	)
+	sh := newTestHandler(server)
+
+	songs, err := sh.MatchStream(context.Background(), newFakeStream(7))
+	if err != nil {
+		t.Fatalf("MatchStream() error = %v", err)
+	}
+
+	want := []struct {
+		title     string
+		timestamp time.Duration
+		duration  time.Duration
+	}{
+		{title: "Song A", timestamp: 0, duration: 40 * time.Second},
+		{title: "Song B", timestamp: 40 * time.Second, duration: 10 * time.Second},
+		{title: "Song A", timestamp: 50 * time.Second, duration: 10 * time.Second},
+	}
+	if len(songs) != len(want) {
+		t.Fatalf("MatchStream() returned %d songs, want %d", len(songs), len(want))
+	}
+	for i, found := range songs {
+		if *found.SongTitle != want[i].title {
+			t.Errorf("songs[%d].SongTitle = %q, want %q", i, *found.SongTitle, want[i].title)
+		}
+		if *found.TimestampFound != want[i].timestamp {
+			t.Errorf("songs[%d].TimestampFound = %v, want %v", i, *found.TimestampFound, want[i].timestamp)
+		}
+		if found.Duration == nil || *found.Duration != want[i].duration {
+			t.Errorf("songs[%d].Duration = %v, want %v", i, found.Duration, want[i].duration)
+		}
+	}
+	if len(*sh.finds) != 0 {
+		t.Errorf("MatchStream() added %d songs to the handler's finds, want 0", len(*sh.finds))
+	}
+}
+
+// lengthStream is a test stream that knows its total length
+type lengthStream struct {
+	*audiostreamtest.StaticStream
+	length time.Duration
+}
+
+func (ls lengthStream) GetLength() time.Duration { return ls.length }
+
+func TestMatchProgress(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      audiostream.Stream
+		concurrency int
+		wantTotal   time.Duration
+	}{
+		{name: "Known length", stream: lengthStream{newFakeStream(4), 35 * time.Second}, wantTotal: 35 * time.Second},
+		{name: "Live stream", stream: newFakeStream(4)},
+		{name: "Concurrent", stream: lengthStream{newFakeStream(4), 35 * time.Second}, concurrency: 3, wantTotal: 35 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := newTestHandler(newSequenceServer(t, ShazamResponse{}))
+			sh.SetConcurrency(tt.concurrency)
+			var done []time.Duration
+			sh.SetProgress(func(d, total time.Duration) {
+				if total != tt.wantTotal {
+					t.Errorf("progress total = %v, want %v", total, tt.wantTotal)
+				}
+				done = append(done, d)
+			})
+
+			if _, err := sh.Match(context.Background(), tt.stream); err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+
+			// The last chunk runs past the end, so is capped at the length
+			want := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 40 * time.Second}
+			if tt.wantTotal > 0 {
+				want[3] = tt.wantTotal
+			}
+			if !slices.Equal(done, want) {
+				t.Errorf("progress reported %v, want %v", done, want)
+			}
+		})
+	}
+}
+
+// resizableStream is a stream of silent chunks as long as its chunk
+// duration, recording the duration of each chunk served
+type resizableStream struct {
+	chunkDuration time.Duration
+	position      time.Duration
+	length        time.Duration
+	served        []time.Duration
+}
+
+func (rs *resizableStream) InitStream(V any) error { return nil }
+func (rs *resizableStream) Close() error           { return nil }
+
+func (rs *resizableStream) SetChunkDuration(d time.Duration) error {
+	rs.chunkDuration = d
+	return nil
+}
+
+func (rs *resizableStream) GetChunk() (audiostream.Chunk, error) {
+	if rs.position >= rs.length {
+		return nil, io.EOF
+	}
+	// 8kHz keeps the silent audio small
+	chunk := audiostream.NewPCMChunk(make([]byte, int(rs.chunkDuration.Seconds()*16000)), rs.position, 8000)
+	rs.position += rs.chunkDuration
+	rs.served = append(rs.served, rs.chunkDuration)
+	return chunk, nil
+}
+
+func TestMatchAdaptiveChunks(t *testing.T) {
+	noMatch := ShazamResponse{}
+	songA := trackResponse("Song A", "Artist A")
+	songB := trackResponse("Song B", "Artist B")
+	server := newSequenceServer(t, noMatch, noMatch, noMatch, songA, songA, songA, noMatch, songB)
+
+	sh := newTestHandler(server)
+	sh.SetConcurrency(4) // Ignored while chunks are sized adaptively
+	if err := sh.SetAdaptiveChunks(5*time.Second, 20*time.Second); err != nil {
+		t.Fatalf("SetAdaptiveChunks() error = %v", err)
+	}
+	stream := &resizableStream{chunkDuration: 10 * time.Second, length: 110 * time.Second}
+	finds, err := sh.Match(context.Background(), stream)
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+
+	// Starting at the longest, misses halve the duration down to the
+	// shortest and matches double it back up to the longest
+	want := []time.Duration{20, 10, 5, 5, 10, 20, 20, 10, 20}
+	for i := range want {
+		want[i] *= time.Second
+	}
+	if !slices.Equal(stream.served, want) {
+		t.Errorf("chunk durations = %v, want %v", stream.served, want)
+	}
+	if len(*finds) != 2 || *(*finds)[0].TimestampFound != 35*time.Second || *(*finds)[1].TimestampFound != 90*time.Second {
+		t.Errorf("Match() found %v, want Song A at 35s and Song B at 90s", *finds)
+	}
+}
+
+// toneSpanServer answers with a match only when a request's signature holds
+// peaks spanning at least minSpan, counting the requests it gets
+func toneSpanServer(t *testing.T, minSpan time.Duration, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var body struct {
+			Signature struct {
+				URI string `json:"uri"`
+			} `json:"signature"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		signature, err := audiostream.DecodeFromURI(body.Signature.URI)
+		if err != nil {
+			t.Errorf("DecodeFromURI() error = %v", err)
+		}
+
+		first, last := math.MaxInt, -1
+		for _, peaks := range signature.FrequencyBandToSoundPeaks {
+			for _, peak := range peaks {
+				first = min(first, peak.FFTPassNumber)
+				last = max(last, peak.FFTPassNumber)
+			}
+		}
+		var resp ShazamResponse
+		span := time.Duration(last-first) * hopSize * time.Second / time.Duration(signature.SampleRateHz)
+		if last >= 0 && span >= minSpan {
+			resp = trackResponse("Song A", "Artist A")
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMatchMissRetry(t *testing.T) {
+	// Two seconds of tone straddling the boundary of the first two chunks,
+	// in twelve seconds of silence
+	pcm := make([]byte, 12*32000)
+	for i := 3 * 16000; i < 5*16000; i++ {
+		sample := int16(10000 * math.Sin(2*math.Pi*1000*float64(i)/16000))
+		pcm[2*i] = byte(sample)
+		pcm[2*i+1] = byte(sample >> 8)
+	}
+	path := filepath.Join(t.TempDir(), "set.wav")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := audiostream.WriteWAV(file, pcm, 16000); err != nil {
+		t.Fatalf("WriteWAV() error = %v", err)
+	}
+	file.Close()
+
+	tests := []struct {
+		name         string
+		widen        time.Duration
+		concurrency  int
+		wantFinds    []time.Duration
+		wantRequests int32
+	}{
+		{name: "Off", widen: 0, wantRequests: 3},
+		// Each chunk misses with a second of the tone, and the retry of the
+		// first, covering both, finds the song
+		{name: "Widened", widen: 2 * time.Second, wantFinds: []time.Duration{0}, wantRequests: 6},
+		{name: "Concurrent", widen: 2 * time.Second, concurrency: 3, wantFinds: []time.Duration{0}, wantRequests: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			sh := newTestHandler(toneSpanServer(t, 1500*time.Millisecond, &requests))
+			sh.SetMissRetry(tt.widen)
+			sh.SetConcurrency(tt.concurrency)
+
+			stream := &audiostream.FileStream{}
+			stream.SetChunkDuration(4 * time.Second)
+			if err := stream.InitStream(path); err != nil {
+				t.Fatalf("InitStream() error = %v", err)
+			}
+			defer stream.Close()
+			finds, err := sh.Match(context.Background(), stream)
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+
+			var got []time.Duration
+			for _, find := range *finds {
+				got = append(got, *find.TimestampFound)
+			}
+			if !slices.Equal(got, tt.wantFinds) {
+				t.Errorf("Match() found songs at %v, want %v", got, tt.wantFinds)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestMatchMissRetryFixedStream(t *testing.T) {
+	// Streams that can't serve a window are matched chunk by chunk as before
+	server := newSequenceServer(t, ShazamResponse{}, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+	sh.SetMissRetry(5 * time.Second)
+	finds, err := sh.Match(context.Background(), newFakeStream(2))
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+	if len(*finds) != 1 || *(*finds)[0].TimestampFound != 10*time.Second {
+		t.Errorf("Match() found %v, want Song A at 10s", *finds)
+	}
+}
+
+func TestSetAdaptiveChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		wantErr  bool
+	}{
+		{name: "Off", min: 0, max: 0},
+		{name: "Bounds", min: 5 * time.Second, max: 20 * time.Second},
+		{name: "Fixed", min: 10 * time.Second, max: 10 * time.Second},
+		{name: "No minimum", min: 0, max: 20 * time.Second, wantErr: true},
+		{name: "Inverted", min: 20 * time.Second, max: 5 * time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := &ShazamHandler{}
+			if err := sh.SetAdaptiveChunks(tt.min, tt.max); (err != nil) != tt.wantErr {
+				t.Errorf("SetAdaptiveChunks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := NewShazamHandler(WithAdaptiveChunks(tt.min, tt.max)); (err != nil) != tt.wantErr {
+				t.Errorf("NewShazamHandler(WithAdaptiveChunks()) error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchAdaptiveChunksFixedStream(t *testing.T) {
+	sh := newTestHandler(newSequenceServer(t, ShazamResponse{}))
+	sh.SetAdaptiveChunks(5*time.Second, 20*time.Second)
+	// Hide SetChunkDuration so the stream can't be resized
+	stream := struct{ audiostream.Stream }{newFakeStream(1)}
+	if _, err := sh.Match(context.Background(), stream); err == nil {
+		t.Error("Match() error = nil, want error for a stream that can't be resized")
+	}
+}
+
+func TestMatchStreamPosition(t *testing.T) {
+	server := newSequenceServer(t,
+		ShazamResponse{},
+		ShazamResponse{},
+		trackResponse("Song A", "Artist A"),
+		ShazamResponse{},
+	)
+	sh := newTestHandler(server)
+
+	finds, err := sh.Match(context.Background(), newFakeStream(4))
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+	if len(*finds) != 1 {
+		t.Fatalf("Match() returned %d songs, want 1", len(*finds))
+	}
+	// Found in the third ten second chunk
+	if got := *(*finds)[0].TimestampFound; got < 20*time.Second || got >= 30*time.Second {
+		t.Errorf("TimestampFound = %v, want within the third chunk, 20s to 30s", got)
+	}
+}
+
+func TestSendMatchRequestCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	sh := newTestHandler(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := sh.SendMatchRequest(ctx, testChunk())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SendMatchRequest() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendMatchRequest() took %v after cancel", elapsed)
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	newConns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			newConns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	sh := &ShazamHandler{}
+	sh.InitWithClient(server.Client())
+	requestURL := server.URL + "/tag"
+	sh.requestURLs = []string{requestURL}
+
+	for _, chunk := range audiostreamtest.PatternChunks(5, 10*time.Second) {
+		if _, err := sh.SendMatchRequest(context.Background(), chunk); err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if newConns != 1 {
+		t.Errorf("server saw %d connections, want 1", newConns)
+	}
+}
+
+func TestSendMatchRequestNoMatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"matches": [], "tagid": "6b3e4bb0-5c5a-4b4c-9a55-5a3ef5f4c1e2"}`)
+	}))
+	defer server.Close()
+	sh := newTestHandler(server)
+
+	found, err := sh.SendMatchRequest(context.Background(), testChunk())
+	if found != nil || err != nil {
+		t.Errorf("SendMatchRequest() = %v, %v, want nil, nil", found, err)
+	}
+}
+
+func TestSendMatchRequestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "Fails twice then succeeds",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			wantErr:      false,
+			wantRequests: 3,
+		},
+		{
+			name:         "Retry budget exhausted",
+			statuses:     []int{http.StatusInternalServerError, http.StatusGatewayTimeout, http.StatusServiceUnavailable, http.StatusOK},
+			wantErr:      true,
+			wantRequests: 3,
+		},
+		{
+			name:         "Bad request is not retried",
+			statuses:     []int{http.StatusBadRequest, http.StatusOK},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := tt.statuses[requests]
+				requests++
+				mu.Unlock()
+
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+			}))
+			defer server.Close()
+			sh := newTestHandler(server)
+			sh.SetRetries(3, time.Millisecond)
+
+			found, err := sh.SendMatchRequest(context.Background(), testChunk())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SendMatchRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && found == nil {
+				t.Errorf("SendMatchRequest() returned no song")
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server saw %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "Seconds", value: "120", want: 2 * time.Minute, wantOK: true},
+		{name: "Zero seconds", value: "0", want: 0, wantOK: true},
+		{name: "HTTP date", value: "Sat, 01 Mar 2025 12:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{name: "HTTP date in the past", value: "Sat, 01 Mar 2025 11:59:00 GMT", want: 0, wantOK: true},
+		{name: "Empty", value: "", wantOK: false},
+		{name: "Negative seconds", value: "-5", wantOK: false},
+		{name: "Garbage", value: "soon", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRetryAfter(%q) ok = %v, want %v", tt.value, ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestRateLimited(t *testing.T) {
+	newServer := func(retryAfter ...string) (*httptest.Server, *int) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() { requests++ }()
+			if requests < len(retryAfter) {
+				w.Header().Set("Retry-After", retryAfter[requests])
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+		}))
+		t.Cleanup(server.Close)
+		return server, &requests
+	}
+
+	t.Run("Retries once after delay", func(t *testing.T) {
+		server, requests := newServer("0")
+		sh := newTestHandler(server)
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil || found == nil {
+			t.Fatalf("SendMatchRequest() = %v, %v, want song", found, err)
+		}
+		if *requests != 2 {
+			t.Errorf("server saw %d requests, want 2", *requests)
+		}
+	})
+
+	t.Run("Still rate limited", func(t *testing.T) {
+		server, requests := newServer(time.Now().UTC().Format(http.TimeFormat), "120")
+		sh := newTestHandler(server)
+
+		_, err := sh.SendMatchRequest(context.Background(), testChunk())
+		var rateLimitErr *RateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			t.Fatalf("SendMatchRequest() error = %v, want RateLimitError", err)
+		}
+		if rateLimitErr.RetryAfter != 2*time.Minute {
+			t.Errorf("RetryAfter = %v, want %v", rateLimitErr.RetryAfter, 2*time.Minute)
+		}
+		if *requests != 2 {
+			t.Errorf("server saw %d requests, want 2", *requests)
+		}
+	})
+}
+
+func TestInitWithOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       ShazamOptions
+		wantPrefix string
+	}{
+		{
+			name:       "Defaults",
+			opts:       ShazamOptions{},
+			wantPrefix: "/discovery/v5/en/US/desktop_mac/-/tag/",
+		},
+		{
+			name:       "French",
+			opts:       ShazamOptions{Language: "fr", Country: "FR"},
+			wantPrefix: "/discovery/v5/fr/FR/desktop_mac/-/tag/",
+		},
+		{
+			name:       "Custom device",
+			opts:       ShazamOptions{Language: "de", Country: "DE", Device: "iphone"},
+			wantPrefix: "/discovery/v5/de/DE/iphone/-/tag/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := &ShazamHandler{}
+			if err := sh.InitWithOptions(tt.opts); err != nil {
+				t.Fatalf("InitWithOptions() error = %v", err)
+			}
+
+			requestURL, err := url.Parse(sh.requestURLs[0])
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			if !strings.HasPrefix(requestURL.Path, tt.wantPrefix) {
+				t.Errorf("request path = %q, want prefix %q", requestURL.Path, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	defer server.Close()
+
+	headers := http.Header{}
+	headers.Set("Cookie", "session=abc")
+	headers.Set("DNT", "1")
+	headers.Set("User-Agent", "listr-test")
+	headers["content-type"] = []string{"text/plain"}
+	sh := &ShazamHandler{}
+	if err := sh.InitWithOptions(ShazamOptions{Headers: headers}); err != nil {
+		t.Fatalf("InitWithOptions() error = %v", err)
+	}
+	requestURL := server.URL + "/tag"
+	sh.requestURLs = []string{requestURL}
+	// Later changes to the options don't reach the handler
+	headers.Set("Cookie", "session=changed")
+
+	if _, err := sh.SendMatchRequest(context.Background(), testChunk()); err != nil {
+		t.Fatalf("SendMatchRequest() error = %v", err)
+	}
+
+	want := map[string]string{
+		"Cookie":       "session=abc",
+		"Dnt":          "1",
+		"User-Agent":   "listr-test",
+		"Content-Type": "application/json",
+	}
+	for key, value := range want {
+		if got.Get(key) != value || len(got.Values(key)) != 1 {
+			t.Errorf("header %s = %q, want %q", key, got.Values(key), value)
+		}
+	}
+}
+
+// newFixtureServer returns a server answering every request with the named
+// file from testdata
+func newFixtureServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSendMatchRequestAlbum(t *testing.T) {
+	t.Run("Album present", func(t *testing.T) {
+		sh := newTestHandler(newFixtureServer(t, "match_response.json"))
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		if found.AlbumName == nil || *found.AlbumName != "Windowlicker - EP" {
+			t.Errorf("AlbumName = %v, want %q", found.AlbumName, "Windowlicker - EP")
+		}
+	})
+
+	t.Run("Album missing", func(t *testing.T) {
+		sh := newTestHandler(newSequenceServer(t, trackResponse("Song A", "Artist A")))
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		if found.AlbumName != nil {
+			t.Errorf("AlbumName = %q, want nil", *found.AlbumName)
+		}
+	})
+}
+
+func TestSendMatchRequestNotMusic(t *testing.T) {
+	sh := newTestHandler(newFixtureServer(t, "not_music_response.json"))
+
+	found, err := sh.SendMatchRequest(context.Background(), testChunk())
+	if found != nil || !errors.Is(err, ErrNotMusic) {
+		t.Fatalf("SendMatchRequest() = %v, %v, want ErrNotMusic", found, err)
+	}
+	if !strings.Contains(err.Error(), "speech") || !strings.Contains(err.Error(), "12s") {
+		t.Errorf("SendMatchRequest() error = %v, want the classification and retry delay", err)
+	}
+
+	// Misses aren't classified, even those with a retry delay, and stay
+	// plain misses
+	for name, server := range map[string]*httptest.Server{
+		"Retry delay": newFixtureServer(t, "no_match_response.json"),
+		"Empty":       newSequenceServer(t, ShazamResponse{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			found, err := newTestHandler(server).SendMatchRequest(context.Background(), testChunk())
+			if found != nil || err != nil {
+				t.Errorf("SendMatchRequest() = %v, %v, want no match and no error", found, err)
+			}
+		})
+	}
+}
+
+func TestMatchSkipsNotMusic(t *testing.T) {
+	// Talk over the first two chunks, then a song
+	noMusic, err := os.ReadFile(filepath.Join("testdata", "not_music_response.json"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.Write(noMusic)
+			return
+		}
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	defer server.Close()
+
+	sh := newTestHandler(server)
+	finds, err := sh.Match(context.Background(), newFakeStream(3))
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+	if len(*finds) != 1 || *(*finds)[0].TimestampFound != 20*time.Second {
+		t.Errorf("Match() found %v, want Song A at 20s", *finds)
+	}
+}
+
+func TestSendMatchRequestAlbumArt(t *testing.T) {
+	t.Run("Cover art present", func(t *testing.T) {
+		sh := newTestHandler(newFixtureServer(t, "match_response.json"))
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		want := "https://is1-ssl.mzstatic.com/image/thumb/Music115/v4/12/34/56/cover/400x400cc.jpg"
+		if found.AlbumArtURL == nil || *found.AlbumArtURL != want {
+			t.Errorf("AlbumArtURL = %v, want %q", found.AlbumArtURL, want)
+		}
+	})
+
+	// Responses with no usable cover art, down to no images object at all
+	for name, body := range map[string]string{
+		"No images":       `{"track":{"title":"Song A","subtitle":"Artist A"}}`,
+		"Null images":     `{"track":{"title":"Song A","subtitle":"Artist A","images":null}}`,
+		"No cover art":    `{"track":{"title":"Song A","subtitle":"Artist A","images":{"background":"https://example.com/bg.jpg"}}}`,
+		"Empty cover art": `{"track":{"title":"Song A","subtitle":"Artist A","images":{"coverart":""}}}`,
+		"Blank cover art": `{"track":{"title":"Song A","subtitle":"Artist A","images":{"coverart":"  "}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			}))
+			defer server.Close()
+			sh := newTestHandler(server)
+
+			found, err := sh.SendMatchRequest(context.Background(), testChunk())
+			if err != nil {
+				t.Fatalf("SendMatchRequest() error = %v", err)
+			}
+			if found == nil || *found.SongTitle != "Song A" {
+				t.Fatalf("SendMatchRequest() = %v, want Song A", found)
+			}
+			if found.AlbumArtURL != nil {
+				t.Errorf("AlbumArtURL = %q, want nil", *found.AlbumArtURL)
+			}
+		})
+	}
+}
+
+func TestShazamMatchConfidence(t *testing.T) {
+	tests := []struct {
+		name  string
+		match ShazamMatch
+		want  float64
+	}{
+		{name: "Exact", match: ShazamMatch{}, want: 1},
+		{name: "Small skew", match: ShazamMatch{TimeSkew: 0.001, FrequencySkew: -0.001}, want: 0.8},
+		{name: "Skew at limit", match: ShazamMatch{TimeSkew: 0.01}, want: 0},
+		{name: "Skew past limit", match: ShazamMatch{TimeSkew: -0.5}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.Confidence(); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Confidence() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchMinConfidence(t *testing.T) {
+	server := newSequenceServer(t,
+		skewedResponse("Song A", "Artist A", 0.0002),
+		skewedResponse("Song B", "Artist B", 0.009),
+		trackResponse("Song C", "Artist C"),
+		skewedResponse("Song D", "Artist D", -0.001),
+	)
+	sh := newTestHandler(server)
+	sh.SetMinConfidence(0.5)
+
+	finds, err := sh.Match(context.Background(), newFakeStream(4))
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+
+	want := []string{"Song A", "Song D"}
+	if len(*finds) != len(want) {
+		t.Fatalf("Match() returned %d songs, want %d", len(*finds), len(want))
+	}
+	for i, found := range *finds {
+		if *found.SongTitle != want[i] {
+			t.Errorf("finds[%d].SongTitle = %q, want %q", i, *found.SongTitle, want[i])
+		}
+		if *found.MatchOffset != 42500*time.Millisecond {
+			t.Errorf("finds[%d].MatchOffset = %v, want %v", i, *found.MatchOffset, 42500*time.Millisecond)
+		}
+	}
+}
+
+func TestSendMatchRequestLinks(t *testing.T) {
+	t.Run("Providers present", func(t *testing.T) {
+		sh := newTestHandler(newFixtureServer(t, "match_response.json"))
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		if found.ISRC == nil || *found.ISRC != "GBBPW9900011" {
+			t.Errorf("ISRC = %v, want %q", found.ISRC, "GBBPW9900011")
+		}
+
+		want := map[string]string{
+			"applemusic": "https://music.apple.com/us/album/windowlicker/1434388352?i=1434388364",
+			"spotify":    "spotify:search:Windowlicker%20Aphex%20Twin",
+			"deezer":     "deezer-query://www.deezer.com/play?query=%7Btrack%3A%27Windowlicker%27%20artist%3A%27Aphex%20Twin%27%7D",
+		}
+		if !reflect.DeepEqual(found.StreamLinks, want) {
+			t.Errorf("StreamLinks = %v, want %v", found.StreamLinks, want)
+		}
+	})
+
+	t.Run("Providers missing", func(t *testing.T) {
+		sh := newTestHandler(newSequenceServer(t, trackResponse("Song A", "Artist A")))
+
+		found, err := sh.SendMatchRequest(context.Background(), testChunk())
+		if err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		if found.ISRC != nil {
+			t.Errorf("ISRC = %q, want nil", *found.ISRC)
+		}
+		if found.StreamLinks == nil || len(found.StreamLinks) != 0 {
+			t.Errorf("StreamLinks = %v, want empty map", found.StreamLinks)
+		}
+	})
+}
+
+// newSlowServer returns a server that identifies each chunk by the length
+// of its audio, answering "Song n" for a chunk of n tenths of a second after
+// the delay given for its length in milliseconds. It also returns the most
+// requests it has had in flight at once.
+func newSlowServer(t *testing.T, delay func(samplems int) time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var inFlight, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+
+		var body struct {
+			SampleMS int `json:"samplems"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case <-time.After(delay(body.SampleMS)):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trackResponse(fmt.Sprintf("Song %d", body.SampleMS/100), "Artist"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &peak
+}
+
+func TestMatchConcurrent(t *testing.T) {
+	// The first chunks take longest to answer, so responses come back out of
+	// order
+	const chunks = 8
+	delay := func(samplems int) time.Duration {
+		return time.Duration(chunks+1-samplems/100) * 20 * time.Millisecond
+	}
+
+	// Chunk i is i+1 tenths of a second long, a minute after the one before
+	newStream := func() audiostream.Stream {
+		var stream []audiostream.Chunk
+		for i := range chunks {
+			stream = append(stream, audiostreamtest.NewStaticChunk(make([]byte, (i+1)*3200), time.Duration(i)*time.Minute))
+		}
+		return audiostreamtest.NewChunkStream(stream...)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		server, peak := newSlowServer(t, delay)
+		sh := newTestHandler(server)
+		sh.SetConcurrency(concurrency)
+
+		finds, err := sh.Match(context.Background(), newStream())
+		if err != nil {
+			t.Fatalf("Match() with concurrency %d error = %v", concurrency, err)
+		}
+
+		if len(*finds) != chunks {
+			t.Fatalf("Match() with concurrency %d returned %d songs, want %d", concurrency, len(*finds), chunks)
+		}
+		for i, found := range *finds {
+			if want := fmt.Sprintf("Song %d", i+1); *found.SongTitle != want {
+				t.Errorf("concurrency %d: finds[%d] = %q, want %q", concurrency, i, *found.SongTitle, want)
+			}
+			if want := time.Duration(i) * time.Minute; *found.TimestampFound != want {
+				t.Errorf("concurrency %d: finds[%d].TimestampFound = %v, want %v", concurrency, i, *found.TimestampFound, want)
+			}
+		}
+
+		// One worker sends its requests one at a time, more overlap them
+		// without ever exceeding the limit
+		got := int(peak.Load())
+		if concurrency == 1 && got != 1 {
+			t.Errorf("concurrency 1: %d requests in flight at once, want 1", got)
+		}
+		if concurrency > 1 && (got < 2 || got > concurrency) {
+			t.Errorf("concurrency %d: %d requests in flight at once, want 2 to %d", concurrency, got, concurrency)
+		}
+	}
+}
+
+func TestMatchConcurrentError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 3 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(trackResponse("Song", "Artist"))
+	}))
+	defer server.Close()
+
+	sh := newTestHandler(server)
+	sh.SetConcurrency(3)
+	if _, err := sh.Match(context.Background(), newFakeStream(20)); err == nil {
+		t.Error("Match() error = nil, want the failed request's error")
+	}
+	if n := requests.Load(); n >= 20 {
+		t.Errorf("sent %d requests, want matching to stop after the failure", n)
+	}
+}
+
+func TestMatchConcurrentCancel(t *testing.T) {
+	server, _ := newSlowServer(t, func(int) time.Duration { return time.Minute })
+	sh := newTestHandler(server)
+	sh.SetConcurrency(4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := sh.Match(ctx, newFakeStream(8))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Match() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Match() took %v to return after cancellation", elapsed)
+	}
+}
+
+// gatedStream is a test stream that holds back each chunk after the first
+// until it is let through
+type gatedStream struct {
+	*audiostreamtest.StaticStream
+	gate  chan struct{}
+	reads int
+}
+
+func (gs *gatedStream) GetChunk() (audiostream.Chunk, error) {
+	if gs.reads > 0 {
+		<-gs.gate
+	}
+	gs.reads++
+	return gs.StaticStream.GetChunk()
+}
+
+func TestMatchStreaming(t *testing.T) {
+	server := newSequenceServer(t,
+		trackResponse("Song A", "Artist A"),
+		ShazamResponse{},
+		trackResponse("Song B", "Artist B"),
+	)
+	sh := newTestHandler(server)
+
+	stream := &gatedStream{StaticStream: newFakeStream(3), gate: make(chan struct{})}
+	events := make(chan string, 3)
+	done := make(chan error, 1)
+	go func() {
+		done <- sh.MatchStreaming(context.Background(), stream, func(found *song.Song) {
+			events <- *found.SongTitle
+		})
+	}()
+
+	// The first match arrives while the rest of the stream is held back
+	select {
+	case title := <-events:
+		if title != "Song A" {
+			t.Errorf("first event = %q, want %q", title, "Song A")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event before the rest of the stream was read")
+	}
+
+	close(stream.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("MatchStreaming() error = %v", err)
+	}
+	close(events)
+	var rest []string
+	for title := range events {
+		rest = append(rest, title)
+	}
+	if want := []string{"Song B"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("later events = %v, want %v", rest, want)
+	}
+}
+
+func TestMatchStreamingCancel(t *testing.T) {
+	server := newSequenceServer(t, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	err := sh.MatchStreaming(ctx, newFakeStream(5), func(*song.Song) {
+		calls++
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("MatchStreaming() error = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("onMatch called %d times, want 1 before cancellation", calls)
+	}
+}
+
+func TestSendMatchRequestCompressed(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		compress func(w io.Writer) io.WriteCloser
+	}{
+		{name: "Uncompressed", encoding: "", compress: nil},
+		{name: "Gzip", encoding: "gzip", compress: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{name: "Zlib deflate", encoding: "deflate", compress: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{name: "Raw deflate", encoding: "deflate", compress: func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if accept := r.Header.Get("Accept-Encoding"); !strings.Contains(accept, "gzip") || !strings.Contains(accept, "deflate") {
+					t.Errorf("Accept-Encoding = %q, want gzip and deflate", accept)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if tt.compress == nil {
+					json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+					return
+				}
+				w.Header().Set("Content-Encoding", tt.encoding)
+				cw := tt.compress(w)
+				json.NewEncoder(cw).Encode(trackResponse("Song A", "Artist A"))
+				cw.Close()
+			}))
+			defer server.Close()
+
+			sh := newTestHandler(server)
+			found, err := sh.SendMatchRequest(context.Background(), testChunk())
+			if err != nil {
+				t.Fatalf("SendMatchRequest() error = %v", err)
+			}
+			if found == nil || *found.SongTitle != "Song A" {
+				t.Errorf("SendMatchRequest() = %v, want Song A", found)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestUnknownEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	sh := newTestHandler(server)
+	if _, err := sh.SendMatchRequest(context.Background(), testChunk()); !errors.Is(err, ErrDecodeResponse) {
+		t.Errorf("SendMatchRequest() error = %v, want ErrDecodeResponse for an unsupported encoding", err)
+	}
+}
+
+func TestEndpointFallback(t *testing.T) {
+	statuses := map[string]int{"/v5/": http.StatusNotFound, "/v4/": http.StatusGone}
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		for prefix, status := range statuses {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				http.Error(w, "gone", status)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		wantPaths []string
+		wantCode  int
+	}{
+		{
+			name:      "Second answers",
+			endpoints: []string{"/v5/{language}/tag", "/v3/{language}/tag"},
+			wantPaths: []string{"/v5/en/tag", "/v3/en/tag", "/v3/en/tag"},
+		},
+		{
+			name:      "All gone",
+			endpoints: []string{"/v5/{language}/tag", "/v4/{language}/tag"},
+			wantPaths: []string{"/v5/en/tag", "/v4/en/tag", "/v4/en/tag"},
+			wantCode:  http.StatusGone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths = nil
+			var templates []string
+			for _, endpoint := range tt.endpoints {
+				templates = append(templates, server.URL+endpoint)
+			}
+			sh, err := NewShazamHandler(WithEndpoints(templates...), WithRetries(1, 0))
+			if err != nil {
+				t.Fatalf("NewShazamHandler() error = %v", err)
+			}
+
+			// The second request goes straight to the endpoint that answered
+			for range 2 {
+				found, err := sh.SendMatchRequest(context.Background(), testChunk())
+				if tt.wantCode == 0 {
+					if err != nil || found == nil || *found.SongTitle != "Song A" {
+						t.Errorf("SendMatchRequest() = %v, %v, want Song A", found, err)
+					}
+					continue
+				}
+				var statusErr *ErrUnexpectedStatus
+				if !errors.As(err, &statusErr) || statusErr.Code != tt.wantCode {
+					t.Errorf("SendMatchRequest() error = %v, want status %d", err, tt.wantCode)
+				}
+			}
+			if !slices.Equal(paths, tt.wantPaths) {
+				t.Errorf("requested %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		server  *httptest.Server
+		chunk   audiostream.Chunk
+		wantErr func(err error) bool
+	}{
+		{
+			name:    "Empty chunk",
+			server:  newSequenceServer(t, trackResponse("Song A", "Artist A")),
+			chunk:   audiostreamtest.NewStaticChunk(nil, 0),
+			wantErr: func(err error) bool { return errors.Is(err, ErrEmptyChunk) },
+		},
+		{
+			name: "Unexpected status",
+			server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "gone", http.StatusGone)
+			})),
+			wantErr: func(err error) bool {
+				var statusErr *ErrUnexpectedStatus
+				return errors.As(err, &statusErr) && statusErr.Code == http.StatusGone
+			},
+		},
+		{
+			name: "Invalid JSON",
+			server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "{not json")
+			})),
+			wantErr: func(err error) bool {
+				var syntaxErr *json.SyntaxError
+				return errors.Is(err, ErrDecodeResponse) && errors.As(err, &syntaxErr)
+			},
+		},
+		{
+			name:   "Network error",
+			server: closed,
+			wantErr: func(err error) bool {
+				var netErr *url.Error
+				return errors.As(err, &netErr) && !errors.Is(err, ErrDecodeResponse)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			sh := newTestHandler(tt.server)
+			sh.SetRetries(1, 0)
+			chunk := tt.chunk
+			if chunk == nil {
+				chunk = testChunk()
+			}
+
+			found, err := sh.SendMatchRequest(context.Background(), chunk)
+			if found != nil || !tt.wantErr(err) {
+				t.Errorf("SendMatchRequest() = %v, %v, want an error of this kind", found, err)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestSampleRates(t *testing.T) {
+	for _, rate := range []int{8000, 16000, 32000, 44100, 48000} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			var body struct {
+				SampleMS  int `json:"samplems"`
+				Signature struct {
+					URI string `json:"uri"`
+				} `json:"signature"`
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&body)
+				json.NewEncoder(w).Encode(ShazamResponse{})
+			}))
+			defer server.Close()
+
+			// Two seconds of a 1kHz tone
+			data := make([]byte, 4*rate)
+			for i := 0; i < 2*rate; i++ {
+				sample := int16(8000 * math.Sin(2*math.Pi*1000*float64(i)/float64(rate)))
+				data[2*i], data[2*i+1] = byte(sample), byte(sample>>8)
+			}
+
+			sh := newTestHandler(server)
+			if _, err := sh.SendMatchRequest(context.Background(), audiostream.NewPCMChunk(data, 0, rate)); err != nil {
+				t.Fatalf("SendMatchRequest() error = %v", err)
+			}
+
+			if body.SampleMS != 2000 {
+				t.Errorf("samplems = %d, want 2000", body.SampleMS)
+			}
+			signature, err := audiostream.DecodeFromURI(body.Signature.URI)
+			if err != nil {
+				t.Fatalf("DecodeFromURI() error = %v", err)
+			}
+			if signature.SampleRateHz != rate {
+				t.Errorf("signature SampleRateHz = %d, want %d", signature.SampleRateHz, rate)
+			}
+			peaks := signature.FrequencyBandToSoundPeaks[audiostream.MidBand]
+			if len(peaks) == 0 {
+				t.Fatal("signature has no peaks for the tone")
+			}
+			// Within a bin of a 1024 point FFT at this rate
+			for _, peak := range peaks {
+				if hz := peak.GetFrequencyHz(); math.Abs(hz-1000) > float64(rate)/1024 {
+					t.Errorf("peak at %vHz, want 1000Hz", hz)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchKeepSampleRate(t *testing.T) {
+	// Three seconds of a 1kHz tone at rate, as raw PCM and as a WAV file
+	tone := func(rate int) []byte {
+		data := make([]byte, 6*rate)
+		for i := 0; i < 3*rate; i++ {
+			sample := int16(8000 * math.Sin(2*math.Pi*1000*float64(i)/float64(rate)))
+			data[2*i], data[2*i+1] = byte(sample), byte(sample>>8)
+		}
+		return data
+	}
+	pcmStream := func(t *testing.T, rate int) audiostream.Stream {
+		ps := &audiostream.PCMStream{}
+		ps.SetKeepSampleRate(true)
+		if err := ps.InitStream(audiostream.PCMSource{Reader: bytes.NewReader(tone(rate)), SampleRate: rate}); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		return ps
+	}
+	fileStream := func(t *testing.T, rate int) audiostream.Stream {
+		var wav bytes.Buffer
+		if err := audiostream.WriteWAV(&wav, tone(rate), rate); err != nil {
+			t.Fatalf("WriteWAV() error = %v", err)
+		}
+		path := filepath.Join(t.TempDir(), "tone.wav")
+		if err := os.WriteFile(path, wav.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fs := &audiostream.FileStream{}
+		fs.SetKeepSampleRate(true)
+		if err := fs.InitStream(path); err != nil {
+			t.Fatalf("InitStream() error = %v", err)
+		}
+		return fs
+	}
+
+	for name, newStream := range map[string]func(*testing.T, int) audiostream.Stream{"PCM": pcmStream, "File": fileStream} {
+		for _, rate := range []int{8000, 32000} {
+			t.Run(fmt.Sprintf("%s %d", name, rate), func(t *testing.T) {
+				var mu sync.Mutex
+				var sampleMS, signatureRates []int
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					var body struct {
+						SampleMS  int `json:"samplems"`
+						Signature struct {
+							URI string `json:"uri"`
+						} `json:"signature"`
+					}
+					json.NewDecoder(r.Body).Decode(&body)
+					signature, err := audiostream.DecodeFromURI(body.Signature.URI)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					mu.Lock()
+					sampleMS = append(sampleMS, body.SampleMS)
+					signatureRates = append(signatureRates, signature.SampleRateHz)
+					mu.Unlock()
+					json.NewEncoder(w).Encode(ShazamResponse{})
+				}))
+				defer server.Close()
+
+				stream := newStream(t, rate)
+				defer stream.Close()
+				if err := stream.(audiostream.ChunkResizer).SetChunkDuration(2 * time.Second); err != nil {
+					t.Fatalf("SetChunkDuration() error = %v", err)
+				}
+				if _, err := newTestHandler(server).Match(context.Background(), stream); err != nil {
+					t.Fatalf("Match() error = %v", err)
+				}
+
+				// The chunks keep the stream's rate, so their lengths come out
+				// right without ever being converted to 16kHz
+				if want := []int{2000, 1000}; !slices.Equal(sampleMS, want) {
+					t.Errorf("samplems = %v, want %v", sampleMS, want)
+				}
+				if want := []int{rate, rate}; !slices.Equal(signatureRates, want) {
+					t.Errorf("signature rates = %v, want %v", signatureRates, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSendMatchRequestUnsupportedRate(t *testing.T) {
+	sh := newTestHandler(newSequenceServer(t, ShazamResponse{}))
+	chunk := audiostream.NewPCMChunk(make([]byte, 22050), 0, 22050)
+	if _, err := sh.SendMatchRequest(context.Background(), chunk); !errors.Is(err, audiostream.ErrUnsupportedSampleRate) {
+		t.Errorf("SendMatchRequest() error = %v, want ErrUnsupportedSampleRate", err)
+	}
+}
+
+func TestSendMatchRequestLogging(t *testing.T) {
+	server := newSequenceServer(t, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+	const id = "0f8b6a2e-3c1d-4e5f-9a7b-1c2d3e4f5a6b"
+	requestURL := server.URL + "/tag/" + id + "/" + id + "?sync=true"
+	sh.requestURLs = []string{requestURL}
+	var logs strings.Builder
+	sh.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	if _, err := sh.SendMatchRequest(context.Background(), testChunk()); err != nil {
+		t.Fatalf("SendMatchRequest() error = %v", err)
+	}
+
+	out := logs.String()
+	for _, want := range []string{
+		`msg="fingerprinted chunk" timestamp=0s duration=10s peaks=`,
+		`msg="match request sent" url=` + server.URL + `/tag/REDACTED/REDACTED status=200`,
+		`msg="matched chunk" timestamp=0s title="Song A" artist="Artist A"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logs missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, id) || strings.Contains(out, "sync=true") {
+		t.Errorf("logs leak the request URL:\n%s", out)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "https://amp.shazam.com/discovery/v5/en/US/android/-/tag/0f8b6a2e-3c1d-4e5f-9a7b-1c2d3e4f5a6b/6b3e4bb0-5c5a-4b4c-9a55-5a3ef5f4c1e2?sync=true",
+			want: "https://amp.shazam.com/discovery/v5/en/US/android/-/tag/REDACTED/REDACTED",
+		},
+		{in: "http://localhost:8080/tag", want: "http://localhost:8080/tag"},
+		{in: "://bad", want: "<invalid url>"},
+	}
+	for _, tt := range tests {
+		if got := redactURL(tt.in); got != tt.want {
+			t.Errorf("redactURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSendMatchRequestSilence(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode(trackResponse("Song A", "Artist A"))
+	}))
+	defer server.Close()
+
+	// One second of a 440Hz tone at the given amplitude in 16-bit samples
+	tone := func(amplitude float64) []byte {
+		data := make([]byte, 32000)
+		for i := 0; i < len(data)/2; i++ {
+			sample := int16(math.Round(amplitude * math.Sin(2*math.Pi*440*float64(i)/16000)))
+			data[2*i] = byte(sample)
+			data[2*i+1] = byte(sample >> 8)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name      string
+		threshold float64
+		amplitude float64
+		wantSent  bool
+	}{
+		{name: "near silence skipped", threshold: -50, amplitude: 2, wantSent: false},
+		{name: "loud chunk sent", threshold: -50, amplitude: 10000, wantSent: true},
+		{name: "detection off", threshold: 0, amplitude: 2, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			sh := newTestHandler(server)
+			sh.SetSilenceThreshold(tt.threshold)
+
+			found, err := sh.SendMatchRequest(context.Background(), audiostreamtest.NewStaticChunk(tone(tt.amplitude), 0))
+			if err != nil {
+				t.Fatalf("SendMatchRequest() error = %v", err)
+			}
+			if sent := requests.Load() > 0; sent != tt.wantSent {
+				t.Errorf("request sent = %v, want %v", sent, tt.wantSent)
+			}
+			if (found != nil) != tt.wantSent {
+				t.Errorf("SendMatchRequest() = %v, want a match only when sent", found)
+			}
+		})
+	}
+}
+
+func TestSendMatchRequestNormalize(t *testing.T) {
+	// The signature of the last request
+	var signature *audiostream.DecodedMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Signature struct {
+				URI string `json:"uri"`
+			} `json:"signature"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		var err error
+		if signature, err = audiostream.DecodeFromURI(body.Signature.URI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(ShazamResponse{})
+	}))
+	defer server.Close()
+
+	// Two seconds of a chord whose tones fade in and out of step, peaking
+	// near the given level in 16-bit samples
+	chord := func(peak float64) []byte {
+		data := make([]byte, 64000)
+		for i := 0; i < len(data)/2; i++ {
+			ti := float64(i) / 16000
+			var sample float64
+			for j, hz := range []float64{523, 1319, 2637, 4186} {
+				sample += math.Sin(2*math.Pi*hz*ti) * (1 + math.Sin(2*math.Pi*(1+float64(j))*ti)) / 8
+			}
+			sample16 := int16(math.Round(peak * sample))
+			data[2*i], data[2*i+1] = byte(sample16), byte(sample16>>8)
+		}
+		return data
+	}
+
+	// Peak count and mean magnitude of a chunk's signature
+	type summary struct {
+		peaks     int
+		magnitude float64
+	}
+	fingerprint := func(peak float64, normalize bool) summary {
+		t.Helper()
+		signature = nil
+		sh := newTestHandler(server)
+		sh.SetNormalize(normalize)
+		if _, err := sh.SendMatchRequest(context.Background(), audiostreamtest.NewStaticChunk(chord(peak), 0)); err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+		var sum summary
+		for _, peaks := range signature.FrequencyBandToSoundPeaks {
+			for _, peak := range peaks {
+				sum.peaks++
+				sum.magnitude += float64(peak.PeakMagnitude)
+			}
+		}
+		if sum.peaks > 0 {
+			sum.magnitude /= float64(sum.peaks)
+		}
+		return sum
+	}
+
+	quiet := fingerprint(600, false)
+	normalized := fingerprint(600, true)
+	loud := fingerprint(29000, false)
+
+	// Peaks are picked relative to each frame, so scaling keeps them, but
+	// they are stored as loud as in a loud recording of the same audio
+	if normalized.peaks < quiet.peaks {
+		t.Errorf("normalized chunk has %d peaks, want at least the %d without", normalized.peaks, quiet.peaks)
+	}
+	if math.Abs(normalized.magnitude-loud.magnitude) > 1000 {
+		t.Errorf("normalized mean magnitude = %.0f, want near the %.0f of a loud chunk", normalized.magnitude, loud.magnitude)
+	}
+	if loud.magnitude-quiet.magnitude < 5000 {
+		t.Errorf("quiet mean magnitude = %.0f, want well below the %.0f of a loud chunk", quiet.magnitude, loud.magnitude)
+	}
+	if silence := fingerprint(0, true); silence.peaks != 0 {
+		t.Errorf("normalized silence has %d peaks, want 0", silence.peaks)
+	}
+}
+
+func TestSendMatchRequestRawResponse(t *testing.T) {
+	const body = `{"matches":[{"offset":12.5}],"track":{"title":"Song A","subtitle":"Artist A",` +
+		`"sections":[{"type":"LYRICS","text":["la la la"]}]},"tagid":"6b3e4bb0-5c5a-4b4c-9a55-5a3ef5f4c1e2"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprint(keep), func(t *testing.T) {
+			sh := newTestHandler(server)
+			sh.SetKeepRawResponse(keep)
+
+			found, err := sh.SendMatchRequest(context.Background(), testChunk())
+			if err != nil {
+				t.Fatalf("SendMatchRequest() error = %v", err)
+			}
+			if *found.SongTitle != "Song A" {
+				t.Errorf("SongTitle = %q, want %q", *found.SongTitle, "Song A")
+			}
+			want := ""
+			if keep {
+				want = body
+			}
+			if got := string(found.RawResponse); got != want {
+				t.Errorf("RawResponse = %s, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSignatureDump(t *testing.T) {
+	server := newSequenceServer(t, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+	dir := filepath.Join(t.TempDir(), "signatures")
+	sh.SetSignatureDumpDir(dir)
+
+	for _, chunk := range audiostreamtest.PatternChunks(2, 10*time.Second) {
+		if _, err := sh.SendMatchRequest(context.Background(), chunk); err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+	}
+
+	for _, name := range []string{"0000000000", "0000010000"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".bin"))
+		if err != nil {
+			t.Fatalf("failed to read signature: %v", err)
+		}
+		fromBinary, err := audiostream.DecodeFromBinaryVerify(data)
+		if err != nil {
+			t.Fatalf("DecodeFromBinaryVerify(%s.bin) error = %v", name, err)
+		}
+		if fromBinary.NumberSamples != 1600 {
+			t.Errorf("%s.bin holds %d samples, want 1600", name, fromBinary.NumberSamples)
+		}
+
+		uri, err := os.ReadFile(filepath.Join(dir, name+".uri"))
+		if err != nil {
+			t.Fatalf("failed to read signature uri: %v", err)
+		}
+		fromURI, err := audiostream.DecodeFromURI(string(uri))
+		if err != nil {
+			t.Fatalf("DecodeFromURI(%s.uri) error = %v", name, err)
+		}
+		if !fromURI.Equal(fromBinary) {
+			t.Errorf("%s.uri = %v, want the same signature as %s.bin, %v", name, fromURI, name, fromBinary)
+		}
+	}
+}
+
+func TestChunkDump(t *testing.T) {
+	server := newSequenceServer(t, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+	dir := filepath.Join(t.TempDir(), "dumps")
+	sh.SetSignatureDumpDir(dir)
+	sh.SetChunkDumpDir(dir)
+
+	chunks := []audiostream.Chunk{
+		testChunk(),
+		audiostream.NewPCMChunk(make([]byte, 8000), 10*time.Second, 8000),
+	}
+	for _, chunk := range chunks {
+		if _, err := sh.SendMatchRequest(context.Background(), chunk); err != nil {
+			t.Fatalf("SendMatchRequest() error = %v", err)
+		}
+	}
+
+	// Each chunk's audio is saved next to its signature
+	open := func(name string) *audiostream.FileStream {
+		t.Helper()
+		if _, err := os.Stat(filepath.Join(dir, name+".bin")); err != nil {
+			t.Errorf("signature not saved alongside the chunk: %v", err)
+		}
+		stream := &audiostream.FileStream{}
+		if err := stream.InitStream(filepath.Join(dir, name+".wav")); err != nil {
+			t.Fatalf("failed to open %s.wav: %v", name, err)
+		}
+		t.Cleanup(func() { stream.Close() })
+		return stream
+	}
+
+	// Audio already at 16kHz is read back as it was saved
+	chunk, err := open("0000000000").GetChunk()
+	if err != nil {
+		t.Fatalf("GetChunk() error = %v", err)
+	}
+	if !slices.Equal(chunk.GetAudioData(), chunks[0].GetAudioData()) {
+		t.Error("0000000000.wav audio differs from the chunk's")
+	}
+	// Other rates are saved at their own rate
+	if got := open("0000010000").GetLength(); got != 500*time.Millisecond {
+		t.Errorf("0000010000.wav lasts %v, want 500ms", got)
+	}
+}
+
+func TestSignatureDumpUnwritable(t *testing.T) {
+	server := newSequenceServer(t, trackResponse("Song A", "Artist A"))
+	sh := newTestHandler(server)
+	var logs strings.Builder
+	sh.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// A directory can't be made inside a regular file
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sh.SetSignatureDumpDir(filepath.Join(file, "signatures"))
+
+	found, err := sh.SendMatchRequest(context.Background(), testChunk())
+	if err != nil || found == nil {
+		t.Fatalf("SendMatchRequest() = %v, %v, want a match", found, err)
+	}
+	if !strings.Contains(logs.String(), "failed to save signature") {
+		t.Errorf("logs = %q, want the failure to save reported", logs.String())
+	}
+}
+
+func TestMatchRequestTimeout(t *testing.T) {
+	// The second chunk hangs until its request is abandoned
+	server, _ := newSlowServer(t, func(samplems int) time.Duration {
+		if samplems/100 == 2 {
+			return time.Hour
+		}
+		return 0
+	})
+	newStream := func() audiostream.Stream {
+		var stream []audiostream.Chunk
+		for i := range 3 {
+			stream = append(stream, audiostreamtest.NewStaticChunk(make([]byte, (i+1)*3200), time.Duration(i)*time.Minute))
+		}
+		return audiostreamtest.NewChunkStream(stream...)
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			sh := newTestHandler(server)
+			sh.SetConcurrency(concurrency)
+			sh.SetRequestTimeout(100 * time.Millisecond)
+
+			finds, err := sh.Match(context.Background(), newStream())
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			var titles []string
+			for _, found := range *finds {
+				titles = append(titles, *found.SongTitle)
+			}
+			if want := []string{"Song 1", "Song 3"}; !slices.Equal(titles, want) {
+				t.Errorf("Match() = %v, want %v", titles, want)
+			}
+		})
+	}
+
+	t.Run("parent cancelled", func(t *testing.T) {
+		sh := newTestHandler(server)
+		sh.SetRequestTimeout(time.Minute)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		if _, err := sh.Match(ctx, newStream()); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Match() error = %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package shazam
+
+import "math"
+
+// hannWindow returns an n point Hann window. Tapering a frame to zero at both
+// ends before the FFT stops the abrupt frame edges from leaking energy across
+// the whole spectrum, where it would show up as spurious peaks.
+func hannWindow(n int) []float64 {
+	window := make([]float64, n)
+	if n == 1 {
+		window[0] = 1
+		return window
+	}
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return window
+}
+
+// applyWindow returns samples multiplied point by point by window
+func applyWindow(samples, window []float64) []float64 {
+	windowed := make([]float64, len(samples))
+	for i, sample := range samples {
+		windowed[i] = sample * window[i]
+	}
+	return windowed
+}
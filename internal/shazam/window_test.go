@@ -0,0 +1,42 @@
+package shazam
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestHannWindow(t *testing.T) {
+	window := hannWindow(1024)
+	if window[0] != 0 || math.Abs(window[1023]) > 1e-12 {
+		t.Errorf("window ends = %f, %f, want 0", window[0], window[1023])
+	}
+	if math.Abs(window[511]-window[512]) > 1e-12 || window[511] < 0.99 {
+		t.Errorf("window middle = %f, %f, want symmetric and near 1", window[511], window[512])
+	}
+}
+
+func TestWindowingReducesSpuriousPeaks(t *testing.T) {
+	// A tone between FFT bins over a little noise, which leaks badly without
+	// a window
+	rng := rand.New(rand.NewPCG(1, 2))
+	samples := make([]float64, 16000)
+	for i := range samples {
+		samples[i] = 0.5*math.Sin(2*math.Pi*1007.8*float64(i)/16000) + 0.02*(rng.Float64()-0.5)
+	}
+
+	rectangular := make([]float64, windowSize)
+	for i := range rectangular {
+		rectangular[i] = 1
+	}
+	raw := findPeaksWithWindow(samples, 16000, peakConfig{}, rectangular)
+	windowed := findPeaksWithWindow(samples, 16000, peakConfig{}, analysisWindow)
+
+	if len(windowed) == 0 {
+		t.Fatal("found no peaks in the windowed tone")
+	}
+	if len(windowed) >= len(raw) {
+		t.Errorf("windowed peaks = %d, want fewer than the %d unwindowed peaks", len(windowed), len(raw))
+	}
+	t.Logf("peaks: %d unwindowed, %d windowed", len(raw), len(windowed))
+}
@@ -1,10 +1,139 @@
 package song
 
-import "time"
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
 
 type Song struct {
 	SongTitle      *string
 	ArtistName     *string
+	AlbumName      *string
 	TimestampFound *time.Duration
-	//Album Art Link?
+	Duration       *time.Duration // How long the song was heard for, when known
+	AlbumArtURL    *string
+	MatchOffset    *time.Duration // Position in the song where the matched audio starts
+	Confidence     *float64       // Match confidence in [0, 1]
+	ISRC           *string
+	StreamLinks    map[string]string // Streaming service name to link, e.g. "spotify"
+	RawResponse    json.RawMessage   // Full response the song was matched from, when kept
+}
+
+// String formats the song as "Artist – Title [mm:ss]", with the time it was
+// found in the stream. Unknown parts are left out.
+func (s *Song) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	var parts []string
+	if s.ArtistName != nil && *s.ArtistName != "" {
+		parts = append(parts, *s.ArtistName)
+	}
+	if s.SongTitle != nil && *s.SongTitle != "" {
+		parts = append(parts, *s.SongTitle)
+	}
+	name := strings.Join(parts, " – ")
+	if name == "" {
+		name = "Unknown song"
+	}
+
+	if s.TimestampFound == nil {
+		return name
+	}
+	secs := int(s.TimestampFound.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%s [%02d:%02d]", name, secs/60, secs%60)
+}
+
+// Equal reports whether s and o are the same song, with the same title,
+// artist and album. Case and surrounding space are ignored, as services
+// format the same names inconsistently, and a missing field is the same as an
+// empty one. Two nil songs are equal, but a nil song is not equal to any
+// other.
+func (s *Song) Equal(o *Song) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return sameField(s.SongTitle, o.SongTitle) &&
+		sameField(s.ArtistName, o.ArtistName) &&
+		sameField(s.AlbumName, o.AlbumName)
+}
+
+// sameField reports whether two optional fields hold the same name
+func sameField(a, b *string) bool {
+	return strings.EqualFold(value(a), value(b))
+}
+
+// value returns an optional field trimmed of space, or "" when it is missing
+func value(field *string) string {
+	if field == nil {
+		return ""
+	}
+	return strings.TrimSpace(*field)
+}
+
+// SortByTimestamp sorts songs in place by when they were found in the stream.
+// Songs without a timestamp, and nil songs, go last, and songs found at the
+// same time keep their order.
+func SortByTimestamp(songs []*Song) {
+	slices.SortStableFunc(songs, func(a, b *Song) int {
+		aFound, bFound := a != nil && a.TimestampFound != nil, b != nil && b.TimestampFound != nil
+		switch {
+		case aFound && bFound:
+			return cmp.Compare(*a.TimestampFound, *b.TimestampFound)
+		case aFound:
+			return -1
+		case bFound:
+			return 1
+		default:
+			return 0
+		}
+	})
+}
+
+// jsonSong is the JSON form of a Song. Durations are given in seconds and
+// unknown fields are null.
+type jsonSong struct {
+	Title          *string           `json:"title"`
+	Artist         *string           `json:"artist"`
+	Album          *string           `json:"album"`
+	TimestampFound *float64          `json:"timestampFound"`
+	Duration       *float64          `json:"duration"`
+	AlbumArtURL    *string           `json:"albumArtUrl"`
+	MatchOffset    *float64          `json:"matchOffset"`
+	Confidence     *float64          `json:"confidence"`
+	ISRC           *string           `json:"isrc"`
+	StreamLinks    map[string]string `json:"streamLinks"`
+	RawResponse    json.RawMessage   `json:"rawResponse,omitempty"`
+}
+
+// MarshalJSON encodes the song as a flat object with durations in seconds.
+// The raw response is only included when there is one.
+func (s *Song) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSong{
+		Title:          s.SongTitle,
+		Artist:         s.ArtistName,
+		Album:          s.AlbumName,
+		TimestampFound: seconds(s.TimestampFound),
+		Duration:       seconds(s.Duration),
+		AlbumArtURL:    s.AlbumArtURL,
+		MatchOffset:    seconds(s.MatchOffset),
+		Confidence:     s.Confidence,
+		ISRC:           s.ISRC,
+		StreamLinks:    s.StreamLinks,
+		RawResponse:    s.RawResponse,
+	})
+}
+
+// seconds converts an optional duration to seconds
+func seconds(d *time.Duration) *float64 {
+	if d == nil {
+		return nil
+	}
+	secs := d.Seconds()
+	return &secs
 }
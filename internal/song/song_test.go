@@ -0,0 +1,156 @@
+package song
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fullSong returns a song with every field set
+func fullSong() *Song {
+	title, artist, album := "Windowlicker", "Aphex Twin", "Windowlicker EP"
+	artURL, isrc := "https://example.com/art.jpg", "GBBPW9900001"
+	found, duration, offset := 95*time.Second, 4*time.Minute, 42500*time.Millisecond
+	confidence := 0.75
+	return &Song{
+		SongTitle:      &title,
+		ArtistName:     &artist,
+		AlbumName:      &album,
+		TimestampFound: &found,
+		Duration:       &duration,
+		AlbumArtURL:    &artURL,
+		MatchOffset:    &offset,
+		Confidence:     &confidence,
+		ISRC:           &isrc,
+		StreamLinks:    map[string]string{"spotify": "https://open.spotify.com/track/1"},
+	}
+}
+
+func TestSongString(t *testing.T) {
+	title, artist := "Xtal", "Aphex Twin"
+	found, late := 65*time.Second, 75*time.Minute+3*time.Second
+
+	tests := []struct {
+		name string
+		song *Song
+		want string
+	}{
+		{name: "Full", song: fullSong(), want: "Aphex Twin – Windowlicker [01:35]"},
+		{name: "No timestamp", song: &Song{SongTitle: &title, ArtistName: &artist}, want: "Aphex Twin – Xtal"},
+		{name: "No artist", song: &Song{SongTitle: &title, TimestampFound: &found}, want: "Xtal [01:05]"},
+		{name: "No title", song: &Song{ArtistName: &artist}, want: "Aphex Twin"},
+		{name: "Over an hour in", song: &Song{SongTitle: &title, ArtistName: &artist, TimestampFound: &late}, want: "Aphex Twin – Xtal [75:03]"},
+		{name: "Empty", song: &Song{}, want: "Unknown song"},
+		{name: "Nil", song: nil, want: "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.song.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSongEqual(t *testing.T) {
+	title, artist, album, empty := "Xtal", "Aphex Twin", "Selected Ambient Works 85-92", ""
+	other, lower, padded := "Ageispolis", "xtal", " Xtal "
+	found := 10 * time.Second
+
+	tests := []struct {
+		name string
+		a, b *Song
+		want bool
+	}{
+		{name: "Same fields", a: &Song{SongTitle: &title, ArtistName: &artist, AlbumName: &album}, b: &Song{SongTitle: &title, ArtistName: &artist, AlbumName: &album}, want: true},
+		{name: "Other fields ignored", a: fullSong(), b: &Song{SongTitle: fullSong().SongTitle, ArtistName: fullSong().ArtistName, AlbumName: fullSong().AlbumName}, want: true},
+		{name: "Different title", a: &Song{SongTitle: &title, ArtistName: &artist}, b: &Song{SongTitle: &other, ArtistName: &artist}, want: false},
+		{name: "Case differs", a: &Song{SongTitle: &title}, b: &Song{SongTitle: &lower}, want: true},
+		{name: "Surrounding space", a: &Song{SongTitle: &title, ArtistName: &artist}, b: &Song{SongTitle: &padded, ArtistName: &artist}, want: true},
+		{name: "Album missing on one", a: &Song{SongTitle: &title, AlbumName: &album}, b: &Song{SongTitle: &title}, want: false},
+		{name: "Missing and empty", a: &Song{SongTitle: &title, AlbumName: &empty}, b: &Song{SongTitle: &title, TimestampFound: &found}, want: true},
+		{name: "Both empty", a: &Song{}, b: &Song{}, want: true},
+		{name: "Both nil", a: nil, b: nil, want: true},
+		{name: "Nil and empty", a: nil, b: &Song{}, want: false},
+		{name: "Empty and nil", a: &Song{}, b: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortByTimestamp(t *testing.T) {
+	at := func(title string, found *time.Duration) *Song {
+		return &Song{SongTitle: &title, TimestampFound: found}
+	}
+	early, late := 30*time.Second, 5*time.Minute
+	songs := []*Song{
+		at("No time A", nil),
+		at("Late", &late),
+		nil,
+		at("Early A", &early),
+		at("No time B", nil),
+		at("Early B", &early),
+	}
+
+	SortByTimestamp(songs)
+	var got []string
+	for _, s := range songs {
+		got = append(got, s.String())
+	}
+	want := []string{"Early A [00:30]", "Early B [00:30]", "Late [05:00]", "No time A", "<nil>", "No time B"}
+	if !slices.Equal(got, want) {
+		t.Errorf("SortByTimestamp() order = %q, want %q", got, want)
+	}
+}
+
+func TestSongMarshalJSON(t *testing.T) {
+	title := "Xtal"
+
+	tests := []struct {
+		name string
+		song *Song
+		want string
+	}{
+		{
+			name: "Full",
+			song: fullSong(),
+			want: `{"title":"Windowlicker","artist":"Aphex Twin","album":"Windowlicker EP",` +
+				`"timestampFound":95,"duration":240,"albumArtUrl":"https://example.com/art.jpg",` +
+				`"matchOffset":42.5,"confidence":0.75,"isrc":"GBBPW9900001",` +
+				`"streamLinks":{"spotify":"https://open.spotify.com/track/1"}}`,
+		},
+		{
+			name: "Partial",
+			song: &Song{SongTitle: &title},
+			want: `{"title":"Xtal","artist":null,"album":null,"timestampFound":null,"duration":null,` +
+				`"albumArtUrl":null,"matchOffset":null,"confidence":null,"isrc":null,"streamLinks":null}`,
+		},
+		{
+			name: "Raw response",
+			song: &Song{SongTitle: &title, RawResponse: json.RawMessage(`{"track":{"title":"Xtal"}}`)},
+			want: `{"title":"Xtal","artist":null,"album":null,"timestampFound":null,"duration":null,` +
+				`"albumArtUrl":null,"matchOffset":null,"confidence":null,"isrc":null,"streamLinks":null,` +
+				`"rawResponse":{"track":{"title":"Xtal"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.song)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Marshal() = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
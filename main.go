@@ -1,9 +1,22 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"listr/internal/identify"
+	"log"
+)
+
 const (
 	scUrl = "https://soundcloud.com/platform/lolsnake-boiler-room-berlin-weeirdos?si=94e7ecc220b7403693eec08bcd7a9f52&utm_source=clipboard&utm_medium=text&utm_campaign=social_sharing"
 )
 
 func main() {
-
+	songs, err := identify.IdentifyStream(context.Background(), scUrl, identify.Options{})
+	for _, s := range songs {
+		fmt.Println(s)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }